@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// amendmentsPrefix - the original terms of an amended contract and its amendments are kept under _amendments_<id>
+const amendmentsPrefix = "_amendments_"
+
+// amendment statuses. A proposed amendment takes effect once both parties have signed it, or is rejected.
+const (
+	amendmentProposed = "proposed"
+	amendmentSigned   = "signed"
+	amendmentRejected = "rejected"
+)
+
+// the parties that sign a contract and its amendments, known by the client_id and supplier_id certificate attributes
+const (
+	partyClient   = "client"
+	partySupplier = "supplier"
+)
+
+// fixedContractFields - the id, parties and currency of a contract cannot be amended
+var fixedContractFields = []string{"contract_id", "client_id", "supplier_id", "currency", "last_modified"}
+
+// contractAmendment - a numbered change to the terms of a contract from its effective date on
+type contractAmendment struct {
+	Number         int                  `json:"number"`
+	Effective_Date string               `json:"effective_date"`
+	Changes        map[string]string    `json:"changes"` //init_contract argument names to their new values
+	Reason         string               `json:"reason"`
+	Status         string               `json:"status"`
+	Terms_Version  int                  `json:"terms_version"` //the version the amendment makes once signed
+	Supersede      bool                 `json:"supersede"`     //end the active contracts the new terms overlap
+	Signatures     []amendmentSignature `json:"signatures"`
+	Proposed_At    string               `json:"proposed_at"`
+}
+
+type amendmentSignature struct {
+	Party     string `json:"party"`
+	Party_ID  string `json:"party_id"`
+	Signed_At string `json:"signed_at"`
+	Tx_ID     string `json:"tx_id"`
+}
+
+// contractTerms - the terms a contract was signed with and the amendments made to them since
+type contractTerms struct {
+	Original   Contract            `json:"original"`
+	Amendments []contractAmendment `json:"amendments"`
+}
+
+// contractView - the get_contract result
+type contractView struct {
+	Contract_ID   string              `json:"contract_id"`
+	As_Of         string              `json:"as_of"`
+	Terms_Version int                 `json:"terms_version"` //in effect on As_Of
+	Terms         Contract            `json:"terms"`
+	Amendments    []contractAmendment `json:"amendments"`
+}
+
+// ============================================================================================================================
+// Amend contract - propose new terms for an active contract from an effective date. The proposing party signs it
+// straight away, the amendment takes effect once the other party has signed it too with sign_amendment.
+//
+// changes is a JSON object of init_contract argument names to new values, such as {"flat_off_rate_1": "90.00",
+// "contract_end_date": "2017-06-30"}, and "units" to a set_contract_units object as a string. The contract, client
+// and supplier ids and the currency cannot change. New terms that overlap another active contract of the client need
+// supersede, which ends the other contract when the amendment is signed.
+// args: contract_id, effective_date, changes, reason, optional supersede (true or false)
+// ============================================================================================================================
+func (t *SimpleChaincode) amend_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 and optional supersede")
+	}
+	fmt.Println("- start amend contract")
+	if err := requireArgs(args, 4); err != nil {
+		return nil, err
+	}
+	supersede, err := supersedeArg(args, 4)
+	if err != nil {
+		return nil, err
+	}
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, partyId, err := signingParty(stub, contract)
+	if err != nil {
+		return nil, err
+	}
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return nil, err
+	}
+	if pending := pendingAmendment(terms); pending != nil {
+		return nil, errors.New("Amendment " + strconv.Itoa(pending.Number) + " of " + args[0] + " is still waiting to be signed")
+	}
+	amendment, amended, err := proposeAmendment(stub, contract, terms, args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	if !supersede {
+		if err := checkOverlaps(stub, amended, amendment.Effective_Date, false); err != nil {
+			return nil, err
+		}
+	}
+	amendment.Reason, amendment.Supersede = args[3], supersede
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	amendment.Proposed_At = now.Format(time.RFC3339)
+	amendment.Signatures = []amendmentSignature{{party, partyId, now.Format(time.RFC3339), stub.GetTxID()}}
+
+	terms.Amendments = append(terms.Amendments, amendment)
+	if err := putContractTerms(stub, args[0], terms); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end amend contract")
+	return json.Marshal(amendment)
+}
+
+// ============================================================================================================================
+// Sign amendment / reject amendment - the other party signs a proposed amendment, which puts its terms in force and
+// prorates what was already invoiced from its effective date, or either party rejects it
+//
+// args: contract_id, amendment number
+// ============================================================================================================================
+func (t *SimpleChaincode) sign_amendment(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.decide_amendment(stub, args, amendmentSigned)
+}
+
+func (t *SimpleChaincode) reject_amendment(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.decide_amendment(stub, args, amendmentRejected)
+}
+
+func (t *SimpleChaincode) decide_amendment(stub *shim.ChaincodeStub, args []string, decision string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	fmt.Println("- start " + decision + " amendment")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	party, partyId, err := signingParty(stub, contract)
+	if err != nil {
+		return nil, err
+	}
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return nil, err
+	}
+	amendment := pendingAmendment(terms)
+	if amendment == nil || strconv.Itoa(amendment.Number) != strings.TrimSpace(args[1]) {
+		return nil, errors.New("NOT_FOUND: no amendment " + args[1] + " of " + args[0] + " is waiting to be signed")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if decision == amendmentRejected {
+		amendment.Status = amendmentRejected
+	} else {
+		if err := addSignature(amendment, amendmentSignature{party, partyId, now.Format(time.RFC3339), stub.GetTxID()}); err != nil {
+			return nil, err
+		}
+		amended, err := applyAmendment(contract, *amendment)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOverlaps(stub, amended, amendment.Effective_Date, amendment.Supersede); err != nil {
+			return nil, err
+		}
+		reason := "amendment " + args[1] + ": " + amendment.Reason
+		if err := prorateContractChange(stub, amended, amendment.Effective_Date, reason); err != nil {
+			return nil, err
+		}
+		amendment.Status = amendmentSigned
+		if err := storeContract(stub, &amended); err != nil {
+			return nil, err
+		}
+		if err := recordChange(stub, args[0], "terms_version", strconv.Itoa(termsVersion(contract)), strconv.Itoa(amended.Terms_Version)); err != nil {
+			return nil, err
+		}
+	}
+	if err := putContractTerms(stub, args[0], terms); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end " + decision + " amendment")
+	return json.Marshal(amendment)
+}
+
+// ============================================================================================================================
+// Get contract - the terms of a contract in effect on a date and the chain of amendments
+//
+// args: contract_id, optional date (defaults to the transaction date)
+// ============================================================================================================================
+func (t *SimpleChaincode) get_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting contract_id and optional date")
+	}
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	asOf, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 2 && args[1] != "" {
+		if asOf, err = canonicalDate("date", args[1]); err != nil {
+			return nil, err
+		}
+	}
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return nil, err
+	}
+	effective, err := termsOn(contract, terms, asOf)
+	if err != nil {
+		return nil, err
+	}
+	view := contractView{Contract_ID: args[0], As_Of: asOf, Terms_Version: termsVersion(effective), Terms: effective,
+		Amendments: terms.Amendments}
+	return json.Marshal(view)
+}
+
+// proposeAmendment - validate an effective date and changes against the current terms, the amendment that would
+// make them and the contract it would leave
+func proposeAmendment(stub *shim.ChaincodeStub, contract Contract, terms contractTerms, date string, changesJSON string) (contractAmendment, Contract, error) {
+	amendment, amended, err := draftAmendment(contract, terms, date, changesJSON)
+	if err != nil {
+		return amendment, contract, err
+	}
+	if err := checkUnits(stub, amended); err != nil {
+		return amendment, contract, err
+	}
+	return amendment, amended, nil
+}
+
+// draftAmendment - the checks of proposeAmendment that need nothing but the contract and its terms
+func draftAmendment(contract Contract, terms contractTerms, date string, changesJSON string) (contractAmendment, Contract, error) {
+	var amendment contractAmendment
+	if status := contractStatus(contract.Status); status != contractActive {
+		return amendment, contract, errors.New("Contract " + contract.Contract_ID + " is " + status + ", only active contracts are amended")
+	}
+	effective, err := canonicalDate("effective_date", date)
+	if err != nil {
+		return amendment, contract, err
+	}
+	if err := checkWithin("effective_date", effective, effective, "contract term", contract.Contract_Start_Date, contract.Contract_End_Date); err != nil {
+		return amendment, contract, err
+	}
+	for _, earlier := range terms.Amendments {
+		if earlier.Status == amendmentSigned && earlier.Effective_Date > effective {
+			return amendment, contract, errors.New("effective_date is before amendment " + strconv.Itoa(earlier.Number) +
+				", which takes effect on " + earlier.Effective_Date)
+		}
+	}
+	var changes map[string]string
+	if err := json.Unmarshal([]byte(changesJSON), &changes); err != nil || len(changes) == 0 {
+		return amendment, contract, errors.New("changes must be a non-empty JSON object of contract fields to new string values")
+	}
+	for field := range changes {
+		if !find_id_in_index(contractFields, field) && field != "units" {
+			return amendment, contract, errors.New(field + " is not a contract field")
+		}
+		if find_id_in_index(fixedContractFields, field) {
+			return amendment, contract, errors.New(field + " cannot be amended")
+		}
+	}
+	amendment = contractAmendment{Number: len(terms.Amendments) + 1, Effective_Date: effective, Changes: changes,
+		Status: amendmentProposed, Terms_Version: termsVersion(contract) + 1}
+	amended, err := applyAmendment(contract, amendment)
+	if err != nil {
+		return amendment, contract, err
+	}
+	return amendment, amended, nil
+}
+
+// applyAmendment - the contract with the amendment's changes, validated like init_contract arguments. A units
+// change replaces the contract's units like set_contract_units.
+func applyAmendment(contract Contract, amendment contractAmendment) (Contract, error) {
+	contractAsBytes, _ := json.Marshal(contract)
+	var rec map[string]interface{}
+	json.Unmarshal(contractAsBytes, &rec)
+	for field, value := range amendment.Changes {
+		rec[field] = value
+	}
+	rows, err := objectRows(contractFields, nil, []map[string]interface{}{onlyFields(rec, contractFields)})
+	if err != nil {
+		return contract, err
+	}
+	amended, err := buildContract(rows[0])
+	if err != nil {
+		return contract, errors.New("amendment " + strconv.Itoa(amendment.Number) + ": " + err.Error())
+	}
+	keepState(&amended, contract)
+	amended.Units = contract.Units
+	if units, ok := amendment.Changes["units"]; ok {
+		if amended.Units, err = parseUnits(amended, units); err != nil {
+			return contract, errors.New("amendment " + strconv.Itoa(amendment.Number) + ": " + err.Error())
+		}
+	}
+	amended.Status, amended.Terms_Version = contract.Status, amendment.Terms_Version
+	amended.Created_At, amended.Updated_At, amended.Last_Modified = contract.Created_At, contract.Updated_At, contract.Last_Modified
+	return amended, nil
+}
+
+// termsOn - the terms in effect on a date: the original terms with the signed amendments effective by then applied
+func termsOn(contract Contract, terms contractTerms, date string) (Contract, error) {
+	if len(terms.Amendments) == 0 {
+		return contract, nil
+	}
+	effective := terms.Original
+	keepState(&effective, contract)
+	effective.Status = contract.Status
+	signed := []contractAmendment{}
+	for _, amendment := range terms.Amendments {
+		if amendment.Status == amendmentSigned && amendment.Effective_Date <= date {
+			signed = append(signed, amendment)
+		}
+	}
+	sort.Sort(byAmendmentNumber(signed))
+	for _, amendment := range signed {
+		var err error
+		if effective, err = applyAmendment(effective, amendment); err != nil {
+			return contract, err
+		}
+	}
+	return effective, nil
+}
+
+// endContractEarly - the contract ending on an earlier date, recorded as an amendment that needs no signatures. The
+// amendment and the history are stored, the caller stores the contract.
+func endContractEarly(stub *shim.ChaincodeStub, contract Contract, end string, reason string) (Contract, error) {
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return contract, err
+	}
+	if pending := pendingAmendment(terms); pending != nil {
+		return contract, errors.New("Contract " + contract.Contract_ID + " has amendment " + strconv.Itoa(pending.Number) +
+			" waiting to be signed, reject it first")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return contract, err
+	}
+	effective := now.Format(dateLayout) //the amendment takes effect when it is made, but no later than the new end
+	if effective < contract.Contract_Start_Date {
+		effective = contract.Contract_Start_Date
+	}
+	for _, earlier := range terms.Amendments {
+		if earlier.Status == amendmentSigned && earlier.Effective_Date > effective {
+			effective = earlier.Effective_Date
+		}
+	}
+	if effective > end {
+		effective = end
+	}
+	amendment := contractAmendment{Number: len(terms.Amendments) + 1, Effective_Date: effective,
+		Changes: map[string]string{"contract_end_date": end}, Reason: reason, Status: amendmentSigned,
+		Terms_Version: termsVersion(contract) + 1, Signatures: []amendmentSignature{}, Proposed_At: now.Format(time.RFC3339)}
+	ended, err := applyAmendment(contract, amendment)
+	if err != nil {
+		return contract, err
+	}
+	terms.Amendments = append(terms.Amendments, amendment)
+	if err := putContractTerms(stub, contract.Contract_ID, terms); err != nil {
+		return contract, err
+	}
+	if err := recordChange(stub, contract.Contract_ID, "contract_end_date", contract.Contract_End_Date, end); err != nil {
+		return contract, err
+	}
+	return ended, nil
+}
+
+// contractTermsOn - the terms of a contract in effect on a date
+func contractTermsOn(stub *shim.ChaincodeStub, contract Contract, date string) (Contract, error) {
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return contract, err
+	}
+	return termsOn(contract, terms, date)
+}
+
+// prorateAmendments - an invoice is billed on the terms in effect on its period start, amendments that take effect
+// later in the period are prorated onto it as adjustments
+func prorateAmendments(stub *shim.ChaincodeStub, contract Contract, invoice *Invoice, billed Contract) error {
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return err
+	}
+	for _, amendment := range terms.Amendments {
+		if amendment.Status != amendmentSigned || amendment.Effective_Date <= invoice.Period_Start || amendment.Effective_Date > invoice.Period_End {
+			continue
+		}
+		amended, err := termsOn(contract, terms, amendment.Effective_Date)
+		if err != nil {
+			return err
+		}
+		reason := "amendment " + strconv.Itoa(amendment.Number) + ": " + amendment.Reason
+		prorated, err := prorateInvoice(stub, *invoice, billed, amended, amendment.Effective_Date, reason)
+		if err != nil {
+			return err
+		}
+		for _, line := range prorated {
+			invoice.Adjustments = append(invoice.Adjustments, line)
+			invoice.Adjustments_Total = invoice.Adjustments_Total.Add(line.Amount)
+		}
+		billed = amended
+	}
+	return nil
+}
+
+// signingParty - the caller must be the contract's client or supplier, as given by the client_id or supplier_id
+// certificate attribute
+func signingParty(stub *shim.ChaincodeStub, contract Contract) (string, string, error) {
+	if clientId, err := stub.ReadCertAttribute("client_id"); err == nil && len(clientId) > 0 && string(clientId) == contract.Client_ID {
+		return partyClient, contract.Client_ID, nil
+	}
+	if supplierId, err := stub.ReadCertAttribute("supplier_id"); err == nil && len(supplierId) > 0 && string(supplierId) == contract.Supplier_ID {
+		return partySupplier, contract.Supplier_ID, nil
+	}
+	return "", "", errors.New("Caller is neither the client nor the supplier of contract " + contract.Contract_ID)
+}
+
+// addSignature - sign an amendment for a party that has not signed it yet
+func addSignature(amendment *contractAmendment, signature amendmentSignature) error {
+	for _, signed := range amendment.Signatures {
+		if signed.Party == signature.Party {
+			return errors.New("The " + signature.Party + " has already signed amendment " + strconv.Itoa(amendment.Number))
+		}
+	}
+	amendment.Signatures = append(amendment.Signatures, signature)
+	return nil
+}
+
+// pendingAmendment - the amendment of the contract still waiting for a signature, nil when there is none
+func pendingAmendment(terms contractTerms) *contractAmendment {
+	for i := range terms.Amendments {
+		if terms.Amendments[i].Status == amendmentProposed {
+			return &terms.Amendments[i]
+		}
+	}
+	return nil
+}
+
+// termsVersion - contracts stored before versions existed are on version 1
+func termsVersion(contract Contract) int {
+	if contract.Terms_Version == 0 {
+		return 1
+	}
+	return contract.Terms_Version
+}
+
+// getContractTerms - the original terms and amendments of a contract. A contract that was never amended is on its
+// original terms.
+func getContractTerms(stub *shim.ChaincodeStub, contract Contract) (contractTerms, error) {
+	terms := contractTerms{Original: contract, Amendments: []contractAmendment{}}
+	termsAsBytes, err := stub.GetState(amendmentsPrefix + contract.Contract_ID)
+	if err != nil {
+		return terms, errors.New("Failed to get the amendments of " + contract.Contract_ID)
+	}
+	if termsAsBytes != nil {
+		if err := json.Unmarshal(termsAsBytes, &terms); err != nil {
+			return terms, errors.New("Failed to decode the amendments of " + contract.Contract_ID)
+		}
+	}
+	return terms, nil
+}
+
+func putContractTerms(stub *shim.ChaincodeStub, contractId string, terms contractTerms) error {
+	termsAsBytes, _ := json.Marshal(terms)
+	if err := stub.PutState(amendmentsPrefix+contractId, termsAsBytes); err != nil {
+		return errors.New("Failed to store the amendments of " + contractId)
+	}
+	return nil
+}
+
+type byAmendmentNumber []contractAmendment
+
+func (s byAmendmentNumber) Len() int           { return len(s) }
+func (s byAmendmentNumber) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byAmendmentNumber) Less(i, j int) bool { return s[i].Number < s[j].Number }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testContract - an active USD contract for 2016 billing offering o1 at 80.00 and product p1 at 9.50, less 12.5%
+func testContract(t *testing.T) Contract {
+	contract, err := buildContract([]string{"c0", "cl1", "o1", "", "", "", "80", "0", "0", "0", "9.5", "0", "0", "0", "0", "0",
+		"p1", "", "", "", "", "", "s1", "12.5", "USD", "2016-01-01", "2016-12-31", ""})
+	if err != nil {
+		t.Fatalf("buildContract: %v", err)
+	}
+	contract.Status, contract.Terms_Version = contractActive, 1
+	return contract
+}
+
+func TestDraftAmendment(t *testing.T) {
+	contract := testContract(t)
+	terms := contractTerms{Original: contract, Amendments: []contractAmendment{
+		{Number: 1, Effective_Date: "2016-03-01", Status: amendmentSigned, Terms_Version: 2},
+		{Number: 2, Effective_Date: "2016-09-01", Status: amendmentRejected, Terms_Version: 3},
+	}}
+	contract.Terms_Version = 2
+
+	amendment, amended, err := draftAmendment(contract, terms, "2016-06-01T10:00:00Z", `{"flat_off_rate_1": "90"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amendment.Number != 3 || amendment.Effective_Date != "2016-06-01" || amendment.Status != amendmentProposed ||
+		amendment.Terms_Version != 3 {
+		t.Errorf("amendment = %+v, want number 3 for version 3 from 2016-06-01, proposed", amendment)
+	}
+	if amended.Flat_Off_Rate_1.String() != "90.00" || amended.Terms_Version != 3 || !contract.Flat_Off_Rate_1.Equal(mustDecimal(t, "80")) {
+		t.Errorf("amended rate %s version %d, contract rate %s", amended.Flat_Off_Rate_1, amended.Terms_Version, contract.Flat_Off_Rate_1)
+	}
+
+	refuse := func(date, changes, message string) {
+		if _, _, err := draftAmendment(contract, terms, date, changes); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("amending %s from %s: %v, want %q", changes, date, err, message)
+		}
+	}
+	refuse("2016-02-01", `{"flat_off_rate_1": "90"}`, "before amendment 1")
+	refuse("2017-01-01", `{"flat_off_rate_1": "90"}`, "outside contract term")
+	refuse("2016-06-01", `{}`, "non-empty JSON object")
+	refuse("2016-06-01", `{"flat_off_rate_1": 90}`, "non-empty JSON object")
+	refuse("2016-06-01", `{"colour": "red"}`, "colour is not a contract field")
+	for _, fixed := range fixedContractFields {
+		refuse("2016-06-01", `{"`+fixed+`": "x"}`, fixed+" cannot be amended")
+	}
+
+	contract.Status = contractExpired
+	refuse("2016-06-01", `{"flat_off_rate_1": "90"}`, "only active contracts are amended")
+}
+
+func TestApplyAmendment(t *testing.T) {
+	amend := func(t *testing.T, changes map[string]string) (Contract, error) {
+		contract := testContract(t)
+		return applyAmendment(contract, contractAmendment{Number: 1, Effective_Date: "2016-04-01", Changes: changes, Terms_Version: 2})
+	}
+
+	t.Run("rates", func(t *testing.T) {
+		got, err := amend(t, map[string]string{"flat_off_rate_1": "90", "offering_id_2": "o2", "flat_off_rate_2": "15.5"})
+		if err != nil || got.Flat_Off_Rate_1.String() != "90.00" || got.Offering_ID_2 != "o2" || got.Flat_Off_Rate_2.String() != "15.50" {
+			t.Fatalf("%+v, %v", got, err)
+		}
+		if got.Flat_Prod_Rate_1.String() != "9.50" || got.Contract_ID != "c0" || got.Status != contractActive || got.Terms_Version != 2 {
+			t.Errorf("the rest of the contract: %+v", got)
+		}
+	})
+	t.Run("term", func(t *testing.T) {
+		if got, err := amend(t, map[string]string{"contract_end_date": "2016-06-30"}); err != nil || got.Contract_End_Date != "2016-06-30" {
+			t.Errorf("%s, %v", got.Contract_End_Date, err)
+		}
+	})
+	t.Run("units", func(t *testing.T) {
+		got, err := amend(t, map[string]string{"units": `{"o1":{"quantity":250,"tiered":true}}`})
+		if err != nil || got.Units["o1"].Quantity != 250 || !got.Units["o1"].Tiered {
+			t.Errorf("%+v, %v", got.Units, err)
+		}
+	})
+	t.Run("refused", func(t *testing.T) {
+		for name, changes := range map[string]map[string]string{
+			"a rate in tenths of a cent": {"flat_off_rate_1": "90.001"},
+			"an end before the start":    {"contract_end_date": "2015-12-31"},
+			"a discount over 100":        {"discount_percent": "101"},
+			"a tiered product":           {"units": `{"p1":{"quantity":2,"tiered":true}}`},
+			"units of another item":      {"units": `{"o9":{"quantity":2}}`},
+		} {
+			if _, err := amend(t, changes); err == nil || !strings.HasPrefix(err.Error(), "amendment 1: ") {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	})
+}
+
+// get_contract shows the terms of the signed amendments in effect on the date asked for
+func TestTermsOn(t *testing.T) {
+	original := testContract(t)
+	amendment := func(number int, effective string, rate string, status string, version int) contractAmendment {
+		return contractAmendment{Number: number, Effective_Date: effective, Changes: map[string]string{"flat_off_rate_1": rate},
+			Status: status, Terms_Version: version}
+	}
+	terms := contractTerms{Original: original, Amendments: []contractAmendment{
+		amendment(3, "2016-10-01", "60", amendmentSigned, 3),
+		amendment(1, "2016-04-01", "90", amendmentSigned, 2),
+		amendment(2, "2016-07-01", "70", amendmentRejected, 3),
+		amendment(4, "2016-11-01", "50", amendmentProposed, 4),
+	}}
+	current := original
+	current.Flat_Off_Rate_1, current.Terms_Version = mustDecimal(t, "60.00"), 3
+
+	on := func(date string) string {
+		effective, err := termsOn(current, terms, date)
+		if err != nil {
+			t.Fatalf("termsOn(%s): %v", date, err)
+		}
+		return effective.Flat_Off_Rate_1.String() + " v" + strconv.Itoa(termsVersion(effective))
+	}
+	if got := on("2016-03-31"); got != "80.00 v1" {
+		t.Errorf("before any amendment: %s", got)
+	}
+	if got := on("2016-04-01"); got != "90.00 v2" {
+		t.Errorf("on the day amendment 1 takes effect: %s", got)
+	}
+	if got := on("2016-08-15"); got != "90.00 v2" {
+		t.Errorf("after the rejected amendment: %s", got)
+	}
+	if got := on("2016-12-31"); got != "60.00 v3" {
+		t.Errorf("at the end, with amendment 4 unsigned: %s", got)
+	}
+
+	if unamended, _ := termsOn(current, contractTerms{Original: original}, "2016-01-01"); !unamended.Flat_Off_Rate_1.Equal(current.Flat_Off_Rate_1) {
+		t.Errorf("a contract never amended is on rate %s, want the contract as it is", unamended.Flat_Off_Rate_1)
+	}
+}
+
+// the proposing party signs when it proposes, the amendment then waits for the other party
+func TestAmendmentSignatures(t *testing.T) {
+	terms := contractTerms{Amendments: []contractAmendment{{Number: 1, Status: amendmentSigned}}}
+	if pendingAmendment(terms) != nil {
+		t.Fatal("a signed amendment is pending")
+	}
+	terms.Amendments = append(terms.Amendments, contractAmendment{Number: 2, Status: amendmentProposed,
+		Signatures: []amendmentSignature{{Party: partySupplier, Party_ID: "s1"}}})
+	pending := pendingAmendment(terms)
+	if pending == nil || pending.Number != 2 {
+		t.Fatalf("pending = %+v, want amendment 2", pending)
+	}
+
+	if err := addSignature(pending, amendmentSignature{Party: partySupplier, Party_ID: "s1"}); err == nil ||
+		err.Error() != "The supplier has already signed amendment 2" {
+		t.Errorf("the supplier signing twice: %v", err)
+	}
+	if err := addSignature(pending, amendmentSignature{Party: partyClient, Party_ID: "cl1"}); err != nil {
+		t.Fatal(err)
+	}
+	if signatures := terms.Amendments[1].Signatures; len(signatures) != 2 || signatures[1].Party != partyClient {
+		t.Errorf("signatures stored with the terms = %+v", signatures)
+	}
+}
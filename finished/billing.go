@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// billing frequencies, by the number of months in a period
+var billingFrequencies = map[string]int{"monthly": 1, "quarterly": 3, "annual": 12}
+
+// billing timings, a period is billed on its first day in advance or on the day after it ends in arrears
+const (
+	billInAdvance = "advance"
+	billInArrears = "arrears"
+)
+
+// billingSchedule - how a subscription contract is billed. Periods start on the anchor date and every frequency
+// months before and after it, the first and last period are cut to the contract term and billed by day count.
+type billingSchedule struct {
+	Frequency   string `json:"frequency"`
+	Anchor_Date string `json:"anchor_date"`
+	Timing      string `json:"timing"`
+}
+
+// billingPeriod - one period of a contract's billing calendar
+type billingPeriod struct {
+	Period_Start string `json:"period_start"`
+	Period_End   string `json:"period_end"`
+	Bill_Date    string `json:"bill_date"`
+	Full_Days    int    `json:"full_days"` //the days of the period before it was cut to the contract term
+	Status       string `json:"status"`    //invoiced, due or scheduled
+	Invoice_ID   string `json:"invoice_id"`
+}
+
+// billingCalendar - the get_billing_calendar result
+type billingCalendar struct {
+	Contract_ID string           `json:"contract_id"`
+	As_Of       string           `json:"as_of"`
+	Billing     *billingSchedule `json:"billing"`
+	Periods     []billingPeriod  `json:"periods"`
+}
+
+// billingRun - the run_billing result, also sent as the "run_billing" event
+type billingRun struct {
+	Run_Date string         `json:"run_date"`
+	Invoices []string       `json:"invoices"`
+	Errors   []billingError `json:"errors"`
+}
+
+type billingError struct {
+	Contract_ID  string `json:"contract_id"`
+	Period_Start string `json:"period_start"`
+	Error        string `json:"error"`
+}
+
+func (b billingSchedule) String() string {
+	return b.Frequency + " from " + b.Anchor_Date + " in " + b.Timing
+}
+
+// ============================================================================================================================
+// Set billing schedule - bill a contract monthly, quarterly or annually, in advance or in arrears. The anchor date
+// must fall in the contract term and on one of the first 28 days of a month, so every period starts on the same day.
+//
+// args: contract_id, frequency (monthly, quarterly, annual or none to stop billing), anchor_date, timing (advance or arrears)
+// ============================================================================================================================
+func (t *SimpleChaincode) set_billing_schedule(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	fmt.Println("- start set billing schedule")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := buildBillingSchedule(contract, args[1], args[2], args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	from, to := "none", "none"
+	if contract.Billing != nil {
+		from = contract.Billing.String()
+	}
+	if schedule != nil {
+		to = schedule.String()
+	}
+	contract.Billing = schedule
+	if err := storeContract(stub, &contract); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "billing", from, to); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end set billing schedule")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Run billing - invoice every period of every scheduled contract that is or was in force whose bill date has come by the transaction
+// date. Periods that already have an invoice, void ones included, are skipped, so running it again bills nothing
+// twice. A voided period is billed again with generate_invoice. A contract that cannot be billed is reported and the
+// run goes on with the others.
+// ============================================================================================================================
+func (t *SimpleChaincode) run_billing(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	fmt.Println("- start run billing")
+	today, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	run := billingRun{Run_Date: today, Invoices: []string{}, Errors: []billingError{}}
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range contractIndex {
+		contract, err := getContract(stub, id)
+		if err != nil || contract.Billing == nil || !contractInvoiced(contract.Status) {
+			continue
+		}
+		periods, err := contractCalendar(stub, contract, today)
+		if err != nil {
+			return nil, err
+		}
+		for _, period := range periods {
+			if period.Status != "due" {
+				continue
+			}
+			invoice, err := invoiceContract(stub, contract, period.Period_Start, period.Period_End)
+			if err != nil {
+				run.Errors = append(run.Errors, billingError{id, period.Period_Start, err.Error()})
+				break
+			}
+			run.Invoices = append(run.Invoices, invoice.Invoice_ID)
+		}
+	}
+
+	runAsBytes, _ := json.Marshal(run)
+	if err := stub.SetEvent("run_billing", runAsBytes); err != nil {
+		fmt.Println("Failed to set run_billing event")
+	}
+	fmt.Println("- end run billing")
+	return runAsBytes, nil
+}
+
+// ============================================================================================================================
+// Get billing calendar - every billing period of a scheduled contract: invoiced, due (the bill date has come but it
+// is not invoiced yet) or scheduled
+//
+// args: contract_id, optional as_of date (defaults to the transaction date)
+// ============================================================================================================================
+func (t *SimpleChaincode) get_billing_calendar(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting contract_id and optional as_of date")
+	}
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	asOf, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 2 && args[1] != "" {
+		if asOf, err = canonicalDate("as_of", args[1]); err != nil {
+			return nil, err
+		}
+	}
+	calendar := billingCalendar{Contract_ID: args[0], As_Of: asOf, Billing: contract.Billing, Periods: []billingPeriod{}}
+	if contract.Billing != nil {
+		if calendar.Periods, err = contractCalendar(stub, contract, asOf); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(calendar)
+}
+
+// contractCalendar - the billing periods of a scheduled contract with their status on asOf. A period is invoiced
+// when any invoice of the contract overlaps it.
+func contractCalendar(stub *shim.ChaincodeStub, contract Contract, asOf string) ([]billingPeriod, error) {
+	invoices, err := contractInvoices(stub, contract.Contract_ID)
+	if err != nil {
+		return nil, err
+	}
+	return periodStatuses(billingPeriods(contract), invoices, asOf), nil
+}
+
+// periodStatuses - mark each period invoiced when one of the invoices overlaps it, else due once its bill date has
+// come by asOf, else scheduled
+func periodStatuses(periods []billingPeriod, invoices []Invoice, asOf string) []billingPeriod {
+	for i, period := range periods {
+		periods[i].Status = "scheduled"
+		if period.Bill_Date <= asOf {
+			periods[i].Status = "due"
+		}
+		for _, invoice := range invoices {
+			if !invoice.Settlement && invoice.Period_Start <= period.Period_End && period.Period_Start <= invoice.Period_End {
+				periods[i].Status, periods[i].Invoice_ID = "invoiced", invoice.Invoice_ID
+			}
+		}
+	}
+	return periods
+}
+
+// buildBillingSchedule - the schedule of set_billing_schedule checked against the contract term, nil for none
+func buildBillingSchedule(contract Contract, frequency string, anchorDate string, timing string) (*billingSchedule, error) {
+	frequency = strings.ToLower(strings.TrimSpace(frequency))
+	if frequency == "none" {
+		return nil, nil
+	}
+	if _, ok := billingFrequencies[frequency]; !ok {
+		return nil, errors.New("frequency must be one of monthly, quarterly, annual or none")
+	}
+	anchor, err := parseDate(anchorDate)
+	if err != nil {
+		return nil, errors.New("anchor_date must be a date (YYYY-MM-DD), got \"" + anchorDate + "\"")
+	}
+	if anchor.Day() > 28 {
+		return nil, errors.New("anchor_date must fall on one of the first 28 days of a month")
+	}
+	anchorDate = anchor.Format(dateLayout)
+	if err := checkWithin("anchor_date", anchorDate, anchorDate, "contract term", contract.Contract_Start_Date, contract.Contract_End_Date); err != nil {
+		return nil, err
+	}
+	timing = strings.ToLower(strings.TrimSpace(timing))
+	if timing != billInAdvance && timing != billInArrears {
+		return nil, errors.New("timing must be advance or arrears")
+	}
+	return &billingSchedule{frequency, anchorDate, timing}, nil
+}
+
+// billingPeriods - the periods of the contract's billing schedule inside its term, in order
+func billingPeriods(contract Contract) []billingPeriod {
+	periods := []billingPeriod{}
+	schedule := contract.Billing
+	anchor, errAnchor := time.Parse(dateLayout, schedule.Anchor_Date)
+	start, errStart := time.Parse(dateLayout, contract.Contract_Start_Date)
+	end, errEnd := time.Parse(dateLayout, contract.Contract_End_Date)
+	months := billingFrequencies[schedule.Frequency]
+	if errAnchor != nil || errStart != nil || errEnd != nil || months == 0 {
+		return periods
+	}
+	k := 0 //moved to the last period boundary on or before the contract start
+	for anchor.AddDate(0, k*months, 0).After(start) {
+		k--
+	}
+	for !anchor.AddDate(0, (k+1)*months, 0).After(start) {
+		k++
+	}
+	for boundary := anchor.AddDate(0, k*months, 0); !boundary.After(end); boundary = anchor.AddDate(0, k*months, 0) {
+		k++
+		periodStart, periodEnd := boundary, anchor.AddDate(0, k*months, -1)
+		if periodStart.Before(start) {
+			periodStart = start
+		}
+		if periodEnd.After(end) {
+			periodEnd = end
+		}
+		if periodStart.After(periodEnd) {
+			continue
+		}
+		billDate := periodStart
+		if schedule.Timing == billInArrears {
+			billDate = periodEnd.AddDate(0, 0, 1)
+		}
+		periods = append(periods, billingPeriod{Period_Start: periodStart.Format(dateLayout),
+			Period_End: periodEnd.Format(dateLayout), Bill_Date: billDate.Format(dateLayout),
+			Full_Days: dayCount(boundary.Format(dateLayout), anchor.AddDate(0, k*months, -1).Format(dateLayout))})
+	}
+	return periods
+}
+
+// fullPeriodDays - the days of the billing period the rates of a contract are for: a scheduled period cut to the
+// contract term is billed for its share of the full period, any other period in full
+func fullPeriodDays(contract Contract, start string, end string) int {
+	days := dayCount(start, end)
+	if contract.Billing == nil {
+		return days
+	}
+	for _, period := range billingPeriods(contract) {
+		if period.Period_Start == start && period.Period_End == end && period.Full_Days > days {
+			return period.Full_Days
+		}
+	}
+	return days
+}
+
+// periodShare - the part of an amount for a full period of fullDays that falls on the days billed, by day count
+func periodShare(amount Decimal, days int, fullDays int, currency string) Decimal {
+	if fullDays <= 0 || days >= fullDays {
+		return amount
+	}
+	return amount.ProRata(int64(days), int64(fullDays), currencyMinorUnits[currency])
+}
+
+// dayCount - the number of days from start to end, both included, for dates in the canonical layout
+func dayCount(start string, end string) int {
+	s, errStart := time.Parse(dateLayout, start)
+	e, errEnd := time.Parse(dateLayout, end)
+	if errStart != nil || errEnd != nil {
+		return 0
+	}
+	return int(e.Sub(s).Hours()/24) + 1
+}
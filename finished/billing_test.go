@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// calendar - the billing periods of a contract as "start..end on bill_date (full_days)"
+func calendar(frequency, anchor, timing, start, end string) []string {
+	contract := Contract{Contract_Start_Date: start, Contract_End_Date: end, Billing: &billingSchedule{frequency, anchor, timing}}
+	out := []string{}
+	for _, p := range billingPeriods(contract) {
+		out = append(out, p.Period_Start+".."+p.Period_End+" on "+p.Bill_Date+" ("+strconv.Itoa(p.Full_Days)+")")
+	}
+	return out
+}
+
+func TestBillingPeriods(t *testing.T) {
+	expect := func(name string, got []string, want ...string) {
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s:\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	expect("quarterly in advance on the term", calendar("quarterly", "2016-01-01", billInAdvance, "2016-01-01", "2016-12-31"),
+		"2016-01-01..2016-03-31 on 2016-01-01 (91)",
+		"2016-04-01..2016-06-30 on 2016-04-01 (91)",
+		"2016-07-01..2016-09-30 on 2016-07-01 (92)",
+		"2016-10-01..2016-12-31 on 2016-10-01 (92)")
+
+	// the first and last periods are cut to the term but keep the days of the full period
+	expect("quarterly in arrears from February", calendar("quarterly", "2016-02-01", billInArrears, "2016-01-01", "2016-12-31"),
+		"2016-01-01..2016-01-31 on 2016-02-01 (92)",
+		"2016-02-01..2016-04-30 on 2016-05-01 (90)",
+		"2016-05-01..2016-07-31 on 2016-08-01 (92)",
+		"2016-08-01..2016-10-31 on 2016-11-01 (92)",
+		"2016-11-01..2016-12-31 on 2017-01-01 (92)")
+
+	// an anchor outside the term still fixes the day the periods start on
+	expect("monthly, anchored after the start", calendar("monthly", "2016-06-15", billInAdvance, "2016-03-01", "2016-04-30"),
+		"2016-03-01..2016-03-14 on 2016-03-01 (29)",
+		"2016-03-15..2016-04-14 on 2016-03-15 (31)",
+		"2016-04-15..2016-04-30 on 2016-04-15 (30)")
+	expect("monthly, renewed a year after the anchor", calendar("monthly", "2016-01-01", billInArrears, "2017-01-01", "2017-03-31"),
+		"2017-01-01..2017-01-31 on 2017-02-01 (31)",
+		"2017-02-01..2017-02-28 on 2017-03-01 (28)",
+		"2017-03-01..2017-03-31 on 2017-04-01 (31)")
+
+	expect("annual, one day term", calendar("annual", "2016-01-01", billInArrears, "2016-05-05", "2016-05-05"),
+		"2016-05-05..2016-05-05 on 2016-05-06 (366)")
+	expect("no such frequency", calendar("weekly", "2016-01-01", billInAdvance, "2016-01-01", "2016-12-31"))
+}
+
+// run_billing invoices the due periods, and running it again finds nothing due
+func TestPeriodStatuses(t *testing.T) {
+	contract := Contract{Contract_ID: "c1", Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-12-31",
+		Billing: &billingSchedule{"quarterly", "2016-01-01", billInArrears}}
+	statuses := func(invoices []Invoice, asOf string) string {
+		out := []string{}
+		for _, p := range periodStatuses(billingPeriods(contract), invoices, asOf) {
+			out = append(out, p.Status+p.Invoice_ID)
+		}
+		return strings.Join(out, " ")
+	}
+
+	if got := statuses(nil, "2016-03-31"); got != "scheduled scheduled scheduled scheduled" {
+		t.Errorf("on the last day of the first quarter: %s, want nothing due yet in arrears", got)
+	}
+	if got := statuses(nil, "2016-07-01"); got != "due due scheduled scheduled" {
+		t.Errorf("a missed run: %s, want both past quarters due", got)
+	}
+
+	invoices := []Invoice{
+		{Invoice_ID: "#1", Period_Start: "2016-01-01", Period_End: "2016-03-31", Status: invoicePaid},
+		{Invoice_ID: "#2", Period_Start: "2016-04-01", Period_End: "2016-06-30", Status: invoiceVoid},
+	}
+	if got := statuses(invoices, "2016-07-01"); got != "invoiced#1 invoiced#2 scheduled scheduled" {
+		t.Errorf("billed again: %s, want the void period left to generate_invoice", got)
+	}
+	// an invoice for part of a period, raised by hand, keeps the run off the whole period
+	invoices = []Invoice{{Invoice_ID: "#3", Period_Start: "2016-08-15", Period_End: "2016-08-31", Status: invoiceIssued}}
+	if got := statuses(invoices, "2017-01-01"); got != "due due invoiced#3 due" {
+		t.Errorf("after the term: %s", got)
+	}
+}
+
+func TestBuildBillingSchedule(t *testing.T) {
+	contract := Contract{Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-12-31"}
+	schedule, err := buildBillingSchedule(contract, " Quarterly", "2016-02-01T09:00:00Z", "ARREARS")
+	if err != nil || schedule.String() != "quarterly from 2016-02-01 in arrears" {
+		t.Errorf("schedule = %v, %v", schedule, err)
+	}
+	if schedule, err := buildBillingSchedule(contract, "none", "", ""); schedule != nil || err != nil {
+		t.Errorf("none = %v, %v, want billing stopped", schedule, err)
+	}
+	for _, bad := range [][3]string{
+		{"weekly", "2016-02-01", "advance"},
+		{"monthly", "2016-01-31", "advance"},
+		{"monthly", "2017-01-01", "advance"},
+		{"monthly", "first of the month", "advance"},
+		{"monthly", "2016-02-01", "later"},
+	} {
+		if schedule, err := buildBillingSchedule(contract, bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("%v gave %v", bad, schedule)
+		}
+	}
+}
+
+// a period cut to the term is charged its share of the rate for the full period
+func TestCutPeriodsAreBilledByDayCount(t *testing.T) {
+	contract := Contract{Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-12-31",
+		Billing: &billingSchedule{"quarterly", "2016-02-01", billInAdvance}}
+	rate := mustDecimal(t, "100.00")
+
+	january := fullPeriodDays(contract, "2016-01-01", "2016-01-31")
+	december := fullPeriodDays(contract, "2016-11-01", "2016-12-31")
+	if january != 92 || december != 92 || fullPeriodDays(contract, "2016-02-01", "2016-04-30") != 90 {
+		t.Fatalf("full days of the cut periods: %d and %d", january, december)
+	}
+	if got := periodShare(rate, 31, january, "USD"); got.String() != "33.70" {
+		t.Errorf("January = %s, want 31/92 of the quarter", got)
+	}
+	if got := periodShare(rate, 61, december, "USD"); got.String() != "66.30" {
+		t.Errorf("November and December = %s", got)
+	}
+	if got := periodShare(rate, 90, 90, "USD"); !got.Equal(rate) {
+		t.Errorf("a full quarter = %s", got)
+	}
+
+	// periods that are not on the schedule, and contracts without one, are billed in full
+	if days := fullPeriodDays(contract, "2016-01-01", "2016-01-15"); days != 15 {
+		t.Errorf("half of January as a period of its own: %d days", days)
+	}
+	contract.Billing = nil
+	if days := fullPeriodDays(contract, "2016-01-01", "2016-01-31"); days != 31 {
+		t.Errorf("no schedule: %d days", days)
+	}
+	if got := periodShare(mustDecimal(t, "1000"), 1, 3, "JPY"); got.String() != "333" {
+		t.Errorf("a third of 1000 JPY = %s", got)
+	}
+	if got := periodShare(rate, 10, 0, "USD"); !got.Equal(rate) {
+		t.Errorf("no full days = %s", got)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// column order of each record type, the same order the init_* functions take their arguments in
+var productFields = []string{"product_id", "category", "product_description", "availability_start_date",
+	"availability_end_date", "list_price", "currency", "price_start_date", "price_end_date", "user_type"}
+var offeringFields = []string{"offering_id", "offering_category", "offering_description", "availability_start_date",
+	"availability_end_date", "current_list_price", "currency", "price_start_date", "price_end_date", "product_id_01", "product_id_02"}
+var clientFields = []string{"client_id", "last_name", "first_name", "company", "username", "password", "last_modified"}
+var contractFields = []string{"contract_id", "client_id", "offering_id_1", "offering_id_2", "offering_id_3", "offering_id_4",
+	"flat_off_rate_1", "flat_off_rate_2", "flat_off_rate_3", "flat_off_rate_4",
+	"flat_prod_rate_1", "flat_prod_rate_2", "flat_prod_rate_3", "flat_prod_rate_4", "flat_prod_rate_5", "flat_prod_rate_6",
+	"product_id_1", "product_id_2", "product_id_3", "product_id_4", "product_id_5", "product_id_6",
+	"supplier_id", "discount_percent", "currency", "contract_start_date", "contract_end_date", "last_modified"}
+
+// pending offerings are keyed by their generated request id, which init_pendingOffering does not take as an argument
+var pendingOfferingFields = []string{"request_id", "client_id", "product_id_1", "product_id_2", "flag"}
+
+// timestampFields - set from the transaction time, accepted in a payload but never required
+var timestampFields = []string{"created_at", "updated_at"}
+
+// importSpec - how to turn one row of a bulk import into a record.
+// kindField is a field only this record type has, it recognises records stored before they carried a doc_type.
+// extraFields are fields that are not init_* arguments, a restore carries them over from the dump as they are.
+type importSpec struct {
+	name        string
+	indexStr    string
+	fields      []string
+	kindField   string
+	extraFields []string
+	build       func(args []string) (stampedRecord, error)
+}
+
+var productImportSpec = importSpec{"products", productIndexStr, productFields, "product_description", []string{"prices", "status"},
+	func(args []string) (stampedRecord, error) { p, err := buildProduct(args); return &p, err }}
+var offeringImportSpec = importSpec{"offerings", offeringIndexStr, offeringFields, "offering_id", []string{"prices", "tiers"},
+	func(args []string) (stampedRecord, error) { o, err := buildOffering(args); return &o, err }}
+var clientImportSpec = importSpec{"clients", clientIndexStr, clientFields, "username", []string{"user_type"},
+	func(args []string) (stampedRecord, error) { c, err := buildClient(args); return &c, err }}
+var contractImportSpec = importSpec{"contracts", contractIndexStr, contractFields, "contract_id", []string{"status", "billing", "terms_version", "renewal",
+	"renewed_from", "renewed_to", "notice_sent", "superseded_by", "termination_terms", "termination", "units"},
+	func(args []string) (stampedRecord, error) { c, err := buildContract(args); return &c, err }}
+var pendingOfferingImportSpec = importSpec{"pending_offerings", pendingOfferingIndexStr, pendingOfferingFields, "flag", nil,
+	func(args []string) (stampedRecord, error) { p, err := buildPendingOffering(args); return &p, err }}
+
+// importedRecord - a validated row, ready to be stored.
+// created_at/updated_at are only set when a restore carries them over from the dump.
+type importedRecord struct {
+	row        int
+	id         string
+	record     stampedRecord
+	created_at string
+	updated_at string
+}
+
+type importRowError struct {
+	Row   int    `json:"row"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// importReport - returned by the bulk_import_* invokes and sent as the "bulk_import" event
+type importReport struct {
+	Entity   string           `json:"entity"`
+	Mode     string           `json:"mode"`
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	Errors   []importRowError `json:"errors"`
+}
+
+// ============================================================================================================================
+// Bulk import - load many records in one transaction
+//
+// args: format ("json" or "csv"), payload, mode ("atomic" - the default - or "partial")
+//
+// A json payload is an array of objects keyed by the record's json tags, a csv payload has a header row of the same names.
+// In atomic mode one bad row fails the whole transaction, in partial mode the valid rows are stored and the bad ones reported.
+// ============================================================================================================================
+func (t *SimpleChaincode) bulk_import_products(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.bulk_import(stub, productImportSpec, args)
+}
+
+func (t *SimpleChaincode) bulk_import_offerings(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.bulk_import(stub, offeringImportSpec, args)
+}
+
+func (t *SimpleChaincode) bulk_import_clients(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.bulk_import(stub, clientImportSpec, args)
+}
+
+func (t *SimpleChaincode) bulk_import(stub *shim.ChaincodeStub, spec importSpec, args []string) ([]byte, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting format, payload and optional mode")
+	}
+	mode, err := importMode(args[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- start bulk import " + spec.name)
+	var rows [][]string
+	switch strings.ToLower(args[0]) {
+	case "json":
+		rows, err = jsonImportRows(spec.fields, args[1])
+	case "csv":
+		rows, err = csvImportRows(spec.fields, args[1])
+	default:
+		return nil, errors.New("Format must be json or csv")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := importReport{Entity: spec.name, Mode: mode, Rows: len(rows)}
+	valid, rowErrors := validateRows(stub, spec, rows, false)
+	report.Errors = rowErrors
+	if len(report.Errors) > 0 && mode == "atomic" {
+		reportAsBytes, _ := json.Marshal(report)
+		return nil, errors.New("Bulk import rejected, nothing was stored: " + string(reportAsBytes))
+	}
+
+	if err := storeRecords(stub, spec.indexStr, valid); err != nil {
+		return nil, err
+	}
+	report.Imported = len(valid)
+
+	reportAsBytes, _ := json.Marshal(report)
+	if err := stub.SetEvent("bulk_import", reportAsBytes); err != nil {
+		fmt.Println("Failed to set bulk_import event")
+	}
+	fmt.Println("- end bulk import " + spec.name + ", imported " + strconv.Itoa(report.Imported) + " of " + strconv.Itoa(report.Rows))
+	return reportAsBytes, nil
+}
+
+// importMode - the optional mode argument, atomic when it is left out
+func importMode(args []string) (string, error) {
+	mode := "atomic"
+	if len(args) > 0 && args[0] != "" {
+		mode = strings.ToLower(args[0])
+	}
+	if mode != "atomic" && mode != "partial" {
+		return "", errors.New("Mode must be atomic or partial")
+	}
+	return mode, nil
+}
+
+// validateRows - build every row, collecting the rows that fail instead of stopping at the first one. An import
+// also settles each record against the stored one here, a restore does so once the extra fields are copied.
+func validateRows(stub *shim.ChaincodeStub, spec importSpec, rows [][]string, restoring bool) ([]importedRecord, []importRowError) {
+	var valid []importedRecord
+	rowErrors := []importRowError{}
+	seen := map[string]int{}
+	for i, row := range rows {
+		rowNum := i + 1
+		id := row[0]
+		record, err := spec.build(row)
+		if err == nil {
+			if first, dup := seen[id]; dup {
+				err = errors.New("duplicate id, already given on row " + strconv.Itoa(first))
+			}
+		}
+		if err == nil && !restoring {
+			err = settleRecord(stub, id, record, false)
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, importRowError{Row: rowNum, ID: id, Error: err.Error()})
+			continue
+		}
+		seen[id] = rowNum
+		valid = append(valid, importedRecord{row: rowNum, id: id, record: record})
+	}
+	return valid, rowErrors
+}
+
+// settleRecord - check a record against the one stored under its id. A restored product or offering brings its
+// whole price schedule, otherwise the row's price joins the stored schedule.
+func settleRecord(stub *shim.ChaincodeStub, id string, record stampedRecord, restoring bool) error {
+	if product, ok := record.(*Product); ok {
+		if err := settleProductStatus(stub, id, product, restoring); err != nil {
+			return err
+		}
+		if err := settleProductUserType(stub, id, product, restoring); err != nil {
+			return err
+		}
+	}
+	if priced, ok := record.(pricedRecord); ok {
+		if !restoring {
+			if err := mergeStoredSchedule(stub, id, priced); err != nil {
+				return err
+			}
+		}
+		return checkSchedule(priced)
+	}
+	return nil
+}
+
+// storeRecords - stamp and write the records settled by settleRecord, then add any new ids to the index with a single
+// index write
+func storeRecords(stub *shim.ChaincodeStub, indexStr string, records []importedRecord) error {
+	index, err := getIndex(stub, indexStr)
+	if err != nil {
+		return err
+	}
+	inIndex := map[string]bool{}
+	for _, id := range index {
+		inIndex[id] = true
+	}
+	for _, rec := range records {
+		if priced, ok := rec.record.(pricedRecord); ok {
+			if err := refreshListPrice(stub, priced); err != nil {
+				return err
+			}
+		}
+		if rec.created_at != "" {
+			rec.record.setTimestamps(rec.created_at, rec.updated_at)
+		} else if err := stampRecord(stub, rec.id, rec.record); err != nil {
+			return err
+		}
+		value, _ := json.Marshal(rec.record)
+		if err := stub.PutState(rec.id, value); err != nil {
+			return errors.New("Failed to store " + rec.id)
+		}
+		if !inIndex[rec.id] {
+			index = append(index, rec.id)
+			inIndex[rec.id] = true
+		}
+	}
+	indexAsBytes, _ := json.Marshal(index)
+	if err := stub.PutState(indexStr, indexAsBytes); err != nil {
+		return errors.New("Failed to update index " + indexStr)
+	}
+	return nil
+}
+
+// jsonImportRows - a JSON array of objects into rows in field order
+func jsonImportRows(fields []string, payload string) ([][]string, error) {
+	var objects []map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &objects); err != nil {
+		return nil, errors.New("JSON payload must be an array of objects")
+	}
+	return objectRows(fields, nil, objects)
+}
+
+// objectRows - decoded JSON objects into rows in field order, numbers are turned back into strings.
+// Timestamps and the given extra fields may be present, they are not part of the row.
+func objectRows(fields []string, extra []string, objects []map[string]interface{}) ([][]string, error) {
+	known := map[string]bool{}
+	for _, list := range [][]string{fields, timestampFields, extra, {docTypeField}} {
+		for _, f := range list {
+			known[f] = true
+		}
+	}
+	rows := make([][]string, 0, len(objects))
+	for i, obj := range objects {
+		for key := range obj {
+			if !known[key] {
+				return nil, errors.New("Row " + strconv.Itoa(i+1) + ": unknown field " + key)
+			}
+		}
+		row := make([]string, len(fields))
+		for j, f := range fields {
+			row[j] = fieldString(obj, f)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// csvImportRows - a CSV document whose header names the fields, columns may come in any order
+func csvImportRows(fields []string, payload string) ([][]string, error) {
+	records, err := csv.NewReader(strings.NewReader(payload)).ReadAll()
+	if err != nil {
+		return nil, errors.New("Invalid CSV payload: " + err.Error())
+	}
+	if len(records) == 0 {
+		return nil, errors.New("CSV payload must start with a header row")
+	}
+	column := map[string]int{}
+	for i, name := range records[0] {
+		name = strings.TrimSpace(name)
+		if _, dup := column[name]; dup {
+			return nil, errors.New("CSV header repeats column " + name)
+		}
+		column[name] = i
+	}
+	known := map[string]bool{}
+	for _, f := range timestampFields {
+		known[f] = true
+	}
+	for _, f := range fields {
+		known[f] = true
+		if _, ok := column[f]; !ok {
+			return nil, errors.New("CSV header is missing column " + f)
+		}
+	}
+	for name := range column {
+		if !known[name] {
+			return nil, errors.New("CSV header has unknown column " + name)
+		}
+	}
+	rows := make([][]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make([]string, len(fields))
+		for j, f := range fields {
+			row[j] = strings.TrimSpace(record[column[f]])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
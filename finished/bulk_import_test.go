@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportMode(t *testing.T) {
+	for _, args := range [][]string{nil, {""}, {"atomic"}, {"ATOMIC"}} {
+		if mode, err := importMode(args); mode != "atomic" || err != nil {
+			t.Errorf("importMode(%q) = %q, %v, want atomic", args, mode, err)
+		}
+	}
+	if mode, err := importMode([]string{"Partial"}); mode != "partial" || err != nil {
+		t.Errorf("importMode(Partial) = %q, %v", mode, err)
+	}
+	if _, err := importMode([]string{"best-effort"}); err == nil {
+		t.Error("importMode accepted an unknown mode")
+	}
+}
+
+func TestJSONAndCSVPayloadsGiveTheSameRows(t *testing.T) {
+	jsonRows, err := jsonImportRows(clientFields, `[
+		{"client_id":"cl1","last_name":"Doe","first_name":"Jo","company":"Acme","username":"jo","password":"pw"},
+		{"client_id":"cl2","username":"al","created_at":"2016-01-01T00:00:00Z"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvRows, err := csvImportRows(clientFields, "username,client_id,last_name,first_name,company,password,last_modified\n"+
+		" jo ,cl1,Doe,Jo,Acme,pw,\nal,cl2,,,,,\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"cl1", "Doe", "Jo", "Acme", "jo", "pw", ""}, {"cl2", "", "", "", "al", "", ""}}
+	if !reflect.DeepEqual(jsonRows, want) {
+		t.Errorf("json rows = %q", jsonRows)
+	}
+	if !reflect.DeepEqual(csvRows, want) {
+		t.Errorf("csv rows = %q", csvRows)
+	}
+}
+
+func TestMalformedPayloads(t *testing.T) {
+	if _, err := jsonImportRows(clientFields, `{"client_id":"cl1"}`); err == nil {
+		t.Error("json: accepted an object instead of an array")
+	}
+	if _, err := jsonImportRows(clientFields, `[{"client_id":"cl1"},{"client":"cl2"}]`); err == nil ||
+		!strings.Contains(err.Error(), "Row 2") {
+		t.Errorf("json: unknown field gave %v, want it reported on row 2", err)
+	}
+	header := strings.Join(clientFields, ",")
+	for name, payload := range map[string]string{
+		"empty":          "",
+		"missing column": "client_id,username\ncl1,jo\n",
+		"unknown column": header + ",email\n",
+		"repeated":       header + ",client_id\n",
+		"ragged row":     header + "\ncl1,Doe\n",
+	} {
+		if _, err := csvImportRows(clientFields, payload); err == nil {
+			t.Errorf("csv %s: accepted", name)
+		}
+	}
+}
+
+// validateRows reports every bad row and keeps the rest, whatever the mode - bulk_import then stores nothing in
+// atomic mode and the valid rows in partial mode. A restore does not settle against the stored records, so it needs
+// no stub.
+func TestValidateRowsCollectsEveryBadRow(t *testing.T) {
+	rows := [][]string{
+		{"cl1", "Doe", "Jo", "Acme", "jo", "pw", ""},
+		{"cl2", "", "", "", "al", "pw", ""},
+		{"cl1", "Roe", "Al", "Acme", "al", "pw", ""},
+		{"cl3", "Poe", "Ed", "Acme", "ed", "pw", ""},
+	}
+	valid, rowErrors := validateRows(nil, clientImportSpec, rows, true)
+	if len(valid) != 2 || valid[0].id != "cl1" || valid[1].id != "cl3" || valid[1].row != 4 {
+		t.Errorf("valid rows = %+v, want cl1 (row 1) and cl3 (row 4)", valid)
+	}
+	if len(rowErrors) != 2 {
+		t.Fatalf("errors = %+v, want rows 2 and 3", rowErrors)
+	}
+	if rowErrors[0].Row != 2 || rowErrors[0].ID != "cl2" {
+		t.Errorf("first error = %+v, want the empty last name on row 2", rowErrors[0])
+	}
+	if rowErrors[1].Row != 3 || !strings.Contains(rowErrors[1].Error, "row 1") {
+		t.Errorf("second error = %+v, want the duplicate of row 1", rowErrors[1])
+	}
+	if _, rowErrors := validateRows(nil, clientImportSpec, rows[:1], true); rowErrors == nil || len(rowErrors) != 0 {
+		t.Errorf("clean rows gave errors %v, want an empty list", rowErrors)
+	}
+}
@@ -23,11 +23,16 @@ type Product struct{
 	Product_Description string `json:"product_description"`
 	Availability_Start_Date string `json:"availability_start_date"`
 	Availability_End_Date string `json:"availability_end_date"`
-	List_Price float64 `json:"list_price"`
+	List_Price Decimal `json:"list_price"`
 	Currency string `json:"currency"`
 	Price_Start_Date string `json:"price_start_date"`
 	Price_End_Date string `json:"price_end_date"`
 	User_Type string `json:"user_type"`
+	Status string `json:"status"`
+	Prices []priceEntry `json:"prices"`
+	Created_At string `json:"created_at"`
+	Updated_At string `json:"updated_at"`
+	Doc_Type string `json:"doc_type"`
 }
 
 type Offering struct{
@@ -36,16 +41,21 @@ type Offering struct{
 	Offering_Description string `json:"offering_description"`
 	Availability_Start_Date string `json:"availability_start_date"`
 	Availability_End_Date string `json:"availability_end_date"`
-	Current_List_Price float64 `json:"current_list_price"`
+	Current_List_Price Decimal `json:"current_list_price"`
 	Currency string `json:"currency"`
 	Price_Start_Date string `json:"price_start_date"`
 	Price_End_Date string `json:"price_end_date"`
 	Product_ID_01 string `json:"product_id_01"`
 	Product_ID_02 string `json:"product_id_02"`
+	Prices []priceEntry `json:"prices"`
+	Tiers []tierTable `json:"tiers,omitempty"`			//tiered unit prices, one table per currency
+	Created_At string `json:"created_at"`
+	Updated_At string `json:"updated_at"`
+	Doc_Type string `json:"doc_type"`
 }
 var offeringIndexStr = "_offeringindex"
 
-//Contract index and table structure
+//Contract index and table structure, the rates are stored as JSON strings (see Decimal)
 
 type Contract struct{
 	Contract_ID string `json:"contract_id"`
@@ -54,17 +64,17 @@ type Contract struct{
 	Offering_ID_2 string `json:"offering_id_2"`
 	Offering_ID_3 string `json:"offering_id_3"`
 	Offering_ID_4 string `json:"offering_id_4"`
-	Flat_Off_Rate_1 float64 `json:"flat_off_rate_1"`
-	Flat_Off_Rate_2 float64 `json:"flat_off_rate_2"`
-	Flat_Off_Rate_3 float64 `json:"flat_off_rate_3"`
-	Flat_Off_Rate_4 float64 `json:"flat_off_rate_4"`
-
-	Flat_Prod_Rate_1 float64 `json:"flat_prod_rate_1"`
-	Flat_Prod_Rate_2 float64 `json:"flat_prod_rate_2"`
-	Flat_Prod_Rate_3 float64 `json:"flat_prod_rate_3"`
-	Flat_Prod_Rate_4 float64 `json:"flat_prod_rate_4"`
-	Flat_Prod_Rate_5 float64 `json:"flat_prod_rate_5"`
-	Flat_Prod_Rate_6 float64 `json:"flat_prod_rate_6"`
+	Flat_Off_Rate_1 Decimal `json:"flat_off_rate_1"`
+	Flat_Off_Rate_2 Decimal `json:"flat_off_rate_2"`
+	Flat_Off_Rate_3 Decimal `json:"flat_off_rate_3"`
+	Flat_Off_Rate_4 Decimal `json:"flat_off_rate_4"`
+
+	Flat_Prod_Rate_1 Decimal `json:"flat_prod_rate_1"`
+	Flat_Prod_Rate_2 Decimal `json:"flat_prod_rate_2"`
+	Flat_Prod_Rate_3 Decimal `json:"flat_prod_rate_3"`
+	Flat_Prod_Rate_4 Decimal `json:"flat_prod_rate_4"`
+	Flat_Prod_Rate_5 Decimal `json:"flat_prod_rate_5"`
+	Flat_Prod_Rate_6 Decimal `json:"flat_prod_rate_6"`
 
 	Product_Id_1 string `json:"product_id_1"`
 	Product_Id_2 string `json:"product_id_2"`
@@ -75,11 +85,25 @@ type Contract struct{
 
 	Supplier_ID string `json:"supplier_id"`
 
-	Discount_Percent float64 `json:"discount_percent"`
+	Discount_Percent Decimal `json:"discount_percent"`
 	Currency string `json:"currency"`
 	Contract_Start_Date string `json:"contract_start_date"`
 	Contract_End_Date string `json:"contract_end_date"`
+	Status string `json:"status"`
+	Billing *billingSchedule `json:"billing,omitempty"`
+	Terms_Version int `json:"terms_version"`
+	Renewal *renewalTerms `json:"renewal,omitempty"`
+	Renewed_From string `json:"renewed_from,omitempty"`
+	Renewed_To string `json:"renewed_to,omitempty"`
+	Notice_Sent string `json:"notice_sent,omitempty"`			//the end date the notice window event was sent for
+	Superseded_By string `json:"superseded_by,omitempty"`
+	Termination_Terms *terminationTerms `json:"termination_terms,omitempty"`
+	Termination *contractTermination `json:"termination,omitempty"`
+	Units map[string]contractUnits `json:"units,omitempty"`			//quantities billed each period by item id
 	Last_Modified string `json:"last_modified"`
+	Created_At string `json:"created_at"`
+	Updated_At string `json:"updated_at"`
+	Doc_Type string `json:"doc_type"`
 }
 
 var contractIndexStr="_contractindex";
@@ -92,17 +116,25 @@ type Client struct{
 	Company string `json:"company"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	User_Type string `json:"user_type"`
 	Last_Modified string `json:"last_modified"`
+	Created_At string `json:"created_at"`
+	Updated_At string `json:"updated_at"`
+	Doc_Type string `json:"doc_type"`
 }
 var clientIndexStr = "_clientindex"
 
 type pendingOffering struct{
+	Request_ID string `json:"request_id"`
 	Client_ID string `json:"client_id"`
 	Product_ID_1 string `json:"product_id_1"`
 	Product_ID_2 string `json:"product_id_2"`
 	Flag string  `json:"flag"`
+	Created_At string `json:"created_at"`
+	Updated_At string `json:"updated_at"`
+	Doc_Type string `json:"doc_type"`
 }
-var pendingOfferingIndexStr="_pendingOfferingIndex";
+var pendingOfferingIndexStr="_pendingOfferingIndex";						//request ids, a client can have many requests open
 
 // ============================================================================================================================
 // Main
@@ -201,6 +233,84 @@ func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args
 	} else if function == "set_user_type" {										//change user_type of a product
 		res, err := t.set_user_type(stub, args)
 		return res, err
+	} else if function == "bulk_import_products" {
+		return t.bulk_import_products(stub, args)
+	} else if function == "bulk_import_offerings" {
+		return t.bulk_import_offerings(stub, args)
+	} else if function == "bulk_import_clients" {
+		return t.bulk_import_clients(stub, args)
+	} else if function == "restore_ledger" {
+		return t.restore_ledger(stub, args)
+	} else if function == "rebuild_indexes" {
+		return t.rebuild_indexes(stub, args)
+	} else if function == "add_price" {
+		return t.add_price(stub, args)
+	} else if function == "retire_price" {
+		return t.retire_price(stub, args)
+	} else if function == "set_fx_rate" {
+		return t.set_fx_rate(stub, args)
+	} else if function == "init_supplier" {
+		return t.init_supplier(stub, args)
+	} else if function == "update_supplier" {
+		return t.update_supplier(stub, args)
+	} else if function == "delete_supplier" {
+		return t.delete_supplier(stub, args)
+	} else if function == "activate_product" {
+		return t.activate_product(stub, args)
+	} else if function == "suspend_product" {
+		return t.suspend_product(stub, args)
+	} else if function == "discontinue_product" {
+		return t.discontinue_product(stub, args)
+	} else if function == "retire_product" {
+		return t.retire_product(stub, args)
+	} else if function == "define_user_type" {
+		return t.define_user_type(stub, args)
+	} else if function == "remove_user_type" {
+		return t.remove_user_type(stub, args)
+	} else if function == "assign_user_type" {
+		return t.assign_user_type(stub, args)
+	} else if function == "set_category_user_type" {
+		return t.set_category_user_type(stub, args)
+	} else if function == "set_pending_offering_status" {
+		return t.set_pending_offering_status(stub, args)
+	} else if function == "generate_quote" {
+		return t.generate_quote(stub, args)
+	} else if function == "accept_quote" {
+		return t.accept_quote(stub, args)
+	} else if function == "activate_contract" {
+		return t.activate_contract(stub, args)
+	} else if function == "generate_invoice" {
+		return t.generate_invoice(stub, args)
+	} else if function == "void_invoice" {
+		return t.void_invoice(stub, args)
+	} else if function == "record_payment" {
+		return t.record_payment(stub, args)
+	} else if function == "allocate_payment" {
+		return t.allocate_payment(stub, args)
+	} else if function == "issue_credit_note" {
+		return t.issue_credit_note(stub, args)
+	} else if function == "set_billing_schedule" {
+		return t.set_billing_schedule(stub, args)
+	} else if function == "run_billing" {
+		return t.run_billing(stub, args)
+	} else if function == "amend_contract" {
+		return t.amend_contract(stub, args)
+	} else if function == "sign_amendment" {
+		return t.sign_amendment(stub, args)
+	} else if function == "reject_amendment" {
+		return t.reject_amendment(stub, args)
+	} else if function == "set_renewal_terms" {
+		return t.set_renewal_terms(stub, args)
+	} else if function == "process_expirations" {
+		return t.process_expirations(stub, args)
+	} else if function == "set_termination_terms" {
+		return t.set_termination_terms(stub, args)
+	} else if function == "terminate_contract" {
+		return t.terminate_contract(stub, args)
+	} else if function == "set_offering_tiers" {
+		return t.set_offering_tiers(stub, args)
+	} else if function == "set_contract_units" {
+		return t.set_contract_units(stub, args)
 	}
 
 	fmt.Println("run did not find func: " + function)						//error
@@ -213,7 +323,9 @@ func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args
 // ============================================================================================================================
 func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
-	fmt.Println("Argument " + args[0])
+	if len(args) > 0 {
+		fmt.Println("Argument " + args[0])
+	}
 	// Handle different functions
 	if function == "read" {													//read a variable
 		return t.read(stub, args)
@@ -230,6 +342,68 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 	}else if function == "read_client_index" {
 		return t.read_client_index(stub,args);
 
+	} else if function == "list_products" {
+		return t.list_products(stub, args)
+	} else if function == "list_offerings" {
+		return t.list_offerings(stub, args)
+	} else if function == "list_contracts" {
+		return t.list_contracts(stub, args)
+	} else if function == "list_clients" {
+		return t.list_clients(stub, args)
+	} else if function == "export_ledger" {
+		return t.export_ledger(stub, args)
+	} else if function == "verify_indexes" {
+		return t.verify_indexes(stub, args)
+	} else if function == "get_price" {
+		return t.get_price(stub, args)
+	} else if function == "get_fx_rate" {
+		return t.get_fx_rate(stub, args)
+	} else if function == "list_currencies" {
+		return t.list_currencies(stub, args)
+	} else if function == "get_supplier" {
+		return t.get_supplier(stub, args)
+	} else if function == "list_suppliers" {
+		return t.list_suppliers(stub, args)
+	} else if function == "get_supplier_records" {
+		return t.get_supplier_records(stub, args)
+	} else if function == "list_user_types" {
+		return t.list_user_types(stub, args)
+	} else if function == "get_history" {
+		return t.get_history(stub, args)
+	} else if function == "list_pending_offerings_by_client" {
+		return t.list_pending_offerings_by_client(stub, args)
+	} else if function == "list_pending_offerings_by_status" {
+		return t.list_pending_offerings_by_status(stub, args)
+	} else if function == "get_quote" {
+		return t.get_quote(stub, args)
+	} else if function == "get_invoice" {
+		return t.get_invoice(stub, args)
+	} else if function == "list_invoices_by_client" {
+		return t.list_invoices_by_client(stub, args)
+	} else if function == "list_invoices_by_contract" {
+		return t.list_invoices_by_contract(stub, args)
+	} else if function == "get_payment" {
+		return t.get_payment(stub, args)
+	} else if function == "client_balance" {
+		return t.client_balance(stub, args)
+	} else if function == "get_credit_note" {
+		return t.get_credit_note(stub, args)
+	} else if function == "list_credit_notes" {
+		return t.list_credit_notes(stub, args)
+	} else if function == "get_billing_calendar" {
+		return t.get_billing_calendar(stub, args)
+	} else if function == "preview_proration" {
+		return t.preview_proration(stub, args)
+	} else if function == "get_pending_adjustments" {
+		return t.get_pending_adjustments(stub, args)
+	} else if function == "get_contract" {
+		return t.get_contract(stub, args)
+	} else if function == "list_expiring_contracts" {
+		return t.list_expiring_contracts(stub, args)
+	} else if function == "list_contract_overlaps" {
+		return t.list_contract_overlaps(stub, args)
+	} else if function == "price_offering" {
+		return t.price_offering(stub, args)
 	}
 	fmt.Println("query did not find func: " + function)						//error
 
@@ -254,6 +428,10 @@ func (t *SimpleChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte,
 		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
 		return nil, errors.New(jsonResp)
 	}
+	err = requireVisible(stub, name)										//products and offerings only for the user types allowed to see them
+	if err != nil {
+		return nil, err
+	}
 
 	return valAsbytes, nil													//send it onward
 }
@@ -343,6 +521,9 @@ func (t *SimpleChaincode) delete_product(stub *shim.ChaincodeStub, args []string
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
 
+	if err := requireKind(stub, args[0], productImportSpec.name); err != nil {
+		return nil, err
+	}
 	name := args[0]
 	err := stub.DelState(name)													//remove the key from chaincode state
 	if err != nil {
@@ -371,6 +552,9 @@ func (t *SimpleChaincode) delete_product(stub *shim.ChaincodeStub, args []string
 	}
 	jsonAsBytes, _ := json.Marshal(productIndex)									//save new index
 	err = stub.PutState(productIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, errors.New("Failed to update product index")
+	}
 	return nil, nil
 }
 
@@ -383,6 +567,9 @@ func (t *SimpleChaincode) delete_offering(stub *shim.ChaincodeStub, args []strin
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
 
+	if err := requireKind(stub, args[0], offeringImportSpec.name); err != nil {
+		return nil, err
+	}
 	name := args[0]
 	err := stub.DelState(name)
 
@@ -415,20 +602,31 @@ func (t *SimpleChaincode) delete_offering(stub *shim.ChaincodeStub, args []strin
 	jsonAsBytes, _ := json.Marshal(offeringIndex)
 
 	err = stub.PutState(offeringIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, errors.New("Failed to update offering index")
+	}
 	return nil, nil
 }
 
 
 //=====================================================
 // ============================================================================================================================
-// Delete an Contract
+// Delete an Contract - only drafts, a signed contract is kept and ended with terminate_contract
 // ============================================================================================================================
 func (t *SimpleChaincode) delete_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
 
+	if err := requireKind(stub, args[0], contractImportSpec.name); err != nil {
+		return nil, err
+	}
 	name := args[0]
+	if contract, err := getContract(stub, name); err == nil {
+		if err := checkDeletable(contract); err != nil {
+			return nil, err
+		}
+	}
 	err := stub.DelState(name)
 	if err != nil {
 		return nil, errors.New("Failed to delete state")
@@ -455,6 +653,9 @@ func (t *SimpleChaincode) delete_contract(stub *shim.ChaincodeStub, args []strin
 	}
 	jsonAsBytes, _ := json.Marshal(contractIndex)
 	err = stub.PutState(contractIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, errors.New("Failed to update Contract index")
+	}
 	return nil, nil
 }
 
@@ -466,6 +667,9 @@ func (t *SimpleChaincode) delete_client(stub *shim.ChaincodeStub, args []string)
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
 
+	if err := requireKind(stub, args[0], clientImportSpec.name); err != nil {
+		return nil, err
+	}
 	name := args[0]
 	err := stub.DelState(name)
 	if err != nil {
@@ -493,6 +697,9 @@ func (t *SimpleChaincode) delete_client(stub *shim.ChaincodeStub, args []string)
 	}
 	jsonAsBytes, _ := json.Marshal(clientIndex)
 	err = stub.PutState(clientIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, errors.New("Failed to update client index")
+	}
 	return nil, nil
 }
 
@@ -532,49 +739,23 @@ func (t *SimpleChaincode) init_product(stub *shim.ChaincodeStub, args []string)
 	}
 
 	fmt.Println("- start init product")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
-	}
-	if len(args[4]) <= 0 {
-		return nil, errors.New("5th argument must be a non-empty string")
-	}
-	if len(args[5]) <= 0 {
-		return nil, errors.New("6th argument must be a non-empty string")
+	product, err := buildProduct(args)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[6]) <= 0 {
-		return nil, errors.New("7th argument must be a non-empty string")
+	err = mergeStoredSchedule(stub, args[0], &product)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[7]) <= 0 {
-		return nil, errors.New("8th argument must be a non-empty string")
+	err = settleProductStatus(stub, args[0], &product, false)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[8]) <= 0 {
- 	 return nil, errors.New("9th argument must be a non-empty string")
-  }
-	list_price, err := strconv.ParseFloat(args[5],64)
+	err = settleProductUserType(stub, args[0], &product, false)
 	if err != nil {
-		return nil, errors.New("5rd argument must be a numeric string")
+		return nil, err
 	}
-
-
-
-	user_type := strings.ToLower(args[9])
-
-	str := `{"product_id": "` + args[0] + `", "category": "` + args[1] +
-	 `", "product_description": "` + args[2] + `", "availability_start_date": "` + args[3] +
-	 `", "availability_end_date": "` + args[4] + `", "list_price": ` + strconv.FormatFloat(list_price, 'f', -1, 64) +
-	 `, "currency": "` + args[6] + `", "price_start_date": "` + args[7] +
-	 `", "price_end_date": "` + args[8]+ `", "user_type": "` + user_type +
-	  `"}`
-	err = stub.PutState(args[0], []byte(str))								//store marble with id as key
+	err = storePricedRecord(stub, args[0], &product)							//store product with id as key
 	if err != nil {
 		return nil, err
 	}
@@ -611,6 +792,43 @@ func (t *SimpleChaincode) init_product(stub *shim.ChaincodeStub, args []string)
 	return nil, nil
 }
 
+// buildProduct - validate init_product style arguments into a Product
+func buildProduct(args []string) (Product, error) {
+	if len(args) != 10 {
+		return Product{}, errors.New("Incorrect number of arguments. Expecting 10")
+	}
+	if err := requireArgs(args, 9); err != nil {
+		return Product{}, err
+	}
+	currency, err := currencyCode(args[6])
+	if err != nil {
+		return Product{}, err
+	}
+	list_price, err := parseAmount("list_price", args[5], currency)
+	if err != nil {
+		return Product{}, err
+	}
+
+	product := Product{
+		Product_Id: args[0],
+		Category: args[1],
+		Product_Description: args[2],
+		Availability_Start_Date: args[3],
+		Availability_End_Date: args[4],
+		List_Price: list_price,
+		Currency: currency,
+		Price_Start_Date: args[7],
+		Price_End_Date: args[8],
+		User_Type: strings.ToLower(args[9]),
+	}
+	err = productDates(&product.Availability_Start_Date, &product.Availability_End_Date, &product.Price_Start_Date, &product.Price_End_Date)
+	if err != nil {
+		return Product{}, err
+	}
+	product.Prices = []priceEntry{{list_price, product.Price_Start_Date, product.Price_End_Date}}
+	return product, nil
+}
+
 func findProduct(productsIndex []string, product_id string) (bool) {
 
 	for _,value:= range productsIndex {
@@ -634,53 +852,16 @@ func (t *SimpleChaincode) init_offering(stub *shim.ChaincodeStub, args []string)
 		return nil, errors.New("Incorrect number of arguments. Expecting 4")
 	}
 
-	fmt.Println("- start init marble")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
-	}
-	if len(args[4]) <= 0 {
-		return nil, errors.New("5th argument must be a non-empty string")
-	}
-	if len(args[5]) <= 0 {
-		return nil, errors.New("6th argument must be a non-empty string")
-	}
-	if len(args[6]) <= 0 {
-		return nil, errors.New("7th argument must be a non-empty string")
-	}
-	if len(args[7]) <= 0 {
-		return nil, errors.New("8th argument must be a non-empty string")
+	fmt.Println("- start init offering")
+	offering, err := buildOffering(args)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[8]) <= 0 {
- 	 return nil, errors.New("9th argument must be a non-empty string")
-  }
-  	if len(args[9]) <= 0 {
- 	 return nil, errors.New("10th argument must be a non-empty string")
-  }
-  	if len(args[10]) <= 0 {
- 	 return nil, errors.New("11th argument must be a non-empty string")
-  }
-	list_price, err := strconv.ParseFloat(args[5],64)
+	err = mergeStoredSchedule(stub, args[0], &offering)
 	if err != nil {
-		return nil, errors.New("5rd argument must be a numeric string")
+		return nil, err
 	}
-
-
-	str := `{"offering_id": "` + args[0] + `", "offering_category": "` + args[1] +
-	 `", "offering_description": "` + args[2] + `", "availability_start_date": "` + args[3] +
-	 `", "availability_end_date": "` + args[4] + `", "current_list_price": ` + strconv.FormatFloat(list_price, 'f', -1, 64) +
-	 `, "currency": "` + args[6] + `", "price_start_date": "` + args[7] +
-	 `", "price_end_date": "` + args[8]+ `", "product_id_01": "` + args[9] +`", "product_id_02": "` + args[10] +
-	  `"}`
-	err = stub.PutState(args[0], []byte(str))
+	err = storePricedRecord(stub, args[0], &offering)
 
 	if err != nil {
 		return nil, err
@@ -720,6 +901,41 @@ func (t *SimpleChaincode) init_offering(stub *shim.ChaincodeStub, args []string)
 	return nil, nil
 }
 
+// buildOffering - validate init_offering style arguments into an Offering
+func buildOffering(args []string) (Offering, error) {
+	if err := requireArgs(args, 11); err != nil {
+		return Offering{}, err
+	}
+	currency, err := currencyCode(args[6])
+	if err != nil {
+		return Offering{}, err
+	}
+	list_price, err := parseAmount("current_list_price", args[5], currency)
+	if err != nil {
+		return Offering{}, err
+	}
+
+	offering := Offering{
+		Offering_ID: args[0],
+		Offering_Category: args[1],
+		Offering_Description: args[2],
+		Availability_Start_Date: args[3],
+		Availability_End_Date: args[4],
+		Current_List_Price: list_price,
+		Currency: currency,
+		Price_Start_Date: args[7],
+		Price_End_Date: args[8],
+		Product_ID_01: args[9],
+		Product_ID_02: args[10],
+	}
+	err = productDates(&offering.Availability_Start_Date, &offering.Availability_End_Date, &offering.Price_Start_Date, &offering.Price_End_Date)
+	if err != nil {
+		return Offering{}, err
+	}
+	offering.Prices = []priceEntry{{list_price, offering.Price_Start_Date, offering.Price_End_Date}}
+	return offering, nil
+}
+
 func findOffering(offeringsIndex []string, offering_id string) (bool) {
 
 	for _,value:= range offeringsIndex {
@@ -733,119 +949,156 @@ func findOffering(offeringsIndex []string, offering_id string) (bool) {
 
 
 // ============================================================================================================================
-// Create a new Contract
+// Create a new Contract - a 29th argument, supersede, ends the active contracts of the client it overlaps
 // ============================================================================================================================
 func (t *SimpleChaincode) init_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
 	var err error
 
 
-	if len(args) != 28 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 28")
-	}
-
-//Validating Float string
-	flat_off_rate_1, err := strconv.ParseFloat(args[6],64)
-	if err != nil {
-		return nil, errors.New("flat_off_rate_1 argument must be a numeric string")
-	}
-	flat_off_rate_2, err := strconv.ParseFloat(args[7],64)
-	if err != nil {
-		return nil, errors.New("flat_off_rate_2 argument must be a numeric string")
+	if len(args) != 28 && len(args) != 29 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 28 and optional supersede")
 	}
-	flat_off_rate_3, err := strconv.ParseFloat(args[8],64)
+	supersede, err := supersedeArg(args, 28)
 	if err != nil {
-		return nil, errors.New("flat_off_rate_3 argument must be a numeric string")
-	}
-	flat_off_rate_4, err := strconv.ParseFloat(args[9],64)
-	if err != nil {
-		return nil, errors.New("flat_off_rate_4 argument must be a numeric string")
+		return nil, err
 	}
 
-	flat_prod_rate_1, err := strconv.ParseFloat(args[10],64)
+	contract, err := buildContract(args[:28])
 	if err != nil {
-		return nil, errors.New("flat_prod_rate_1 argument must be a numeric string")
+		return nil, err
 	}
-
-	flat_prod_rate_2, err := strconv.ParseFloat(args[11],64)
+	err = keepContractState(stub, &contract)
 	if err != nil {
-		return nil, errors.New("flat_prod_rate_2 argument must be a numeric string")
+		return nil, err
 	}
-
-	flat_prod_rate_3, err := strconv.ParseFloat(args[12],64)
-	if err != nil {
-		return nil, errors.New("flat_prod_rate_3 argument must be a numeric string")
+	if contract.Status == contractActive {
+		err = checkOverlaps(stub, contract, contract.Contract_Start_Date, supersede)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	flat_prod_rate_4, err := strconv.ParseFloat(args[13],64)
+	err = storeContract(stub, &contract)
 	if err != nil {
-		return nil, errors.New("flat_prod_rate_4 argument must be a numeric string")
+		return nil, err
 	}
 
-	flat_prod_rate_5, err := strconv.ParseFloat(args[14],64)
-	if err != nil {
-		return nil, errors.New("flat_prod_rate_5 argument must be a numeric string")
-	}
+	fmt.Println("- end init contract")
+	return nil, nil
+}
 
-	flat_prod_rate_6, err := strconv.ParseFloat(args[15],64)
-	if err != nil {
-		return nil, errors.New("flat_prod_rate_6 argument must be a numeric string")
+// storeContract - stamp and store a contract built by buildContract and add it to the index. The supplier is
+// checked when the contract is created or activated or changes supplier, the contracts of a supplier that went
+// inactive can still be billed, amended and ended.
+func storeContract(stub *shim.ChaincodeStub, contract *Contract) error {
+	if newContractSupplier(stub, *contract) {
+		if err := checkContractSupplier(stub, contract.Supplier_ID); err != nil {
+			return err
+		}
 	}
-
-	discount_percent, err := strconv.ParseFloat(args[23],64)
+	err := stampRecord(stub, contract.Contract_ID, contract)
 	if err != nil {
-		return nil, errors.New("discount_percent argument must be a numeric string")
+		return err
 	}
-
-
-	str := `{"contract_id": "` + args[0] + `", "client_id": "` + args[1] +
-	 `", "offering_id_1": "` + args[2] + `", "offering_id_2": "` + args[3] +
-	 `", "offering_id_3": "` + args[4] + `", "offering_id_4": "` + args[5] +
-	 `", "flat_off_rate_1": "` + strconv.FormatFloat(flat_off_rate_1, 'f', -1, 64) + `", "flat_off_rate_2": "` + strconv.FormatFloat(flat_off_rate_2, 'f', -1, 64) +
-	 `", "flat_off_rate_3": "` + strconv.FormatFloat(flat_off_rate_3, 'f', -1, 64)+ `", "flat_off_rate_4": "` + strconv.FormatFloat(flat_off_rate_4, 'f', -1, 64) +`", "flat_prod_rate_1": "` + strconv.FormatFloat(flat_prod_rate_1, 'f', -1, 64) +
-	 `", "flat_prod_rate_2": "` + strconv.FormatFloat(flat_prod_rate_2, 'f', -1, 64)+ `", "flat_prod_rate_3": "` + strconv.FormatFloat(flat_prod_rate_3, 'f', -1, 64) +`", "flat_prod_rate_4": "` + strconv.FormatFloat(flat_prod_rate_4, 'f', -1, 64) +
-	 `", "flat_prod_rate_5": "` + strconv.FormatFloat(flat_prod_rate_5, 'f', -1, 64)+ `", "flat_prod_rate_6": "` + strconv.FormatFloat(flat_prod_rate_6, 'f', -1, 64) +`", "product_id_1": "` + args[16] +
-	 `", "product_id_2": "` + args[17]+ `", "product_id_3": "` + args[18] +`", "product_id_4": "` + args[19] +
-	 `", "product_id_5": "` + args[20]+ `", "product_id_6": "` + args[21] +`", "supplier_id": "` + args[22] +
-
-	 `", "discount_percent": "` +strconv.FormatFloat(discount_percent, 'f', -1, 64)+ `", "currency": "` + args[24] +`", "contract_start_date": "` + args[25] +
-	 `", "contract_end_date": "` + args[26] +`", "last_modified": "` + args[27] +
-		`"}`
-
-	err = stub.PutState(args[0], []byte(str))
+	contractAsBytes, _ := json.Marshal(contract)
+	err = stub.PutState(contract.Contract_ID, contractAsBytes)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	//get the contract index
 	contractsAsBytes, err := stub.GetState(contractIndexStr)
 	if err != nil {
-		return nil, errors.New("Failed to get contract index")
+		return errors.New("Failed to get contract index")
 	}
 	var contractIndex []string
 	json.Unmarshal(contractsAsBytes, &contractIndex)
 
 	//check if the contract_id exist
-	if(!find_id_in_index(contractIndex,args[0]) ) {
+	if(!find_id_in_index(contractIndex,contract.Contract_ID) ) {
 	//append
-	contractIndex = append(contractIndex, args[0])
+	contractIndex = append(contractIndex, contract.Contract_ID)
 	fmt.Println("! Contract index: ", contractIndex)
 	jsonAsBytes, _ := json.Marshal(contractIndex)
 	err = stub.PutState(contractIndexStr, jsonAsBytes)
 
 	if err != nil {
 			fmt.Println("Error creating Contract Index");
-			return nil, errors.New("Failed to add Contract index")
+			return errors.New("Failed to add Contract index")
 		}
 
 		fmt.Println("New Contract index added")
 	} else {
 	fmt.Println("Modified the existing Contract")
 	}
+	return nil
+}
 
+// buildContract - validate init_contract style arguments into a Contract.
+// The last_modified argument (27) is ignored, it is set from the transaction time when the contract is stored.
+func buildContract(args []string) (Contract, error) {
+	if len(args) != 28 {
+		return Contract{}, errors.New("Incorrect number of arguments. Expecting 28")
+	}
+	if len(args[0]) <= 0 {
+		return Contract{}, errors.New("1st argument must be a non-empty string")
+	}
 
-
-	fmt.Println("- end init contract")
-	return nil, nil
+	//Validating amounts, flat rates are args 6 to 15 in the contract currency and the discount is arg 23
+	currency, err := currencyCode(args[24])
+	if err != nil {
+		return Contract{}, err
+	}
+	var rates [10]Decimal
+	for i := range rates {
+		if rates[i], err = parseAmount(contractFields[6+i], args[6+i], currency); err != nil {
+			return Contract{}, err
+		}
+	}
+	discount_percent, err := parsePercent("discount_percent", args[23])
+	if err != nil {
+		return Contract{}, err
+	}
+	start_date, err := canonicalDate("contract_start_date", args[25])
+	if err != nil {
+		return Contract{}, err
+	}
+	end_date, err := canonicalDate("contract_end_date", args[26])
+	if err != nil {
+		return Contract{}, err
+	}
+	if err := checkWindow("contract_start_date", start_date, "contract_end_date", end_date); err != nil {
+		return Contract{}, err
+	}
+
+	return Contract{
+		Contract_ID: args[0],
+		Client_ID: args[1],
+		Offering_ID_1: args[2],
+		Offering_ID_2: args[3],
+		Offering_ID_3: args[4],
+		Offering_ID_4: args[5],
+		Flat_Off_Rate_1: rates[0],
+		Flat_Off_Rate_2: rates[1],
+		Flat_Off_Rate_3: rates[2],
+		Flat_Off_Rate_4: rates[3],
+		Flat_Prod_Rate_1: rates[4],
+		Flat_Prod_Rate_2: rates[5],
+		Flat_Prod_Rate_3: rates[6],
+		Flat_Prod_Rate_4: rates[7],
+		Flat_Prod_Rate_5: rates[8],
+		Flat_Prod_Rate_6: rates[9],
+		Product_Id_1: args[16],
+		Product_Id_2: args[17],
+		Product_Id_3: args[18],
+		Product_Id_4: args[19],
+		Product_Id_5: args[20],
+		Product_Id_6: args[21],
+		Supplier_ID: args[22],
+		Discount_Percent: discount_percent,
+		Currency: currency,
+		Contract_Start_Date: start_date,
+		Contract_End_Date: end_date,
+	}, nil
 }
 
 // function to find a given "id" in the corresponding index
@@ -859,6 +1112,30 @@ func find_id_in_index(indexList []string, id string) (bool) {
 	return false;
 }
 
+// getIndex - read one of the id indexes, an index that was never written is empty
+func getIndex(stub *shim.ChaincodeStub, indexStr string) ([]string, error) {
+	indexAsBytes, err := stub.GetState(indexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get index " + indexStr)
+	}
+	var index []string
+	if len(indexAsBytes) > 0 {
+		if err := json.Unmarshal(indexAsBytes, &index); err != nil {
+			return nil, errors.New("Failed to decode index " + indexStr)
+		}
+	}
+	return index, nil
+}
+
+// requireAdmin - administrative functions need a caller whose certificate carries the attribute role=admin
+func requireAdmin(stub *shim.ChaincodeStub) error {
+	role, err := stub.ReadCertAttribute("role")
+	if err != nil || string(role) != "admin" {
+		return errors.New("Caller is not an administrator")
+	}
+	return nil
+}
+
 /********************************************************************************************************************
 		Get individual client data
 *******************************************************************************************************************/
@@ -900,35 +1177,17 @@ func (t *SimpleChaincode) init_client(stub *shim.ChaincodeStub, args []string) (
 		return nil, errors.New("Incorrect number of arguments. Expecting 4")
 	}
 
-	fmt.Println("- start init product")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
-	}
-	if len(args[4]) <= 0 {
-		return nil, errors.New("5th argument must be a non-empty string")
-	}
-	if len(args[5]) <= 0 {
-		return nil, errors.New("6th argument must be a non-empty string")
+	fmt.Println("- start init client")
+	client, err := buildClient(args)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[6]) <= 0 {
-		return nil, errors.New("7th argument must be a non-empty string")
+	err = stampRecord(stub, args[0], &client)
+	if err != nil {
+		return nil, err
 	}
-
-
-	str := `{"client_id": "` + args[0] + `", "last_name": "` + args[1] +
-	 `", "first_name": "` + args[2] + `", "company": "` + args[3] +
-	 `", "username": "` + args[4] + `", "password": ` +  args[5] +
-	 `, "last_modified": "`+  args[6]  +  `"}`
-	err = stub.PutState(args[0], []byte(str))
+	clientAsBytes, _ := json.Marshal(client)
+	err = stub.PutState(args[0], clientAsBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -962,62 +1221,117 @@ func (t *SimpleChaincode) init_client(stub *shim.ChaincodeStub, args []string) (
 	return nil, nil
 }
 
+// buildClient - validate init_client style arguments into a Client.
+// The last_modified argument (6) is ignored, it is set from the transaction time when the client is stored.
+func buildClient(args []string) (Client, error) {
+	if err := requireArgs(args, 6); err != nil {
+		return Client{}, err
+	}
+	return Client{
+		Client_ID: args[0],
+		Last_Name: args[1],
+		First_Name: args[2],
+		Company: args[3],
+		Username: args[4],
+		Password: args[5],
+	}, nil
+}
+
+// requireArgs - the first n arguments must be non-empty strings
+func requireArgs(args []string, n int) error {
+	for i := 0; i < n; i++ {
+		if i >= len(args) || len(args[i]) <= 0 {
+			return errors.New(ordinal(i+1) + " argument must be a non-empty string")
+		}
+	}
+	return nil
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
 // Init offering when client requests a new offering.
 func (t *SimpleChaincode) init_pendingOffering(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
 	var err error
 
-	// client_id, Product_id_1, product_id_2,flag
+	// client_id, Product_id_1, product_id_2, flag (empty or pending, a request always starts pending)
 	if len(args) != 4 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 4")
 	}
 
-	fmt.Println("- start init product")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+	fmt.Println("- start init pendingOffering")
+	if _, ok := loadRecord(stub, args[0], clientImportSpec.name); !ok {
+		return nil, errors.New("NOT_FOUND: client " + args[0])
 	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+	status, err := requestStatus(args[3])
+	if err != nil {
+		return nil, err
 	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+	if status != requestPending {
+		return nil, errors.New("A new request is always " + requestPending + ", change its status with set_pending_offering_status")
 	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+	request_id, err := nextRequestId(stub)
+	if err != nil {
+		return nil, err
+	}
+	request, err := buildPendingOffering(append([]string{request_id}, args...))
+	if err != nil {
+		return nil, err
 	}
-	str := `{"client_id": "` + args[0] + `", "product_id_1": "` + args[1] + `", "product_id_2": "` + args[2] +
-	 `", "flag": "`+  args[3]  +  `"}`
-	err = stub.PutState(args[0], []byte(str))
+	err = stampRecord(stub, request_id, &request)
+	if err != nil {
+		return nil, err
+	}
+	requestAsBytes, _ := json.Marshal(request)
+	err = stub.PutState(request_id, requestAsBytes)							//the request has its own key, the client record is left alone
 	if err != nil {
 		return nil, err
 	}
 
-	//get the client index
-	pendingOfferingAsBytes, err := stub.GetState(pendingOfferingIndexStr)
+	//get the pending offering index
+	pendingOfferingIndex, err := getIndex(stub, pendingOfferingIndexStr)
 	if err != nil {
-		return nil, errors.New("Failed to get client index")
+		return nil, err
 	}
-	var pendingOfferingIndex []string
-	json.Unmarshal(pendingOfferingAsBytes, &pendingOfferingIndex)
-	//check if the client_id exist
-	// if !find_id_in_index(pendingOfferingIndex,args[0])  {
-	//append
-	pendingOfferingIndex = append(pendingOfferingIndex, args[0])
-	fmt.Println("! client index: ", pendingOfferingIndex)
+	pendingOfferingIndex = append(pendingOfferingIndex, request_id)
+	fmt.Println("! pending offering index: ", pendingOfferingIndex)
 	jsonAsBytes, _ := json.Marshal(pendingOfferingIndex)
-	err = stub.PutState(pendingOfferingIndexStr, jsonAsBytes)						//store id of client
-
+	err = stub.PutState(pendingOfferingIndexStr, jsonAsBytes)
 	if err != nil {
-			fmt.Println("Error creating Client Index");
-			return nil, errors.New("Failed to add client index")
-		}
-
-		fmt.Println("New offering request index added")
-	// } else {
-	// fmt.Println("Modified the existing offering request")
-	// }
+		return nil, errors.New("Failed to add pending offering index")
+	}
 
 	fmt.Println("- end init pendingOffering")
-	return nil, nil
+	return []byte(request_id), nil
+}
+
+// buildPendingOffering - validate a request id followed by init_pendingOffering style arguments into a pendingOffering
+func buildPendingOffering(args []string) (pendingOffering, error) {
+	if err := requireArgs(args, 4); err != nil {
+		return pendingOffering{}, err
+	}
+	status, err := requestStatus(args[4])
+	if err != nil {
+		return pendingOffering{}, err
+	}
+	return pendingOffering{
+		Request_ID: args[0],
+		Client_ID: args[1],
+		Product_ID_1: args[2],
+		Product_ID_2: args[3],
+		Flag: status,
+	}, nil
 }
 
 // ============================================================================================================================
@@ -1027,23 +1341,29 @@ func (t *SimpleChaincode) set_user_type(stub *shim.ChaincodeStub, args []string)
 	var err error
 
 	//   0       1
-	// "name", "bob"
-	if len(args) < 2 {
+	// "product_id", "gold"
+	if len(args) != 2 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 2")
 	}
+	err = requireAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- start set user type")
 	fmt.Println(args[0] + " - " + args[1])
-	productAsBytes, err := stub.GetState(args[0])
+	user_type := normalizeUserType(args[1])
+	if user_type != "" {														//an empty user type makes the product visible to everybody
+		err = checkUserType(stub, user_type)
+		if err != nil {
+			return nil, err
+		}
+	}
+	product, err := getProduct(stub, args[0])								//NOT_FOUND, or an error when the key holds anything but a Product
 	if err != nil {
-		return nil, errors.New("Failed to get thing")
+		return nil, err
 	}
-	res := Product{}
-	json.Unmarshal(productAsBytes, &res)										//un stringify it aka JSON.parse()
-	res.User_Type = args[1]														//change the user type
-
-	jsonAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(args[0], jsonAsBytes)								//rewrite the Product with id as key
+	err = setProductUserType(stub, args[0], product, user_type)
 	if err != nil {
 		return nil, err
 	}
@@ -1051,6 +1371,7 @@ func (t *SimpleChaincode) set_user_type(stub *shim.ChaincodeStub, args []string)
 	fmt.Println("- end set user type")
 	return nil, nil
 }
+
 //Start Contract Blockchain
 
 
@@ -1060,8 +1381,12 @@ func (t *SimpleChaincode) set_user_type(stub *shim.ChaincodeStub, args []string)
 
 
 // ============================================================================================================================
-// Make Timestamp - create a timestamp in ms
+// Make Timestamp - create a timestamp in ms from the transaction time
 // ============================================================================================================================
-func makeTimestamp() int64 {
-    return time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
+func makeTimestamp(stub *shim.ChaincodeStub) (int64, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return 0, err
+	}
+	return now.UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond)), nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// contract statuses. init_contract stores active contracts, accept_quote drafts that still need activate_contract.
+// Contracts stored before statuses existed have none and count as active.
+const (
+	contractDraft  = "draft"
+	contractActive = "active"
+)
+
+// ============================================================================================================================
+// Activate contract - put a draft contract in force. A draft that overlaps an active contract of the client is only
+// activated with supersede, which ends the older contract the day before the draft starts.
+//
+// args: contract_id, optional supersede (true or false)
+// ============================================================================================================================
+func (t *SimpleChaincode) activate_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting contract_id and optional supersede")
+	}
+	supersede, err := supersedeArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("- start activate contract")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if contract.Status != contractDraft {
+		return nil, errors.New("Contract " + args[0] + " is " + contractStatus(contract.Status) + ", only drafts can be activated")
+	}
+	contract.Status = contractActive
+	if err := checkOverlaps(stub, contract, contract.Contract_Start_Date, supersede); err != nil {
+		return nil, err
+	}
+	if err := storeContract(stub, &contract); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "status", contractDraft, contractActive); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end activate contract")
+	return nil, nil
+}
+
+// keepContractState - init_contract replaces the terms of a draft contract but keeps the rest of it, the terms
+// of an active contract only change with a signed amendment. A new contract is active straight away.
+func keepContractState(stub *shim.ChaincodeStub, contract *Contract) error {
+	contract.Status, contract.Terms_Version = contractActive, 1
+	if _, ok := loadRecord(stub, contract.Contract_ID, contractImportSpec.name); !ok {
+		return nil
+	}
+	stored, err := getContract(stub, contract.Contract_ID)
+	if err != nil {
+		return err
+	}
+	if status := contractStatus(stored.Status); status != contractDraft {
+		return errors.New("Contract " + contract.Contract_ID + " is " + status + ", only drafts are replaced, active contracts are amended with amend_contract")
+	}
+	keepState(contract, stored)
+	contract.Units = stored.Units
+	return nil
+}
+
+// keepState - what a contract carries beyond its init_contract terms: status, billing schedule, renewal, supersession
+// and termination
+func keepState(contract *Contract, stored Contract) {
+	contract.Status, contract.Billing, contract.Renewal = contractStatus(stored.Status), stored.Billing, stored.Renewal
+	contract.Renewed_From, contract.Renewed_To, contract.Notice_Sent = stored.Renewed_From, stored.Renewed_To, stored.Notice_Sent
+	contract.Superseded_By, contract.Termination_Terms, contract.Termination = stored.Superseded_By, stored.Termination_Terms, stored.Termination
+}
+
+// getContract - load a contract, refusing keys that hold anything else
+func getContract(stub *shim.ChaincodeStub, id string) (Contract, error) {
+	var contract Contract
+	if _, ok := loadRecord(stub, id, contractImportSpec.name); !ok {
+		return contract, errors.New("NOT_FOUND: contract " + id)
+	}
+	contractAsBytes, _ := stub.GetState(id)
+	if err := json.Unmarshal(contractAsBytes, &contract); err != nil {
+		return contract, errors.New("Failed to decode " + id)
+	}
+	return contract, nil
+}
+
+// contractStatus - the status of a stored contract, empty for contracts stored before statuses existed
+func contractStatus(status string) string {
+	if status == "" {
+		return contractActive
+	}
+	return status
+}
+
+// contractListStatus - the list_contracts status filter: the stored status of drafts and of contracts that expired,
+// were renewed or terminated, otherwise pending, active or expired depending on where as_of falls in the contract term
+func contractListStatus(rec map[string]interface{}, asOf string) string {
+	if status := fieldString(rec, "status"); status == contractDraft || status == contractExpired || status == contractRenewed ||
+		status == contractTerminated {
+		return status
+	}
+	return contractWindowStatus(rec, asOf)
+}
+
+// contractInvoiced - contracts are invoiced for their term once they are active, also after it has ended, so the
+// last periods can be billed in arrears
+func contractInvoiced(status string) bool {
+	status = contractStatus(status)
+	return status == contractActive || status == contractExpired || status == contractRenewed || status == contractTerminated
+}
+
+// contractItem - an offering or product slot of a contract that is in use, with its flat rate and the units it bills
+type contractItem struct {
+	itemType string //offering or product
+	id       string
+	rate     Decimal
+	quantity int
+	tiered   bool //priced from the offering's tier table, see contractUnits
+}
+
+// contractItems - the offerings and then the products of a contract, in slot order, skipping empty slots
+func contractItems(c Contract) []contractItem {
+	var items []contractItem
+	item := func(itemType string, id string, rate Decimal) contractItem {
+		units, ok := c.Units[id]
+		if !ok {
+			units.Quantity = 1
+		}
+		return contractItem{itemType, id, rate, units.Quantity, units.Tiered}
+	}
+	offerings := []string{c.Offering_ID_1, c.Offering_ID_2, c.Offering_ID_3, c.Offering_ID_4}
+	offeringRates := []Decimal{c.Flat_Off_Rate_1, c.Flat_Off_Rate_2, c.Flat_Off_Rate_3, c.Flat_Off_Rate_4}
+	for i, id := range offerings {
+		if id != "" {
+			items = append(items, item("offering", id, offeringRates[i]))
+		}
+	}
+	products := []string{c.Product_Id_1, c.Product_Id_2, c.Product_Id_3, c.Product_Id_4, c.Product_Id_5, c.Product_Id_6}
+	productRates := []Decimal{c.Flat_Prod_Rate_1, c.Flat_Prod_Rate_2, c.Flat_Prod_Rate_3, c.Flat_Prod_Rate_4, c.Flat_Prod_Rate_5, c.Flat_Prod_Rate_6}
+	for i, id := range products {
+		if id != "" {
+			items = append(items, item("product", id, productRates[i]))
+		}
+	}
+	return items
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var creditNoteIndexStr = "_creditnoteindex"
+
+// credit notes are numbered per supplier like invoices, from a counter under this prefix followed by the supplier id
+var creditNoteSeqPrefix = "_creditNoteSeq_"
+
+var creditNoteImportSpec = importSpec{"credit_notes", creditNoteIndexStr, nil, "", nil, nil}
+
+var creditNoteListSpec = listSpec{
+	name:          "list_credit_notes",
+	indexStr:      creditNoteIndexStr,
+	idField:       "credit_note_id",
+	currencyField: "currency",
+	clientField:   "client_id",
+	supplierField: "supplier_id",
+}
+
+// CreditNote - money taken back off an invoice, in the invoice currency
+type CreditNote struct {
+	Credit_Note_ID     string           `json:"credit_note_id"`
+	Credit_Note_Number int              `json:"credit_note_number"` //sequential per supplier
+	Invoice_ID         string           `json:"invoice_id"`
+	Supplier_ID        string           `json:"supplier_id"`
+	Client_ID          string           `json:"client_id"`
+	Contract_ID        string           `json:"contract_id"`
+	Currency           string           `json:"currency"`
+	Issue_Date         string           `json:"issue_date"`
+	Reason             string           `json:"reason"`
+	Lines              []creditNoteLine `json:"lines"`
+	Total              Decimal          `json:"total"`
+	Created_At         string           `json:"created_at"`
+	Updated_At         string           `json:"updated_at"`
+	Doc_Type           string           `json:"doc_type"`
+}
+
+// creditNoteLine - the amount credited against one invoice line, after the invoice discount
+type creditNoteLine struct {
+	Item_ID string  `json:"item_id"`
+	Amount  Decimal `json:"amount"`
+	Reason  string  `json:"reason"`
+}
+
+// creditRequest - one entry of the issue_credit_note lines argument, no amount credits all that is left of the line
+type creditRequest struct {
+	Item_ID string   `json:"item_id"`
+	Amount  *Decimal `json:"amount"`
+	Reason  string   `json:"reason"`
+}
+
+func (c *CreditNote) setTimestamps(created_at string, updated_at string) {
+	c.Created_At, c.Updated_At, c.Doc_Type = created_at, updated_at, creditNoteImportSpec.name
+}
+
+// ============================================================================================================================
+// Issue credit note - credit all or part of an invoice that is not void
+//
+// lines is a JSON array such as [{"item_id": "o1", "amount": "10.00", "reason": "late delivery"}]. A line without an
+// amount credits what is left of it, a line without a reason takes the credit note reason. Without lines the whole of
+// what is left of the invoice is credited. Credits lower what is outstanding on the invoice, a credit on an invoice
+// that is already paid leaves the client in credit.
+// args: invoice_id, reason, optional lines
+// ============================================================================================================================
+func (t *SimpleChaincode) issue_credit_note(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting invoice_id, reason and optional lines JSON")
+	}
+	fmt.Println("- start issue credit note")
+	if err := requireArgs(args, 2); err != nil {
+		return nil, err
+	}
+	invoice, err := getInvoice(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status == invoiceVoid {
+		return nil, errors.New("Invoice " + args[0] + " is void and already credited in full")
+	}
+	var requests []creditRequest
+	if len(args) == 3 && args[2] != "" {
+		if err := json.Unmarshal([]byte(args[2]), &requests); err != nil || len(requests) == 0 {
+			return nil, errors.New("lines must be a non-empty JSON array of {item_id, optional amount, optional reason}")
+		}
+	}
+	note, err := creditInvoice(stub, &invoice, args[1], requests)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status == invoiceIssued && invoice.outstanding().IsZero() {
+		invoice.Status = invoicePaid
+		if err := recordChange(stub, invoice.Invoice_ID, "status", invoiceIssued, invoicePaid); err != nil {
+			return nil, err
+		}
+	}
+	if err := storeInvoice(stub, &invoice); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end issue credit note")
+	return json.Marshal(note)
+}
+
+// ============================================================================================================================
+// Get credit note / list credit notes - list_credit_notes takes the filter JSON of the other list_* queries
+//
+// args: credit_note_id / optional filter JSON
+// ============================================================================================================================
+func (t *SimpleChaincode) get_credit_note(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	note, err := getCreditNote(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(note)
+}
+
+func (t *SimpleChaincode) list_credit_notes(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_records(stub, creditNoteListSpec, args)
+}
+
+// creditInvoice - store a credit note against the invoice and add it to the invoice's Amount_Credited and
+// Credit_Notes, the caller stores the invoice. No requests credits everything that is left.
+func creditInvoice(stub *shim.ChaincodeStub, invoice *Invoice, reason string, requests []creditRequest) (CreditNote, error) {
+	note := CreditNote{
+		Invoice_ID:  invoice.Invoice_ID,
+		Supplier_ID: invoice.Supplier_ID,
+		Client_ID:   invoice.Client_ID,
+		Contract_ID: invoice.Contract_ID,
+		Currency:    invoice.Currency,
+		Reason:      reason,
+		Lines:       []creditNoteLine{},
+	}
+	left, err := creditableLines(stub, *invoice)
+	if err != nil {
+		return note, err
+	}
+	if note.Lines, note.Total, err = creditNoteLines(*invoice, left, reason, requests); err != nil {
+		return note, err
+	}
+	if note.Total.IsZero() {
+		return note, errors.New("Invoice " + invoice.Invoice_ID + " has nothing left to credit")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return note, err
+	}
+	note.Issue_Date = now.Format(dateLayout)
+	note.Credit_Note_Number, note.Credit_Note_ID, err = nextFreeId(stub, creditNoteSeqPrefix+invoice.Supplier_ID, "CN-"+invoice.Supplier_ID+"-")
+	if err != nil {
+		return note, err
+	}
+	if err := stampRecord(stub, note.Credit_Note_ID, &note); err != nil {
+		return note, err
+	}
+	noteAsBytes, _ := json.Marshal(note)
+	if err := stub.PutState(note.Credit_Note_ID, noteAsBytes); err != nil {
+		return note, errors.New("Failed to store " + note.Credit_Note_ID)
+	}
+	if err := addToIndexes(stub, note.Credit_Note_ID, creditNoteIndexStr); err != nil {
+		return note, err
+	}
+	invoice.Amount_Credited = invoice.Amount_Credited.Add(note.Total)
+	invoice.Credit_Notes = append(invoice.Credit_Notes, note.Credit_Note_ID)
+	if err := stub.SetEvent("issue_credit_note", noteAsBytes); err != nil {
+		fmt.Println("Failed to set issue_credit_note event")
+	}
+	return note, nil
+}
+
+// creditNoteLines - the note lines for the requests and their total, given what is left to credit on each invoice
+// line. No requests credits everything that is left.
+func creditNoteLines(invoice Invoice, left map[string]Decimal, reason string, requests []creditRequest) ([]creditNoteLine, Decimal, error) {
+	lines := []creditNoteLine{}
+	total := Decimal{}
+	creditable := invoice.Total.Sub(invoice.Amount_Credited)
+	if len(requests) == 0 {
+		for _, line := range invoice.Lines {
+			if left[line.Item_ID].Sign() > 0 {
+				requests = append(requests, creditRequest{Item_ID: line.Item_ID})
+			}
+		}
+	}
+	for i, request := range requests {
+		where := "line " + strconv.Itoa(i+1) + ": "
+		remaining, ok := left[request.Item_ID]
+		if !ok {
+			return nil, Decimal{}, errors.New(where + request.Item_ID + " is not billed on " + invoice.Invoice_ID)
+		}
+		amount := remaining
+		if request.Amount != nil {
+			if err := checkAmount("amount", *request.Amount, invoice.Currency); err != nil {
+				return nil, Decimal{}, errors.New(where + err.Error())
+			}
+			amount = request.Amount.RoundTo(invoice.Currency)
+		}
+		if amount.Sign() <= 0 {
+			return nil, Decimal{}, errors.New(where + "nothing to credit on " + request.Item_ID)
+		}
+		if amount.Cmp(remaining) > 0 {
+			return nil, Decimal{}, errors.New(where + amount.String() + " is more than the " + remaining.String() + " left to credit on " + request.Item_ID)
+		}
+		if request.Reason == "" {
+			request.Reason = reason
+		}
+		left[request.Item_ID] = remaining.Sub(amount)
+		lines = append(lines, creditNoteLine{request.Item_ID, amount, request.Reason})
+		total = total.Add(amount)
+	}
+	//line shares of the discount are rounded one by one, crediting every line in full may be a cent off the invoice
+	if len(lines) > 0 && (total.Cmp(creditable) > 0 || fullyCredited(left)) {
+		var err error
+		if lines, err = settleCreditGap(lines, creditable.Sub(total)); err != nil {
+			return nil, Decimal{}, errors.New("Invoice " + invoice.Invoice_ID + ": " + err.Error())
+		}
+		total = creditable
+	}
+	return lines, total, nil
+}
+
+// creditableLines - what is left to credit on each invoice line: its total less its share of the invoice discount,
+// less what earlier credit notes took off it
+func creditableLines(stub *shim.ChaincodeStub, invoice Invoice) (map[string]Decimal, error) {
+	notes := []CreditNote{}
+	for _, id := range invoice.Credit_Notes {
+		note, err := getCreditNote(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	return leftToCredit(invoice, notes), nil
+}
+
+// leftToCredit - see creditableLines, notes are the invoice's earlier credit notes
+func leftToCredit(invoice Invoice, notes []CreditNote) map[string]Decimal {
+	left := map[string]Decimal{}
+	for _, line := range invoice.Lines {
+		left[line.Item_ID] = line.Line_Total.Sub(line.Line_Total.Percent(invoice.Discount_Percent).RoundTo(invoice.Currency))
+	}
+	for _, note := range notes {
+		for _, line := range note.Lines {
+			left[line.Item_ID] = left[line.Item_ID].Sub(line.Amount)
+		}
+	}
+	return left
+}
+
+// settleCreditGap - bring the note lines to the creditable total. A rounding cent still to credit goes on the last
+// line, credit beyond the total comes off the lines from the last one up, none of them going below zero. Lines left
+// with nothing to credit are dropped.
+func settleCreditGap(lines []creditNoteLine, gap Decimal) ([]creditNoteLine, error) {
+	if len(lines) == 0 {
+		return lines, nil
+	}
+	if gap.Sign() >= 0 {
+		lines[len(lines)-1].Amount = lines[len(lines)-1].Amount.Add(gap)
+		return lines, nil
+	}
+	over := gap.Neg()
+	for i := len(lines) - 1; i >= 0 && over.Sign() > 0; i-- {
+		take := over
+		if take.Cmp(lines[i].Amount) > 0 {
+			take = lines[i].Amount
+		}
+		lines[i].Amount = lines[i].Amount.Sub(take)
+		over = over.Sub(take)
+	}
+	if over.Sign() > 0 {
+		return lines, errors.New("the credit lines are " + over.String() + " more than what is left to credit")
+	}
+	settled := []creditNoteLine{}
+	for _, line := range lines {
+		if line.Amount.Sign() > 0 {
+			settled = append(settled, line)
+		}
+	}
+	return settled, nil
+}
+
+// fullyCredited - nothing is left to credit on any line
+func fullyCredited(left map[string]Decimal) bool {
+	for _, amount := range left {
+		if amount.Sign() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func getCreditNote(stub *shim.ChaincodeStub, id string) (CreditNote, error) {
+	var note CreditNote
+	if _, ok := loadRecord(stub, id, creditNoteImportSpec.name); !ok {
+		return note, errors.New("NOT_FOUND: credit note " + id)
+	}
+	noteAsBytes, _ := stub.GetState(id)
+	if err := json.Unmarshal(noteAsBytes, &note); err != nil {
+		return note, errors.New("Failed to decode " + id)
+	}
+	return note, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import "testing"
+
+func TestSettleCreditGap(t *testing.T) {
+	lines := func(amounts ...string) []creditNoteLine {
+		out := []creditNoteLine{}
+		for i, amount := range amounts {
+			out = append(out, creditNoteLine{Item_ID: string(rune('a' + i)), Amount: mustDecimal(t, amount)})
+		}
+		return out
+	}
+	amounts := func(lines []creditNoteLine) string {
+		out := ""
+		for _, line := range lines {
+			out += " " + line.Item_ID + "=" + line.Amount.String()
+		}
+		return out
+	}
+
+	t.Run("cent still to credit goes on the last line", func(t *testing.T) {
+		got, err := settleCreditGap(lines("33.33", "33.33", "33.33"), mustDecimal(t, "0.01"))
+		if err != nil || amounts(got) != " a=33.33 b=33.33 c=33.34" {
+			t.Errorf("got%s, %v", amounts(got), err)
+		}
+	})
+	t.Run("cent too much comes off the last line", func(t *testing.T) {
+		got, err := settleCreditGap(lines("33.34", "33.34", "33.34"), mustDecimal(t, "-0.01"))
+		if err != nil || amounts(got) != " a=33.34 b=33.34 c=33.33" {
+			t.Errorf("got%s, %v", amounts(got), err)
+		}
+	})
+	t.Run("a small last line stops at zero and is dropped", func(t *testing.T) {
+		got, err := settleCreditGap(lines("50.00", "0.01"), mustDecimal(t, "-0.03"))
+		if err != nil || amounts(got) != " a=49.98" {
+			t.Errorf("got%s, %v", amounts(got), err)
+		}
+	})
+	t.Run("more than the lines add up to", func(t *testing.T) {
+		if got, err := settleCreditGap(lines("0.01", "0.01"), mustDecimal(t, "-0.05")); err == nil {
+			t.Errorf("got%s, want an error", amounts(got))
+		}
+	})
+	t.Run("no gap", func(t *testing.T) {
+		got, err := settleCreditGap(lines("10.00"), mustDecimal(t, "0.00"))
+		if err != nil || amounts(got) != " a=10.00" {
+			t.Errorf("got%s, %v", amounts(got), err)
+		}
+	})
+}
+
+// testInvoice - an issued USD invoice billing the given line totals as items a, b, c... less the discount
+func testInvoice(t *testing.T, discount string, totals ...string) Invoice {
+	invoice := Invoice{Invoice_ID: "INV-s1-000001", Currency: "USD", Discount_Percent: mustDecimal(t, discount),
+		Status: invoiceIssued}
+	for i, total := range totals {
+		line := invoiceLine{Item_ID: string(rune('a' + i)), Line_Total: mustDecimal(t, total)}
+		invoice.Lines = append(invoice.Lines, line)
+		invoice.Subtotal = invoice.Subtotal.Add(line.Line_Total)
+	}
+	invoice.Discount_Amount = invoice.Subtotal.Percent(invoice.Discount_Percent).RoundTo("USD")
+	invoice.Total = invoice.Subtotal.Sub(invoice.Discount_Amount)
+	return invoice
+}
+
+func TestLeftToCredit(t *testing.T) {
+	invoice := testInvoice(t, "12.5", "100.00", "50.00")
+	earlier := CreditNote{Lines: []creditNoteLine{{Item_ID: "a", Amount: mustDecimal(t, "7.50")}}}
+	left := leftToCredit(invoice, []CreditNote{earlier})
+	if left["a"].String() != "80.00" || left["b"].String() != "43.75" || len(left) != 2 {
+		t.Errorf("left to credit = %v, want a 87.50 less the 7.50 already credited, b 43.75", left)
+	}
+}
+
+func TestCreditNoteLines(t *testing.T) {
+	invoice := testInvoice(t, "10", "10.00", "10.00", "10.00")
+
+	partial := mustDecimal(t, "4")
+	lines, total, err := creditNoteLines(invoice, leftToCredit(invoice, nil), "faulty unit",
+		[]creditRequest{{Item_ID: "b", Amount: &partial}, {Item_ID: "c", Reason: "late delivery"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.String() != "13.00" || len(lines) != 2 {
+		t.Fatalf("lines %+v, total %s, want 4.00 off b and the 9.00 left on c", lines, total)
+	}
+	if lines[0].Reason != "faulty unit" || lines[1].Reason != "late delivery" {
+		t.Errorf("reasons %q %q, want the note's reason unless the line gives its own", lines[0].Reason, lines[1].Reason)
+	}
+
+	lines, total, err = creditNoteLines(invoice, leftToCredit(invoice, nil), "cancelled", nil)
+	if err != nil || total.Cmp(invoice.Total) != 0 || len(lines) != 3 {
+		t.Errorf("no requests: %+v, %s, %v, want every line credited, %s in all", lines, total, err, invoice.Total)
+	}
+
+	for name, requests := range map[string][]creditRequest{
+		"unbilled item": {{Item_ID: "z"}},
+		"over the line": {{Item_ID: "a", Amount: &Decimal{}}},
+	} {
+		if _, _, err := creditNoteLines(invoice, leftToCredit(invoice, nil), "", requests); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	tooMuch := mustDecimal(t, "9.01")
+	requests := []creditRequest{{Item_ID: "a", Amount: &tooMuch}}
+	if _, _, err := creditNoteLines(invoice, leftToCredit(invoice, nil), "", requests); err == nil {
+		t.Error("credited more than is left on a line")
+	}
+}
+
+// each line's share of the discount is rounded on its own, crediting the lines in full must still come to the
+// invoice total
+func TestCreditNoteLinesMatchTheInvoiceTotal(t *testing.T) {
+	invoice := testInvoice(t, "50", "0.05", "0.05")
+	left := leftToCredit(invoice, nil)
+	if left["a"].String() != "0.02" || invoice.Total.String() != "0.05" {
+		t.Fatalf("left %v of an invoice of %s, want 0.02 a line of 0.05", left, invoice.Total)
+	}
+	lines, total, err := creditNoteLines(invoice, left, "", nil)
+	if err != nil || total.String() != "0.05" || lines[0].Amount.String() != "0.02" || lines[1].Amount.String() != "0.03" {
+		t.Errorf("credited %+v, %s, %v, want the missing cent on the last line", lines, total, err)
+	}
+}
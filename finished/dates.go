@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// dateLayout - the canonical ISO 8601 calendar date every stored date is written in
+const dateLayout = "2006-01-02"
+
+// parseDate - accept an ISO 8601 date or an RFC 3339 timestamp, the time of day is dropped
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if d, err := time.Parse(dateLayout, value); err == nil {
+		return d, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, value); err == nil {
+		return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Time{}, errors.New("not a date")
+}
+
+// canonicalDate - parse a date argument and return it in the canonical layout
+func canonicalDate(name string, value string) (string, error) {
+	d, err := parseDate(value)
+	if err != nil {
+		return "", errors.New(name + " must be a date (YYYY-MM-DD), got \"" + value + "\"")
+	}
+	return d.Format(dateLayout), nil
+}
+
+// checkWindow - a start date may not come after its end date, both in the canonical layout
+func checkWindow(startName string, start string, endName string, end string) error {
+	if start > end {
+		return errors.New(startName + " " + start + " is after " + endName + " " + end)
+	}
+	return nil
+}
+
+// checkWithin - the inner window must lie inside the outer one, all dates in the canonical layout
+func checkWithin(innerName string, innerStart string, innerEnd string, outerName string, outerStart string, outerEnd string) error {
+	if innerStart < outerStart || innerEnd > outerEnd {
+		return errors.New(innerName + " " + innerStart + " to " + innerEnd + " is outside " + outerName + " " + outerStart + " to " + outerEnd)
+	}
+	return nil
+}
+
+// productDates - canonicalise and check an availability window and the price window inside it.
+// The four dates are rewritten in place.
+func productDates(availStart *string, availEnd *string, priceStart *string, priceEnd *string) error {
+	var err error
+	if *availStart, err = canonicalDate("availability_start_date", *availStart); err != nil {
+		return err
+	}
+	if *availEnd, err = canonicalDate("availability_end_date", *availEnd); err != nil {
+		return err
+	}
+	if *priceStart, err = canonicalDate("price_start_date", *priceStart); err != nil {
+		return err
+	}
+	if *priceEnd, err = canonicalDate("price_end_date", *priceEnd); err != nil {
+		return err
+	}
+	if err = checkWindow("availability_start_date", *availStart, "availability_end_date", *availEnd); err != nil {
+		return err
+	}
+	if err = checkWindow("price_start_date", *priceStart, "price_end_date", *priceEnd); err != nil {
+		return err
+	}
+	return checkWithin("price window", *priceStart, *priceEnd, "availability window", *availStart, *availEnd)
+}
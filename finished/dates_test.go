@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalDate(t *testing.T) {
+	accepted := map[string]string{
+		"2016-02-29":                "2016-02-29",
+		" 2016-01-01 ":              "2016-01-01",
+		"2016-01-01T23:30:00Z":      "2016-01-01",
+		"2016-01-01T23:30:00-05:00": "2016-01-01", //the calendar day it was given on, not the UTC one
+	}
+	for value, want := range accepted {
+		if got, err := canonicalDate("date", value); got != want || err != nil {
+			t.Errorf("canonicalDate(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"2017-02-29", "2016-1-1", "01/01/2016", "tomorrow", ""} {
+		_, err := canonicalDate("contract_end_date", value)
+		if err == nil || !strings.HasPrefix(err.Error(), "contract_end_date must be a date") {
+			t.Errorf("canonicalDate(%q): %v, want it refused naming the argument", value, err)
+		}
+	}
+}
+
+func TestProductDates(t *testing.T) {
+	availStart, availEnd, priceStart, priceEnd := "2016-01-01", " 2016-12-31", "2016-01-01T08:00:00Z", "2016-06-30"
+	if err := productDates(&availStart, &availEnd, &priceStart, &priceEnd); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join([]string{availStart, availEnd, priceStart, priceEnd}, " "); got != "2016-01-01 2016-12-31 2016-01-01 2016-06-30" {
+		t.Errorf("dates rewritten as %s, want each in the canonical layout", got)
+	}
+
+	refuse := func(why string, message string, dates ...string) {
+		err := productDates(&dates[0], &dates[1], &dates[2], &dates[3])
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: %v, want an error mentioning %q", why, err, message)
+		}
+	}
+	refuse("availability reversed", "availability_start_date 2016-12-31 is after", "2016-12-31", "2016-01-01", "2016-02-01", "2016-02-28")
+	refuse("price reversed", "price_start_date 2016-11-30 is after", "2016-01-01", "2016-12-31", "2016-11-30", "2016-02-01")
+	refuse("price starts early", "outside availability window", "2016-01-01", "2016-12-31", "2015-12-31", "2016-11-30")
+	refuse("price ends late", "outside availability window", "2016-01-01", "2016-12-31", "2016-02-01", "2017-01-01")
+	refuse("not a date", "availability_end_date must be a date", "2016-01-01", "someday", "2016-02-01", "2016-11-30")
+}
+
+func TestCheckWindowAllowsASingleDay(t *testing.T) {
+	if err := checkWindow("contract_start_date", "2016-03-01", "contract_end_date", "2016-03-01"); err != nil {
+		t.Errorf("a one day contract: %v", err)
+	}
+	if err := checkWithin("billing period", "2016-03-01", "2016-03-01", "contract term", "2016-03-01", "2016-03-01"); err != nil {
+		t.Errorf("a one day period in a one day term: %v", err)
+	}
+}
+
+// the date filters compare stored dates as dates, records written before dates were canonical included
+func TestRecordDate(t *testing.T) {
+	rec := map[string]interface{}{"contract_start_date": "2016-01-01T10:00:00Z", "contract_end_date": "soon"}
+	if d, ok := recordDate(rec, "contract_start_date"); !ok || d != "2016-01-01" {
+		t.Errorf("stored timestamp read as %q %v", d, ok)
+	}
+	if _, ok := recordDate(rec, "contract_end_date"); ok {
+		t.Error("a stored value that is not a date was read as one")
+	}
+	if _, ok := recordDate(rec, "price_end_date"); ok {
+		t.Error("a missing field was read as a date")
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ledgerFormatVersion - bumped whenever the layout of the export document changes
+const ledgerFormatVersion = 1
+
+// ledgerSections - every record type that belongs to the product domain, in export order
+var ledgerSections = []importSpec{productImportSpec, offeringImportSpec, supplierImportSpec, contractImportSpec, clientImportSpec,
+	pendingOfferingImportSpec}
+
+// ledgerDump - the export document, one array of records per section keyed by the section name, the rates of every
+// currency pair keyed <FROM>_<TO> and the history of the records keyed by record id
+type ledgerDump struct {
+	Format_Version int                          `json:"format_version"`
+	Sections       map[string][]json.RawMessage `json:"sections"`
+	Fx_Rates       map[string][]fxRate          `json:"fx_rates"`
+	History        map[string][]fieldChange     `json:"history"`
+}
+
+// ledgerCSVDump - the export document with every section rendered as CSV. Headers are the bulk_import_* columns, then
+// the fields only a restore sets, JSON encoded, then the timestamps.
+type ledgerCSVDump struct {
+	Format_Version int               `json:"format_version"`
+	CSV            map[string]string `json:"csv"`
+	Fx_Rates       string            `json:"fx_rates"`
+	History        string            `json:"history"`
+}
+
+// fxRateColumns - the header of the fx rates CSV, one row per rate
+var fxRateColumns = []string{"from_currency", "to_currency", "rate", "effective_date", "set_at", "tx_id"}
+
+// historyColumns - the header of the history CSV, one row per field change
+var historyColumns = []string{"id", "field", "from", "to", "changed_at", "tx_id"}
+
+// restoreReport - returned by restore_ledger and sent as the "restore_ledger" event
+type restoreReport struct {
+	Mode      string                      `json:"mode"`
+	Restored  map[string]int              `json:"restored"`
+	Fx_Pairs  int                         `json:"fx_pairs"`  //currency pairs whose rates were restored
+	Histories int                         `json:"histories"` //records whose history was restored
+	Removed   int                         `json:"removed"`
+	Errors    map[string][]importRowError `json:"errors"`
+}
+
+// ============================================================================================================================
+// Export - dump every record reachable from the domain indexes, their history and the fx rates
+//
+// args: optional format, "json" (default) or "csv"
+//
+// The csv format renders each section with the columns the bulk_import_* invokes accept, followed by the fields only
+// a restore sets (prices, ...) as JSON. restore_ledger accepts either format.
+// ============================================================================================================================
+func (t *SimpleChaincode) export_ledger(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0 or 1 (format)")
+	}
+	format := "json"
+	if len(args) == 1 && args[0] != "" {
+		format = strings.ToLower(args[0])
+	}
+	if format != "json" && format != "csv" {
+		return nil, errors.New("Format must be json or csv")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err //the dump holds every product, whatever its user type
+	}
+
+	dump := ledgerDump{Format_Version: ledgerFormatVersion, Sections: map[string][]json.RawMessage{}}
+	for _, spec := range ledgerSections {
+		records, err := exportSection(stub, spec)
+		if err != nil {
+			return nil, err
+		}
+		dump.Sections[spec.name] = records
+	}
+	rates, err := allFxRates(stub)
+	if err != nil {
+		return nil, err
+	}
+	dump.Fx_Rates = rates
+	if dump.History, err = ledgerHistory(stub); err != nil {
+		return nil, err
+	}
+	if format == "json" {
+		return json.Marshal(dump)
+	}
+
+	csvDump := ledgerCSVDump{Format_Version: ledgerFormatVersion, CSV: map[string]string{}, Fx_Rates: fxRatesCSV(dump.Fx_Rates),
+		History: historyCSV(dump.History)}
+	for _, spec := range ledgerSections {
+		doc, err := sectionCSV(spec, dump.Sections[spec.name])
+		if err != nil {
+			return nil, err
+		}
+		csvDump.CSV[spec.name] = doc
+	}
+	return json.Marshal(csvDump)
+}
+
+// exportSection - the stored records of one index, each id once, in index order
+func exportSection(stub *shim.ChaincodeStub, spec importSpec) ([]json.RawMessage, error) {
+	index, err := getIndex(stub, spec.indexStr)
+	if err != nil {
+		return nil, err
+	}
+	records := []json.RawMessage{}
+	seen := map[string]bool{}
+	for _, id := range index {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		recAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return nil, errors.New("Failed to get state for " + id)
+		}
+		if recAsBytes == nil {
+			fmt.Println("export: " + id + " is in " + spec.indexStr + " but has no record")
+			continue
+		}
+		var probe interface{}
+		if json.Unmarshal(recAsBytes, &probe) != nil {
+			fmt.Println("export: skipping undecodable record " + id)
+			continue
+		}
+		records = append(records, json.RawMessage(recAsBytes))
+	}
+	return records, nil
+}
+
+// fxRatesCSV - the rates of every pair, pairs in key order and rates by effective date
+func fxRatesCSV(pairs map[string][]fxRate) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fxRateColumns)
+	for _, pair := range sortedPairs(pairs) {
+		codes := strings.SplitN(pair, "_", 2)
+		for _, rate := range pairs[pair] {
+			w.Write([]string{codes[0], codes[len(codes)-1], rate.Rate.String(), rate.Effective_Date, rate.Set_At, rate.Tx_ID})
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// historyCSV - the history of every record, records in id order and changes oldest first
+func historyCSV(histories map[string][]fieldChange) string {
+	ids := make([]string, 0, len(histories))
+	for id := range histories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(historyColumns)
+	for _, id := range ids {
+		for _, change := range histories[id] {
+			w.Write([]string{id, change.Field, change.From, change.To, change.Changed_At, change.Tx_ID})
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func sectionCSV(spec importSpec, records []json.RawMessage) (string, error) {
+	columns := append(append(append([]string{}, spec.fields...), spec.extraFields...), timestampFields...)
+	extra := map[string]bool{}
+	for _, f := range spec.extraFields {
+		extra[f] = true
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+	for _, raw := range records {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return "", errors.New("Failed to decode " + spec.name + " record")
+		}
+		row := make([]string, len(columns))
+		for i, f := range columns {
+			if v, ok := rec[f]; ok && v != nil && extra[f] {
+				valueAsBytes, _ := json.Marshal(v)
+				row[i] = string(valueAsBytes)
+			} else {
+				row[i] = fieldString(rec, f)
+			}
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ============================================================================================================================
+// Restore - load an export_ledger document, json or csv
+//
+// args: dump, mode ("merge" - the default - or "replace")
+//
+// merge writes the dump over the current records of the same kind and keeps everything else, replace first removes
+// every record reachable from the domain indexes, every fx rate and the history of every record. replace is refused while
+// the ledger holds data that refers to those records and is not part of the dump, such as quotes. Every record is
+// validated first; any error rejects the whole restore. Records keep the created_at/updated_at they were exported with.
+// The rates of a dumped currency pair replace the stored rates of that pair.
+// ============================================================================================================================
+func (t *SimpleChaincode) restore_ledger(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting dump and optional mode")
+	}
+	mode := "merge"
+	if len(args) == 2 && args[1] != "" {
+		mode = strings.ToLower(args[1])
+	}
+	if mode != "merge" && mode != "replace" {
+		return nil, errors.New("Mode must be merge or replace")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err //replace removes every record and merge overwrites any of them
+	}
+
+	dump, err := decodeDump(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if mode == "replace" {
+		if err := refuseReplace(stub); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("- start restore ledger, mode " + mode)
+	report := restoreReport{Mode: mode, Restored: map[string]int{}, Errors: map[string][]importRowError{}}
+	valid := map[string][]importedRecord{}
+	owner := map[string]string{} //all records share one key space
+	for _, spec := range ledgerSections {
+		rows, err := objectRows(spec.fields, spec.extraFields, dump.Sections[spec.name])
+		if err != nil {
+			return nil, errors.New(spec.name + ": " + err.Error())
+		}
+		records, rowErrors := validateRows(stub, spec, rows, true)
+		for i, rec := range records {
+			source := dump.Sections[spec.name][rec.row-1] //keep the original timestamps
+			records[i].created_at = fieldString(source, "created_at")
+			records[i].updated_at = fieldString(source, "updated_at")
+			if docType := fieldString(source, docTypeField); docType != "" && docType != spec.name {
+				rowErrors = append(rowErrors, importRowError{Row: rec.row, ID: rec.id, Error: "a " + docType + " record"})
+			} else if err := copyExtraFields(spec, source, rec.record); err != nil {
+				rowErrors = append(rowErrors, importRowError{Row: rec.row, ID: rec.id, Error: err.Error()})
+			} else if err := settleRecord(stub, rec.id, rec.record, true); err != nil {
+				rowErrors = append(rowErrors, importRowError{Row: rec.row, ID: rec.id, Error: err.Error()})
+			} else if mode == "merge" {
+				if err := requireKind(stub, rec.id, spec.name); err != nil {
+					rowErrors = append(rowErrors, importRowError{Row: rec.row, ID: rec.id, Error: err.Error()})
+				}
+			}
+			if other, taken := owner[rec.id]; taken {
+				rowErrors = append(rowErrors, importRowError{Row: rec.row, ID: rec.id, Error: "id is also used by a record in " + other})
+			}
+			owner[rec.id] = spec.name
+		}
+		if len(rowErrors) > 0 {
+			report.Errors[spec.name] = rowErrors
+		}
+		valid[spec.name] = records
+	}
+	rates := map[string][]fxRate{}
+	for i, pair := range sortedPairs(dump.Fx_Rates) {
+		from, to, checked, err := checkFxRates(pair, dump.Fx_Rates[pair])
+		if err != nil {
+			report.Errors["fx_rates"] = append(report.Errors["fx_rates"], importRowError{Row: i + 1, ID: pair, Error: err.Error()})
+			continue
+		}
+		rates[fxRateKey(from, to)] = checked
+	}
+	for id, history := range dump.History {
+		if _, ok := owner[id]; !ok {
+			report.Errors["history"] = append(report.Errors["history"], importRowError{ID: id,
+				Error: "history of a record that is not in the dump"})
+			continue
+		}
+		for i, change := range history {
+			if change.Field == "" || change.Changed_At == "" {
+				report.Errors["history"] = append(report.Errors["history"], importRowError{Row: i + 1, ID: id,
+					Error: "a change needs a field and changed_at"})
+			}
+		}
+	}
+	if len(report.Errors) > 0 {
+		reportAsBytes, _ := json.Marshal(report)
+		return nil, errors.New("Restore rejected, nothing was stored: " + string(reportAsBytes))
+	}
+
+	if mode == "replace" {
+		removed, err := clearSections(stub)
+		if err != nil {
+			return nil, err
+		}
+		cleared, err := clearFxRates(stub)
+		if err != nil {
+			return nil, err
+		}
+		erased, err := clearHistory(stub)
+		if err != nil {
+			return nil, err
+		}
+		report.Removed = removed + cleared + erased
+	}
+	for _, spec := range ledgerSections {
+		if err := storeRecords(stub, spec.indexStr, valid[spec.name]); err != nil {
+			return nil, err
+		}
+		report.Restored[spec.name] = len(valid[spec.name])
+	}
+	for key, checked := range rates {
+		ratesAsBytes, _ := json.Marshal(checked)
+		if err := stub.PutState(key, ratesAsBytes); err != nil {
+			return nil, errors.New("Failed to store " + key)
+		}
+	}
+	report.Fx_Pairs = len(rates)
+	for id, history := range dump.History {
+		historyAsBytes, _ := json.Marshal(history)
+		if err := stub.PutState(historyPrefix+id, historyAsBytes); err != nil {
+			return nil, errors.New("Failed to store the history of " + id)
+		}
+	}
+	report.Histories = len(dump.History)
+
+	reportAsBytes, _ := json.Marshal(report)
+	if err := stub.SetEvent("restore_ledger", reportAsBytes); err != nil {
+		fmt.Println("Failed to set restore_ledger event")
+	}
+	fmt.Println("- end restore ledger")
+	return reportAsBytes, nil
+}
+
+// restoreDump - an export_ledger document as restore_ledger reads it, whatever its format
+type restoreDump struct {
+	Format_Version int                                 `json:"format_version"`
+	Sections       map[string][]map[string]interface{} `json:"sections"`
+	Fx_Rates       map[string][]fxRate                 `json:"fx_rates"`
+	History        map[string][]fieldChange            `json:"history"`
+}
+
+// decodeDump - read a json or csv export_ledger document, a csv one is turned into the records of a json one
+func decodeDump(doc string) (restoreDump, error) {
+	var dump restoreDump
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(doc), &probe); err != nil {
+		return dump, errors.New("Dump must be an export_ledger document")
+	}
+	if _, isCSV := probe["csv"]; !isCSV {
+		if err := json.Unmarshal([]byte(doc), &dump); err != nil {
+			return dump, errors.New("Dump must be an export_ledger document")
+		}
+	} else {
+		var csvDump ledgerCSVDump
+		if err := json.Unmarshal([]byte(doc), &csvDump); err != nil {
+			return dump, errors.New("Dump must be an export_ledger document")
+		}
+		dump.Format_Version, dump.Sections = csvDump.Format_Version, map[string][]map[string]interface{}{}
+		for _, spec := range ledgerSections {
+			if sectionDoc, ok := csvDump.CSV[spec.name]; ok {
+				records, err := csvSectionRecords(spec, sectionDoc)
+				if err != nil {
+					return dump, errors.New(spec.name + ": " + err.Error())
+				}
+				dump.Sections[spec.name] = records
+			}
+		}
+		for name := range csvDump.CSV {
+			if _, ok := dump.Sections[name]; !ok {
+				return dump, errors.New("Dump has unknown section " + name)
+			}
+		}
+		rates, err := csvFxRates(csvDump.Fx_Rates)
+		if err != nil {
+			return dump, errors.New("fx_rates: " + err.Error())
+		}
+		dump.Fx_Rates = rates
+		if dump.History, err = csvHistory(csvDump.History); err != nil {
+			return dump, errors.New("history: " + err.Error())
+		}
+	}
+	if dump.Format_Version != ledgerFormatVersion {
+		return dump, errors.New("Unsupported dump format_version " + strconv.Itoa(dump.Format_Version))
+	}
+	known := map[string]bool{}
+	for _, spec := range ledgerSections {
+		known[spec.name] = true
+	}
+	for name := range dump.Sections {
+		if !known[name] {
+			return dump, errors.New("Dump has unknown section " + name)
+		}
+	}
+	return dump, nil
+}
+
+// csvSectionRecords - the records of a section rendered by sectionCSV, its extra fields decoded from their JSON
+func csvSectionRecords(spec importSpec, doc string) ([]map[string]interface{}, error) {
+	rows, err := csv.NewReader(strings.NewReader(doc)).ReadAll()
+	if err != nil {
+		return nil, errors.New("Invalid CSV: " + err.Error())
+	}
+	records := []map[string]interface{}{}
+	if len(rows) == 0 {
+		return records, nil
+	}
+	extra := map[string]bool{}
+	for _, f := range spec.extraFields {
+		extra[f] = true
+	}
+	for i, row := range rows[1:] {
+		rec := map[string]interface{}{}
+		for j, name := range rows[0] {
+			switch {
+			case !extra[name]:
+				rec[name] = row[j]
+			case row[j] != "":
+				var value interface{}
+				if err := json.Unmarshal([]byte(row[j]), &value); err != nil {
+					return nil, errors.New("Row " + strconv.Itoa(i+1) + ": " + name + " must hold JSON")
+				}
+				rec[name] = value
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// csvFxRates - the rates rendered by fxRatesCSV, keyed <FROM>_<TO>
+func csvFxRates(doc string) (map[string][]fxRate, error) {
+	pairs := map[string][]fxRate{}
+	rows, err := csv.NewReader(strings.NewReader(doc)).ReadAll()
+	if err != nil {
+		return nil, errors.New("Invalid CSV: " + err.Error())
+	}
+	if len(rows) == 0 {
+		return pairs, nil
+	}
+	if strings.Join(rows[0], ",") != strings.Join(fxRateColumns, ",") {
+		return nil, errors.New("CSV header must be " + strings.Join(fxRateColumns, ","))
+	}
+	for i, row := range rows[1:] {
+		rate, err := ParseDecimal(row[2])
+		if err != nil {
+			return nil, errors.New("Row " + strconv.Itoa(i+1) + ": rate " + err.Error())
+		}
+		pair := row[0] + "_" + row[1]
+		pairs[pair] = append(pairs[pair], fxRate{Rate: rate, Effective_Date: row[3], Set_At: row[4], Tx_ID: row[5]})
+	}
+	return pairs, nil
+}
+
+// csvHistory - the history rendered by historyCSV, keyed by record id
+func csvHistory(doc string) (map[string][]fieldChange, error) {
+	histories := map[string][]fieldChange{}
+	rows, err := csv.NewReader(strings.NewReader(doc)).ReadAll()
+	if err != nil {
+		return nil, errors.New("Invalid CSV: " + err.Error())
+	}
+	if len(rows) == 0 {
+		return histories, nil
+	}
+	if strings.Join(rows[0], ",") != strings.Join(historyColumns, ",") {
+		return nil, errors.New("CSV header must be " + strings.Join(historyColumns, ","))
+	}
+	for _, row := range rows[1:] {
+		histories[row[0]] = append(histories[row[0]], fieldChange{row[1], row[2], row[3], row[4], row[5]})
+	}
+	return histories, nil
+}
+
+// prefixEnd - the exclusive end key of a RangeQueryState over every key that starts with prefix, ids may hold any
+// character so "~" is not enough
+func prefixEnd(prefix string) string {
+	return prefix + string(utf8.MaxRune)
+}
+
+// replaceBlockers - data that refers to the ledger records and is not part of the dump. Removing the records under it
+// would leave it pointing at nothing, so a replace restore is refused while any of it exists.
+var replaceBlockers = []struct {
+	name   string
+	prefix string
+}{{"amendments", amendmentsPrefix}, {"adjustments", adjustmentsPrefix}}
+
+// refuseReplace - the error a replace restore fails with while documents or other replaceBlockers exist
+func refuseReplace(stub *shim.ChaincodeStub) error {
+	found := []string{}
+	for _, spec := range documentSections {
+		index, err := getIndex(stub, spec.indexStr)
+		if err != nil {
+			return err
+		}
+		if len(index) > 0 {
+			found = append(found, spec.name)
+		}
+	}
+	for _, blocker := range replaceBlockers {
+		iter, err := stub.RangeQueryState(blocker.prefix, prefixEnd(blocker.prefix))
+		if err != nil {
+			return errors.New("Failed to scan the " + blocker.name)
+		}
+		if iter.HasNext() {
+			found = append(found, blocker.name)
+		}
+		iter.Close()
+	}
+	if len(found) > 0 {
+		return errors.New("Cannot replace the ledger, its " + strings.Join(found, ", ") +
+			" refer to the records a replace removes. Restore with merge instead.")
+	}
+	return nil
+}
+
+// copyExtraFields - decode the extra fields of a dumped record onto the record built from its row
+func copyExtraFields(spec importSpec, source map[string]interface{}, record stampedRecord) error {
+	extras := map[string]interface{}{}
+	for _, f := range spec.extraFields {
+		if v, ok := source[f]; ok {
+			extras[f] = v
+		}
+	}
+	if len(extras) == 0 {
+		return nil
+	}
+	extrasAsBytes, _ := json.Marshal(extras)
+	if err := json.Unmarshal(extrasAsBytes, record); err != nil {
+		return errors.New("invalid " + strings.Join(spec.extraFields, ", "))
+	}
+	return nil
+}
+
+// clearSections - delete every record reachable from the domain indexes and empty the indexes
+func clearSections(stub *shim.ChaincodeStub) (int, error) {
+	removed := 0
+	deleted := map[string]bool{}
+	for _, spec := range ledgerSections {
+		index, err := getIndex(stub, spec.indexStr)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range index {
+			if deleted[id] {
+				continue
+			}
+			if err := stub.DelState(id); err != nil {
+				return 0, errors.New("Failed to delete state for " + id)
+			}
+			deleted[id] = true
+			removed++
+		}
+		emptyAsBytes, _ := json.Marshal([]string{})
+		if err := stub.PutState(spec.indexStr, emptyAsBytes); err != nil {
+			return 0, errors.New("Failed to reset index " + spec.indexStr)
+		}
+	}
+	return removed, nil
+}
+
+// clearFxRates - delete the rates of every currency pair
+func clearFxRates(stub *shim.ChaincodeStub) (int, error) {
+	pairs, err := allFxRates(stub)
+	if err != nil {
+		return 0, err
+	}
+	for pair := range pairs {
+		if err := stub.DelState(fxRatePrefix + pair); err != nil {
+			return 0, errors.New("Failed to delete the " + pair + " rates")
+		}
+	}
+	return len(pairs), nil
+}
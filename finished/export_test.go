@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSectionCSVRoundTrip(t *testing.T) {
+	stored := []string{
+		`{"product_id":"p1","category":"hw","product_description":"disk, 2TB","list_price":"10.99","currency":"USD",` +
+			`"prices":[{"start_date":"2016-01-01","end_date":"2016-12-31","price":"10.99"}],"status":"active",` +
+			`"created_at":"2016-10-01T00:00:00Z","updated_at":"2016-10-02T00:00:00Z"}`,
+		`{"product_id":"p2","category":"sw","product_description":"say \"hi\"","list_price":5,"currency":"EUR"}`,
+	}
+	records := []json.RawMessage{}
+	for _, rec := range stored {
+		records = append(records, json.RawMessage(rec))
+	}
+	doc, err := sectionCSV(productImportSpec, records)
+	if err != nil {
+		t.Fatalf("sectionCSV: %v", err)
+	}
+	header := strings.SplitN(doc, "\n", 2)[0]
+	if !strings.HasSuffix(header, ",user_type,prices,status,created_at,updated_at") {
+		t.Errorf("header %s, want the import columns, then the extra fields, then the timestamps", header)
+	}
+
+	got, err := csvSectionRecords(productImportSpec, doc)
+	if err != nil {
+		t.Fatalf("csvSectionRecords: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("%d records, want 2", len(got))
+	}
+	var first map[string]interface{}
+	json.Unmarshal(records[0], &first)
+	if !reflect.DeepEqual(got[0]["prices"], first["prices"]) || got[0]["status"] != "active" {
+		t.Errorf("extra fields came back as %v and %v", got[0]["prices"], got[0]["status"])
+	}
+	if got[0]["product_description"] != "disk, 2TB" || got[0]["updated_at"] != "2016-10-02T00:00:00Z" {
+		t.Errorf("first record %v", got[0])
+	}
+	if got[1]["product_description"] != `say "hi"` || got[1]["list_price"] != "5" {
+		t.Errorf("second record %v", got[1])
+	}
+	if _, ok := got[1]["prices"]; ok {
+		t.Errorf("an empty extra column should leave the field out, got %v", got[1]["prices"])
+	}
+	if _, err := objectRows(productImportSpec.fields, productImportSpec.extraFields, got); err != nil {
+		t.Errorf("the records do not pass as restore rows: %v", err)
+	}
+}
+
+func TestCSVSectionRecordsErrors(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unbalanced quote": "product_id,prices\np1,\"[\n",
+		"extra not json":   "product_id,prices\np1,[{\n",
+		"short row":        "product_id,category\np1\n",
+	} {
+		if _, err := csvSectionRecords(productImportSpec, doc); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if records, err := csvSectionRecords(productImportSpec, ""); err != nil || len(records) != 0 {
+		t.Errorf("empty section: %v %v", records, err)
+	}
+}
+
+func TestDecodeDump(t *testing.T) {
+	csvDoc := `{"format_version":1,"csv":{"clients":"client_id,last_name\ncl1,Doe\n"}}`
+	dump, err := decodeDump(csvDoc)
+	if err != nil || len(dump.Sections["clients"]) != 1 || dump.Sections["clients"][0]["last_name"] != "Doe" {
+		t.Errorf("csv dump = %+v, %v", dump, err)
+	}
+	for doc, message := range map[string]string{
+		`[]`:                                 "export_ledger document",
+		`{"format_version":2,"sections":{}}`: "format_version 2",
+		`{"format_version":1,"sections":{"invoices":[]}}`:  "unknown section invoices",
+		`{"format_version":1,"csv":{"invoices":""}}`:       "unknown section invoices",
+		`{"format_version":1,"csv":{"clients":"a,\"b\n"}}`: "clients: Invalid CSV",
+	} {
+		if _, err := decodeDump(doc); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: %v, want %q", doc, err, message)
+		}
+	}
+}
+
+func TestCopyExtraFields(t *testing.T) {
+	product := &Product{Product_Id: "p1"}
+	source := map[string]interface{}{"status": "retired", "category": "ignored"}
+	if err := copyExtraFields(productImportSpec, source, product); err != nil {
+		t.Fatalf("copyExtraFields: %v", err)
+	}
+	if product.Status != "retired" || product.Category != "" {
+		t.Errorf("copied status %q and category %q, want only the status", product.Status, product.Category)
+	}
+	if err := copyExtraFields(productImportSpec, map[string]interface{}{"prices": "soon"}, product); err == nil {
+		t.Errorf("prices that are not a schedule were copied")
+	}
+}
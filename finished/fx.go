@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// fxRatePrefix - the rates of one currency pair are stored under _fx_<FROM>_<TO>, the "_" keeps them out of scanRecords
+const fxRatePrefix = "_fx_"
+
+// maxFxRateScale - exchange rates may be quoted to 10 decimals
+const maxFxRateScale = 10
+
+// fxRate - one effective-dated rate: 1 unit of the pair's first currency buys Rate units of the second.
+// A rate applies from its effective date until the next rate of the pair takes effect.
+type fxRate struct {
+	Rate           Decimal `json:"rate"`
+	Effective_Date string  `json:"effective_date"`
+	Set_At         string  `json:"set_at"`
+	Tx_ID          string  `json:"tx_id"`
+	Inverted       bool    `json:"inverted,omitempty"` //looked up as the inverse of a rate set the other way round
+}
+
+// fxConversion - an amount converted into another currency, with the rate that was used
+type fxConversion struct {
+	Amount              Decimal `json:"amount"`
+	Currency            string  `json:"currency"`
+	From_Amount         Decimal `json:"from_amount"`
+	From_Currency       string  `json:"from_currency"`
+	Rate                Decimal `json:"rate"`
+	Rate_Effective_Date string  `json:"rate_effective_date"`
+	Rate_Date           string  `json:"rate_date"` //the date the rate was looked up for
+}
+
+// currencyInfo - one entry of the list_currencies result
+type currencyInfo struct {
+	Code        string `json:"code"`
+	Minor_Units int    `json:"minor_units"`
+}
+
+// ============================================================================================================================
+// List currencies - the ISO 4217 currencies records may be priced in
+// ============================================================================================================================
+func (t *SimpleChaincode) list_currencies(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	codes := make([]string, 0, len(currencyMinorUnits))
+	for code := range currencyMinorUnits {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	currencies := []currencyInfo{}
+	for _, code := range codes {
+		currencies = append(currencies, currencyInfo{code, currencyMinorUnits[code]})
+	}
+	return json.Marshal(currencies)
+}
+
+// ============================================================================================================================
+// Set FX rate - admin only, record the rate of a currency pair from an effective date on
+//
+// A rate set again for the same pair and effective date replaces the earlier one. A pair converts the other way round
+// with the inverse rate, setting the rates of that direction too is only needed where they must differ.
+// args: from_currency, to_currency, rate, effective_date
+// ============================================================================================================================
+func (t *SimpleChaincode) set_fx_rate(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err
+	}
+	fmt.Println("- start set fx rate")
+	from, to, err := fxPair(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, errors.New("Cannot set a rate from " + from + " to itself")
+	}
+	rate, err := ParseDecimal(args[2])
+	if err != nil {
+		return nil, errors.New("rate argument must be a decimal number, " + err.Error())
+	}
+	if rate.Sign() <= 0 {
+		return nil, errors.New("rate must be greater than zero")
+	}
+	if rate.precision() > maxFxRateScale {
+		return nil, errors.New("rate may have at most " + strconv.Itoa(maxFxRateScale) + " decimals")
+	}
+	effective, err := canonicalDate("effective_date", args[3])
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := getFxRates(stub, from, to)
+	if err != nil {
+		return nil, err
+	}
+	entry := fxRate{Rate: rate.Round(rate.precision()), Effective_Date: effective, Set_At: now.Format(time.RFC3339),
+		Tx_ID: stub.GetTxID()}
+	replaced := false
+	for i := range rates {
+		if rates[i].Effective_Date == effective {
+			rates[i], replaced = entry, true
+		}
+	}
+	if !replaced {
+		rates = append(rates, entry)
+	}
+	sort.Sort(byEffectiveDate(rates))
+
+	ratesAsBytes, _ := json.Marshal(rates)
+	if err := stub.PutState(fxRateKey(from, to), ratesAsBytes); err != nil {
+		return nil, errors.New("Failed to store the " + from + "/" + to + " rates")
+	}
+	eventAsBytes, _ := json.Marshal(struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		fxRate
+	}{from, to, entry})
+	if err := stub.SetEvent("set_fx_rate", eventAsBytes); err != nil {
+		fmt.Println("Failed to set set_fx_rate event")
+	}
+	fmt.Println("- end set fx rate")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get FX rate - the rate of a currency pair on a date
+//
+// args: from_currency, to_currency, optional date (defaults to the transaction date)
+// ============================================================================================================================
+func (t *SimpleChaincode) get_fx_rate(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting from_currency, to_currency and optional date")
+	}
+	from, to, err := fxPair(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	var date string
+	if len(args) == 3 && args[2] != "" {
+		date, err = canonicalDate("date", args[2])
+	} else {
+		date, err = txDate(stub)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rate, err := fxRateOn(stub, from, to, date)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Date string `json:"date"`
+		fxRate
+	}{from, to, date, rate})
+}
+
+// convertAmount - convert an amount into another currency with the rate in force on date, rounded to the minor
+// unit of the target currency. Converting into the same currency uses a rate of 1.
+func convertAmount(stub *shim.ChaincodeStub, amount Decimal, from string, to string, date string) (fxConversion, error) {
+	rate, err := fxRateOn(stub, from, to, date)
+	if err != nil {
+		return fxConversion{}, err
+	}
+	return fxConversion{
+		Amount:              amount.Mul(rate.Rate).RoundTo(to),
+		Currency:            to,
+		From_Amount:         amount,
+		From_Currency:       from,
+		Rate:                rate.Rate,
+		Rate_Effective_Date: rate.Effective_Date,
+		Rate_Date:           date,
+	}, nil
+}
+
+// fxRateOn - the rate of the pair in force on date, see rateInForce
+func fxRateOn(stub *shim.ChaincodeStub, from string, to string, date string) (fxRate, error) {
+	if from == to {
+		return fxRate{Rate: NewDecimal(1, 0), Effective_Date: date}, nil
+	}
+	rates, err := getFxRates(stub, from, to)
+	if err != nil {
+		return fxRate{}, err
+	}
+	inverse, err := getFxRates(stub, to, from)
+	if err != nil {
+		return fxRate{}, err
+	}
+	if rate, ok := rateInForce(rates, inverse, date); ok {
+		return rate, nil
+	}
+	return fxRate{}, errors.New("NOT_FOUND: no " + from + "/" + to + " or " + to + "/" + from + " rate in force on " + date)
+}
+
+// rateInForce - the latest rate that took effect on or before date, taken from the rates of the pair or inverted from
+// the rates set the other way round. The later of the two wins, the pair's own rate on the same effective date.
+func rateInForce(rates []fxRate, inverse []fxRate, date string) (fxRate, bool) {
+	rate, found := latestRate(rates, date)
+	other, foundOther := latestRate(inverse, date)
+	if foundOther && (!found || other.Effective_Date > rate.Effective_Date) {
+		other.Rate, other.Inverted = other.Rate.Inverse(maxFxRateScale), true
+		return other, true
+	}
+	return rate, found
+}
+
+// latestRate - the last of the sorted rates that took effect on or before date
+func latestRate(rates []fxRate, date string) (fxRate, bool) {
+	for i := len(rates) - 1; i >= 0; i-- {
+		if rates[i].Effective_Date <= date {
+			return rates[i], true
+		}
+	}
+	return fxRate{}, false
+}
+
+func getFxRates(stub *shim.ChaincodeStub, from string, to string) ([]fxRate, error) {
+	ratesAsBytes, err := stub.GetState(fxRateKey(from, to))
+	if err != nil {
+		return nil, errors.New("Failed to get the " + from + "/" + to + " rates")
+	}
+	rates := []fxRate{}
+	if ratesAsBytes != nil {
+		if err := json.Unmarshal(ratesAsBytes, &rates); err != nil {
+			return nil, errors.New("Failed to decode the " + from + "/" + to + " rates")
+		}
+	}
+	return rates, nil
+}
+
+// allFxRates - the rates of every pair, keyed <FROM>_<TO>
+func allFxRates(stub *shim.ChaincodeStub) (map[string][]fxRate, error) {
+	pairs := map[string][]fxRate{}
+	iter, err := stub.RangeQueryState(fxRatePrefix, fxRatePrefix+"~")
+	if err != nil {
+		return nil, errors.New("Failed to scan the fx rates")
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan the fx rates")
+		}
+		rates := []fxRate{}
+		if err := json.Unmarshal(value, &rates); err != nil {
+			return nil, errors.New("Failed to decode the rates under " + key)
+		}
+		pairs[strings.TrimPrefix(key, fxRatePrefix)] = rates
+	}
+	return pairs, nil
+}
+
+// checkFxRates - validate the dumped rates of a pair keyed <FROM>_<TO>, the rates come back sorted
+func checkFxRates(pair string, rates []fxRate) (string, string, []fxRate, error) {
+	codes := strings.Split(pair, "_")
+	if len(codes) != 2 {
+		return "", "", nil, errors.New("pair must be <FROM>_<TO>")
+	}
+	from, to, err := fxPair(codes[0], codes[1])
+	if err != nil {
+		return "", "", nil, err
+	}
+	if from == to {
+		return "", "", nil, errors.New("a rate from " + from + " to itself")
+	}
+	checked := []fxRate{}
+	seen := map[string]bool{}
+	for _, rate := range rates {
+		if rate.Rate.Sign() <= 0 || rate.Rate.precision() > maxFxRateScale {
+			return "", "", nil, errors.New("rate " + rate.Rate.String() + " must be greater than zero with at most " +
+				strconv.Itoa(maxFxRateScale) + " decimals")
+		}
+		effective, err := canonicalDate("effective_date", rate.Effective_Date)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if seen[effective] {
+			return "", "", nil, errors.New("two rates take effect on " + effective)
+		}
+		seen[effective] = true
+		rate.Effective_Date, rate.Inverted = effective, false
+		checked = append(checked, rate)
+	}
+	sort.Sort(byEffectiveDate(checked))
+	return from, to, checked, nil
+}
+
+func sortedPairs(pairs map[string][]fxRate) []string {
+	keys := make([]string, 0, len(pairs))
+	for pair := range pairs {
+		keys = append(keys, pair)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fxPair - validate both currencies of a pair
+func fxPair(from string, to string) (string, string, error) {
+	var err error
+	if from, err = currencyCode(from); err != nil {
+		return "", "", err
+	}
+	if to, err = currencyCode(to); err != nil {
+		return "", "", err
+	}
+	return from, to, nil
+}
+
+func fxRateKey(from string, to string) string {
+	return fxRatePrefix + from + "_" + to
+}
+
+type byEffectiveDate []fxRate
+
+func (s byEffectiveDate) Len() int           { return len(s) }
+func (s byEffectiveDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEffectiveDate) Less(i, j int) bool { return s[i].Effective_Date < s[j].Effective_Date }
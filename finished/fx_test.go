@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRateInForce(t *testing.T) {
+	rate := func(value string, effective string) fxRate {
+		return fxRate{Rate: mustDecimal(t, value), Effective_Date: effective}
+	}
+	usdEur := []fxRate{rate("0.9", "2016-01-01"), rate("0.915", "2016-09-15")}
+	eurUsd := []fxRate{rate("1.2", "2015-01-01"), rate("1.25", "2016-09-15"), rate("1.1", "2016-11-01")}
+
+	got, ok := rateInForce(usdEur, nil, "2016-06-30")
+	if !ok || got.Rate.String() != "0.9" || got.Inverted {
+		t.Errorf("own rate: %+v %v", got, ok)
+	}
+	got, ok = rateInForce(nil, eurUsd, "2016-06-30")
+	if !ok || got.Rate.String() != "0.8333333333" || !got.Inverted || got.Effective_Date != "2015-01-01" {
+		t.Errorf("inverse only: %+v %v", got, ok)
+	}
+	got, _ = rateInForce(usdEur, eurUsd, "2016-10-01")
+	if got.Rate.String() != "0.915" || got.Inverted {
+		t.Errorf("same effective date: %+v, want the pair's own 0.915", got)
+	}
+	got, _ = rateInForce(usdEur, eurUsd, "2016-12-01")
+	if got.Rate.String() != "0.9090909091" || !got.Inverted {
+		t.Errorf("later inverse: %+v, want 1/1.1", got)
+	}
+	if got, ok := rateInForce(usdEur, eurUsd, "2014-12-31"); ok {
+		t.Errorf("before every rate: %+v", got)
+	}
+}
+
+func TestDecimalInverse(t *testing.T) {
+	for value, want := range map[string]string{"2": "0.5000000000", "0.9": "1.1111111111", "3": "0.3333333333",
+		"1.5": "0.6666666667", "0.0000000001": "10000000000.0000000000", "-4": "-0.2500000000"} {
+		if got := mustDecimal(t, value).Inverse(maxFxRateScale); got.String() != want {
+			t.Errorf("1/%s = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestCheckFxRates(t *testing.T) {
+	from, to, rates, err := checkFxRates("USD_EUR", []fxRate{
+		{Rate: mustDecimal(t, "0.915"), Effective_Date: "2016-09-15"},
+		{Rate: mustDecimal(t, "0.9"), Effective_Date: "2016-01-01", Inverted: true},
+	})
+	if err != nil || from != "USD" || to != "EUR" {
+		t.Fatalf("checkFxRates = %s %s %v", from, to, err)
+	}
+	if rates[0].Effective_Date != "2016-01-01" || rates[1].Effective_Date != "2016-09-15" || rates[0].Inverted {
+		t.Errorf("rates not sorted: %+v", rates)
+	}
+
+	bad := map[string][]fxRate{
+		"USD":     nil,
+		"USD_XXX": nil,
+		"EUR_EUR": nil,
+		"USD_GBP": {{Rate: mustDecimal(t, "0"), Effective_Date: "2016-01-01"}},
+		"USD_JPY": {{Rate: mustDecimal(t, "1.00000000001"), Effective_Date: "2016-01-01"}},
+		"USD_CHF": {{Rate: mustDecimal(t, "1"), Effective_Date: "2016-02-30"}},
+		"USD_CAD": {{Rate: mustDecimal(t, "1.3"), Effective_Date: "2016-01-01"},
+			{Rate: mustDecimal(t, "1.31"), Effective_Date: "2016-01-01"}},
+	}
+	for pair, rates := range bad {
+		if _, _, _, err := checkFxRates(pair, rates); err == nil {
+			t.Errorf("checkFxRates(%s) accepted %+v", pair, rates)
+		}
+	}
+}
+
+func TestFxRatesCSVRoundTrip(t *testing.T) {
+	pairs := map[string][]fxRate{
+		"EUR_USD": {{Rate: mustDecimal(t, "1.2"), Effective_Date: "2015-01-01", Set_At: "2016-10-01T00:00:00Z", Tx_ID: "tx1"}},
+		"USD_EUR": {{Rate: mustDecimal(t, "0.9"), Effective_Date: "2016-01-01", Set_At: "2016-10-01T00:00:00Z", Tx_ID: "tx2"},
+			{Rate: mustDecimal(t, "0.915"), Effective_Date: "2016-09-15", Set_At: "2016-10-01T00:00:00Z", Tx_ID: "tx3"}},
+	}
+	got, err := csvFxRates(fxRatesCSV(pairs))
+	if err != nil {
+		t.Fatalf("csvFxRates: %v", err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(pairs)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("round trip gave %s, want %s", gotJSON, wantJSON)
+	}
+	if _, err := csvFxRates("from,to,rate\nUSD,EUR,0.9\n"); err == nil {
+		t.Errorf("a header other than fxRateColumns was accepted")
+	}
+	if _, err := csvFxRates(fxRatesCSV(nil) + "USD,EUR,ninety,2016-01-01,,\n"); err == nil {
+		t.Errorf("a rate that is not a decimal was accepted")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// historyPrefix - the changes made to a record by the field setters are kept under _history_<id>
+const historyPrefix = "_history_"
+
+// fieldChange - one change of one field, as recorded by a field setter
+type fieldChange struct {
+	Field      string `json:"field"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Changed_At string `json:"changed_at"`
+	Tx_ID      string `json:"tx_id"`
+}
+
+// ============================================================================================================================
+// Get history - the field changes recorded for a record, oldest first
+//
+// args: id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_history(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if err := requireVisible(stub, args[0]); err != nil {
+		return nil, err
+	}
+	history, err := getHistory(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(history)
+}
+
+// recordChange - append a change to the history of a record, nothing is recorded when the value did not change
+func recordChange(stub *shim.ChaincodeStub, id string, field string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	history, err := getHistory(stub, id)
+	if err != nil {
+		return err
+	}
+	history = append(history, fieldChange{field, from, to, now.Format(time.RFC3339), stub.GetTxID()})
+	historyAsBytes, _ := json.Marshal(history)
+	if err := stub.PutState(historyPrefix+id, historyAsBytes); err != nil {
+		return errors.New("Failed to store the history of " + id)
+	}
+	return nil
+}
+
+func getHistory(stub *shim.ChaincodeStub, id string) ([]fieldChange, error) {
+	historyAsBytes, err := stub.GetState(historyPrefix + id)
+	if err != nil {
+		return nil, errors.New("Failed to get the history of " + id)
+	}
+	history := []fieldChange{}
+	if historyAsBytes != nil {
+		if err := json.Unmarshal(historyAsBytes, &history); err != nil {
+			return nil, errors.New("Failed to decode the history of " + id)
+		}
+	}
+	return history, nil
+}
+
+// ledgerHistory - the history of every record listed in the ledger indexes, keyed by record id
+func ledgerHistory(stub *shim.ChaincodeStub) (map[string][]fieldChange, error) {
+	histories := map[string][]fieldChange{}
+	for _, spec := range ledgerSections {
+		index, err := getIndex(stub, spec.indexStr)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range index {
+			history, err := getHistory(stub, id)
+			if err != nil {
+				return nil, err
+			}
+			if len(history) > 0 {
+				histories[id] = history
+			}
+		}
+	}
+	return histories, nil
+}
+
+// clearHistory - delete the history of every record
+func clearHistory(stub *shim.ChaincodeStub) (int, error) {
+	iter, err := stub.RangeQueryState(historyPrefix, prefixEnd(historyPrefix))
+	if err != nil {
+		return 0, errors.New("Failed to scan the history")
+	}
+	keys := []string{}
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return 0, errors.New("Failed to scan the history")
+		}
+		keys = append(keys, key)
+	}
+	iter.Close()
+	for _, key := range keys {
+		if err := stub.DelState(key); err != nil {
+			return 0, errors.New("Failed to delete " + key)
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHistoryCSVRoundTrip(t *testing.T) {
+	histories := map[string][]fieldChange{
+		"p1": {{"user_type", "", "gold", "2016-10-01T00:00:00Z", "tx1"}, {"status", "draft", "active", "2016-10-02T00:00:00Z", "tx2"}},
+		"c0": {{"billing", "none", "quarterly from 2016-01-01 in advance", "2016-10-01T00:00:00Z", "tx3"}},
+	}
+	doc := historyCSV(histories)
+	if want := "id,field,from,to,changed_at,tx_id\nc0,"; doc[:len(want)] != want {
+		t.Errorf("history CSV starts %q, want the header and then c0 before p1", doc)
+	}
+	got, err := csvHistory(doc)
+	if err != nil {
+		t.Fatalf("csvHistory: %v", err)
+	}
+	if !reflect.DeepEqual(got, histories) {
+		t.Errorf("round trip gave %v, want %v", got, histories)
+	}
+	if _, err := csvHistory("id,field\np1,status\n"); err == nil {
+		t.Errorf("a header other than historyColumns was accepted")
+	}
+	if got, err := csvHistory(""); err != nil || len(got) != 0 {
+		t.Errorf("empty history: %v %v", got, err)
+	}
+}
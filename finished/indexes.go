@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// indexCheck - what verify_indexes found for one index
+type indexCheck struct {
+	Index       string   `json:"index"`
+	Entries     int      `json:"entries"`
+	Orphaned    []string `json:"orphaned"`    //in the index, no record stored
+	Duplicates  []string `json:"duplicates"`  //in the index more than once
+	Wrong_Type  []string `json:"wrong_type"`  //in the index, but the record is of another type
+	Undecodable []string `json:"undecodable"` //in the index, but the record is not JSON
+	Invalid     []string `json:"invalid"`     //decodes, but fails the init_* validation
+	Missing     []string `json:"missing"`     //a record of this type that is not in the index
+	Misfiled    []string `json:"misfiled"`    //in a secondary index, but its field value files it under another key
+}
+
+// indexVerification - the verify_indexes result
+type indexVerification struct {
+	Consistent   bool         `json:"consistent"`
+	Indexes      []indexCheck `json:"indexes"`
+	Unclassified []string     `json:"unclassified"` //JSON objects that match no record type
+	Undecodable  []string     `json:"undecodable"`  //values that are not JSON at all
+}
+
+// documentSections - records the chaincode generates (quotes, credit notes, invoices, payments, ...). They have an index
+// like the ledger sections, but no init_* arguments, so they are verified and rebuilt but not exported or imported.
+var documentSections = []importSpec{quoteImportSpec, creditNoteImportSpec, invoiceImportSpec, paymentImportSpec}
+
+// secondaryIndex - the ids of the records of a section that share a field value, kept under prefix + the value
+type secondaryIndex struct {
+	section string
+	prefix  string
+	field   string
+}
+
+// secondaryIndexes - the indexes the list_*_by_* queries read, verified and rebuilt along with the section indexes
+var secondaryIndexes = []secondaryIndex{
+	{invoiceImportSpec.name, invoiceClientIndexPrefix, "client_id"},
+	{invoiceImportSpec.name, invoiceContractIndexPrefix, "contract_id"},
+	{paymentImportSpec.name, paymentClientIndexPrefix, "client_id"},
+}
+
+// docTypeField - every record the chaincode stores names its section under doc_type, see stampedRecord
+const docTypeField = "doc_type"
+
+// indexedSections - every record type that has an index
+func indexedSections() []importSpec {
+	return append(append([]importSpec{}, documentSections...), ledgerSections...)
+}
+
+// addToIndexes - append a newly generated id to each of the indexes named
+func addToIndexes(stub *shim.ChaincodeStub, id string, indexStrs ...string) error {
+	for _, indexStr := range indexStrs {
+		index, err := getIndex(stub, indexStr)
+		if err != nil {
+			return err
+		}
+		index = append(index, id)
+		indexAsBytes, _ := json.Marshal(index)
+		if err := stub.PutState(indexStr, indexAsBytes); err != nil {
+			return errors.New("Failed to add " + id + " to " + indexStr)
+		}
+	}
+	return nil
+}
+
+// scannedRecord - one key from the full state scan, classified by its fields
+type scannedRecord struct {
+	kind string
+	rec  map[string]interface{}
+}
+
+// ============================================================================================================================
+// Verify indexes - compare every domain index against the records actually stored
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_indexes(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	result, err := verifyIndexes(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+func verifyIndexes(stub *shim.ChaincodeStub) (indexVerification, error) {
+	result := indexVerification{Consistent: true, Unclassified: []string{}, Undecodable: []string{}}
+
+	scanned, undecodable, unclassified, err := scanRecords(stub)
+	if err != nil {
+		return result, err
+	}
+	result.Undecodable = append(result.Undecodable, undecodable...)
+	result.Unclassified = append(result.Unclassified, unclassified...)
+
+	for _, spec := range indexedSections() {
+		check := newIndexCheck(spec.indexStr)
+		index, err := getIndex(stub, spec.indexStr)
+		if err != nil {
+			return result, err
+		}
+		check.Entries = len(index)
+
+		seen := map[string]int{}
+		for _, id := range index {
+			seen[id]++
+			if seen[id] == 2 {
+				check.Duplicates = append(check.Duplicates, id)
+			}
+			if seen[id] > 1 {
+				continue
+			}
+			found, stored := scanned[id]
+			switch {
+			case !stored && find_id_in_index(undecodable, id):
+				check.Undecodable = append(check.Undecodable, id)
+			case !stored:
+				check.Orphaned = append(check.Orphaned, id)
+			case found.kind != spec.name:
+				check.Wrong_Type = append(check.Wrong_Type, id)
+			case spec.build == nil:
+				//documents are generated, not built from init_* arguments
+			default:
+				rows, _ := objectRows(spec.fields, nil, []map[string]interface{}{onlyFields(found.rec, spec.fields)})
+				if _, err := spec.build(rows[0]); err != nil {
+					check.Invalid = append(check.Invalid, id)
+				}
+			}
+		}
+		for _, id := range sortedKeys(scanned) {
+			if scanned[id].kind == spec.name && seen[id] == 0 {
+				check.Missing = append(check.Missing, id)
+			}
+		}
+
+		if !check.clean() {
+			result.Consistent = false
+		}
+		result.Indexes = append(result.Indexes, check)
+	}
+	for _, secondary := range secondaryIndexes {
+		checks, err := verifySecondaryIndex(stub, secondary, scanned, undecodable)
+		if err != nil {
+			return result, err
+		}
+		for _, check := range checks {
+			if !check.clean() {
+				result.Consistent = false
+			}
+			result.Indexes = append(result.Indexes, check)
+		}
+	}
+	if len(result.Undecodable)+len(result.Unclassified) > 0 {
+		result.Consistent = false
+	}
+	return result, nil
+}
+
+func newIndexCheck(index string) indexCheck {
+	return indexCheck{Index: index, Orphaned: []string{}, Duplicates: []string{}, Wrong_Type: []string{},
+		Undecodable: []string{}, Invalid: []string{}, Missing: []string{}, Misfiled: []string{}}
+}
+
+func (c indexCheck) clean() bool {
+	return len(c.Orphaned)+len(c.Duplicates)+len(c.Wrong_Type)+len(c.Undecodable)+len(c.Invalid)+len(c.Missing)+
+		len(c.Misfiled) == 0
+}
+
+// verifySecondaryIndex - one check for every key of the secondary index, the stored keys and the keys the stored
+// records call for
+func verifySecondaryIndex(stub *shim.ChaincodeStub, secondary secondaryIndex, scanned map[string]scannedRecord,
+	undecodable []string) ([]indexCheck, error) {
+	stored, err := secondaryKeys(stub, secondary)
+	if err != nil {
+		return nil, err
+	}
+	expected := secondaryEntries(secondary, scanned)
+	keys := sortedIndexKeys(stored)
+	for _, key := range sortedIndexKeys(expected) {
+		if _, ok := stored[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	checks := []indexCheck{}
+	for _, key := range keys {
+		check := newIndexCheck(key)
+		check.Entries = len(stored[key])
+		seen := map[string]int{}
+		for _, id := range stored[key] {
+			seen[id]++
+			if seen[id] == 2 {
+				check.Duplicates = append(check.Duplicates, id)
+			}
+			if seen[id] > 1 {
+				continue
+			}
+			found, ok := scanned[id]
+			switch {
+			case !ok && find_id_in_index(undecodable, id):
+				check.Undecodable = append(check.Undecodable, id)
+			case !ok:
+				check.Orphaned = append(check.Orphaned, id)
+			case found.kind != secondary.section:
+				check.Wrong_Type = append(check.Wrong_Type, id)
+			case secondary.prefix+fieldString(found.rec, secondary.field) != key:
+				check.Misfiled = append(check.Misfiled, id)
+			}
+		}
+		for _, id := range expected[key] {
+			if seen[id] == 0 {
+				check.Missing = append(check.Missing, id)
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// secondaryEntries - the sorted ids every key of the secondary index should hold, going by the stored records
+func secondaryEntries(secondary secondaryIndex, scanned map[string]scannedRecord) map[string][]string {
+	entries := map[string][]string{}
+	for _, id := range sortedKeys(scanned) {
+		if scanned[id].kind != secondary.section {
+			continue
+		}
+		if value := fieldString(scanned[id].rec, secondary.field); value != "" {
+			entries[secondary.prefix+value] = append(entries[secondary.prefix+value], id)
+		}
+	}
+	return entries
+}
+
+// secondaryKeys - the stored keys of the secondary index and the ids under each
+func secondaryKeys(stub *shim.ChaincodeStub, secondary secondaryIndex) (map[string][]string, error) {
+	iter, err := stub.RangeQueryState(secondary.prefix, prefixEnd(secondary.prefix))
+	if err != nil {
+		return nil, errors.New("Failed to scan " + secondary.prefix)
+	}
+	defer iter.Close()
+	stored := map[string][]string{}
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan " + secondary.prefix)
+		}
+		index := []string{}
+		if err := json.Unmarshal(value, &index); err != nil {
+			fmt.Println("verify: " + key + " is not a list of ids, it is rebuilt")
+		}
+		stored[key] = index
+	}
+	return stored, nil
+}
+
+// ============================================================================================================================
+// Rebuild indexes - admin only, rewrite every domain index from the records actually stored
+//
+// Each index becomes the sorted ids of the stored records of its type, so every peer builds the same index. The
+// secondary indexes, such as the invoices of each client, are rewritten the same way.
+// Records that cannot be decoded are left where they are and reported, they are never deleted.
+// ============================================================================================================================
+func (t *SimpleChaincode) rebuild_indexes(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if err := requireAdmin(stub); err != nil {
+		return nil, err
+	}
+	fmt.Println("- start rebuild indexes")
+
+	before, err := verifyIndexes(stub)
+	if err != nil {
+		return nil, err
+	}
+	scanned, _, _, err := scanRecords(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range indexedSections() {
+		index := []string{}
+		for _, id := range sortedKeys(scanned) {
+			if scanned[id].kind == spec.name {
+				index = append(index, id)
+			}
+		}
+		indexAsBytes, _ := json.Marshal(index)
+		if err := stub.PutState(spec.indexStr, indexAsBytes); err != nil {
+			return nil, errors.New("Failed to rewrite index " + spec.indexStr)
+		}
+		fmt.Println("! rebuilt " + spec.indexStr)
+	}
+	for _, secondary := range secondaryIndexes {
+		if err := rebuildSecondaryIndex(stub, secondary, scanned); err != nil {
+			return nil, err
+		}
+	}
+
+	beforeAsBytes, _ := json.Marshal(before)
+	if err := stub.SetEvent("rebuild_indexes", beforeAsBytes); err != nil {
+		fmt.Println("Failed to set rebuild_indexes event")
+	}
+	fmt.Println("- end rebuild indexes")
+	return beforeAsBytes, nil
+}
+
+// rebuildSecondaryIndex - rewrite every key of the secondary index from the stored records, keys no record calls for
+// any more are deleted
+func rebuildSecondaryIndex(stub *shim.ChaincodeStub, secondary secondaryIndex, scanned map[string]scannedRecord) error {
+	stored, err := secondaryKeys(stub, secondary)
+	if err != nil {
+		return err
+	}
+	expected := secondaryEntries(secondary, scanned)
+	for _, key := range sortedIndexKeys(stored) {
+		if _, ok := expected[key]; !ok {
+			if err := stub.DelState(key); err != nil {
+				return errors.New("Failed to delete index " + key)
+			}
+		}
+	}
+	for _, key := range sortedIndexKeys(expected) {
+		indexAsBytes, _ := json.Marshal(expected[key])
+		if err := stub.PutState(key, indexAsBytes); err != nil {
+			return errors.New("Failed to rewrite index " + key)
+		}
+	}
+	fmt.Println("! rebuilt " + secondary.prefix + "*")
+	return nil
+}
+
+// scanRecords - walk the whole key space and classify every stored JSON object.
+// Keys starting with "_" hold indexes and other bookkeeping and are skipped.
+func scanRecords(stub *shim.ChaincodeStub) (map[string]scannedRecord, []string, []string, error) {
+	scanned := map[string]scannedRecord{}
+	undecodable := []string{}
+	unclassified := []string{}
+
+	iter, err := stub.RangeQueryState("", "") //empty bounds scan the whole key space
+	if err != nil {
+		return nil, nil, nil, errors.New("Failed to scan state")
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return nil, nil, nil, errors.New("Failed to scan state")
+		}
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			undecodable = append(undecodable, key)
+			continue
+		}
+		rec, ok := decoded.(map[string]interface{})
+		if !ok {
+			continue //plain values such as the "abc" test var
+		}
+		kind := recordKind(rec)
+		if kind == "" {
+			unclassified = append(unclassified, key)
+			continue
+		}
+		scanned[key] = scannedRecord{kind, rec}
+	}
+	return scanned, undecodable, unclassified, nil
+}
+
+// recordKind - the section a stored record belongs to, as its doc_type says. A record stored before doc_type existed
+// is recognised by the kind field only its type has, and is left unclassified when it has the fields of several.
+func recordKind(rec map[string]interface{}) string {
+	if docType, ok := rec[docTypeField].(string); ok && docType != "" {
+		for _, spec := range indexedSections() {
+			if spec.name == docType {
+				return docType
+			}
+		}
+		return ""
+	}
+	kind := ""
+	for _, spec := range indexedSections() {
+		if _, ok := rec[spec.kindField]; spec.kindField != "" && ok {
+			if kind != "" {
+				return ""
+			}
+			kind = spec.name
+		}
+	}
+	return kind
+}
+
+// indexKind - the type of record an index lists
+func indexKind(indexStr string) string {
+	for _, spec := range indexedSections() {
+		if spec.indexStr == indexStr {
+			return spec.name
+		}
+	}
+	return ""
+}
+
+// onlyFields - drop fields a record type does not define, so old or extended records still validate
+func onlyFields(rec map[string]interface{}, fields []string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, f := range fields {
+		if v, ok := rec[f]; ok {
+			out[f] = v
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]scannedRecord) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedIndexKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRecordKind(t *testing.T) {
+	decode := func(doc string) map[string]interface{} {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(doc), &rec); err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+		return rec
+	}
+	tests := map[string]struct {
+		doc  string
+		want string
+	}{
+		"doc_type wins over the fields": {`{"doc_type":"clients","contract_id":"c0","username":"jo"}`, "clients"},
+		"offering":                      {`{"doc_type":"offerings","offering_id":"o1"}`, "offerings"},
+		"unknown doc_type":              {`{"doc_type":"memos","contract_id":"c0"}`, ""},
+		"legacy product":                {`{"product_id":"p1","product_description":"disk"}`, "products"},
+		"legacy contract":               {`{"contract_id":"c0","offering_id_1":"o1"}`, "contracts"},
+		"legacy pending offering":       {`{"request_id":"r1","flag":"pending"}`, "pending_offerings"},
+		"fields of two types":           {`{"contract_id":"c0","username":"jo"}`, ""},
+		"no known field":                {`{"invoice_id":"INV-1"}`, ""},
+	}
+	for name, tt := range tests {
+		if got := recordKind(decode(tt.doc)); got != tt.want {
+			t.Errorf("%s: recordKind = %q, want %q", name, got, tt.want)
+		}
+	}
+}
+
+func TestStampedRecordsCarryTheirDocType(t *testing.T) {
+	for _, spec := range indexedSections() {
+		if spec.build == nil {
+			continue
+		}
+		record, _ := spec.build(make([]string, len(spec.fields)))
+		record.setTimestamps("2016-10-01T00:00:00Z", "2016-10-01T00:00:00Z")
+		recAsBytes, _ := json.Marshal(record)
+		var rec map[string]interface{}
+		json.Unmarshal(recAsBytes, &rec)
+		if got := recordKind(rec); got != spec.name {
+			t.Errorf("a stamped %s record is recognised as %q", spec.name, got)
+		}
+	}
+}
+
+func TestOnlyFields(t *testing.T) {
+	rec := map[string]interface{}{"client_id": "cl1", "username": "jo", "doc_type": "clients", "rating": 5}
+	got := onlyFields(rec, []string{"client_id", "username", "company"})
+	if len(got) != 2 || got["client_id"] != "cl1" || got["username"] != "jo" {
+		t.Errorf("onlyFields = %v", got)
+	}
+}
+
+func TestSecondaryEntries(t *testing.T) {
+	invoice := func(client string, contract string) scannedRecord {
+		return scannedRecord{invoiceImportSpec.name, map[string]interface{}{"client_id": client, "contract_id": contract}}
+	}
+	scanned := map[string]scannedRecord{
+		"INV-s1-000002": invoice("cl1", "c1"),
+		"INV-s1-000001": invoice("cl1", "c0"),
+		"INV-s2-000001": invoice("cl2", "c2"),
+		"INV-s2-000002": invoice("", ""),
+		"c0":            {contractImportSpec.name, map[string]interface{}{"client_id": "cl1", "contract_id": "c0"}},
+	}
+	byClient := secondaryEntries(secondaryIndex{invoiceImportSpec.name, invoiceClientIndexPrefix, "client_id"}, scanned)
+	if len(byClient) != 2 {
+		t.Errorf("client keys %v, want cl1 and cl2 only", byClient)
+	}
+	if got := strings.Join(byClient[invoiceClientIndexPrefix+"cl1"], " "); got != "INV-s1-000001 INV-s1-000002" {
+		t.Errorf("invoices of cl1: %s", got)
+	}
+	byContract := secondaryEntries(secondaryIndex{invoiceImportSpec.name, invoiceContractIndexPrefix, "contract_id"}, scanned)
+	if got := strings.Join(byContract[invoiceContractIndexPrefix+"c0"], " "); got != "INV-s1-000001" {
+		t.Errorf("invoices of c0: %s, the contract itself is not an invoice", got)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var invoiceIndexStr = "_invoiceindex"
+
+// the invoices of one client and of one contract are also indexed under these prefixes followed by the id
+var invoiceClientIndexPrefix = "_invoiceindex_client_"
+var invoiceContractIndexPrefix = "_invoiceindex_contract_"
+
+// each supplier numbers its invoices from its own counter, kept under this prefix followed by the supplier id
+var invoiceSeqPrefix = "_invoiceSeq_"
+
+// invoice statuses. An issued invoice becomes paid once payments and credit notes cover its total, or void when
+// cancelled, both are final.
+const (
+	invoiceIssued = "issued"
+	invoicePaid   = "paid"
+	invoiceVoid   = "void"
+)
+
+var invoiceImportSpec = importSpec{"invoices", invoiceIndexStr, nil, "", nil, nil}
+
+var invoiceListSpec = listSpec{
+	name:          "list_invoices",
+	indexStr:      invoiceIndexStr,
+	idField:       "invoice_id",
+	currencyField: "currency",
+	startField:    "period_start",
+	endField:      "period_end",
+	clientField:   "client_id",
+	supplierField: "supplier_id",
+	statusFn:      func(rec map[string]interface{}, asOf string) string { return fieldString(rec, "status") },
+}
+
+// Invoice - the bill for one contract over one billing period, every amount in the contract currency
+type Invoice struct {
+	Invoice_ID        string           `json:"invoice_id"`
+	Invoice_Number    int              `json:"invoice_number"` //sequential per supplier
+	Supplier_ID       string           `json:"supplier_id"`
+	Client_ID         string           `json:"client_id"`
+	Contract_ID       string           `json:"contract_id"`
+	Terms_Version     int              `json:"terms_version"`        //of the contract terms in effect on Period_Start
+	Settlement        bool             `json:"settlement,omitempty"` //the final invoice of a terminated contract, it bills no period
+	Currency          string           `json:"currency"`
+	Period_Start      string           `json:"period_start"`
+	Period_End        string           `json:"period_end"`
+	Period_Days       int              `json:"period_days,omitempty"` //the full period of a period cut to the contract term
+	Issue_Date        string           `json:"issue_date"`
+	Due_Date          string           `json:"due_date"`
+	Lines             []invoiceLine    `json:"lines"`
+	Subtotal          Decimal          `json:"subtotal"`
+	Discount_Percent  Decimal          `json:"discount_percent"`
+	Discount_Amount   Decimal          `json:"discount_amount"`
+	Adjustments       []adjustmentLine `json:"adjustments"` //prorated changes of the contract terms since the last invoice
+	Adjustments_Total Decimal          `json:"adjustments_total"`
+	Total             Decimal          `json:"total"`
+	Amount_Paid       Decimal          `json:"amount_paid"`     //allocated from payments
+	Amount_Credited   Decimal          `json:"amount_credited"` //taken off by credit notes
+	Credit_Notes      []string         `json:"credit_notes"`
+	Status            string           `json:"status"`
+	Created_At        string           `json:"created_at"`
+	Updated_At        string           `json:"updated_at"`
+	Doc_Type          string           `json:"doc_type"`
+}
+
+// invoiceLine - one offering or product of the contract, billed at its flat rate per unit or from its tiers
+type invoiceLine struct {
+	Item_Type  string     `json:"item_type"` //offering or product
+	Item_ID    string     `json:"item_id"`
+	Quantity   int        `json:"quantity"`
+	Unit_Price Decimal    `json:"unit_price"`
+	Line_Total Decimal    `json:"line_total"`
+	Pricing    string     `json:"pricing,omitempty"` //graduated or volume for offerings priced from their tiers
+	Tiers      []tierBand `json:"tiers,omitempty"`
+}
+
+func (i *Invoice) setTimestamps(created_at string, updated_at string) {
+	i.Created_At, i.Updated_At, i.Doc_Type = created_at, updated_at, invoiceImportSpec.name
+}
+
+// ============================================================================================================================
+// Generate invoice - bill an active contract for a period inside its term
+//
+// Every offering and product of the contract is billed at its flat rate per unit, or from its tiers, and the contract
+// discount is taken off the subtotal. A billing period cut to the contract term bills its share of the full period by
+// day count. Adjustments prorated from changes to the contract terms are added after the discount. A period that
+// overlaps one already billed on an invoice that is not void is refused.
+// args: contract_id, period_start, period_end
+// ============================================================================================================================
+func (t *SimpleChaincode) generate_invoice(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	fmt.Println("- start generate invoice")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	periodStart, err := canonicalDate("period_start", args[1])
+	if err != nil {
+		return nil, err
+	}
+	periodEnd, err := canonicalDate("period_end", args[2])
+	if err != nil {
+		return nil, err
+	}
+	invoice, err := invoiceContract(stub, contract, periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	invoiceAsBytes, _ := json.Marshal(invoice)
+	if err := stub.SetEvent("generate_invoice", invoiceAsBytes); err != nil {
+		fmt.Println("Failed to set generate_invoice event")
+	}
+	fmt.Println("- end generate invoice")
+	return invoiceAsBytes, nil
+}
+
+// invoiceContract - bill a contract for a period in canonical dates and store the invoice, see generate_invoice
+func invoiceContract(stub *shim.ChaincodeStub, contract Contract, periodStart string, periodEnd string) (Invoice, error) {
+	if !contractInvoiced(contract.Status) {
+		return Invoice{}, errors.New("Contract " + contract.Contract_ID + " is " + contractStatus(contract.Status) + ", it cannot be invoiced")
+	}
+	if contract.Supplier_ID == "" {
+		return Invoice{}, errors.New("Contract " + contract.Contract_ID + " has no supplier to invoice from")
+	}
+	supplier, err := getSupplier(stub, contract.Supplier_ID)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if err := checkWindow("period_start", periodStart, "period_end", periodEnd); err != nil {
+		return Invoice{}, err
+	}
+	if err := checkWithin("billing period", periodStart, periodEnd, "contract term", contract.Contract_Start_Date, contract.Contract_End_Date); err != nil {
+		return Invoice{}, err
+	}
+	billed, err := contractInvoices(stub, contract.Contract_ID)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if other, ok := overlappingInvoice(billed, periodStart, periodEnd); ok {
+		return Invoice{}, errors.New("Contract " + contract.Contract_ID + " is already invoiced from " + other.Period_Start + " to " +
+			other.Period_End + " on " + other.Invoice_ID)
+	}
+	terms, err := contractTermsOn(stub, contract, periodStart)
+	if err != nil {
+		return Invoice{}, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	invoice := Invoice{
+		Supplier_ID:      contract.Supplier_ID,
+		Client_ID:        contract.Client_ID,
+		Contract_ID:      contract.Contract_ID,
+		Currency:         contract.Currency,
+		Period_Start:     periodStart,
+		Period_End:       periodEnd,
+		Issue_Date:       now.Format(dateLayout),
+		Due_Date:         now.AddDate(0, 0, supplier.Payment_Terms_Days).Format(dateLayout),
+		Lines:            []invoiceLine{},
+		Adjustments:      []adjustmentLine{},
+		Credit_Notes:     []string{},
+		Discount_Percent: terms.Discount_Percent,
+		Terms_Version:    termsVersion(terms),
+		Status:           invoiceIssued,
+	}
+	days := dayCount(periodStart, periodEnd)
+	if fullDays := fullPeriodDays(contract, periodStart, periodEnd); fullDays > days {
+		invoice.Period_Days = fullDays
+	}
+	for _, item := range contractItems(terms) {
+		line, err := itemLine(stub, terms, item, periodStart)
+		if err != nil {
+			return Invoice{}, err
+		}
+		line.Line_Total = periodShare(line.Line_Total, days, invoice.Period_Days, contract.Currency)
+		invoice.Lines = append(invoice.Lines, line)
+		invoice.Subtotal = invoice.Subtotal.Add(line.Line_Total)
+	}
+	if len(invoice.Lines) == 0 {
+		return Invoice{}, errors.New("Contract " + contract.Contract_ID + " has no offerings or products to invoice")
+	}
+	invoice.Discount_Amount = invoice.Subtotal.Percent(invoice.Discount_Percent).RoundTo(contract.Currency)
+	invoice.Total = invoice.Subtotal.Sub(invoice.Discount_Amount)
+
+	if err := numberInvoice(stub, &invoice); err != nil {
+		return Invoice{}, err
+	}
+	if err := prorateAmendments(stub, contract, &invoice, terms); err != nil {
+		return Invoice{}, err
+	}
+	if err := applyAdjustments(stub, &invoice); err != nil {
+		return Invoice{}, err
+	}
+	if err := storeInvoice(stub, &invoice); err != nil {
+		return Invoice{}, err
+	}
+	if err := addToIndexes(stub, invoice.Invoice_ID, invoiceIndexStr, invoiceClientIndexPrefix+invoice.Client_ID,
+		invoiceContractIndexPrefix+invoice.Contract_ID); err != nil {
+		return Invoice{}, err
+	}
+	return invoice, nil
+}
+
+// overlappingInvoice - the first of a contract's invoices that bills a day of the period, void invoices and the
+// settlement invoice of a terminated contract bill none
+func overlappingInvoice(billed []Invoice, periodStart string, periodEnd string) (Invoice, bool) {
+	for _, other := range billed {
+		if other.Status != invoiceVoid && !other.Settlement && other.Period_Start <= periodEnd && periodStart <= other.Period_End {
+			return other, true
+		}
+	}
+	return Invoice{}, false
+}
+
+// numberInvoice - give an invoice the next free number of its supplier
+func numberInvoice(stub *shim.ChaincodeStub, invoice *Invoice) error {
+	number, id, err := nextFreeId(stub, invoiceSeqPrefix+invoice.Supplier_ID, "INV-"+invoice.Supplier_ID+"-")
+	if err != nil {
+		return err
+	}
+	invoice.Invoice_Number, invoice.Invoice_ID = number, id
+	return nil
+}
+
+// applyAdjustments - add the contract's pending adjustments to an invoice. Credits that take the invoice below zero
+// are carried forward to the next invoice.
+func applyAdjustments(stub *shim.ChaincodeStub, invoice *Invoice) error {
+	adjustments, err := takeAdjustments(stub, invoice.Contract_ID)
+	if err != nil {
+		return err
+	}
+	for _, line := range adjustments {
+		invoice.Adjustments = append(invoice.Adjustments, line)
+		invoice.Adjustments_Total = invoice.Adjustments_Total.Add(line.Amount)
+	}
+	invoice.Total = invoice.Total.Add(invoice.Adjustments_Total)
+	if invoice.Total.Sign() < 0 {
+		carried := adjustmentLine{Invoice_ID: invoice.Invoice_ID, Item_Type: "carried", Amount: invoice.Total,
+			Reason: "credit carried forward from " + invoice.Invoice_ID}
+		if err := putAdjustments(stub, invoice.Contract_ID, []adjustmentLine{carried}); err != nil {
+			return err
+		}
+		carried.Amount, carried.Reason = invoice.Total.Neg(), "credit carried forward to the next invoice"
+		invoice.Adjustments = append(invoice.Adjustments, carried)
+		invoice.Adjustments_Total = invoice.Adjustments_Total.Add(carried.Amount)
+		invoice.Total = Decimal{}
+	}
+	if invoice.Total.IsZero() {
+		invoice.Status = invoicePaid //nothing to pay
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Void invoice - cancel an issued invoice. Nothing is deleted: a credit note for what is left of the invoice is issued
+// and its billing period can be invoiced again.
+//
+// args: invoice_id, optional reason
+// ============================================================================================================================
+func (t *SimpleChaincode) void_invoice(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting invoice_id and optional reason")
+	}
+	fmt.Println("- start void invoice")
+	invoice, err := getInvoice(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status != invoiceIssued {
+		return nil, errors.New("Invoice " + args[0] + " is " + invoice.Status + ", only issued invoices can be voided")
+	}
+	if !invoice.Amount_Paid.IsZero() {
+		return nil, errors.New("Invoice " + args[0] + " has " + invoice.Amount_Paid.String() + " " + invoice.Currency + " of payments allocated to it")
+	}
+	reason := "invoice " + args[0] + " voided"
+	if len(args) == 2 && args[1] != "" {
+		reason = args[1]
+	}
+	note, err := creditInvoice(stub, &invoice, reason, nil)
+	if err != nil {
+		return nil, err
+	}
+	invoice.Status = invoiceVoid
+	if err := storeInvoice(stub, &invoice); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "status", invoiceIssued, invoiceVoid); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end void invoice")
+	return json.Marshal(note)
+}
+
+// ============================================================================================================================
+// Get invoice - one invoice by id
+//
+// args: invoice_id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_invoice(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	invoice, err := getInvoice(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(invoice)
+}
+
+// ============================================================================================================================
+// List invoices by client / by contract - read through the client and contract indexes, with the optional filter
+// JSON of the other list_* queries for status, dates, sorting and paging
+//
+// args: client_id or contract_id, optional filter JSON
+// ============================================================================================================================
+func (t *SimpleChaincode) list_invoices_by_client(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_invoices_under(stub, args, invoiceClientIndexPrefix, "client_id")
+}
+
+func (t *SimpleChaincode) list_invoices_by_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_invoices_under(stub, args, invoiceContractIndexPrefix, "contract_id")
+}
+
+func (t *SimpleChaincode) list_invoices_under(stub *shim.ChaincodeStub, args []string, prefix string, name string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting " + name + " and optional filter JSON")
+	}
+	if err := requireArgs(args, 1); err != nil {
+		return nil, err
+	}
+	filter, err := parseFilter(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	spec := invoiceListSpec
+	spec.indexStr = prefix + args[0]
+	return t.list_filtered(stub, spec, filter)
+}
+
+// contractInvoices - the invoices of a contract, through the contract index
+func contractInvoices(stub *shim.ChaincodeStub, contractId string) ([]Invoice, error) {
+	index, err := getIndex(stub, invoiceContractIndexPrefix+contractId)
+	if err != nil {
+		return nil, err
+	}
+	invoices := []Invoice{}
+	for _, id := range index {
+		invoice, err := getInvoice(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, nil
+}
+
+// outstanding - what is still owed on an issued invoice, nothing for paid and void ones
+func (i Invoice) outstanding() Decimal {
+	owed := i.Total.Sub(i.Amount_Paid).Sub(i.Amount_Credited)
+	if i.Status != invoiceIssued || owed.Sign() < 0 {
+		return Decimal{}
+	}
+	return owed
+}
+
+// overpaid - what payments and credit notes cover beyond the invoice total, the client's to use elsewhere
+func (i Invoice) overpaid() Decimal {
+	over := i.Amount_Paid.Add(i.Amount_Credited).Sub(i.Total)
+	if over.Sign() < 0 {
+		return Decimal{}
+	}
+	return over
+}
+
+func getInvoice(stub *shim.ChaincodeStub, id string) (Invoice, error) {
+	var invoice Invoice
+	if _, ok := loadRecord(stub, id, invoiceImportSpec.name); !ok {
+		return invoice, errors.New("NOT_FOUND: invoice " + id)
+	}
+	invoiceAsBytes, _ := stub.GetState(id)
+	if err := json.Unmarshal(invoiceAsBytes, &invoice); err != nil {
+		return invoice, errors.New("Failed to decode " + id)
+	}
+	return invoice, nil
+}
+
+func storeInvoice(stub *shim.ChaincodeStub, invoice *Invoice) error {
+	if err := stampRecord(stub, invoice.Invoice_ID, invoice); err != nil {
+		return err
+	}
+	invoiceAsBytes, _ := json.Marshal(invoice)
+	if err := stub.PutState(invoice.Invoice_ID, invoiceAsBytes); err != nil {
+		return errors.New("Failed to store " + invoice.Invoice_ID)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOverlappingInvoice(t *testing.T) {
+	billed := []Invoice{
+		{Invoice_ID: "INV-s1-000001", Period_Start: "2016-01-01", Period_End: "2016-01-31", Status: invoicePaid},
+		{Invoice_ID: "INV-s1-000002", Period_Start: "2016-02-01", Period_End: "2016-02-29", Status: invoiceVoid},
+		{Invoice_ID: "INV-s1-000003", Period_Start: "2016-03-01", Period_End: "2016-03-31", Status: invoiceIssued},
+	}
+
+	if other, ok := overlappingInvoice(billed, "2016-01-31", "2016-02-14"); !ok || other.Invoice_ID != "INV-s1-000001" {
+		t.Errorf("sharing the last day of January: %v %v, want INV-s1-000001", other.Invoice_ID, ok)
+	}
+	if other, ok := overlappingInvoice(billed, "2015-12-01", "2016-12-31"); !ok || other.Invoice_ID != "INV-s1-000001" {
+		t.Errorf("a period around every invoice: %v %v, want the first one reported", other.Invoice_ID, ok)
+	}
+	if other, ok := overlappingInvoice(billed, "2016-02-01", "2016-02-29"); ok {
+		t.Errorf("February is only on a void invoice but clashes with %s", other.Invoice_ID)
+	}
+	if _, ok := overlappingInvoice(billed, "2016-04-01", "2016-04-30"); ok {
+		t.Error("April clashes with nothing")
+	}
+	if _, ok := overlappingInvoice(nil, "2016-01-01", "2016-01-31"); ok {
+		t.Error("a contract with no invoices")
+	}
+}
+
+func TestContractItems(t *testing.T) {
+	contract := Contract{
+		Offering_ID_2: "o2", Flat_Off_Rate_2: mustDecimal(t, "80"),
+		Product_Id_1: "p1", Flat_Prod_Rate_1: mustDecimal(t, "9.5"),
+		Product_Id_6: "p6", Flat_Prod_Rate_6: mustDecimal(t, "1.25"),
+	}
+	items := contractItems(contract)
+	want := []struct{ itemType, id, rate string }{{"offering", "o2", "80"}, {"product", "p1", "9.5"}, {"product", "p6", "1.25"}}
+	if len(items) != len(want) {
+		t.Fatalf("items = %+v, want the offering then the two products", items)
+	}
+	for i, w := range want {
+		if items[i].itemType != w.itemType || items[i].id != w.id || items[i].rate.Cmp(mustDecimal(t, w.rate)) != 0 {
+			t.Errorf("item %d = %+v, want %v", i, items[i], w)
+		}
+	}
+	if items := contractItems(Contract{}); len(items) != 0 {
+		t.Errorf("an empty contract bills %+v", items)
+	}
+}
+
+func TestInvoiceJSONKeepsAmountsExact(t *testing.T) {
+	invoice := Invoice{Invoice_ID: "INV-s1-000001", Currency: "USD", Subtotal: mustDecimal(t, "0.30"),
+		Total: mustDecimal(t, "0.30"), Lines: []invoiceLine{}}
+	invoiceAsBytes, _ := json.Marshal(invoice)
+	var back Invoice
+	if err := json.Unmarshal(invoiceAsBytes, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Total.String() != "0.30" || back.Subtotal.Cmp(invoice.Subtotal) != 0 {
+		t.Errorf("round trip total %s from %s", back.Total, invoiceAsBytes)
+	}
+}
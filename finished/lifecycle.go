@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// product lifecycle states. A new product starts as a draft, products stored before the lifecycle existed are active.
+const (
+	productDraft        = "draft"
+	productActive       = "active"
+	productSuspended    = "suspended"
+	productDiscontinued = "discontinued"
+	productRetired      = "retired"
+)
+
+var productStatuses = []string{productDraft, productActive, productSuspended, productDiscontinued, productRetired}
+
+// productTransitions - the states a product may move to from each state
+var productTransitions = map[string][]string{
+	productDraft:        {productActive, productRetired},
+	productActive:       {productSuspended, productDiscontinued},
+	productSuspended:    {productActive, productDiscontinued},
+	productDiscontinued: {productRetired},
+	productRetired:      {},
+}
+
+// productReferences - offerings and live contracts that still use a product
+type productReferences struct {
+	Offerings []string `json:"offerings"`
+	Contracts []string `json:"contracts"`
+}
+
+// productTransition - the result of a lifecycle invoke, also sent as the "product_status" event
+type productTransition struct {
+	Product_ID string             `json:"product_id"`
+	From       string             `json:"from"`
+	To         string             `json:"to"`
+	Warnings   *productReferences `json:"warnings,omitempty"`
+}
+
+// ============================================================================================================================
+// Product lifecycle - move a product through draft, active, suspended, discontinued and retired
+//
+// args: product_id
+// ============================================================================================================================
+func (t *SimpleChaincode) activate_product(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.transition_product(stub, args, productActive)
+}
+
+func (t *SimpleChaincode) suspend_product(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.transition_product(stub, args, productSuspended)
+}
+
+// discontinue_product - the result warns about the offerings and contracts that still refer to the product
+func (t *SimpleChaincode) discontinue_product(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.transition_product(stub, args, productDiscontinued)
+}
+
+func (t *SimpleChaincode) retire_product(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.transition_product(stub, args, productRetired)
+}
+
+func (t *SimpleChaincode) transition_product(stub *shim.ChaincodeStub, args []string, to string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	fmt.Println("- start " + to + " product")
+	product, err := getProduct(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	from := productStatus(product.Status)
+	if !find_id_in_index(productTransitions[from], to) {
+		return nil, errors.New("Product " + args[0] + " is " + from + " and cannot become " + to)
+	}
+	result := productTransition{Product_ID: args[0], From: from, To: to}
+	if to == productDiscontinued {
+		refs, err := findProductReferences(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		result.Warnings = &refs
+		if len(refs.Offerings)+len(refs.Contracts) > 0 {
+			fmt.Println("! " + args[0] + " is still used by offerings " + strings.Join(refs.Offerings, ", ") +
+				" and contracts " + strings.Join(refs.Contracts, ", "))
+		}
+	}
+
+	product.Status = to
+	if err := storePricedRecord(stub, args[0], product); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "status", from, to); err != nil {
+		return nil, err
+	}
+	resultAsBytes, _ := json.Marshal(result)
+	if err := stub.SetEvent("product_status", resultAsBytes); err != nil {
+		fmt.Println("Failed to set product_status event")
+	}
+	fmt.Println("- end " + to + " product")
+	return resultAsBytes, nil
+}
+
+// getProduct - load a product, refusing keys that hold anything else
+func getProduct(stub *shim.ChaincodeStub, id string) (*Product, error) {
+	rec, err := getPricedRecord(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	product, ok := rec.(*Product)
+	if !ok {
+		return nil, errors.New(id + " is not a product")
+	}
+	return product, nil
+}
+
+// productStatus - the lifecycle state of a stored status, empty for products stored before the lifecycle existed
+func productStatus(status string) string {
+	if status == "" {
+		return productActive
+	}
+	return status
+}
+
+// settleProductStatus - init_product and bulk imports never change the lifecycle state: a product that is already
+// stored keeps its state and a new one starts as a draft. A restore keeps the state from the dump.
+func settleProductStatus(stub *shim.ChaincodeStub, id string, product *Product, restoring bool) error {
+	if restoring {
+		product.Status = productStatus(product.Status)
+		if !find_id_in_index(productStatuses, product.Status) {
+			return errors.New("status must be one of " + strings.Join(productStatuses, ", "))
+		}
+		return nil
+	}
+	product.Status = productDraft
+	if stored, err := getProduct(stub, id); err == nil {
+		product.Status = productStatus(stored.Status)
+	}
+	return nil
+}
+
+// findProductReferences - offerings that bundle the product, and contracts not yet expired that name the product
+// directly or through one of those offerings
+func findProductReferences(stub *shim.ChaincodeStub, id string) (productReferences, error) {
+	refs := productReferences{Offerings: []string{}, Contracts: []string{}}
+	today, err := txDate(stub)
+	if err != nil {
+		return refs, err
+	}
+	offeringIndex, err := getIndex(stub, offeringIndexStr)
+	if err != nil {
+		return refs, err
+	}
+	for _, offeringId := range offeringIndex {
+		offering, ok := loadRecord(stub, offeringId, offeringImportSpec.name)
+		if ok && (fieldString(offering, "product_id_01") == id || fieldString(offering, "product_id_02") == id) {
+			refs.Offerings = appendUnique(refs.Offerings, offeringId)
+		}
+	}
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return refs, err
+	}
+	for _, contractId := range contractIndex {
+		contract, ok := loadRecord(stub, contractId, contractImportSpec.name)
+		if !ok || contractWindowStatus(contract, today) == "expired" {
+			continue
+		}
+		for i := 1; i <= 6; i++ {
+			if fieldString(contract, "product_id_"+strconv.Itoa(i)) == id {
+				refs.Contracts = appendUnique(refs.Contracts, contractId)
+			}
+		}
+		for i := 1; i <= 4; i++ {
+			if find_id_in_index(refs.Offerings, fieldString(contract, "offering_id_"+strconv.Itoa(i))) {
+				refs.Contracts = appendUnique(refs.Contracts, contractId)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// productLifecycleStatus - the list_products status filter matches the lifecycle state
+func productLifecycleStatus(rec map[string]interface{}, asOf string) string {
+	return productStatus(fieldString(rec, "status"))
+}
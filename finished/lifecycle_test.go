@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestProductTransitions(t *testing.T) {
+	allowed := func(from, to string) bool { return find_id_in_index(productTransitions[productStatus(from)], to) }
+
+	// the whole life of a product, with a suspension on the way
+	path := []string{productDraft, productActive, productSuspended, productActive, productDiscontinued, productRetired}
+	for i := 1; i < len(path); i++ {
+		if !allowed(path[i-1], path[i]) {
+			t.Errorf("%s -> %s refused", path[i-1], path[i])
+		}
+	}
+	if !allowed(productDraft, productRetired) {
+		t.Error("a draft that never went live cannot be retired")
+	}
+	if !allowed("", productSuspended) {
+		t.Error("a product stored before the lifecycle is not treated as active")
+	}
+
+	for _, refused := range [][2]string{
+		{productDraft, productSuspended},
+		{productActive, productRetired},
+		{productDiscontinued, productActive},
+		{productRetired, productActive},
+		{productRetired, productDraft},
+		{productActive, productActive},
+	} {
+		if allowed(refused[0], refused[1]) {
+			t.Errorf("%s -> %s allowed", refused[0], refused[1])
+		}
+	}
+	for _, status := range productStatuses {
+		if _, ok := productTransitions[status]; !ok {
+			t.Errorf("no transitions listed for %s", status)
+		}
+	}
+}
+
+func TestRestoredProductStatus(t *testing.T) {
+	product := Product{}
+	if err := settleProductStatus(nil, "p1", &product, true); err != nil || product.Status != productActive {
+		t.Errorf("restored without a status: %q, %v, want active", product.Status, err)
+	}
+	product.Status = productSuspended
+	if err := settleProductStatus(nil, "p1", &product, true); err != nil || product.Status != productSuspended {
+		t.Errorf("restored suspended: %q, %v", product.Status, err)
+	}
+	product.Status = "archived"
+	if err := settleProductStatus(nil, "p1", &product, true); err == nil {
+		t.Error("restored an unknown status")
+	}
+}
+
+func TestListProductsHidesUnavailable(t *testing.T) {
+	rec := map[string]interface{}{"product_id": "p1", "status": "suspended",
+		"availability_start_date": "2016-03-01", "availability_end_date": "2016-09-30"}
+	list := func(doc, asOf string) bool {
+		filter, err := parseFilter([]string{doc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matchesFilter(productListSpec, filter, rec, asOf)
+	}
+	if !list(`{}`, "2016-03-01") || !list(`{}`, "2016-09-30") {
+		t.Error("hidden on the first or last day of its window")
+	}
+	if list(`{}`, "2016-02-29") || list(`{}`, "2016-10-01") {
+		t.Error("shown outside its window")
+	}
+	if !list(`{"include_unavailable":true}`, "2016-10-01") {
+		t.Error("include_unavailable did not show it")
+	}
+	if !list(`{"status":"suspended"}`, "2016-06-01") || list(`{"status":"active"}`, "2016-06-01") {
+		t.Error("the status filter does not follow the lifecycle state")
+	}
+	delete(rec, "status")
+	if productLifecycleStatus(rec, "2016-06-01") != productActive {
+		t.Error("a product without a status is not listed as active")
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const defaultPageSize = 20
+const maxPageSize = 200
+
+// listFilter - the optional JSON argument accepted by the list_* queries
+//
+//	{"category": "hardware", "currency": "USD", "min_price": 10, "max_price": 500,
+//	 "available_from": "2016-09-01", "available_to": "2016-12-31",
+//	 "sort": "-list_price", "page_size": 50, "bookmark": "..."}
+//
+// available_from/available_to keep records whose availability window (contract term for contracts) overlaps them,
+// start_from/start_to and end_from/end_to bound the start and end dates of that window. All dates are YYYY-MM-DD.
+// sort takes the json name of any field of the record, prefixed with "-" for descending order.
+// convert_to adds a converted_price to every product or offering, the price in that currency with the exchange rate
+// in force on as_of (default today); min_price/max_price then compare the converted price.
+// list_products only shows products available on as_of unless include_unavailable is true, and its status filter
+// matches the product lifecycle state.
+// bookmark is the opaque continuation token returned with the previous page.
+type listFilter struct {
+	Category            string   `json:"category"`
+	Currency            string   `json:"currency"`
+	User_Type           string   `json:"user_type"`
+	Min_Price           *Decimal `json:"min_price"`
+	Max_Price           *Decimal `json:"max_price"`
+	Available_From      string   `json:"available_from"`
+	Available_To        string   `json:"available_to"`
+	Start_From          string   `json:"start_from"`
+	Start_To            string   `json:"start_to"`
+	End_From            string   `json:"end_from"`
+	End_To              string   `json:"end_to"`
+	Client_ID           string   `json:"client_id"`
+	Supplier_ID         string   `json:"supplier_id"`
+	Convert_To          string   `json:"convert_to"`
+	Include_Unavailable bool     `json:"include_unavailable"`
+	Status              string   `json:"status"`
+	As_Of               string   `json:"as_of"`
+	Sort                string   `json:"sort"`
+	Page_Size           int      `json:"page_size"`
+	Bookmark            string   `json:"bookmark"`
+}
+
+// listPage - one page of records returned by the list_* queries
+type listPage struct {
+	Records  []map[string]interface{} `json:"records"`
+	Count    int                      `json:"count"`
+	Bookmark string                   `json:"bookmark"`
+}
+
+// listSpec - describes how the filters map onto the fields of one record type.
+// An empty field name means the record type does not support that filter.
+type listSpec struct {
+	name          string
+	indexStr      string
+	idField       string
+	categoryField string
+	currencyField string
+	userTypeField string
+	priceField    string
+	startField    string
+	endField      string
+	clientField   string
+	supplierField string
+	statusFn      func(rec map[string]interface{}, asOf string) string
+	availability  bool //records outside their availability window on as_of are hidden unless include_unavailable is set
+}
+
+var productListSpec = listSpec{
+	name:          "list_products",
+	indexStr:      productIndexStr,
+	idField:       "product_id",
+	categoryField: "category",
+	currencyField: "currency",
+	userTypeField: "user_type",
+	priceField:    "list_price",
+	startField:    "availability_start_date",
+	endField:      "availability_end_date",
+	statusFn:      productLifecycleStatus,
+	availability:  true,
+}
+
+var offeringListSpec = listSpec{
+	name:          "list_offerings",
+	indexStr:      offeringIndexStr,
+	idField:       "offering_id",
+	categoryField: "offering_category",
+	currencyField: "currency",
+	priceField:    "current_list_price",
+	startField:    "availability_start_date",
+	endField:      "availability_end_date",
+}
+
+var contractListSpec = listSpec{
+	name:          "list_contracts",
+	indexStr:      contractIndexStr,
+	idField:       "contract_id",
+	currencyField: "currency",
+	startField:    "contract_start_date",
+	endField:      "contract_end_date",
+	clientField:   "client_id",
+	supplierField: "supplier_id",
+	statusFn:      contractListStatus,
+}
+
+var clientListSpec = listSpec{
+	name:     "list_clients",
+	indexStr: clientIndexStr,
+	idField:  "client_id",
+}
+
+// ============================================================================================================================
+// List queries - full records from an index, filtered, sorted and paginated
+// ============================================================================================================================
+func (t *SimpleChaincode) list_products(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_records(stub, productListSpec, args)
+}
+
+func (t *SimpleChaincode) list_offerings(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_records(stub, offeringListSpec, args)
+}
+
+func (t *SimpleChaincode) list_contracts(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_records(stub, contractListSpec, args)
+}
+
+func (t *SimpleChaincode) list_clients(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	page, err := t.list_page(stub, clientListSpec, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range page.Records {
+		delete(rec, "password") //never hand out client passwords in bulk
+	}
+	return json.Marshal(page)
+}
+
+func (t *SimpleChaincode) list_records(stub *shim.ChaincodeStub, spec listSpec, args []string) ([]byte, error) {
+	page, err := t.list_page(stub, spec, args)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(page)
+}
+
+func (t *SimpleChaincode) list_page(stub *shim.ChaincodeStub, spec listSpec, args []string) (listPage, error) {
+	filter, err := parseFilter(args)
+	if err != nil {
+		return listPage{}, err
+	}
+	return t.filtered_page(stub, spec, filter)
+}
+
+// parseFilter - the optional filter JSON argument
+func parseFilter(args []string) (listFilter, error) {
+	filter := listFilter{}
+	if len(args) > 1 {
+		return filter, errors.New("Incorrect number of arguments. Expecting 0 or 1 (filter JSON)")
+	}
+	if len(args) == 1 && len(strings.TrimSpace(args[0])) > 0 {
+		if err := json.Unmarshal([]byte(args[0]), &filter); err != nil {
+			return filter, errors.New("Filter argument must be a JSON object")
+		}
+	}
+	return filter, nil
+}
+
+func (t *SimpleChaincode) filtered_page(stub *shim.ChaincodeStub, spec listSpec, filter listFilter) (listPage, error) {
+	var page listPage
+
+	if err := checkFilter(spec, filter); err != nil {
+		return page, err
+	}
+	if err := filterDates(&filter); err != nil {
+		return page, err
+	}
+	if filter.Convert_To != "" {
+		currency, err := currencyCode(filter.Convert_To)
+		if err != nil {
+			return page, err
+		}
+		filter.Convert_To = currency
+	}
+
+	offset, err := decodeBookmark(filter.Bookmark)
+	if err != nil {
+		return page, err
+	}
+	pageSize := filter.Page_Size
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	asOf := filter.As_Of
+	if asOf == "" {
+		if asOf, err = txDate(stub); err != nil {
+			return page, err
+		}
+	}
+
+	index, err := getIndex(stub, spec.indexStr)
+	if err != nil {
+		return page, err
+	}
+
+	v := currentViewer(stub)
+
+	var matches []map[string]interface{}
+	for _, id := range index {
+		recAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return page, errors.New("Failed to get state for " + id)
+		}
+		if recAsBytes == nil {
+			fmt.Println(spec.name + ": " + id + " is in the index but has no record")
+			continue
+		}
+		var rec map[string]interface{}
+		if err := json.Unmarshal(recAsBytes, &rec); err != nil {
+			fmt.Println(spec.name + ": skipping undecodable record " + id)
+			continue
+		}
+		if kind := indexKind(spec.indexStr); kind != "" && recordKind(rec) != kind {
+			fmt.Println(spec.name + ": skipping " + id + ", it holds another type of record")
+			continue
+		}
+		if !v.canSee(rec) {
+			continue //hidden from the caller's user type
+		}
+		if filter.Convert_To != "" {
+			if err := addConvertedPrice(stub, spec, rec, filter.Convert_To, asOf); err != nil {
+				return page, errors.New(id + ": " + err.Error())
+			}
+		}
+		if matchesFilter(spec, filter, rec, asOf) {
+			matches = append(matches, rec)
+		}
+	}
+
+	sortField, desc := spec.idField, false
+	if filter.Sort != "" {
+		sortField = strings.TrimPrefix(filter.Sort, "-")
+		desc = strings.HasPrefix(filter.Sort, "-")
+	}
+	sort.Stable(recordSorter{matches, sortField, spec.idField, desc})
+	return pageOf(matches, offset, pageSize), nil
+}
+
+// pageOf - pageSize of the sorted matches from offset on, with the bookmark of the next page while there is one
+func pageOf(matches []map[string]interface{}, offset int, pageSize int) listPage {
+	page := listPage{Count: len(matches), Records: []map[string]interface{}{}}
+	if offset < len(matches) {
+		end := offset + pageSize
+		if end > len(matches) {
+			end = len(matches)
+		}
+		page.Records = matches[offset:end]
+		if end < len(matches) {
+			page.Bookmark = encodeBookmark(end)
+		}
+	}
+	return page
+}
+
+// checkFilter - refuse filters the record type has no field for, rather than silently ignoring them
+func checkFilter(spec listSpec, f listFilter) error {
+	unsupported := func(name string) error {
+		return errors.New(name + " filter is not supported by " + spec.name)
+	}
+	if f.Category != "" && spec.categoryField == "" {
+		return unsupported("category")
+	}
+	if f.Currency != "" && spec.currencyField == "" {
+		return unsupported("currency")
+	}
+	if f.User_Type != "" && spec.userTypeField == "" {
+		return unsupported("user_type")
+	}
+	if (f.Min_Price != nil || f.Max_Price != nil) && spec.priceField == "" {
+		return unsupported("price")
+	}
+	if dateFiltered(f) && spec.startField == "" {
+		return unsupported("date")
+	}
+	if f.Client_ID != "" && spec.clientField == "" {
+		return unsupported("client_id")
+	}
+	if f.Supplier_ID != "" && spec.supplierField == "" {
+		return unsupported("supplier_id")
+	}
+	if f.Convert_To != "" && spec.priceField == "" {
+		return unsupported("convert_to")
+	}
+	if f.Include_Unavailable && !spec.availability {
+		return unsupported("include_unavailable")
+	}
+	if f.Status != "" && spec.statusFn == nil {
+		return unsupported("status")
+	}
+	return nil
+}
+
+func matchesFilter(spec listSpec, f listFilter, rec map[string]interface{}, asOf string) bool {
+	if f.Category != "" && !strings.EqualFold(fieldString(rec, spec.categoryField), f.Category) {
+		return false
+	}
+	if f.Currency != "" && !strings.EqualFold(fieldString(rec, spec.currencyField), f.Currency) {
+		return false
+	}
+	if f.User_Type != "" && !strings.EqualFold(fieldString(rec, spec.userTypeField), f.User_Type) {
+		return false
+	}
+	if f.Client_ID != "" && fieldString(rec, spec.clientField) != f.Client_ID {
+		return false
+	}
+	if f.Supplier_ID != "" && fieldString(rec, spec.supplierField) != f.Supplier_ID {
+		return false
+	}
+	if spec.availability && !f.Include_Unavailable {
+		start, startOk := recordDate(rec, spec.startField)
+		end, endOk := recordDate(rec, spec.endField)
+		if (startOk && asOf < start) || (endOk && asOf > end) {
+			return false
+		}
+	}
+	if f.Min_Price != nil || f.Max_Price != nil {
+		priceRec, priceField := rec, spec.priceField
+		if converted, ok := rec["converted_price"].(map[string]interface{}); ok {
+			priceRec, priceField = converted, "amount"
+		}
+		price, ok := fieldDecimal(priceRec, priceField)
+		if !ok {
+			return false
+		}
+		if f.Min_Price != nil && price.Cmp(*f.Min_Price) < 0 {
+			return false
+		}
+		if f.Max_Price != nil && price.Cmp(*f.Max_Price) > 0 {
+			return false
+		}
+	}
+	if dateFiltered(f) {
+		start, startOk := recordDate(rec, spec.startField)
+		end, endOk := recordDate(rec, spec.endField)
+		if !startOk || !endOk {
+			return false
+		}
+		// keep the record when its window overlaps the requested one
+		if f.Available_To != "" && start > f.Available_To {
+			return false
+		}
+		if f.Available_From != "" && end < f.Available_From {
+			return false
+		}
+		if (f.Start_From != "" && start < f.Start_From) || (f.Start_To != "" && start > f.Start_To) {
+			return false
+		}
+		if (f.End_From != "" && end < f.End_From) || (f.End_To != "" && end > f.End_To) {
+			return false
+		}
+	}
+	if f.Status != "" && !strings.EqualFold(spec.statusFn(rec, asOf), f.Status) {
+		return false
+	}
+	return true
+}
+
+// contractWindowStatus - pending, active or expired depending on where asOf falls in the contract term
+func contractWindowStatus(rec map[string]interface{}, asOf string) string {
+	start, startOk := recordDate(rec, "contract_start_date")
+	end, endOk := recordDate(rec, "contract_end_date")
+	if startOk && asOf < start {
+		return "pending"
+	}
+	if endOk && asOf > end {
+		return "expired"
+	}
+	return "active"
+}
+
+func dateFiltered(f listFilter) bool {
+	return f.Available_From != "" || f.Available_To != "" || f.Start_From != "" || f.Start_To != "" || f.End_From != "" || f.End_To != ""
+}
+
+// filterDates - validate the date filters and bring them into the canonical layout so they compare as strings
+func filterDates(f *listFilter) error {
+	dates := []struct {
+		name  string
+		value *string
+	}{
+		{"available_from", &f.Available_From}, {"available_to", &f.Available_To},
+		{"start_from", &f.Start_From}, {"start_to", &f.Start_To},
+		{"end_from", &f.End_From}, {"end_to", &f.End_To},
+		{"as_of", &f.As_Of},
+	}
+	for _, d := range dates {
+		if *d.value == "" {
+			continue
+		}
+		canonical, err := canonicalDate(d.name, *d.value)
+		if err != nil {
+			return err
+		}
+		*d.value = canonical
+	}
+	return nil
+}
+
+// recordDate - a date field of a stored record in the canonical layout, false when missing or not a date
+func recordDate(rec map[string]interface{}, field string) (string, bool) {
+	d, err := parseDate(fieldString(rec, field))
+	if err != nil {
+		return "", false
+	}
+	return d.Format(dateLayout), true
+}
+
+func fieldString(rec map[string]interface{}, field string) string {
+	switch v := rec[field].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// fieldDecimal - amounts are stored as decimal strings, records written before Decimal existed hold JSON numbers
+func fieldDecimal(rec map[string]interface{}, field string) (Decimal, bool) {
+	d, err := ParseDecimal(fieldString(rec, field))
+	return d, err == nil
+}
+
+// addConvertedPrice - attach the record's price converted into currency, and the rate used, as converted_price
+func addConvertedPrice(stub *shim.ChaincodeStub, spec listSpec, rec map[string]interface{}, currency string, date string) error {
+	price, ok := fieldDecimal(rec, spec.priceField)
+	if !ok {
+		return errors.New("no " + spec.priceField + " to convert")
+	}
+	from, err := currencyCode(fieldString(rec, spec.currencyField))
+	if err != nil {
+		return err
+	}
+	conversion, err := convertAmount(stub, price, from, currency, date)
+	if err != nil {
+		return err
+	}
+	conversionAsBytes, _ := json.Marshal(conversion)
+	var converted map[string]interface{}
+	json.Unmarshal(conversionAsBytes, &converted)
+	rec["converted_price"] = converted
+	return nil
+}
+
+// recordSorter - orders records on one field, falling back to the id so pages are stable
+type recordSorter struct {
+	records []map[string]interface{}
+	field   string
+	idField string
+	desc    bool
+}
+
+func (s recordSorter) Len() int      { return len(s.records) }
+func (s recordSorter) Swap(i, j int) { s.records[i], s.records[j] = s.records[j], s.records[i] }
+func (s recordSorter) Less(i, j int) bool {
+	c := compareField(s.records[i], s.records[j], s.field)
+	if c == 0 {
+		c = compareField(s.records[i], s.records[j], s.idField)
+	}
+	if s.desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+func compareField(a, b map[string]interface{}, field string) int {
+	an, aok := fieldDecimal(a, field)
+	bn, bok := fieldDecimal(b, field)
+	if aok && bok {
+		return an.Cmp(bn)
+	}
+	return strings.Compare(fieldString(a, field), fieldString(b, field))
+}
+
+// bookmarks are just the offset of the next record, kept opaque so the format can change
+func encodeBookmark(offset int) string {
+	return base64.URLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+func decodeBookmark(bookmark string) (int, error) {
+	if bookmark == "" {
+		return 0, nil
+	}
+	raw, err := base64.URLEncoding.DecodeString(bookmark)
+	if err != nil || !strings.HasPrefix(string(raw), "o:") {
+		return 0, errors.New("Invalid bookmark")
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(raw), "o:"))
+	if err != nil || offset < 0 {
+		return 0, errors.New("Invalid bookmark")
+	}
+	return offset, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	filter, err := parseFilter([]string{`{"category":"hardware","min_price":10,"sort":"-list_price","page_size":5}`})
+	if err != nil {
+		t.Fatalf("parseFilter: %v", err)
+	}
+	if filter.Category != "hardware" || filter.Min_Price == nil || filter.Max_Price != nil || filter.Sort != "-list_price" ||
+		filter.Page_Size != 5 {
+		t.Errorf("parseFilter = %+v", filter)
+	}
+	for _, args := range [][]string{nil, {""}, {"  "}} {
+		if filter, err := parseFilter(args); err != nil || filter.Category != "" || filter.Min_Price != nil {
+			t.Errorf("parseFilter(%q) = %+v, %v, want an empty filter", args, filter, err)
+		}
+	}
+	for _, args := range [][]string{{"category=hardware"}, {`["hardware"]`}, {"{}", "{}"}} {
+		if _, err := parseFilter(args); err == nil {
+			t.Errorf("parseFilter(%q) accepted", args)
+		}
+	}
+}
+
+func TestCheckFilter(t *testing.T) {
+	filter := func(doc string) listFilter {
+		f, err := parseFilter([]string{doc})
+		if err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+		return f
+	}
+	if err := checkFilter(productListSpec, filter(`{"category":"hw","currency":"USD","max_price":5}`)); err != nil {
+		t.Errorf("products refused a category, currency and price filter: %v", err)
+	}
+	if err := checkFilter(contractListSpec, filter(`{"client_id":"cl1","supplier_id":"s1"}`)); err != nil {
+		t.Errorf("contracts refused a client and supplier filter: %v", err)
+	}
+	refused := map[string]listSpec{
+		`{"category":"hw"}`:    clientListSpec,
+		`{"min_price":1}`:      contractListSpec,
+		`{"client_id":"cl1"}`:  productListSpec,
+		`{"user_type":"gold"}`: offeringListSpec,
+	}
+	for doc, spec := range refused {
+		err := checkFilter(spec, filter(doc))
+		if err == nil || !strings.Contains(err.Error(), spec.name) {
+			t.Errorf("%s on %s: error %v, want it refused", doc, spec.name, err)
+		}
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	disk := map[string]interface{}{"product_id": "p1", "category": "Hardware", "currency": "USD", "list_price": 120.5,
+		"availability_start_date": "2016-01-01", "availability_end_date": "2016-12-31"}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`{}`, true},
+		{`{"category":"hardware"}`, true},
+		{`{"category":"software"}`, false},
+		{`{"currency":"usd"}`, true},
+		{`{"currency":"EUR"}`, false},
+		{`{"min_price":120.5,"max_price":"200"}`, true},
+		{`{"min_price":"120.51"}`, false},
+		{`{"max_price":100}`, false},
+		{`{"available_from":"2016-06-01","available_to":"2017-06-01"}`, true},
+		{`{"available_from":"2015-01-01","available_to":"2016-01-01"}`, true},
+		{`{"available_from":"2017-01-01"}`, false},
+		{`{"available_to":"2015-12-31"}`, false},
+	}
+	for _, tt := range tests {
+		filter, err := parseFilter([]string{tt.filter})
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if got := matchesFilter(productListSpec, filter, disk, "2016-10-01"); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSorter(t *testing.T) {
+	records := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{"product_id": "p3", "category": "b", "list_price": "9.5"},
+			{"product_id": "p1", "category": "a", "list_price": 100.0},
+			{"product_id": "p2", "category": "b", "list_price": "10"},
+		}
+	}
+	ids := func(records []map[string]interface{}) string {
+		out := []string{}
+		for _, rec := range records {
+			out = append(out, rec["product_id"].(string))
+		}
+		return strings.Join(out, " ")
+	}
+	sorted := func(field string, desc bool) string {
+		recs := records()
+		sorter := recordSorter{recs, field, "product_id", desc}
+		for i := 1; i < len(recs); i++ { //insertion sort keeps the test independent of sort.Stable
+			for j := i; j > 0 && sorter.Less(j, j-1); j-- {
+				sorter.Swap(j, j-1)
+			}
+		}
+		return ids(recs)
+	}
+	if got := sorted("list_price", false); got != "p3 p2 p1" {
+		t.Errorf("by price: %s, want numbers compared as numbers", got)
+	}
+	if got := sorted("list_price", true); got != "p1 p2 p3" {
+		t.Errorf("by price, descending: %s", got)
+	}
+	if got := sorted("category", false); got != "p1 p2 p3" {
+		t.Errorf("by category: %s, want ties broken on the id", got)
+	}
+	if got := sorted("category", true); got != "p3 p2 p1" {
+		t.Errorf("by category, descending: %s", got)
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	matches := []map[string]interface{}{}
+	for i := 1; i <= 5; i++ {
+		matches = append(matches, map[string]interface{}{"client_id": fmt.Sprintf("cl%d", i)})
+	}
+	var seen []string
+	offset, pages := 0, 0
+	for {
+		page := pageOf(matches, offset, 2)
+		pages++
+		if page.Count != 5 {
+			t.Fatalf("page %d: count %d, want 5", pages, page.Count)
+		}
+		for _, rec := range page.Records {
+			seen = append(seen, rec["client_id"].(string))
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		next, err := decodeBookmark(page.Bookmark)
+		if err != nil || pages > 5 {
+			t.Fatalf("page %d: bookmark %q, %v", pages, page.Bookmark, err)
+		}
+		offset = next
+	}
+	if pages != 3 || strings.Join(seen, " ") != "cl1 cl2 cl3 cl4 cl5" {
+		t.Errorf("%d pages holding %v, want 3 pages holding every client once", pages, seen)
+	}
+	if page := pageOf(matches, 7, 2); len(page.Records) != 0 || page.Bookmark != "" || page.Count != 5 {
+		t.Errorf("past the end: %+v", page)
+	}
+	if page := pageOf(nil, 0, 20); page.Records == nil || page.Count != 0 {
+		t.Errorf("no matches: %+v, want an empty records list", page)
+	}
+}
+
+func TestDecodeBookmark(t *testing.T) {
+	if offset, err := decodeBookmark(""); offset != 0 || err != nil {
+		t.Errorf("no bookmark: %d %v", offset, err)
+	}
+	if offset, err := decodeBookmark(encodeBookmark(40)); offset != 40 || err != nil {
+		t.Errorf("round trip: %d %v", offset, err)
+	}
+	for _, bookmark := range []string{"40", "bzo0MA", "o:40", encodeBookmark(-1), "eDo0MA=="} {
+		if _, err := decodeBookmark(bookmark); err == nil {
+			t.Errorf("decodeBookmark(%q) accepted", bookmark)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================================================================
+// Decimal - an exact fixed-point number used for every price, rate and percentage instead of float64.
+//
+// Amounts are checked against the minor units of their currency (ISO 4217): a USD price may have at most 2 decimals,
+// a JPY price none. Amounts computed from other amounts (discounts, conversions, ...) are rounded half away from zero
+// to the minor unit of the currency, once, on the final value of each line - never on intermediate values.
+// Decimals are stored in JSON as strings so no client parses them through a float.
+// ============================================================================================================================
+type Decimal struct {
+	units *big.Int //the value times 10^scale, nil means zero
+	scale int
+}
+
+const maxDecimalScale = 18
+const maxDecimalDigits = 30
+const percentScale = 4
+
+// currencyMinorUnits - ISO 4217 currency codes and the number of decimals of their minor unit
+var currencyMinorUnits = map[string]int{
+	"AED": 2, "AUD": 2, "BGN": 2, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2, "DKK": 2, "EGP": 2,
+	"EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "MXN": 2, "MYR": 2, "NOK": 2,
+	"NPR": 2, "NZD": 2, "PHP": 2, "PKR": 2, "PLN": 2, "RON": 2, "RUB": 2, "SAR": 2, "SEK": 2, "SGD": 2,
+	"THB": 2, "TRY": 2, "TWD": 2, "USD": 2, "ZAR": 2,
+	"CLP": 0, "ISK": 0, "JPY": 0, "KRW": 0, "PYG": 0, "UGX": 0, "VND": 0, "XAF": 0, "XOF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4,
+}
+
+// ParseDecimal - parse a plain decimal such as "12", "-0.5" or "1234.5678". Exponents, NaN and Inf are refused.
+func ParseDecimal(value string) (Decimal, error) {
+	s := strings.TrimSpace(value)
+	neg := false
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if dot := strings.Index(s, "."); dot >= 0 {
+		intPart, fracPart = s[:dot], s[dot+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return Decimal{}, errors.New("\"" + value + "\" is not a decimal number")
+	}
+	for _, c := range intPart + fracPart {
+		if c < '0' || c > '9' {
+			return Decimal{}, errors.New("\"" + value + "\" is not a decimal number")
+		}
+	}
+	if len(fracPart) > maxDecimalScale || len(intPart)+len(fracPart) > maxDecimalDigits {
+		return Decimal{}, errors.New("\"" + value + "\" has too many digits")
+	}
+	units, _ := new(big.Int).SetString("0"+intPart+fracPart, 10)
+	if neg {
+		units.Neg(units)
+	}
+	return Decimal{units, len(fracPart)}, nil
+}
+
+// NewDecimal - units × 10^-scale
+func NewDecimal(units int64, scale int) Decimal {
+	return Decimal{big.NewInt(units), scale}
+}
+
+func (d Decimal) bigUnits() *big.Int {
+	if d.units == nil {
+		return new(big.Int)
+	}
+	return d.units
+}
+
+func (d Decimal) String() string {
+	digits := new(big.Int).Abs(d.bigUnits()).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+	}
+	if d.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON - accepts a quoted decimal or, for records written before Decimal existed, a bare JSON number
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if s == "" {
+		*d = Decimal{}
+		return nil
+	}
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64) //legacy float written in exponent form
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	parsed, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d Decimal) Sign() int    { return d.bigUnits().Sign() }
+func (d Decimal) IsZero() bool { return d.Sign() == 0 }
+func (d Decimal) Neg() Decimal { return Decimal{new(big.Int).Neg(d.bigUnits()), d.scale} }
+func (d Decimal) Abs() Decimal { return Decimal{new(big.Int).Abs(d.bigUnits()), d.scale} }
+
+// rescaled - the units of d expressed at a larger scale
+func (d Decimal) rescaled(scale int) *big.Int {
+	return new(big.Int).Mul(d.bigUnits(), pow10(scale-d.scale))
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	scale := maxInt(d.scale, o.scale)
+	return Decimal{new(big.Int).Add(d.rescaled(scale), o.rescaled(scale)), scale}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	return d.Add(o.Neg())
+}
+
+// Mul - the exact product, scales add up
+func (d Decimal) Mul(o Decimal) Decimal {
+	return Decimal{new(big.Int).Mul(d.bigUnits(), o.bigUnits()), d.scale + o.scale}
+}
+
+// MulInt - the exact product with a whole number such as a quantity
+func (d Decimal) MulInt(n int64) Decimal {
+	return Decimal{new(big.Int).Mul(d.bigUnits(), big.NewInt(n)), d.scale}
+}
+
+// Percent - the exact value of p percent of d
+func (d Decimal) Percent(p Decimal) Decimal {
+	return Decimal{new(big.Int).Mul(d.bigUnits(), p.bigUnits()), d.scale + p.scale + 2}
+}
+
+// ProRata - num/den of d, such as the share of a period's charge for some of its days, rounded half away from zero
+// to the given number of decimals
+func (d Decimal) ProRata(num int64, den int64, scale int) Decimal {
+	working := maxInt(d.scale, scale)
+	numerator := new(big.Int).Mul(d.rescaled(working), big.NewInt(num))
+	divisor := new(big.Int).Mul(big.NewInt(den), pow10(working-scale))
+	quo, rem := new(big.Int).QuoRem(new(big.Int).Abs(numerator), divisor, new(big.Int))
+	if new(big.Int).Mul(rem, big.NewInt(2)).Cmp(divisor) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if numerator.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	return Decimal{quo, scale}
+}
+
+// Inverse - 1/d rounded half away from zero to the given number of decimals, d must not be zero
+func (d Decimal) Inverse(scale int) Decimal {
+	numerator := pow10(d.scale + scale)
+	divisor := new(big.Int).Abs(d.bigUnits())
+	quo, rem := new(big.Int).QuoRem(numerator, divisor, new(big.Int))
+	if new(big.Int).Mul(rem, big.NewInt(2)).Cmp(divisor) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if d.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	return Decimal{quo, scale}
+}
+
+// Cmp - -1, 0 or +1 as d is less than, equal to or greater than o
+func (d Decimal) Cmp(o Decimal) int {
+	scale := maxInt(d.scale, o.scale)
+	return d.rescaled(scale).Cmp(o.rescaled(scale))
+}
+
+func (d Decimal) Equal(o Decimal) bool { return d.Cmp(o) == 0 }
+
+// Round - round half away from zero to the given number of decimals
+func (d Decimal) Round(scale int) Decimal {
+	if d.scale <= scale {
+		return Decimal{d.rescaled(scale), scale}
+	}
+	divisor := pow10(d.scale - scale)
+	quo, rem := new(big.Int).QuoRem(new(big.Int).Abs(d.bigUnits()), divisor, new(big.Int))
+	if new(big.Int).Mul(rem, big.NewInt(2)).Cmp(divisor) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if d.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	return Decimal{quo, scale}
+}
+
+// RoundTo - round an amount to the minor unit of its currency
+func (d Decimal) RoundTo(currency string) Decimal {
+	return d.Round(currencyMinorUnits[currency])
+}
+
+// precision - the number of decimals actually used, trailing zeros do not count
+func (d Decimal) precision() int {
+	p := d.scale
+	units := new(big.Int).Set(d.bigUnits())
+	ten, rem := big.NewInt(10), new(big.Int)
+	for p > 0 && units.Sign() != 0 {
+		if new(big.Int).QuoRem(units, ten, rem); rem.Sign() != 0 {
+			break
+		}
+		units.Quo(units, ten)
+		p--
+	}
+	if units.Sign() == 0 {
+		return 0
+	}
+	return p
+}
+
+// ============================================================================================================================
+// Validation of money arguments
+// ============================================================================================================================
+
+// currencyCode - an ISO 4217 code we know the minor units of, in upper case
+func currencyCode(value string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(value))
+	if _, ok := currencyMinorUnits[code]; !ok {
+		return "", errors.New("currency \"" + value + "\" is not a supported ISO 4217 code")
+	}
+	return code, nil
+}
+
+// parseAmount - a non-negative amount with no more decimals than the currency's minor unit, at that scale
+func parseAmount(name string, value string, currency string) (Decimal, error) {
+	amount, err := ParseDecimal(value)
+	if err != nil {
+		return Decimal{}, errors.New(name + " argument must be a decimal amount, " + err.Error())
+	}
+	if err := checkAmount(name, amount, currency); err != nil {
+		return Decimal{}, err
+	}
+	return amount.RoundTo(currency), nil
+}
+
+// checkAmount - the rules parseAmount applies, for amounts that were decoded rather than parsed
+func checkAmount(name string, amount Decimal, currency string) error {
+	units, ok := currencyMinorUnits[currency]
+	if !ok {
+		return errors.New("currency \"" + currency + "\" is not a supported ISO 4217 code")
+	}
+	if amount.Sign() < 0 {
+		return errors.New(name + " may not be negative")
+	}
+	if amount.precision() > units {
+		return errors.New(name + " " + amount.String() + " has more decimals than " + currency + " allows (" + strconv.Itoa(units) + ")")
+	}
+	return nil
+}
+
+// parsePercent - a percentage between 0 and 100 with at most percentScale decimals
+func parsePercent(name string, value string) (Decimal, error) {
+	p, err := ParseDecimal(value)
+	if err != nil {
+		return Decimal{}, errors.New(name + " argument must be a decimal percentage, " + err.Error())
+	}
+	if p.Sign() < 0 || p.Cmp(NewDecimal(100, 0)) > 0 {
+		return Decimal{}, errors.New(name + " must be between 0 and 100")
+	}
+	if p.precision() > percentScale {
+		return Decimal{}, errors.New(name + " may have at most " + strconv.Itoa(percentScale) + " decimals")
+	}
+	return p.Round(p.precision()), nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// mustDecimal - a decimal for a test, failing the test on a bad literal
+func mustDecimal(t *testing.T, value string) Decimal {
+	d, err := ParseDecimal(value)
+	if err != nil {
+		t.Fatalf("ParseDecimal(%q): %v", value, err)
+	}
+	return d
+}
+
+// the sums that drifted as float64 come out exact
+func TestDecimalTotalsAreExact(t *testing.T) {
+	total := Decimal{}
+	for i := 0; i < 10; i++ {
+		total = total.Add(mustDecimal(t, "0.10"))
+	}
+	if total.String() != "1.00" || !total.Equal(NewDecimal(1, 0)) {
+		t.Errorf("ten times 0.10 = %s", total)
+	}
+	if got := mustDecimal(t, "0.1").Add(mustDecimal(t, "0.2")); got.String() != "0.3" {
+		t.Errorf("0.1 + 0.2 = %s", got)
+	}
+	if got := mustDecimal(t, "19.99").MulInt(3).Sub(mustDecimal(t, "59.97")); !got.IsZero() {
+		t.Errorf("3 x 19.99 - 59.97 = %s", got)
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	t.Run("accepted", func(t *testing.T) {
+		for value, want := range map[string]string{"12": "12", "-0.5": "-0.5", "+1234.5678": "1234.5678", ".25": "0.25",
+			"7.": "7", " 3.10 ": "3.10"} {
+			if got, err := ParseDecimal(value); err != nil || got.String() != want {
+				t.Errorf("ParseDecimal(%q) = %s, %v, want %s", value, got, err, want)
+			}
+		}
+	})
+	t.Run("refused", func(t *testing.T) {
+		for _, value := range []string{"", "-", ".", "1e3", "NaN", "Inf", "-Inf", "1.2.3", "1,5", "0x10"} {
+			if got, err := ParseDecimal(value); err == nil {
+				t.Errorf("ParseDecimal(%q) = %s, want it refused", value, got)
+			}
+		}
+	})
+	t.Run("too many digits", func(t *testing.T) {
+		for _, value := range []string{"0." + strings.Repeat("1", maxDecimalScale+1), strings.Repeat("9", maxDecimalDigits+1)} {
+			if _, err := ParseDecimal(value); err == nil || !strings.Contains(err.Error(), "too many digits") {
+				t.Errorf("ParseDecimal(%q): %v", value, err)
+			}
+		}
+	})
+}
+
+func TestRoundingIsHalfAwayFromZeroInMinorUnits(t *testing.T) {
+	round := func(value, currency, want string) {
+		if got := mustDecimal(t, value).RoundTo(currency).String(); got != want {
+			t.Errorf("%s %s rounds to %s, want %s", value, currency, got, want)
+		}
+	}
+	round("10.994", "USD", "10.99")
+	round("10.995", "USD", "11.00")
+	round("-10.995", "USD", "-11.00")
+	round("5", "USD", "5.00")
+	round("1234.5", "JPY", "1235")
+	round("1234.49", "JPY", "1234")
+	round("1.2345", "KWD", "1.235")
+	round("0.00005", "CLF", "0.0001")
+}
+
+// a 92 day quarter billed for 31 days, and a discount worked out on the total rather than per line
+func TestProRataAndPercent(t *testing.T) {
+	quarter := mustDecimal(t, "100.00")
+	if got := quarter.ProRata(31, 92, 2); got.String() != "33.70" {
+		t.Errorf("31/92 of 100.00 = %s", got)
+	}
+	if got := quarter.ProRata(92, 92, 2); !got.Equal(quarter) {
+		t.Errorf("the whole quarter = %s", got)
+	}
+	if got := quarter.ProRata(0, 92, 2); got.String() != "0.00" {
+		t.Errorf("no days = %s", got)
+	}
+	// thirds and half cents round once, away from zero
+	if got := mustDecimal(t, "80").ProRata(1, 3, 2); got.String() != "26.67" {
+		t.Errorf("a third of 80 = %s", got)
+	}
+	if a, b := mustDecimal(t, "0.05").ProRata(1, 2, 2), mustDecimal(t, "-0.05").ProRata(1, 2, 2); a.String() != "0.03" || b.String() != "-0.03" {
+		t.Errorf("half of 0.05 and -0.05 = %s and %s", a, b)
+	}
+
+	discount := mustDecimal(t, "2153.50").Percent(mustDecimal(t, "12.5"))
+	if !discount.Equal(mustDecimal(t, "269.1875")) || discount.RoundTo("USD").String() != "269.19" {
+		t.Errorf("12.5%% of 2153.50 = %s, %s rounded", discount, discount.RoundTo("USD"))
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	if got, err := parseAmount("price", "9.5", "USD"); err != nil || got.String() != "9.50" {
+		t.Errorf("9.5 USD = %s, %v, want it at the cent scale", got, err)
+	}
+	if got, err := parseAmount("price", "1000", "JPY"); err != nil || got.String() != "1000" {
+		t.Errorf("1000 JPY = %s, %v", got, err)
+	}
+	// trailing zeros are not extra precision
+	if got, err := parseAmount("price", "9.500", "USD"); err != nil || got.String() != "9.50" {
+		t.Errorf("9.500 USD = %s, %v", got, err)
+	}
+
+	for _, bad := range []struct{ value, currency, message string }{
+		{"9.505", "USD", "more decimals than USD allows (2)"},
+		{"1000.5", "JPY", "more decimals than JPY allows (0)"},
+		{"-1", "USD", "price may not be negative"},
+		{"NaN", "USD", "price argument must be a decimal amount"},
+		{"1", "XXX", "not a supported ISO 4217 code"},
+	} {
+		if _, err := parseAmount("price", bad.value, bad.currency); err == nil || !strings.Contains(err.Error(), bad.message) {
+			t.Errorf("parseAmount(%q, %s): %v, want %q", bad.value, bad.currency, err, bad.message)
+		}
+	}
+	if code, err := currencyCode(" usd"); err != nil || code != "USD" {
+		t.Errorf("currencyCode(\" usd\") = %q, %v", code, err)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	for _, ok := range []string{"0", "12.50", "33.3333", "100"} {
+		if _, err := parsePercent("discount_percent", ok); err != nil {
+			t.Errorf("%s%%: %v", ok, err)
+		}
+	}
+	if p, _ := parsePercent("discount_percent", "12.50"); p.String() != "12.5" {
+		t.Errorf("12.50%% kept as %s", p)
+	}
+	for _, bad := range []string{"100.01", "-1", "1.23456", "ten"} {
+		if _, err := parsePercent("discount_percent", bad); err == nil || !strings.HasPrefix(err.Error(), "discount_percent") {
+			t.Errorf("%s%%: %v", bad, err)
+		}
+	}
+}
+
+// prices are stored as strings, and records written with float prices still load
+func TestDecimalJSON(t *testing.T) {
+	priceAsBytes, _ := json.Marshal(struct{ Price Decimal }{mustDecimal(t, "0.30")})
+	if string(priceAsBytes) != `{"Price":"0.30"}` {
+		t.Errorf("marshalled as %s", priceAsBytes)
+	}
+	for stored, want := range map[string]string{`"12.50"`: "12.50", `12.5`: "12.5", `1e2`: "100", `null`: "0", `""`: "0"} {
+		var d Decimal
+		if err := json.Unmarshal([]byte(stored), &d); err != nil || d.String() != want {
+			t.Errorf("stored %s read as %s, %v, want %s", stored, d, err, want)
+		}
+	}
+	var d Decimal
+	if err := json.Unmarshal([]byte(`"NaN"`), &d); err == nil {
+		t.Error("a stored NaN was read")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// contractOverlap - two active contracts of a client that bill some of the same offerings or products for some of the
+// same days
+type contractOverlap struct {
+	Contract_ID string   `json:"contract_id"`
+	Other_ID    string   `json:"other_id"`
+	Client_ID   string   `json:"client_id"`
+	Items       []string `json:"items"` //the offerings and products both contracts bill
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+}
+
+func (o contractOverlap) String() string {
+	return o.Contract_ID + " overlaps " + o.Other_ID + " on " + strings.Join(o.Items, ", ") + " from " + o.From + " to " + o.To
+}
+
+// ============================================================================================================================
+// List contract overlaps - every pair of active contracts that bill the same client for the same offering or product
+// on the same days, so billing cannot tell which rate applies
+//
+// args: optional client_id
+// ============================================================================================================================
+func (t *SimpleChaincode) list_contract_overlaps(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting optional client_id")
+	}
+	contracts, err := activeContracts(stub)
+	if err != nil {
+		return nil, err
+	}
+	overlaps := []contractOverlap{}
+	for i, contract := range contracts {
+		if len(args) == 1 && args[0] != "" && contract.Client_ID != args[0] {
+			continue
+		}
+		terms, err := getContractTerms(stub, contract)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range contracts[i+1:] {
+			overlap, found, err := effectiveOverlap(stub, contract, terms, other, "")
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				overlaps = append(overlaps, overlap)
+			}
+		}
+	}
+	return json.Marshal(overlaps)
+}
+
+// checkOverlaps - a contract going into force, or new terms of one from a date on, may not overlap another active
+// contract of the client. With supersede the other contracts end the day before the overlap instead.
+func checkOverlaps(stub *shim.ChaincodeStub, contract Contract, from string, supersede bool) error {
+	overlaps, err := contractOverlaps(stub, contract, from)
+	if err != nil || len(overlaps) == 0 {
+		return err
+	}
+	if !supersede {
+		return errors.New("Contract " + overlaps[0].String() + ", pass supersede to end the older contract")
+	}
+	for _, overlap := range overlaps {
+		older, err := getContract(stub, overlap.Other_ID)
+		if err != nil {
+			return err
+		}
+		if err := supersedeContract(stub, older, contract.Contract_ID, overlap.From); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contractOverlaps - the active contracts a contract would overlap from a date on, with its terms as given from then
+// on and theirs as in effect on each day
+func contractOverlaps(stub *shim.ChaincodeStub, contract Contract, from string) ([]contractOverlap, error) {
+	contracts, err := activeContracts(stub)
+	if err != nil {
+		return nil, err
+	}
+	overlaps := []contractOverlap{}
+	terms := contractTerms{Original: contract, Amendments: []contractAmendment{}}
+	for _, other := range contracts {
+		overlap, found, err := effectiveOverlap(stub, contract, terms, other, from)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			overlaps = append(overlaps, overlap)
+		}
+	}
+	return overlaps, nil
+}
+
+// supersedeContract - end an older contract the day before a newer one takes over. The earlier end date is recorded
+// as an amendment of the older contract and what it was invoiced beyond its new end is prorated.
+func supersedeContract(stub *shim.ChaincodeStub, older Contract, by string, from string) error {
+	end, err := supersededEnd(older, by, from)
+	if err != nil {
+		return err
+	}
+	reason := "superseded by " + by
+	ended, err := endContractEarly(stub, older, end, reason)
+	if err != nil {
+		return err
+	}
+	ended.Superseded_By = by
+	if err := prorateContractChange(stub, ended, from, reason); err != nil {
+		return err
+	}
+	if err := storeContract(stub, &ended); err != nil {
+		return err
+	}
+	fmt.Println("! " + older.Contract_ID + " " + reason)
+	return recordChange(stub, older.Contract_ID, "superseded_by", "", by)
+}
+
+// supersededEnd - the day before a newer contract takes over, when the older contract has started by then
+func supersededEnd(older Contract, by string, from string) (string, error) {
+	start, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return "", errors.New("Contract " + by + " has no valid start date")
+	}
+	end := start.AddDate(0, 0, -1).Format(dateLayout)
+	if older.Contract_Start_Date > end {
+		return "", errors.New("Contract " + older.Contract_ID + " starts on " + older.Contract_Start_Date + ", it cannot be superseded by " +
+			by + " from " + from)
+	}
+	return end, nil
+}
+
+// overlapOf - where two contracts of the same client bill the same items on the same days, from a date on when one
+// is given. A contract does not overlap itself.
+func overlapOf(contract Contract, other Contract, from string) (contractOverlap, bool) {
+	overlap, found := overlapWindow(contract, other, from)
+	if !found {
+		return overlap, false
+	}
+	billed := map[string]bool{}
+	for _, item := range contractItems(other) {
+		billed[item.itemType+":"+item.id] = true
+	}
+	for _, item := range contractItems(contract) {
+		if billed[item.itemType+":"+item.id] {
+			overlap.Items = appendUnique(overlap.Items, item.id)
+		}
+	}
+	return overlap, len(overlap.Items) > 0
+}
+
+// overlapWindow - the days two contracts of the same client are both in force, from a date on when one is given
+func overlapWindow(contract Contract, other Contract, from string) (contractOverlap, bool) {
+	overlap := contractOverlap{Contract_ID: contract.Contract_ID, Other_ID: other.Contract_ID, Client_ID: contract.Client_ID,
+		Items: []string{}}
+	if contract.Contract_ID == other.Contract_ID || contract.Client_ID != other.Client_ID {
+		return overlap, false
+	}
+	overlap.From, overlap.To = contract.Contract_Start_Date, contract.Contract_End_Date
+	if other.Contract_Start_Date > overlap.From {
+		overlap.From = other.Contract_Start_Date
+	}
+	if from > overlap.From {
+		overlap.From = from
+	}
+	if other.Contract_End_Date < overlap.To {
+		overlap.To = other.Contract_End_Date
+	}
+	return overlap, overlap.From <= overlap.To
+}
+
+// effectiveOverlap - amendments change what a contract bills from their effective date, two contracts only overlap
+// where the terms in effect on the same days share items. The terms are compared at the start of the days both are
+// in force, from a date on when one is given, and wherever an amendment of either contract takes effect in them.
+// Both list_contract_overlaps and checkOverlaps go through here.
+func effectiveOverlap(stub *shim.ChaincodeStub, contract Contract, termsOf contractTerms, other Contract, from string) (contractOverlap, bool, error) {
+	overlap, found := overlapWindow(contract, other, from)
+	if !found {
+		return overlap, false, nil
+	}
+	otherTerms, err := getContractTerms(stub, other)
+	if err != nil {
+		return overlap, false, err
+	}
+	return termsOverlap(contract, termsOf, other, otherTerms, overlap)
+}
+
+// termsOverlap - the comparison of effectiveOverlap over the window two contracts are both in force, with the terms
+// of both at hand
+func termsOverlap(contract Contract, termsOf contractTerms, other Contract, otherTerms contractTerms, overlap contractOverlap) (contractOverlap, bool, error) {
+	dates := []string{overlap.From}
+	for _, amendment := range append(append([]contractAmendment{}, termsOf.Amendments...), otherTerms.Amendments...) {
+		if amendment.Status == amendmentSigned && amendment.Effective_Date > overlap.From && amendment.Effective_Date <= overlap.To {
+			dates = appendUnique(dates, amendment.Effective_Date)
+		}
+	}
+	sort.Strings(dates)
+	shared := contractOverlap{}
+	for _, date := range dates {
+		current, err := termsOn(contract, termsOf, date)
+		if err != nil {
+			return overlap, false, err
+		}
+		otherCurrent, err := termsOn(other, otherTerms, date)
+		if err != nil {
+			return overlap, false, err
+		}
+		if onDate, ok := overlapOf(current, otherCurrent, date); ok {
+			if len(shared.Items) == 0 {
+				shared = onDate
+			}
+			for _, id := range onDate.Items {
+				shared.Items = appendUnique(shared.Items, id)
+			}
+		}
+	}
+	if len(shared.Items) > 0 {
+		shared.To = overlap.To
+	}
+	return shared, len(shared.Items) > 0, nil
+}
+
+// activeContracts - every active contract, in index order
+func activeContracts(stub *shim.ChaincodeStub) ([]Contract, error) {
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	contracts := []Contract{}
+	for _, id := range contractIndex {
+		contract, err := getContract(stub, id)
+		if err == nil && contractStatus(contract.Status) == contractActive {
+			contracts = append(contracts, contract)
+		}
+	}
+	return contracts, nil
+}
+
+// supersedeArg - the optional supersede argument of init_contract, activate_contract and amend_contract
+func supersedeArg(args []string, i int) (bool, error) {
+	if len(args) <= i || strings.TrimSpace(args[i]) == "" {
+		return false, nil
+	}
+	supersede, err := strconv.ParseBool(strings.TrimSpace(args[i]))
+	if err != nil {
+		return false, errors.New("supersede must be true or false")
+	}
+	return supersede, nil
+}
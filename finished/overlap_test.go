@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// otherContract - a contract of client cl1 like testContract's, for another term and items
+func otherContract(t *testing.T, start string, end string, offering string, product string) Contract {
+	c := testContract(t)
+	c.Contract_ID, c.Contract_Start_Date, c.Contract_End_Date = "c1", start, end
+	c.Offering_ID_1, c.Product_Id_1 = offering, product
+	return c
+}
+
+func TestOverlapOf(t *testing.T) {
+	contract := testContract(t)
+	overlaps := func(t *testing.T, other Contract, from string, want string) {
+		overlap, found := overlapOf(contract, other, from)
+		got := ""
+		if found {
+			got = strings.Join(overlap.Items, ", ") + " from " + overlap.From + " to " + overlap.To
+			if overlap.Contract_ID != "c0" || overlap.Other_ID != "c1" || overlap.Client_ID != "cl1" {
+				t.Errorf("overlap of %s", overlap)
+			}
+		}
+		if got != want {
+			t.Errorf("overlap %q, want %q", got, want)
+		}
+	}
+
+	t.Run("no overlap", func(t *testing.T) {
+		overlaps(t, contract, "", "")
+		otherClient := otherContract(t, "2016-01-01", "2016-12-31", "o1", "p1")
+		otherClient.Client_ID = "cl2"
+		overlaps(t, otherClient, "", "")
+		overlaps(t, otherContract(t, "2015-01-01", "2015-12-31", "o1", "p1"), "", "")
+		overlaps(t, otherContract(t, "2016-01-01", "2016-12-31", "o2", "p2"), "", "")
+	})
+	t.Run("items and days in common", func(t *testing.T) {
+		overlaps(t, otherContract(t, "2016-07-01", "2017-06-30", "o1", "p1"), "", "o1, p1 from 2016-07-01 to 2016-12-31")
+		overlaps(t, otherContract(t, "2015-07-01", "2016-03-31", "", "p1"), "", "p1 from 2016-01-01 to 2016-03-31")
+		overlaps(t, otherContract(t, "2016-12-31", "2017-12-31", "o1", ""), "", "o1 from 2016-12-31 to 2016-12-31")
+	})
+	t.Run("from a date", func(t *testing.T) {
+		overlaps(t, otherContract(t, "2016-01-01", "2016-12-31", "o1", ""), "2016-10-01", "o1 from 2016-10-01 to 2016-12-31")
+		overlaps(t, otherContract(t, "2016-01-01", "2016-06-30", "o1", ""), "2016-07-01", "")
+	})
+	t.Run("an offering and a product with the same id", func(t *testing.T) {
+		overlaps(t, otherContract(t, "2016-01-01", "2016-12-31", "p1", ""), "", "")
+	})
+}
+
+// signed amendments decide what each contract bills on the days they share
+func TestTermsOverlap(t *testing.T) {
+	contract := testContract(t)
+	ownTerms := contractTerms{Original: contract}
+	amendedTo := func(offering string, from string) contractTerms {
+		return contractTerms{Original: otherContract(t, "2016-01-01", "2016-12-31", "o2", ""), Amendments: []contractAmendment{
+			{Number: 1, Effective_Date: from, Changes: map[string]string{"offering_id_1": offering}, Status: amendmentSigned, Terms_Version: 2},
+		}}
+	}
+	compare := func(other Contract, otherTerms contractTerms) string {
+		window, _ := overlapWindow(contract, other, "")
+		overlap, found, err := termsOverlap(contract, ownTerms, other, otherTerms, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			return "none"
+		}
+		return overlap.String()
+	}
+
+	// c1 takes on o1 from July
+	terms := amendedTo("o1", "2016-07-01")
+	if got := compare(otherContract(t, "2016-01-01", "2016-12-31", "o1", ""), terms); got != "c0 overlaps c1 on o1 from 2016-07-01 to 2016-12-31" {
+		t.Errorf("o1 added in July: %s", got)
+	}
+	// and an amendment not signed yet changes nothing
+	terms.Amendments[0].Status = amendmentProposed
+	if got := compare(otherContract(t, "2016-01-01", "2016-12-31", "o2", ""), terms); got != "none" {
+		t.Errorf("o1 proposed for July: %s", got)
+	}
+
+	// c1 gives up o1 in April, the first quarter still clashes
+	terms = amendedTo("o2", "2016-04-01")
+	terms.Original.Offering_ID_1 = "o1"
+	if got := compare(otherContract(t, "2016-01-01", "2016-12-31", "o2", ""), terms); got != "c0 overlaps c1 on o1 from 2016-01-01 to 2016-12-31" {
+		t.Errorf("o1 dropped in April: %s", got)
+	}
+}
+
+func TestSupersededEnd(t *testing.T) {
+	older := otherContract(t, "2016-01-01", "2016-12-31", "o1", "")
+	if end, err := supersededEnd(older, "c2", "2016-07-01"); err != nil || end != "2016-06-30" {
+		t.Errorf("superseded from July: ends %s, %v", end, err)
+	}
+	if end, err := supersededEnd(older, "c2", "2016-01-02"); err != nil || end != "2016-01-01" {
+		t.Errorf("superseded on its second day: ends %s, %v", end, err)
+	}
+	if _, err := supersededEnd(older, "c2", "2016-01-01"); err == nil || !strings.Contains(err.Error(), "cannot be superseded by c2") {
+		t.Errorf("superseded from its first day: %v", err)
+	}
+}
+
+func TestSupersedeArg(t *testing.T) {
+	for args, want := range map[string]bool{"c1": false, "c1,": false, "c1, true": true, "c1,FALSE": false} {
+		if got, err := supersedeArg(strings.Split(args, ","), 1); err != nil || got != want {
+			t.Errorf("supersedeArg(%q) = %v, %v", args, got, err)
+		}
+	}
+	if _, err := supersedeArg([]string{"c1", "always"}, 1); err == nil {
+		t.Error("supersede \"always\" was accepted")
+	}
+}
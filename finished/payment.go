@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var paymentIndexStr = "_paymentindex"
+var paymentClientIndexPrefix = "_paymentindex_client_"
+var paymentSeqStr = "_paymentSeq"
+
+var paymentImportSpec = importSpec{"payments", paymentIndexStr, nil, "", nil, nil}
+
+// Payment - money received from a client. What is not allocated to invoices is a credit the client can still use.
+type Payment struct {
+	Payment_ID   string              `json:"payment_id"`
+	Client_ID    string              `json:"client_id"`
+	Amount       Decimal             `json:"amount"`
+	Currency     string              `json:"currency"`
+	Reference    string              `json:"reference"`
+	Payment_Date string              `json:"payment_date"`
+	Allocations  []paymentAllocation `json:"allocations"`
+	Unallocated  Decimal             `json:"unallocated"`
+	Created_At   string              `json:"created_at"`
+	Updated_At   string              `json:"updated_at"`
+	Doc_Type     string              `json:"doc_type"`
+}
+
+// paymentAllocation - part of a payment applied to an invoice
+type paymentAllocation struct {
+	Invoice_ID   string  `json:"invoice_id"`
+	Amount       Decimal `json:"amount"`
+	Allocated_At string  `json:"allocated_at"`
+	Tx_ID        string  `json:"tx_id"`
+}
+
+// allocationRequest - one entry of the allocate_payment allocations argument, no amount settles what is outstanding
+type allocationRequest struct {
+	Invoice_ID string   `json:"invoice_id"`
+	Amount     *Decimal `json:"amount"`
+}
+
+// currencyBalance - a client's position in one currency
+type currencyBalance struct {
+	Currency    string  `json:"currency"`
+	Invoiced    Decimal `json:"invoiced"`    //total of the invoices, void ones included
+	Paid        Decimal `json:"paid"`        //allocated to those invoices
+	Credited    Decimal `json:"credited"`    //taken off them by credit notes, voided invoices are credited in full
+	Outstanding Decimal `json:"outstanding"` //still owed on issued invoices
+	Overdue     Decimal `json:"overdue"`     //the part of outstanding past its due date
+	Credit      Decimal `json:"credit"`      //received but not allocated, and credit notes beyond what was owed
+	Net         Decimal `json:"net"`         //outstanding less credit, negative when the client is in credit
+}
+
+// clientBalance - the client_balance result
+type clientBalance struct {
+	Client_ID string            `json:"client_id"`
+	As_Of     string            `json:"as_of"`
+	Contracts []string          `json:"contracts"`
+	Balances  []currencyBalance `json:"balances"`
+}
+
+func (p *Payment) setTimestamps(created_at string, updated_at string) {
+	p.Created_At, p.Updated_At, p.Doc_Type = created_at, updated_at, paymentImportSpec.name
+}
+
+// ============================================================================================================================
+// Record payment - money received from a client, held as credit until allocate_payment applies it to invoices
+//
+// A reference can only be recorded once per client, so a payment that is sent twice is not counted twice.
+// args: client_id, amount, currency, reference, payment_date
+// ============================================================================================================================
+func (t *SimpleChaincode) record_payment(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+	fmt.Println("- start record payment")
+	if err := requireArgs(args, 4); err != nil {
+		return nil, err
+	}
+	if _, ok := loadRecord(stub, args[0], clientImportSpec.name); !ok {
+		return nil, errors.New("NOT_FOUND: client " + args[0])
+	}
+	currency, err := currencyCode(args[2])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount("amount", args[1], currency)
+	if err != nil {
+		return nil, err
+	}
+	if amount.IsZero() {
+		return nil, errors.New("amount must be more than zero")
+	}
+	paymentDate, err := canonicalDate("payment_date", args[4])
+	if err != nil {
+		return nil, err
+	}
+	payments, err := clientPayments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range payments {
+		if other.Reference == args[3] {
+			return nil, errors.New("Payment " + args[3] + " of client " + args[0] + " is already recorded as " + other.Payment_ID)
+		}
+	}
+
+	_, paymentId, err := nextFreeId(stub, paymentSeqStr, "PAY")
+	if err != nil {
+		return nil, err
+	}
+	payment := Payment{
+		Payment_ID:   paymentId,
+		Client_ID:    args[0],
+		Amount:       amount,
+		Currency:     currency,
+		Reference:    args[3],
+		Payment_Date: paymentDate,
+		Allocations:  []paymentAllocation{},
+		Unallocated:  amount,
+	}
+	if err := storePayment(stub, &payment); err != nil {
+		return nil, err
+	}
+	if err := addToIndexes(stub, payment.Payment_ID, paymentIndexStr, paymentClientIndexPrefix+payment.Client_ID); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end record payment")
+	return json.Marshal(payment)
+}
+
+// ============================================================================================================================
+// Allocate payment - apply the unallocated part of a payment to invoices of the same client and currency
+//
+// allocations is a JSON array such as [{"invoice_id": "INV-s1-000001", "amount": "50.00"}, {"invoice_id": "INV-s1-000002"}].
+// An allocation without an amount settles what is outstanding on the invoice, or as much of it as the payment has left.
+// Part payments leave the invoice issued, it becomes paid once its total is covered. An invoice cannot be paid more
+// than its total, what is left of the payment stays with it as credit.
+// args: payment_id, allocations
+// ============================================================================================================================
+func (t *SimpleChaincode) allocate_payment(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	fmt.Println("- start allocate payment")
+	payment, err := getPayment(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	var requests []allocationRequest
+	if err := json.Unmarshal([]byte(args[1]), &requests); err != nil || len(requests) == 0 {
+		return nil, errors.New("allocations must be a non-empty JSON array of {invoice_id, optional amount}")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := map[string]*Invoice{}
+	for i, request := range requests {
+		where := "allocation " + strconv.Itoa(i+1) + ": "
+		invoice, seen := invoices[request.Invoice_ID]
+		if !seen {
+			loaded, err := getInvoice(stub, request.Invoice_ID)
+			if err != nil {
+				return nil, errors.New(where + err.Error())
+			}
+			invoice = &loaded
+			invoices[request.Invoice_ID] = invoice
+		}
+		amount, err := allocateToInvoice(&payment, invoice, request.Amount)
+		if err != nil {
+			return nil, errors.New(where + err.Error())
+		}
+		payment.Allocations = append(payment.Allocations, paymentAllocation{invoice.Invoice_ID, amount, now.Format(time.RFC3339), stub.GetTxID()})
+	}
+
+	for _, id := range sortedInvoiceIds(invoices) {
+		invoice := invoices[id]
+		if err := storeInvoice(stub, invoice); err != nil {
+			return nil, err
+		}
+		if err := recordChange(stub, id, "status", invoiceIssued, invoice.Status); err != nil {
+			return nil, err
+		}
+	}
+	if err := storePayment(stub, &payment); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end allocate payment")
+	return json.Marshal(payment)
+}
+
+// ============================================================================================================================
+// Get payment - one payment by id
+//
+// args: payment_id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_payment(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	payment, err := getPayment(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(payment)
+}
+
+// ============================================================================================================================
+// Client balance - what a client owes and holds in credit, per currency, from the invoices and credit notes of the
+// client's contracts and the client's payments
+//
+// args: client_id, optional as_of date deciding what is overdue (defaults to the transaction date)
+// ============================================================================================================================
+func (t *SimpleChaincode) client_balance(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting client_id and optional as_of date")
+	}
+	if _, ok := loadRecord(stub, args[0], clientImportSpec.name); !ok {
+		return nil, errors.New("NOT_FOUND: client " + args[0])
+	}
+	asOf, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 2 && args[1] != "" {
+		if asOf, err = canonicalDate("as_of", args[1]); err != nil {
+			return nil, err
+		}
+	}
+	result := clientBalance{Client_ID: args[0], As_Of: asOf, Contracts: []string{}, Balances: []currencyBalance{}}
+
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	balances := map[string]*currencyBalance{}
+	balance := func(currency string) *currencyBalance {
+		if balances[currency] == nil {
+			balances[currency] = &currencyBalance{Currency: currency}
+		}
+		return balances[currency]
+	}
+	for _, contractId := range contractIndex {
+		contract, ok := loadRecord(stub, contractId, contractImportSpec.name)
+		if !ok || fieldString(contract, "client_id") != args[0] {
+			continue
+		}
+		result.Contracts = append(result.Contracts, contractId)
+		invoices, err := contractInvoices(stub, contractId)
+		if err != nil {
+			return nil, err
+		}
+		for _, invoice := range invoices {
+			balance(invoice.Currency).addInvoice(invoice, asOf)
+		}
+	}
+	payments, err := clientPayments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		b := balance(payment.Currency)
+		b.Credit = b.Credit.Add(payment.Unallocated)
+	}
+
+	currencies := []string{}
+	for currency := range balances {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		b := balances[currency]
+		b.Net = b.Outstanding.Sub(b.Credit)
+		result.Balances = append(result.Balances, *b)
+	}
+	return json.Marshal(result)
+}
+
+// allocateToInvoice - apply part of the payment to an issued invoice of the same client and currency, no amount
+// settles what is outstanding or as much of it as the payment has left. The invoice becomes paid once it is covered.
+func allocateToInvoice(payment *Payment, invoice *Invoice, requested *Decimal) (Decimal, error) {
+	if invoice.Client_ID != payment.Client_ID {
+		return Decimal{}, errors.New("invoice " + invoice.Invoice_ID + " is not billed to client " + payment.Client_ID)
+	}
+	if invoice.Currency != payment.Currency {
+		return Decimal{}, errors.New("invoice " + invoice.Invoice_ID + " is in " + invoice.Currency + ", the payment in " + payment.Currency)
+	}
+	if invoice.Status != invoiceIssued {
+		return Decimal{}, errors.New("invoice " + invoice.Invoice_ID + " is " + invoice.Status)
+	}
+	outstanding := invoice.outstanding()
+	amount := outstanding
+	if amount.Cmp(payment.Unallocated) > 0 {
+		amount = payment.Unallocated
+	}
+	if requested != nil {
+		if err := checkAmount("amount", *requested, payment.Currency); err != nil {
+			return Decimal{}, err
+		}
+		amount = requested.RoundTo(payment.Currency)
+	}
+	if amount.Sign() <= 0 {
+		return Decimal{}, errors.New("nothing to allocate to " + invoice.Invoice_ID)
+	}
+	if amount.Cmp(outstanding) > 0 {
+		return Decimal{}, errors.New(amount.String() + " is more than the " + outstanding.String() + " outstanding on " + invoice.Invoice_ID)
+	}
+	if amount.Cmp(payment.Unallocated) > 0 {
+		return Decimal{}, errors.New(amount.String() + " is more than the " + payment.Unallocated.String() + " left on " + payment.Payment_ID)
+	}
+	payment.Unallocated = payment.Unallocated.Sub(amount)
+	invoice.Amount_Paid = invoice.Amount_Paid.Add(amount)
+	if invoice.outstanding().IsZero() {
+		invoice.Status = invoicePaid
+	}
+	return amount, nil
+}
+
+// addInvoice - add an invoice to the balance of its currency, what is outstanding after asOf's due dates is overdue
+func (b *currencyBalance) addInvoice(invoice Invoice, asOf string) {
+	b.Invoiced = b.Invoiced.Add(invoice.Total)
+	b.Paid = b.Paid.Add(invoice.Amount_Paid)
+	b.Credited = b.Credited.Add(invoice.Amount_Credited)
+	b.Outstanding = b.Outstanding.Add(invoice.outstanding())
+	b.Credit = b.Credit.Add(invoice.overpaid())
+	if invoice.Due_Date < asOf {
+		b.Overdue = b.Overdue.Add(invoice.outstanding())
+	}
+}
+
+// clientPayments - the payments of a client, through the client index
+func clientPayments(stub *shim.ChaincodeStub, clientId string) ([]Payment, error) {
+	index, err := getIndex(stub, paymentClientIndexPrefix+clientId)
+	if err != nil {
+		return nil, err
+	}
+	payments := []Payment{}
+	for _, id := range index {
+		payment, err := getPayment(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+func getPayment(stub *shim.ChaincodeStub, id string) (Payment, error) {
+	var payment Payment
+	if _, ok := loadRecord(stub, id, paymentImportSpec.name); !ok {
+		return payment, errors.New("NOT_FOUND: payment " + id)
+	}
+	paymentAsBytes, _ := stub.GetState(id)
+	if err := json.Unmarshal(paymentAsBytes, &payment); err != nil {
+		return payment, errors.New("Failed to decode " + id)
+	}
+	return payment, nil
+}
+
+func storePayment(stub *shim.ChaincodeStub, payment *Payment) error {
+	if err := stampRecord(stub, payment.Payment_ID, payment); err != nil {
+		return err
+	}
+	paymentAsBytes, _ := json.Marshal(payment)
+	if err := stub.PutState(payment.Payment_ID, paymentAsBytes); err != nil {
+		return errors.New("Failed to store " + payment.Payment_ID)
+	}
+	return nil
+}
+
+// sortedInvoiceIds - the keys of an invoice map in order, so every peer writes them in the same order
+func sortedInvoiceIds(invoices map[string]*Invoice) []string {
+	ids := []string{}
+	for id := range invoices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
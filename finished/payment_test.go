@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAllocateToInvoice(t *testing.T) {
+	dec := func(value string) Decimal { return mustDecimal(t, value) }
+	payment := Payment{Payment_ID: "PAY000001", Client_ID: "cl1", Currency: "USD", Amount: dec("150"), Unallocated: dec("150")}
+	jan := Invoice{Invoice_ID: "INV-s1-000001", Client_ID: "cl1", Currency: "USD", Total: dec("100"), Status: invoiceIssued}
+	feb := Invoice{Invoice_ID: "INV-s1-000002", Client_ID: "cl1", Currency: "USD", Total: dec("100"), Status: invoiceIssued}
+
+	amount, err := allocateToInvoice(&payment, &jan, &Decimal{})
+	if err == nil {
+		t.Errorf("allocated %s of nothing", amount)
+	}
+	part := dec("40.004")
+	if _, err = allocateToInvoice(&payment, &jan, &part); err == nil {
+		t.Error("allocated a fraction of a cent")
+	}
+	// a part payment leaves the invoice issued
+	part = dec("40")
+	if amount, err = allocateToInvoice(&payment, &jan, &part); err != nil || amount.String() != "40.00" {
+		t.Fatalf("part payment: %s, %v, want 40.00", amount, err)
+	}
+	if jan.Status != invoiceIssued || jan.outstanding().String() != "60.00" {
+		t.Errorf("after a part payment: %s with %s outstanding", jan.Status, jan.outstanding())
+	}
+
+	// no amount settles the rest
+	if amount, err = allocateToInvoice(&payment, &jan, nil); err != nil || amount.String() != "60.00" || jan.Status != invoicePaid {
+		t.Fatalf("settling January: %s, %v, status %s", amount, err, jan.Status)
+	}
+	if _, err = allocateToInvoice(&payment, &jan, nil); err == nil || !strings.Contains(err.Error(), "is paid") {
+		t.Errorf("allocating to a paid invoice: %v", err)
+	}
+
+	// 50 is left on the payment, no amount takes all of it and an amount over it is refused
+	tooMuch := dec("50.01")
+	if _, err = allocateToInvoice(&payment, &feb, &tooMuch); err == nil || !strings.Contains(err.Error(), "left on PAY000001") {
+		t.Errorf("over the payment: %v", err)
+	}
+	if amount, err = allocateToInvoice(&payment, &feb, nil); err != nil || amount.String() != "50.00" {
+		t.Fatalf("the rest of the payment: %s, %v", amount, err)
+	}
+	if !payment.Unallocated.IsZero() || feb.Status != invoiceIssued || feb.Amount_Paid.String() != "50.00" {
+		t.Errorf("payment left %s, February %s with %s paid", payment.Unallocated, feb.Status, feb.Amount_Paid)
+	}
+}
+
+func TestAllocateToInvoiceRefusesOtherInvoices(t *testing.T) {
+	for _, invoice := range []Invoice{
+		{Invoice_ID: "INV-s1-000003", Client_ID: "cl2", Currency: "USD", Status: invoiceIssued},
+		{Invoice_ID: "INV-s1-000004", Client_ID: "cl1", Currency: "EUR", Status: invoiceIssued},
+		{Invoice_ID: "INV-s1-000005", Client_ID: "cl1", Currency: "USD", Status: invoiceVoid},
+	} {
+		payment := Payment{Client_ID: "cl1", Currency: "USD", Unallocated: mustDecimal(t, "10")}
+		invoice.Total = mustDecimal(t, "10")
+		if _, err := allocateToInvoice(&payment, &invoice, nil); err == nil || !strings.Contains(err.Error(), invoice.Invoice_ID) {
+			t.Errorf("%s: %v", invoice.Invoice_ID, err)
+		}
+		if !invoice.Amount_Paid.IsZero() || payment.Unallocated.String() != "10" {
+			t.Errorf("%s: a refused allocation moved money", invoice.Invoice_ID)
+		}
+	}
+}
+
+func TestCurrencyBalance(t *testing.T) {
+	b := currencyBalance{Currency: "USD"}
+	b.addInvoice(Invoice{Total: mustDecimal(t, "100"), Amount_Paid: mustDecimal(t, "30"), Status: invoiceIssued,
+		Due_Date: "2016-09-30"}, "2016-10-01")
+	b.addInvoice(Invoice{Total: mustDecimal(t, "50"), Status: invoiceIssued, Due_Date: "2016-10-01"}, "2016-10-01")
+	b.addInvoice(Invoice{Total: mustDecimal(t, "20"), Amount_Paid: mustDecimal(t, "20"), Status: invoicePaid,
+		Due_Date: "2016-01-01"}, "2016-10-01")
+	got := []string{b.Invoiced.String(), b.Paid.String(), b.Outstanding.String(), b.Overdue.String()}
+	if strings.Join(got, " ") != "170 50 120 70" {
+		t.Errorf("invoiced, paid, outstanding, overdue = %v, want 170 50 120 70 (due today is not overdue)", got)
+	}
+}
+
+func TestPaymentClientIndexEntries(t *testing.T) {
+	var paymentIndex secondaryIndex
+	for _, index := range secondaryIndexes {
+		if index.prefix == paymentClientIndexPrefix {
+			paymentIndex = index
+		}
+	}
+	if paymentIndex.section != paymentImportSpec.name || paymentIndex.field != "client_id" {
+		t.Fatalf("payment client index = %+v, want payments indexed by client_id", paymentIndex)
+	}
+}
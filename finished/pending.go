@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// pendingOfferingSeqStr - the counter request ids are generated from
+var pendingOfferingSeqStr = "_pendingOfferingSeq"
+
+// pending offering request statuses, kept in the Flag field. A request is pending until it is approved,
+// rejected or cancelled, and those three are final.
+const (
+	requestPending   = "pending"
+	requestApproved  = "approved"
+	requestRejected  = "rejected"
+	requestCancelled = "cancelled"
+)
+
+var requestStatuses = []string{requestPending, requestApproved, requestRejected, requestCancelled}
+
+var pendingOfferingListSpec = listSpec{
+	name:        "list_pending_offerings",
+	indexStr:    pendingOfferingIndexStr,
+	idField:     "request_id",
+	clientField: "client_id",
+	statusFn:    func(rec map[string]interface{}, asOf string) string { return fieldString(rec, "flag") },
+}
+
+// ============================================================================================================================
+// Set pending offering status - approve, reject or cancel an open request
+//
+// args: request_id, status
+// ============================================================================================================================
+func (t *SimpleChaincode) set_pending_offering_status(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	fmt.Println("- start set pending offering status")
+	status, err := requestStatus(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := loadRecord(stub, args[0], pendingOfferingImportSpec.name); !ok {
+		return nil, errors.New("NOT_FOUND: request " + args[0])
+	}
+	requestAsBytes, _ := stub.GetState(args[0])
+	request := pendingOffering{}
+	if err := json.Unmarshal(requestAsBytes, &request); err != nil {
+		return nil, errors.New("Failed to decode " + args[0])
+	}
+	changed, err := moveRequest(&request, status)
+	if err != nil || !changed {
+		return nil, err
+	}
+	if err := stampRecord(stub, args[0], &request); err != nil {
+		return nil, err
+	}
+	requestAsBytes, _ = json.Marshal(request)
+	if err := stub.PutState(args[0], requestAsBytes); err != nil {
+		return nil, errors.New("Failed to store " + args[0])
+	}
+	if err := recordChange(stub, args[0], "flag", requestPending, status); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end set pending offering status")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// List pending offerings by client / by status - the requests of one client or in one status, with the optional
+// filter JSON of the other list_* queries for sorting and paging
+//
+// args: client_id or status, optional filter JSON
+// ============================================================================================================================
+func (t *SimpleChaincode) list_pending_offerings_by_client(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting client_id and optional filter JSON")
+	}
+	filter, err := parseFilter(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	filter.Client_ID = args[0]
+	return t.list_filtered(stub, pendingOfferingListSpec, filter)
+}
+
+func (t *SimpleChaincode) list_pending_offerings_by_status(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting status and optional filter JSON")
+	}
+	status, err := requestStatus(args[0])
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseFilter(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	filter.Status = status
+	return t.list_filtered(stub, pendingOfferingListSpec, filter)
+}
+
+func (t *SimpleChaincode) list_filtered(stub *shim.ChaincodeStub, spec listSpec, filter listFilter) ([]byte, error) {
+	page, err := t.filtered_page(stub, spec, filter)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(page)
+}
+
+// moveRequest - set the status of a pending request, false when it stays pending. Approved, rejected and cancelled
+// requests can no longer change.
+func moveRequest(request *pendingOffering, status string) (bool, error) {
+	if request.Flag != requestPending {
+		return false, errors.New("Request " + request.Request_ID + " is " + request.Flag + " and can no longer change")
+	}
+	if status == requestPending {
+		return false, nil
+	}
+	request.Flag = status
+	return true, nil
+}
+
+// requestStatus - a valid request status, an empty one is pending
+func requestStatus(value string) (string, error) {
+	status := strings.ToLower(strings.TrimSpace(value))
+	if status == "" {
+		return requestPending, nil
+	}
+	if !find_id_in_index(requestStatuses, status) {
+		return "", errors.New("flag must be one of " + strings.Join(requestStatuses, ", "))
+	}
+	return status, nil
+}
+
+// nextSequence - the next value of a counter kept under key, starting at 1
+func nextSequence(stub *shim.ChaincodeStub, key string) (int, error) {
+	seqAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, errors.New("Failed to get " + key)
+	}
+	seq := 0
+	if seqAsBytes != nil {
+		if seq, err = strconv.Atoi(string(seqAsBytes)); err != nil {
+			return 0, errors.New("Failed to decode " + key)
+		}
+	}
+	seq++
+	if err := stub.PutState(key, []byte(strconv.Itoa(seq))); err != nil {
+		return 0, errors.New("Failed to store " + key)
+	}
+	return seq, nil
+}
+
+// nextRequestId - request ids are REQ followed by a zero padded sequence number, REQ000001 onwards
+func nextRequestId(stub *shim.ChaincodeStub) (string, error) {
+	_, id, err := nextFreeId(stub, pendingOfferingSeqStr, "REQ")
+	return id, err
+}
+
+// nextFreeId - the next number of a counter and its id, the prefix followed by the zero padded number, skipping ids
+// a restore or an import already used
+func nextFreeId(stub *shim.ChaincodeStub, key string, prefix string) (int, string, error) {
+	for {
+		seq, err := nextSequence(stub, key)
+		if err != nil {
+			return 0, "", err
+		}
+		id := sequenceId(prefix, seq)
+		existingAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return 0, "", errors.New("Failed to get state for " + id)
+		}
+		if existingAsBytes == nil {
+			return seq, id, nil
+		}
+	}
+}
+
+// sequenceId - the prefix followed by the number zero padded to six digits
+func sequenceId(prefix string, seq int) string {
+	return fmt.Sprintf("%s%06d", prefix, seq)
+}
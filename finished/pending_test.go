@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestStatus(t *testing.T) {
+	for value, want := range map[string]string{"": requestPending, " Pending ": requestPending,
+		"APPROVED": requestApproved, "rejected": requestRejected, "cancelled": requestCancelled} {
+		if got, err := requestStatus(value); got != want || err != nil {
+			t.Errorf("requestStatus(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"open", "canceled", "1"} {
+		if _, err := requestStatus(value); err == nil {
+			t.Errorf("requestStatus(%q) accepted", value)
+		}
+	}
+}
+
+func TestBuildPendingOffering(t *testing.T) {
+	request, err := buildPendingOffering([]string{sequenceId("REQ", 12), "cl1", "p1", "p2", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pendingOffering{Request_ID: "REQ000012", Client_ID: "cl1", Product_ID_1: "p1", Product_ID_2: "p2",
+		Flag: requestPending}
+	if request != want {
+		t.Errorf("request = %+v, want %+v", request, want)
+	}
+	if _, err := buildPendingOffering([]string{"REQ000013", "cl1", "p1", "", ""}); err == nil {
+		t.Error("a request for a single product was accepted")
+	}
+}
+
+func TestMoveRequest(t *testing.T) {
+	request := pendingOffering{Request_ID: "REQ000001", Flag: requestPending}
+	if changed, err := moveRequest(&request, requestPending); changed || err != nil || request.Flag != requestPending {
+		t.Errorf("pending to pending: %v %v %q, want nothing to change", changed, err, request.Flag)
+	}
+	if changed, err := moveRequest(&request, requestApproved); !changed || err != nil || request.Flag != requestApproved {
+		t.Fatalf("pending to approved: %v %v %q", changed, err, request.Flag)
+	}
+	for _, status := range requestStatuses {
+		changed, err := moveRequest(&request, status)
+		if changed || err == nil || !strings.Contains(err.Error(), "REQ000001 is approved") {
+			t.Errorf("approved to %s: %v %v, want it refused", status, changed, err)
+		}
+	}
+	if request.Flag != requestApproved {
+		t.Errorf("a refused change left the flag %q", request.Flag)
+	}
+}
+
+func TestSequenceId(t *testing.T) {
+	if id := sequenceId("REQ", 1); id != "REQ000001" {
+		t.Errorf("sequenceId(REQ, 1) = %s", id)
+	}
+	if id := sequenceId("REQ", 1234567); id != "REQ1234567" {
+		t.Errorf("past six digits: %s, want the number kept whole", id)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// priceEntry - one dated price of a product or offering, both dates inclusive
+type priceEntry struct {
+	Price      Decimal `json:"price"`
+	Start_Date string  `json:"start_date"`
+	End_Date   string  `json:"end_date"`
+}
+
+// pricedRecord - a Product or Offering, the records that carry a price schedule
+type pricedRecord interface {
+	stampedRecord
+	schedule() *[]priceEntry
+	availability() (string, string)
+	currency() string
+	setListPrice(entry priceEntry)
+}
+
+func (p *Product) schedule() *[]priceEntry { return &p.Prices }
+func (p *Product) availability() (string, string) {
+	return p.Availability_Start_Date, p.Availability_End_Date
+}
+func (p *Product) currency() string { return p.Currency }
+func (p *Product) setListPrice(e priceEntry) {
+	p.List_Price, p.Price_Start_Date, p.Price_End_Date = e.Price, e.Start_Date, e.End_Date
+}
+
+func (o *Offering) schedule() *[]priceEntry { return &o.Prices }
+func (o *Offering) availability() (string, string) {
+	return o.Availability_Start_Date, o.Availability_End_Date
+}
+func (o *Offering) currency() string { return o.Currency }
+func (o *Offering) setListPrice(e priceEntry) {
+	o.Current_List_Price, o.Price_Start_Date, o.Price_End_Date = e.Price, e.Start_Date, e.End_Date
+}
+
+// ============================================================================================================================
+// Add price - schedule a new dated price on a product or offering
+//
+// args: id, price, start_date, end_date
+// ============================================================================================================================
+func (t *SimpleChaincode) add_price(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	fmt.Println("- start add price")
+	rec, err := getPricedRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	entry, err := buildPriceEntry(args[1], args[2], args[3], rec.currency())
+	if err != nil {
+		return nil, err
+	}
+	merged, err := addPriceEntry(*rec.schedule(), entry)
+	if err != nil {
+		return nil, err
+	}
+	*rec.schedule() = merged
+	if err := storePricedRecord(stub, args[0], rec); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end add price")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Retire price - drop a scheduled price, or end it today when it is already in force
+//
+// args: id, start_date of the entry
+// ============================================================================================================================
+func (t *SimpleChaincode) retire_price(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	fmt.Println("- start retire price")
+	start, err := canonicalDate("start_date", args[1])
+	if err != nil {
+		return nil, err
+	}
+	today, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := getPricedRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	prices, err := retireEntry(args[0], *rec.schedule(), start, today)
+	if err != nil {
+		return nil, err
+	}
+	*rec.schedule() = prices
+	if err := storePricedRecord(stub, args[0], rec); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end retire price")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get price - the price of a product or offering on a date, optionally converted into another currency
+//
+// args: id, optional date (defaults to the transaction date), optional currency to convert into
+// ============================================================================================================================
+func (t *SimpleChaincode) get_price(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting id, optional date and optional currency")
+	}
+	var date string
+	var err error
+	if len(args) >= 2 && args[1] != "" {
+		date, err = canonicalDate("date", args[1])
+	} else {
+		date, err = txDate(stub)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := requireVisible(stub, args[0]); err != nil {
+		return nil, err
+	}
+	rec, err := getPricedRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := priceOn(*rec.schedule(), date)
+	if !ok {
+		return nil, errors.New("NOT_FOUND: no price for " + args[0] + " on " + date)
+	}
+	var converted *fxConversion
+	if len(args) == 3 && args[2] != "" {
+		to, err := currencyCode(args[2])
+		if err != nil {
+			return nil, err
+		}
+		conversion, err := convertAmount(stub, entry.Price, rec.currency(), to, date)
+		if err != nil {
+			return nil, err
+		}
+		converted = &conversion
+	}
+	return json.Marshal(struct {
+		ID       string `json:"id"`
+		Date     string `json:"date"`
+		Currency string `json:"currency"`
+		priceEntry
+		Converted *fxConversion `json:"converted,omitempty"`
+	}{args[0], date, rec.currency(), entry, converted})
+}
+
+// getPricedRecord - load a product or offering, refusing keys that hold anything else
+func getPricedRecord(stub *shim.ChaincodeStub, id string) (pricedRecord, error) {
+	recAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + id)
+	}
+	return decodePricedRecord(id, recAsBytes)
+}
+
+// decodePricedRecord - the product or offering stored under id as recAsBytes, nil when nothing is stored
+func decodePricedRecord(id string, recAsBytes []byte) (pricedRecord, error) {
+	if recAsBytes == nil {
+		return nil, errors.New("NOT_FOUND: " + id)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(recAsBytes, &fields); err != nil {
+		return nil, errors.New(id + " is not a product or offering")
+	}
+	var rec pricedRecord
+	switch recordKind(fields) {
+	case productImportSpec.name:
+		rec = &Product{}
+	case offeringImportSpec.name:
+		rec = &Offering{}
+	default:
+		return nil, errors.New(id + " is not a product or offering")
+	}
+	if err := json.Unmarshal(recAsBytes, rec); err != nil {
+		return nil, errors.New("Failed to decode " + id)
+	}
+	if len(*rec.schedule()) == 0 {
+		*rec.schedule() = legacySchedule(fields)
+	}
+	return rec, nil
+}
+
+// legacySchedule - records written before price schedules existed have a single list price
+func legacySchedule(fields map[string]interface{}) []priceEntry {
+	price, ok := fieldDecimal(fields, "list_price")
+	if !ok {
+		price, ok = fieldDecimal(fields, "current_list_price")
+	}
+	start, startOk := recordDate(fields, "price_start_date")
+	end, endOk := recordDate(fields, "price_end_date")
+	if !ok || !startOk || !endOk {
+		return []priceEntry{}
+	}
+	return []priceEntry{{price, start, end}}
+}
+
+// storePricedRecord - check the schedule, refresh the list price and write the record back
+func storePricedRecord(stub *shim.ChaincodeStub, id string, rec pricedRecord) error {
+	if err := checkSchedule(rec); err != nil {
+		return err
+	}
+	if err := refreshListPrice(stub, rec); err != nil {
+		return err
+	}
+	if err := stampRecord(stub, id, rec); err != nil {
+		return err
+	}
+	recAsBytes, _ := json.Marshal(rec)
+	if err := stub.PutState(id, recAsBytes); err != nil {
+		return errors.New("Failed to store " + id)
+	}
+	return nil
+}
+
+// mergeStoredSchedule - re-running init_product/init_offering keeps the prices already scheduled,
+// the price given in the arguments is added to them like add_price would. An offering keeps its tier tables too.
+// The currency only changes once every stored price has ended or been retired to end today, the new currency starts
+// a new schedule.
+func mergeStoredSchedule(stub *shim.ChaincodeStub, id string, rec pricedRecord) error {
+	recAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return errors.New("Failed to get state for " + id)
+	}
+	if recAsBytes == nil {
+		return nil //nothing stored yet
+	}
+	stored, err := getPricedRecord(stub, id)
+	if err != nil {
+		return err
+	}
+	if _, isProduct := rec.(*Product); isProduct != (recordKindOf(stored) == productImportSpec.name) {
+		return errors.New(id + " is already one of the " + recordKindOf(stored))
+	}
+	merged := *stored.schedule()
+	if stored.currency() != rec.currency() {
+		today, err := txDate(stub)
+		if err != nil {
+			return err
+		}
+		for _, entry := range merged {
+			if entry.End_Date > today {
+				return errors.New(id + " has prices in " + stored.currency() + " until " + entry.End_Date +
+					", retire them with retire_price before changing the currency")
+			}
+		}
+		merged = []priceEntry{}
+	}
+	for _, entry := range *rec.schedule() {
+		if merged, err = addPriceEntry(merged, entry); err != nil {
+			return errors.New(err.Error() + ", use add_price and retire_price to change scheduled prices")
+		}
+	}
+	*rec.schedule() = merged
+	if offering, ok := rec.(*Offering); ok && len(offering.Tiers) == 0 {
+		if storedOffering, ok := stored.(*Offering); ok {
+			offering.Tiers = storedOffering.Tiers
+		}
+	}
+	return nil
+}
+
+// recordKindOf - products or offerings, the import section of a priced record
+func recordKindOf(rec pricedRecord) string {
+	if _, ok := rec.(*Product); ok {
+		return productImportSpec.name
+	}
+	return offeringImportSpec.name
+}
+
+// refreshListPrice - the list price fields show the price in force on the transaction date. When nothing is
+// in force they show the next scheduled price, or failing that the last one.
+func refreshListPrice(stub *shim.ChaincodeStub, rec pricedRecord) error {
+	today, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+	if entry, ok := listEntry(*rec.schedule(), today); ok {
+		rec.setListPrice(entry)
+	}
+	return nil
+}
+
+// listEntry - the entry the list price fields show on a day, see refreshListPrice. False for an empty schedule.
+func listEntry(prices []priceEntry, today string) (priceEntry, bool) {
+	if len(prices) == 0 {
+		return priceEntry{}, false
+	}
+	if entry, ok := priceOn(prices, today); ok {
+		return entry, true
+	}
+	for _, e := range prices {
+		if e.Start_Date > today {
+			return e, true
+		}
+	}
+	return prices[len(prices)-1], true
+}
+
+// checkSchedule - every entry lies inside the availability window, the entries are sorted and never overlap
+func checkSchedule(rec pricedRecord) error {
+	availStart, availEnd := rec.availability()
+	prices := *rec.schedule()
+	sort.Sort(byStartDate(prices))
+	for i, e := range prices {
+		if err := checkAmount("price starting "+e.Start_Date, e.Price, rec.currency()); err != nil {
+			return err
+		}
+		if err := checkWindow("start_date", e.Start_Date, "end_date", e.End_Date); err != nil {
+			return err
+		}
+		if err := checkWithin("price window", e.Start_Date, e.End_Date, "availability window", availStart, availEnd); err != nil {
+			return err
+		}
+		if i > 0 && prices[i-1].End_Date >= e.Start_Date {
+			return errors.New("Price starting " + e.Start_Date + " overlaps the price starting " + prices[i-1].Start_Date)
+		}
+	}
+	return nil
+}
+
+// addPriceEntry - add an entry to a schedule, an identical entry already scheduled is not an overlap
+func addPriceEntry(prices []priceEntry, entry priceEntry) ([]priceEntry, error) {
+	for _, e := range prices {
+		if e.Price.Equal(entry.Price) && e.Start_Date == entry.Start_Date && e.End_Date == entry.End_Date {
+			return prices, nil
+		}
+		if e.Start_Date <= entry.End_Date && entry.Start_Date <= e.End_Date {
+			return nil, errors.New("Price " + entry.Start_Date + " to " + entry.End_Date + " overlaps the price " + e.Start_Date + " to " + e.End_Date)
+		}
+	}
+	merged := append(append([]priceEntry{}, prices...), entry)
+	sort.Sort(byStartDate(merged))
+	return merged, nil
+}
+
+// retireEntry - retire the entry of id's schedule starting on start: one in force ends today, one not in force yet is
+// removed. An entry that has ended stays as it was.
+func retireEntry(id string, prices []priceEntry, start string, today string) ([]priceEntry, error) {
+	found := -1
+	for i, e := range prices {
+		if e.Start_Date == start {
+			found = i
+		}
+	}
+	switch {
+	case found < 0:
+		return nil, errors.New("NOT_FOUND: no price starting " + start + " on " + id)
+	case prices[found].End_Date < today:
+		return nil, errors.New("Price starting " + start + " has already ended and cannot be retired")
+	case prices[found].Start_Date > today:
+		return append(prices[:found:found], prices[found+1:]...), nil //not in force yet, remove it
+	}
+	retired := append([]priceEntry{}, prices...)
+	retired[found].End_Date = today //in force, it ends today
+	return retired, nil
+}
+
+func priceOn(prices []priceEntry, date string) (priceEntry, bool) {
+	for _, e := range prices {
+		if e.Start_Date <= date && date <= e.End_Date {
+			return e, true
+		}
+	}
+	return priceEntry{}, false
+}
+
+func buildPriceEntry(price string, start string, end string, currency string) (priceEntry, error) {
+	value, err := parseAmount("price", price, currency)
+	if err != nil {
+		return priceEntry{}, err
+	}
+	entry := priceEntry{Price: value}
+	if entry.Start_Date, err = canonicalDate("start_date", start); err != nil {
+		return priceEntry{}, err
+	}
+	if entry.End_Date, err = canonicalDate("end_date", end); err != nil {
+		return priceEntry{}, err
+	}
+	return entry, checkWindow("start_date", entry.Start_Date, "end_date", entry.End_Date)
+}
+
+type byStartDate []priceEntry
+
+func (s byStartDate) Len() int           { return len(s) }
+func (s byStartDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStartDate) Less(i, j int) bool { return s[i].Start_Date < s[j].Start_Date }
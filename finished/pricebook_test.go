@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testSchedule - 10.00 in the first half of 2016 and 12.00 in the second
+func testSchedule(t *testing.T) []priceEntry {
+	prices := []priceEntry{}
+	for _, e := range [][3]string{{"12", "2016-07-01", "2016-12-31"}, {"10", "2016-01-01", "2016-06-30"}} {
+		entry, err := buildPriceEntry(e[0], e[1], e[2], "USD")
+		if err != nil {
+			t.Fatalf("buildPriceEntry(%v): %v", e, err)
+		}
+		if prices, err = addPriceEntry(prices, entry); err != nil {
+			t.Fatalf("addPriceEntry(%v): %v", e, err)
+		}
+	}
+	return prices
+}
+
+// describePrices - a schedule as "price start..end" entries
+func describePrices(prices []priceEntry) string {
+	out := []string{}
+	for _, e := range prices {
+		out = append(out, e.Price.String()+" "+e.Start_Date+".."+e.End_Date)
+	}
+	return strings.Join(out, ", ")
+}
+
+func TestAddPriceEntry(t *testing.T) {
+	if got := describePrices(testSchedule(t)); got != "10.00 2016-01-01..2016-06-30, 12.00 2016-07-01..2016-12-31" {
+		t.Fatalf("schedule = %s, want the entries sorted by start date", got)
+	}
+	add := func(price, start, end string) ([]priceEntry, error) {
+		entry, err := buildPriceEntry(price, start, end, "USD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addPriceEntry(testSchedule(t), entry)
+	}
+
+	// next year's price is scheduled without touching this year's
+	prices, err := add("14", "2017-01-01", "2017-12-31")
+	if err != nil || len(prices) != 3 || prices[2].Price.String() != "14.00" {
+		t.Errorf("next year: %s, %v", describePrices(prices), err)
+	}
+	prices, err = add("9", "2015-01-01", "2015-12-31")
+	if err != nil || prices[0].Start_Date != "2015-01-01" {
+		t.Errorf("last year: %s, %v, want it first", describePrices(prices), err)
+	}
+	// sending the same entry again is not an overlap, so an add_price can be retried
+	if prices, err = add("10", "2016-01-01", "2016-06-30"); err != nil || len(prices) != 2 {
+		t.Errorf("the same entry again: %s, %v", describePrices(prices), err)
+	}
+
+	for _, overlapping := range [][3]string{
+		{"11", "2016-01-01", "2016-06-30"},
+		{"14", "2016-12-31", "2017-12-31"},
+		{"14", "2016-03-01", "2016-03-31"},
+		{"14", "2015-01-01", "2017-12-31"},
+	} {
+		if prices, err := add(overlapping[0], overlapping[1], overlapping[2]); err == nil {
+			t.Errorf("%v overlaps but gave %s", overlapping, describePrices(prices))
+		}
+	}
+}
+
+func TestPriceOnAndListEntry(t *testing.T) {
+	prices := testSchedule(t)
+	for date, want := range map[string]string{"2016-01-01": "10.00", "2016-06-30": "10.00", "2016-07-01": "12.00",
+		"2016-12-31": "12.00"} {
+		if entry, ok := priceOn(prices, date); !ok || entry.Price.String() != want {
+			t.Errorf("priceOn(%s) = %s %v, want %s", date, entry.Price, ok, want)
+		}
+	}
+	for _, date := range []string{"2015-12-31", "2017-01-01"} {
+		if entry, ok := priceOn(prices, date); ok {
+			t.Errorf("priceOn(%s) = %s, want no price outside the schedule", date, entry.Price)
+		}
+	}
+
+	// the list price fields show the price in force, else the next one, else the last one
+	if entry, _ := listEntry(prices, "2016-08-15"); entry.Price.String() != "12.00" {
+		t.Errorf("list price in August = %s", entry.Price)
+	}
+	if entry, _ := listEntry(prices, "2015-06-01"); entry.Start_Date != "2016-01-01" {
+		t.Errorf("list price before the schedule starts from %s, want the next price", entry.Start_Date)
+	}
+	if entry, _ := listEntry(prices, "2018-01-01"); entry.Start_Date != "2016-07-01" {
+		t.Errorf("list price after the schedule starts from %s, want the last price", entry.Start_Date)
+	}
+	if _, ok := listEntry(nil, "2016-08-15"); ok {
+		t.Error("an empty schedule has a list price")
+	}
+}
+
+func TestRetireEntry(t *testing.T) {
+	today := "2016-03-15"
+
+	prices, err := retireEntry("p1", testSchedule(t), "2016-01-01", today)
+	if err != nil || describePrices(prices) != "10.00 2016-01-01..2016-03-15, 12.00 2016-07-01..2016-12-31" {
+		t.Errorf("retiring the price in force: %s, %v, want it to end today", describePrices(prices), err)
+	}
+
+	schedule := testSchedule(t)
+	prices, err = retireEntry("p1", schedule, "2016-07-01", today)
+	if err != nil || describePrices(prices) != "10.00 2016-01-01..2016-06-30" {
+		t.Errorf("retiring a future price: %s, %v, want it removed", describePrices(prices), err)
+	}
+	if len(schedule) != 2 || schedule[1].Start_Date != "2016-07-01" {
+		t.Errorf("retiring changed the schedule it was given: %s", describePrices(schedule))
+	}
+
+	if _, err := retireEntry("p1", testSchedule(t), "2016-01-01", "2016-07-01"); err == nil {
+		t.Error("retired a price that has already ended")
+	}
+	if _, err := retireEntry("p1", testSchedule(t), "2016-02-01", today); err == nil || !strings.HasPrefix(err.Error(), "NOT_FOUND") {
+		t.Errorf("retiring a start date with no price: %v", err)
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	product := &Product{Currency: "USD", Availability_Start_Date: "2016-01-01", Availability_End_Date: "2016-12-31"}
+	product.Prices = testSchedule(t)
+	product.Prices[0], product.Prices[1] = product.Prices[1], product.Prices[0]
+	if err := checkSchedule(product); err != nil || product.Prices[0].Start_Date != "2016-01-01" {
+		t.Errorf("a valid schedule given out of order: %v, %s", err, describePrices(product.Prices))
+	}
+	product.Availability_End_Date = "2016-09-30"
+	if err := checkSchedule(product); err == nil {
+		t.Error("a price beyond the availability window was accepted")
+	}
+}
+
+func TestBuildPriceEntry(t *testing.T) {
+	if entry, err := buildPriceEntry("1000", "2016-01-01T12:00:00Z", "2016-01-01", "JPY"); err != nil ||
+		entry.Price.String() != "1000" || entry.Start_Date != "2016-01-01" {
+		t.Errorf("a one day JPY price: %+v, %v", entry, err)
+	}
+	for _, bad := range [][4]string{
+		{"10.5", "2016-01-01", "2016-12-31", "JPY"},
+		{"-10", "2016-01-01", "2016-12-31", "USD"},
+		{"ten", "2016-01-01", "2016-12-31", "USD"},
+		{"10", "2016-12-31", "2016-01-01", "USD"},
+		{"10", "01/01/2016", "2016-12-31", "USD"},
+		{"10", "2016-01-01", "2016-02-30", "USD"},
+	} {
+		if _, err := buildPriceEntry(bad[0], bad[1], bad[2], bad[3]); err == nil {
+			t.Errorf("buildPriceEntry%q accepted", bad)
+		}
+	}
+}
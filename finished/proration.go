@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// adjustmentsPrefix - the prorated adjustments waiting for a contract's next invoice are kept under _adjustments_<id>
+const adjustmentsPrefix = "_adjustments_"
+
+// adjustmentLine - the prorated difference the new terms of a contract make to one item of an invoice already issued,
+// for the days of its period from the change on. Amounts are in the contract currency and after the discount;
+// a negative Amount is a credit.
+type adjustmentLine struct {
+	Invoice_ID   string  `json:"invoice_id"`
+	Item_Type    string  `json:"item_type"`
+	Item_ID      string  `json:"item_id"`
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Days         int     `json:"days"`         //days from the change to the end of the invoiced period, inside the old term
+	Charged_Days int     `json:"charged_days"` //the same days inside the new term
+	Period_Days  int     `json:"period_days"`
+	Credit       Decimal `json:"credit"` //the old terms' charge for Days
+	Charge       Decimal `json:"charge"` //the new terms' charge for Charged_Days
+	Amount       Decimal `json:"amount"` //Charge less Credit
+	Reason       string  `json:"reason"`
+}
+
+// prorationPreview - the preview_proration result
+type prorationPreview struct {
+	Contract_ID    string           `json:"contract_id"`
+	Effective_Date string           `json:"effective_date"`
+	Currency       string           `json:"currency"`
+	Lines          []adjustmentLine `json:"lines"`
+	Total          Decimal          `json:"total"`
+}
+
+// ============================================================================================================================
+// Preview proration - the adjustments an amendment would make to what is already invoiced, nothing is stored
+//
+// args: contract_id, effective_date, changes (as for amend_contract)
+// ============================================================================================================================
+func (t *SimpleChaincode) preview_proration(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	terms, err := getContractTerms(stub, contract)
+	if err != nil {
+		return nil, err
+	}
+	amendment, amended, err := proposeAmendment(stub, contract, terms, args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	lines, err := prorateChange(stub, amended, amendment.Effective_Date, "preview")
+	if err != nil {
+		return nil, err
+	}
+	preview := prorationPreview{Contract_ID: args[0], Effective_Date: amendment.Effective_Date, Currency: amended.Currency, Lines: lines}
+	for _, line := range lines {
+		preview.Total = preview.Total.Add(line.Amount)
+	}
+	return json.Marshal(preview)
+}
+
+// ============================================================================================================================
+// Get pending adjustments - the prorated adjustments the next invoice of a contract will carry
+//
+// args: contract_id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_pending_adjustments(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if _, err := getContract(stub, args[0]); err != nil {
+		return nil, err
+	}
+	lines, err := getAdjustments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(lines)
+}
+
+// prorateContractChange - store the adjustments new terms from a date on make to the invoices already issued for an
+// active contract, for its next invoice
+func prorateContractChange(stub *shim.ChaincodeStub, contract Contract, from string, reason string) error {
+	lines, err := prorateChange(stub, contract, from, reason)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	pending, err := getAdjustments(stub, contract.Contract_ID)
+	if err != nil {
+		return err
+	}
+	return putAdjustments(stub, contract.Contract_ID, append(pending, lines...))
+}
+
+// prorateChange - by day count, what the new terms of a contract change on each invoice that is not void and bills
+// days from the change date on. The stored terms, which earlier adjustments already brought the invoice in line
+// with, are credited for those days inside the stored term, and the new terms are charged for the days inside the
+// new term. Only active contracts are prorated.
+func prorateChange(stub *shim.ChaincodeStub, contract Contract, from string, reason string) ([]adjustmentLine, error) {
+	lines := []adjustmentLine{}
+	stored, err := getContract(stub, contract.Contract_ID)
+	if err != nil || contractStatus(stored.Status) != contractActive {
+		return lines, nil //a new contract or a draft has nothing billed yet
+	}
+	invoices, err := contractInvoices(stub, contract.Contract_ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, invoice := range invoices {
+		if invoice.Status == invoiceVoid || invoice.Settlement || invoice.Period_End < from {
+			continue
+		}
+		if contract.Currency != stored.Currency {
+			return nil, errors.New("Contract " + contract.Contract_ID + " is invoiced in " + stored.Currency + ", its currency cannot change")
+		}
+		prorated, err := prorateInvoice(stub, invoice, stored, contract, from, reason)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, prorated...)
+	}
+	return lines, nil
+}
+
+// prorateInvoice - what changing an invoice's contract from the old to the new terms on a date makes to the days of
+// its period from that date on, by item. Tiered offerings are priced as of the period start, like the invoice was.
+func prorateInvoice(stub *shim.ChaincodeStub, invoice Invoice, old Contract, contract Contract, from string, reason string) ([]adjustmentLine, error) {
+	oldItems, oldNet, err := netRates(stub, old, invoice.Period_Start)
+	if err != nil {
+		return nil, err
+	}
+	newItems, newNet, err := netRates(stub, contract, invoice.Period_Start)
+	if err != nil {
+		return nil, err
+	}
+	return prorateNet(invoice, netTerms{old, oldItems, oldNet}, netTerms{contract, newItems, newNet}, from, reason), nil
+}
+
+// netTerms - a contract with its items and their net rates for an invoice period, as netRates gives them
+type netTerms struct {
+	contract Contract
+	items    []contractItem
+	net      map[string]Decimal
+}
+
+// prorateNet - the adjustment lines of prorateInvoice: each item of either terms is credited at its old net rate
+// for the days left of the old term and charged at its new one for the days left of the new term
+func prorateNet(invoice Invoice, old netTerms, updated netTerms, from string, reason string) []adjustmentLine {
+	lines := []adjustmentLine{}
+	items := old.items
+	for _, item := range updated.items {
+		if _, found := old.net[item.id]; !found {
+			items = append(items, item)
+		}
+	}
+	scale := currencyMinorUnits[updated.contract.Currency]
+	start := invoice.Period_Start
+	if from > start {
+		start = from
+	}
+	periodDays := dayCount(invoice.Period_Start, invoice.Period_End)
+	if invoice.Period_Days > periodDays {
+		periodDays = invoice.Period_Days //a cut period was billed for its share of the full period
+	}
+	if periodDays <= 0 {
+		return lines
+	}
+	days := termDays(old.contract, start, invoice.Period_End)
+	chargedDays := termDays(updated.contract, start, invoice.Period_End)
+	for _, item := range items {
+		line := adjustmentLine{Invoice_ID: invoice.Invoice_ID, Item_Type: item.itemType, Item_ID: item.id,
+			From: start, To: invoice.Period_End, Days: days, Charged_Days: chargedDays, Period_Days: periodDays, Reason: reason}
+		line.Credit = old.net[item.id].ProRata(int64(days), int64(periodDays), scale)
+		line.Charge = updated.net[item.id].ProRata(int64(chargedDays), int64(periodDays), scale)
+		line.Amount = line.Charge.Sub(line.Credit)
+		if !line.Amount.IsZero() {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// netRates - the items of a contract and what each is billed for the period starting on the date, after the
+// contract discount
+func netRates(stub *shim.ChaincodeStub, contract Contract, date string) ([]contractItem, map[string]Decimal, error) {
+	items := contractItems(contract)
+	net := map[string]Decimal{}
+	for _, item := range items {
+		line, err := itemLine(stub, contract, item, date)
+		if err != nil {
+			return nil, nil, err
+		}
+		net[item.id] = line.Line_Total.Sub(line.Line_Total.Percent(contract.Discount_Percent).RoundTo(contract.Currency))
+	}
+	return items, net, nil
+}
+
+// termDays - the days from start to end that fall inside the contract term
+func termDays(contract Contract, start string, end string) int {
+	if contract.Contract_Start_Date > start {
+		start = contract.Contract_Start_Date
+	}
+	if contract.Contract_End_Date < end {
+		end = contract.Contract_End_Date
+	}
+	if start > end {
+		return 0
+	}
+	return dayCount(start, end)
+}
+
+// takeAdjustments - the pending adjustments of a contract, cleared so no other invoice carries them
+func takeAdjustments(stub *shim.ChaincodeStub, contractId string) ([]adjustmentLine, error) {
+	lines, err := getAdjustments(stub, contractId)
+	if err != nil || len(lines) == 0 {
+		return lines, err
+	}
+	if err := stub.DelState(adjustmentsPrefix + contractId); err != nil {
+		return nil, errors.New("Failed to clear the adjustments of " + contractId)
+	}
+	return lines, nil
+}
+
+func getAdjustments(stub *shim.ChaincodeStub, contractId string) ([]adjustmentLine, error) {
+	linesAsBytes, err := stub.GetState(adjustmentsPrefix + contractId)
+	if err != nil {
+		return nil, errors.New("Failed to get the adjustments of " + contractId)
+	}
+	lines := []adjustmentLine{}
+	if linesAsBytes != nil {
+		if err := json.Unmarshal(linesAsBytes, &lines); err != nil {
+			return nil, errors.New("Failed to decode the adjustments of " + contractId)
+		}
+	}
+	return lines, nil
+}
+
+func putAdjustments(stub *shim.ChaincodeStub, contractId string, lines []adjustmentLine) error {
+	linesAsBytes, _ := json.Marshal(lines)
+	if err := stub.PutState(adjustmentsPrefix+contractId, linesAsBytes); err != nil {
+		return errors.New("Failed to store the adjustments of " + contractId)
+	}
+	fmt.Println("! " + contractId + " has adjustments for its next invoice")
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// ratedTerms - a 2016 USD contract whose items bill the given net rates per period, as "type:id" => rate
+func ratedTerms(t *testing.T, end string, rates map[string]string) netTerms {
+	n := netTerms{contract: Contract{Contract_Start_Date: "2016-01-01", Contract_End_Date: end, Currency: "USD"},
+		net: map[string]Decimal{}}
+	for _, key := range []string{"offering:o1", "offering:o2", "product:p1"} {
+		if rate, ok := rates[key]; ok {
+			kind := strings.SplitN(key, ":", 2)
+			n.items = append(n.items, contractItem{itemType: kind[0], id: kind[1]})
+			n.net[kind[1]] = mustDecimal(t, rate)
+		}
+	}
+	return n
+}
+
+// adjustments - the lines as "id days/charged_days/period_days -credit +charge = amount"
+func adjustments(lines []adjustmentLine) string {
+	out := []string{}
+	for _, l := range lines {
+		out = append(out, fmt.Sprintf("%s %d/%d/%d -%s +%s = %s", l.Item_ID, l.Days, l.Charged_Days, l.Period_Days,
+			l.Credit, l.Charge, l.Amount))
+	}
+	return strings.Join(out, "; ")
+}
+
+func TestProrateNet(t *testing.T) {
+	q1 := Invoice{Invoice_ID: "INV-c1-000001", Period_Start: "2016-01-01", Period_End: "2016-03-31"}
+	before := ratedTerms(t, "2016-12-31", map[string]string{"offering:o1": "300.00", "product:p1": "91.00"})
+
+	// o1 doubles from March: 31 of the quarter's 91 days are credited at 300 and charged at 600
+	doubled := ratedTerms(t, "2016-12-31", map[string]string{"offering:o1": "600.00", "product:p1": "91.00"})
+	lines := prorateNet(q1, before, doubled, "2016-03-01", "amendment")
+	if got := adjustments(lines); got != "o1 31/31/91 -102.20 +204.40 = 102.20" {
+		t.Errorf("rate doubled: %s", got)
+	}
+	if lines[0].From != "2016-03-01" || lines[0].To != "2016-03-31" || lines[0].Invoice_ID != q1.Invoice_ID || lines[0].Reason != "amendment" {
+		t.Errorf("line = %+v", lines[0])
+	}
+
+	// a change before the period starts reprices the whole period, unchanged items make no line
+	if got := adjustments(prorateNet(q1, before, doubled, "2015-12-01", "amendment")); got != "o1 91/91/91 -300.00 +600.00 = 300.00" {
+		t.Errorf("changed from before the period: %s", got)
+	}
+
+	// swapping p1 for o2 credits one and charges the other
+	swapped := ratedTerms(t, "2016-12-31", map[string]string{"offering:o1": "300.00", "offering:o2": "45.50"})
+	if got := adjustments(prorateNet(q1, before, swapped, "2016-03-01", "amendment")); got !=
+		"p1 31/31/91 -31.00 +0.00 = -31.00; o2 31/31/91 -0.00 +15.50 = 15.50" {
+		t.Errorf("item swapped: %s", got)
+	}
+
+	// ending the contract on March 15 credits the days after it at no charge
+	shortened := ratedTerms(t, "2016-03-15", map[string]string{"offering:o1": "300.00", "product:p1": "91.00"})
+	if got := adjustments(prorateNet(q1, before, shortened, "2016-03-01", "termination")); got !=
+		"o1 31/15/91 -102.20 +49.45 = -52.75; p1 31/15/91 -31.00 +15.00 = -16.00" {
+		t.Errorf("term shortened: %s", got)
+	}
+
+	if lines := prorateNet(q1, before, before, "2016-03-01", "amendment"); len(lines) != 0 {
+		t.Errorf("the same terms: %s", adjustments(lines))
+	}
+}
+
+// a period cut to the contract term was billed its share of the full period, so it is prorated over the full one
+func TestProrateNetOverACutPeriod(t *testing.T) {
+	january := Invoice{Invoice_ID: "INV-c1-000001", Period_Start: "2016-01-01", Period_End: "2016-01-31", Period_Days: 92}
+	before := ratedTerms(t, "2016-12-31", map[string]string{"offering:o1": "92.00"})
+	after := ratedTerms(t, "2016-12-31", map[string]string{"offering:o1": "184.00"})
+	if got := adjustments(prorateNet(january, before, after, "2016-01-17", "amendment")); got != "o1 15/15/92 -15.00 +30.00 = 15.00" {
+		t.Errorf("cut January: %s", got)
+	}
+}
+
+func TestTermDaysAndDayCount(t *testing.T) {
+	contract := Contract{Contract_Start_Date: "2016-01-15", Contract_End_Date: "2016-12-31"}
+	for period, want := range map[[2]string]int{
+		{"2016-01-01", "2016-03-31"}: 77,  //the term starts inside the period
+		{"2016-10-01", "2017-03-31"}: 92,  //and ends inside it
+		{"2016-12-31", "2016-12-31"}: 1,   //its last day
+		{"2017-01-01", "2017-03-31"}: 0,   //after it
+		{"2015-10-01", "2015-12-31"}: 0,   //before it
+		{"2015-01-01", "2017-12-31"}: 352, //around it
+	} {
+		if got := termDays(contract, period[0], period[1]); got != want {
+			t.Errorf("termDays%v = %d, want %d", period, got, want)
+		}
+	}
+
+	if dayCount("2016-01-01", "2016-12-31") != 366 || dayCount("2017-01-01", "2017-12-31") != 365 {
+		t.Error("a year is not counted in days")
+	}
+	// days are calendar days, a daylight saving change is still one day
+	if dayCount("2016-03-26", "2016-03-28") != 3 || dayCount("2016-10-29", "2016-10-31") != 3 {
+		t.Error("daylight saving weekends")
+	}
+	if dayCount("2016-02-01", "2016-01-31") != 0 || dayCount("2016-02-30", "2016-03-01") != 0 {
+		t.Error("a reversed period or a bad date has days")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var quoteIndexStr = "_quoteindex"
+var quoteSeqStr = "_quoteSeq"
+
+// quote statuses, an open quote past its Valid_Until date can no longer be accepted
+const (
+	quoteOpen     = "open"
+	quoteAccepted = "accepted"
+)
+
+// maxQuoteValidDays - quotes are valid for at most a year
+const maxQuoteValidDays = 365
+
+// a contract has 4 offering and 6 product slots, a quote must fit in them to be accepted
+const contractOfferingSlots = 4
+const contractProductSlots = 6
+
+var quoteImportSpec = importSpec{"quotes", quoteIndexStr, nil, "", nil, nil}
+
+// Quote - a priced, hypothetical deal for a client. Every amount is in the quote currency.
+type Quote struct {
+	Quote_ID             string      `json:"quote_id"`
+	Client_ID            string      `json:"client_id"`
+	Supplier_ID          string      `json:"supplier_id"`
+	Currency             string      `json:"currency"`
+	Lines                []quoteLine `json:"lines"`
+	Subtotal             Decimal     `json:"subtotal"`
+	Discount_Percent     Decimal     `json:"discount_percent"`
+	Discount_Amount      Decimal     `json:"discount_amount"`
+	Total                Decimal     `json:"total"`
+	Valid_From           string      `json:"valid_from"`
+	Valid_Until          string      `json:"valid_until"`
+	Status               string      `json:"status"`
+	Accepted_Contract_ID string      `json:"accepted_contract_id"`
+	Created_At           string      `json:"created_at"`
+	Updated_At           string      `json:"updated_at"`
+	Doc_Type             string      `json:"doc_type"`
+}
+
+// quoteLine - one offering or product of a quote. Unit_Price is the client's contract rate when one of the
+// client's contracts in force covers the item, otherwise the list price, converted into the quote currency. An
+// offering with a tier table is priced from its tiers instead of its list price, Unit_Price is then the average.
+type quoteLine struct {
+	Item_Type       string        `json:"item_type"` //offering or product
+	Item_ID         string        `json:"item_id"`
+	Quantity        int           `json:"quantity"`
+	Price_Source    string        `json:"price_source"` //list, contract, or graduated or volume for tiered offerings
+	Source_ID       string        `json:"source_id"`    //the contract whose rate was used
+	Source_Price    Decimal       `json:"source_price"`
+	Source_Currency string        `json:"source_currency"`
+	Conversion      *fxConversion `json:"conversion,omitempty"`
+	Unit_Price      Decimal       `json:"unit_price"`
+	Line_Total      Decimal       `json:"line_total"`
+	Tiers           []tierBand    `json:"tiers,omitempty"`
+}
+
+// quoteItem - one entry of the generate_quote items argument
+type quoteItem struct {
+	Offering_ID string `json:"offering_id"`
+	Product_ID  string `json:"product_id"`
+	Quantity    int    `json:"quantity"`
+}
+
+func (q *Quote) setTimestamps(created_at string, updated_at string) {
+	q.Created_At, q.Updated_At, q.Doc_Type = created_at, updated_at, quoteImportSpec.name
+}
+
+// ============================================================================================================================
+// Generate quote - price offerings and products for a client and store the result as a Quote
+//
+// items is a JSON array such as [{"offering_id": "o1", "quantity": 2}, {"product_id": "p1", "quantity": 1}]. The
+// quote can be accepted on valid_days days, the day it is generated included.
+// args: client_id, supplier_id, currency, items, discount_percent, valid_days
+// ============================================================================================================================
+func (t *SimpleChaincode) generate_quote(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+	fmt.Println("- start generate quote")
+	if _, ok := loadRecord(stub, args[0], clientImportSpec.name); !ok {
+		return nil, errors.New("NOT_FOUND: client " + args[0])
+	}
+	if err := checkContractSupplier(stub, args[1]); err != nil {
+		return nil, err
+	}
+	currency, err := currencyCode(args[2])
+	if err != nil {
+		return nil, err
+	}
+	var items []quoteItem
+	if err := json.Unmarshal([]byte(args[3]), &items); err != nil || len(items) == 0 {
+		return nil, errors.New("items must be a non-empty JSON array of {offering_id or product_id, quantity}")
+	}
+	discount, err := parsePercent("discount_percent", args[4])
+	if err != nil {
+		return nil, err
+	}
+	validDays, err := strconv.Atoi(strings.TrimSpace(args[5]))
+	if err != nil || validDays < 1 || validDays > maxQuoteValidDays {
+		return nil, errors.New("valid_days must be a whole number of days between 1 and " + strconv.Itoa(maxQuoteValidDays))
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today := now.Format(dateLayout)
+
+	rates, err := clientContractRates(stub, args[0], today)
+	if err != nil {
+		return nil, err
+	}
+	quote := Quote{
+		Client_ID:        args[0],
+		Supplier_ID:      args[1],
+		Currency:         currency,
+		Lines:            []quoteLine{},
+		Discount_Percent: discount,
+		Valid_From:       today,
+		Valid_Until:      quoteValidUntil(today, validDays),
+		Status:           quoteOpen,
+	}
+	for i, item := range items {
+		line, err := priceQuoteItem(stub, item, rates, currency, today)
+		if err != nil {
+			return nil, errors.New("item " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		for _, l := range quote.Lines {
+			if l.Item_ID == line.Item_ID {
+				return nil, errors.New("item " + strconv.Itoa(i+1) + ": " + line.Item_ID + " is quoted twice")
+			}
+		}
+		quote.Lines = append(quote.Lines, line)
+	}
+	if err := totalQuote(&quote); err != nil {
+		return nil, err
+	}
+
+	if _, quote.Quote_ID, err = nextFreeId(stub, quoteSeqStr, "QUO"); err != nil {
+		return nil, err
+	}
+	if err := storeQuote(stub, &quote); err != nil {
+		return nil, err
+	}
+	if err := addToIndexes(stub, quote.Quote_ID, quoteIndexStr); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end generate quote")
+	return json.Marshal(quote)
+}
+
+// totalQuote - the subtotal, discount and total of a quote's lines, which must fit in the slots of a contract
+func totalQuote(quote *Quote) error {
+	offerings, products := 0, 0
+	quote.Subtotal = Decimal{}
+	for _, line := range quote.Lines {
+		if line.Item_Type == "offering" {
+			offerings++
+		} else {
+			products++
+		}
+		quote.Subtotal = quote.Subtotal.Add(line.Line_Total)
+	}
+	if offerings > contractOfferingSlots || products > contractProductSlots {
+		return errors.New("A quote holds at most " + strconv.Itoa(contractOfferingSlots) + " offerings and " +
+			strconv.Itoa(contractProductSlots) + " products, the slots of a contract")
+	}
+	quote.Subtotal = quote.Subtotal.RoundTo(quote.Currency)
+	quote.Discount_Amount = quote.Subtotal.Percent(quote.Discount_Percent).RoundTo(quote.Currency)
+	quote.Total = quote.Subtotal.Sub(quote.Discount_Amount)
+	return nil
+}
+
+// quoteValidUntil - the last day a quote generated on a day can be accepted on, valid for validDays days in all
+func quoteValidUntil(today string, validDays int) string {
+	from, err := time.Parse(dateLayout, today)
+	if err != nil {
+		return today
+	}
+	return from.AddDate(0, 0, validDays-1).Format(dateLayout)
+}
+
+// ============================================================================================================================
+// Accept quote - turn an open, unexpired quote into a draft contract at the quoted unit prices, quantities and
+// discount. Offerings the quote priced from their tiers stay tiered on the contract.
+//
+// args: quote_id, contract_id, contract_start_date, contract_end_date
+// ============================================================================================================================
+func (t *SimpleChaincode) accept_quote(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	fmt.Println("- start accept quote")
+	quote, err := getQuote(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	today, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if quote.Status != quoteOpen {
+		return nil, errors.New("Quote " + args[0] + " is " + quote.Status + " already")
+	}
+	if today > quote.Valid_Until {
+		return nil, errors.New("Quote " + args[0] + " expired on " + quote.Valid_Until)
+	}
+	if err := requireArgs(args, 2); err != nil {
+		return nil, err
+	}
+	existingAsBytes, err := stub.GetState(args[1])
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + args[1])
+	}
+	if existingAsBytes != nil {
+		return nil, errors.New(args[1] + " is already in use")
+	}
+
+	//lay the quote out as init_contract arguments so it goes through the same validation
+	contractArgs := make([]string, len(contractFields))
+	for i := 6; i < 16; i++ {
+		contractArgs[i] = "0"
+	}
+	contractArgs[0], contractArgs[1] = args[1], quote.Client_ID
+	offering, product := 0, 0
+	for _, line := range quote.Lines {
+		if line.Item_Type == "offering" {
+			contractArgs[2+offering], contractArgs[6+offering] = line.Item_ID, line.Unit_Price.String()
+			offering++
+		} else {
+			contractArgs[16+product], contractArgs[10+product] = line.Item_ID, line.Unit_Price.String()
+			product++
+		}
+	}
+	contractArgs[22], contractArgs[23], contractArgs[24] = quote.Supplier_ID, quote.Discount_Percent.String(), quote.Currency
+	contractArgs[25], contractArgs[26] = args[2], args[3]
+
+	contract, err := buildContract(contractArgs)
+	if err != nil {
+		return nil, err
+	}
+	contract.Status, contract.Units = contractDraft, quoteUnits(quote)
+	if err := storeContract(stub, &contract); err != nil {
+		return nil, err
+	}
+	quote.Status, quote.Accepted_Contract_ID = quoteAccepted, contract.Contract_ID
+	if err := storeQuote(stub, &quote); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end accept quote")
+	return json.Marshal(contract)
+}
+
+// ============================================================================================================================
+// Get quote - one quote by id
+//
+// args: quote_id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_quote(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	quote, err := getQuote(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(quote)
+}
+
+// priceQuoteItem - price one item at the client's contract rate, from its tiers or at its list price
+func priceQuoteItem(stub *shim.ChaincodeStub, item quoteItem, rates map[string]contractRate, currency string, today string) (quoteLine, error) {
+	line := quoteLine{Item_Type: "offering", Item_ID: item.Offering_ID, Quantity: item.Quantity}
+	if (item.Offering_ID == "") == (item.Product_ID == "") {
+		return line, errors.New("give either an offering_id or a product_id")
+	}
+	if item.Product_ID != "" {
+		line.Item_Type, line.Item_ID = "product", item.Product_ID
+	}
+	if item.Quantity < 1 {
+		return line, errors.New("quantity must be a whole number of at least 1")
+	}
+	if err := requireVisible(stub, line.Item_ID); err != nil {
+		return line, err
+	}
+	rec, err := getPricedRecord(stub, line.Item_ID)
+	if err != nil {
+		return line, err
+	}
+	if product, ok := rec.(*Product); ok != (line.Item_Type == "product") {
+		return line, errors.New(line.Item_ID + " is not a " + line.Item_Type)
+	} else if ok && productStatus(product.Status) != productActive {
+		return line, errors.New("product " + line.Item_ID + " is " + productStatus(product.Status) + " and cannot be quoted")
+	}
+
+	if offering, ok := rec.(*Offering); ok && len(offering.Tiers) > 0 {
+		if _, contracted := rates[line.Item_ID]; !contracted {
+			return priceTieredLine(stub, line, offering, currency, today)
+		}
+	}
+	if rate, ok := rates[line.Item_ID]; ok {
+		line.Price_Source, line.Source_ID, line.Source_Price, line.Source_Currency = "contract", rate.contractId, rate.rate, rate.currency
+	} else {
+		entry, ok := priceOn(*rec.schedule(), today)
+		if !ok {
+			return line, errors.New("NOT_FOUND: no price for " + line.Item_ID + " on " + today)
+		}
+		line.Price_Source, line.Source_Price, line.Source_Currency = "list", entry.Price, rec.currency()
+	}
+	line.Unit_Price = line.Source_Price
+	if line.Source_Currency != currency {
+		conversion, err := convertAmount(stub, line.Source_Price, line.Source_Currency, currency, today)
+		if err != nil {
+			return line, err
+		}
+		line.Conversion, line.Unit_Price = &conversion, conversion.Amount.RoundTo(currency)
+	}
+	line.Line_Total = line.Unit_Price.MulInt(int64(line.Quantity)).RoundTo(currency)
+	return line, nil
+}
+
+// quoteUnits - the contract units of a quote's lines, lines of a single flat priced unit need none
+func quoteUnits(quote Quote) map[string]contractUnits {
+	var units map[string]contractUnits
+	for _, line := range quote.Lines {
+		tiered := line.Price_Source == tierGraduated || line.Price_Source == tierVolume
+		if line.Quantity == 1 && !tiered {
+			continue
+		}
+		if units == nil {
+			units = map[string]contractUnits{}
+		}
+		units[line.Item_ID] = contractUnits{line.Quantity, tiered}
+	}
+	return units
+}
+
+// priceTieredLine - price a quote line from the offering's tiers
+func priceTieredLine(stub *shim.ChaincodeStub, line quoteLine, offering *Offering, currency string, today string) (quoteLine, error) {
+	price, err := priceOffering(stub, offering, line.Quantity, currency, today)
+	if err != nil {
+		return line, err
+	}
+	line.Price_Source, line.Source_Currency, line.Conversion, line.Tiers = price.Pricing, price.Source_Currency, price.Conversion, price.Bands
+	line.Source_Price = price.Source_Total.ProRata(1, int64(line.Quantity), currencyMinorUnits[price.Source_Currency])
+	line.Unit_Price, line.Line_Total = price.Unit_Price, price.Total
+	return line, nil
+}
+
+// contractRate - the rate a contract gives an offering or product
+type contractRate struct {
+	contractId string
+	rate       Decimal
+	currency   string
+}
+
+// clientContractRates - the rates of the client's active contracts in force today, by offering and product id.
+// When several contracts cover an item the one that started last wins. Tiered offerings have no contract rate.
+func clientContractRates(stub *shim.ChaincodeStub, clientId string, today string) (map[string]contractRate, error) {
+	rates := map[string]contractRate{}
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	var contracts []Contract
+	for _, id := range contractIndex {
+		contract, err := getContract(stub, id)
+		if err != nil || contract.Client_ID != clientId || contractStatus(contract.Status) != contractActive {
+			continue
+		}
+		if contract.Contract_Start_Date <= today && today <= contract.Contract_End_Date {
+			contracts = append(contracts, contract)
+		}
+	}
+	sort.Stable(byContractStart(contracts))
+	for _, c := range contracts {
+		for _, item := range contractItems(c) {
+			if item.tiered {
+				delete(rates, item.id) //the contract pays the tier price, so does the quote
+				continue
+			}
+			rates[item.id] = contractRate{c.Contract_ID, item.rate, c.Currency}
+		}
+	}
+	return rates, nil
+}
+
+func getQuote(stub *shim.ChaincodeStub, id string) (Quote, error) {
+	var quote Quote
+	if _, ok := loadRecord(stub, id, quoteImportSpec.name); !ok {
+		return quote, errors.New("NOT_FOUND: quote " + id)
+	}
+	quoteAsBytes, _ := stub.GetState(id)
+	if err := json.Unmarshal(quoteAsBytes, &quote); err != nil {
+		return quote, errors.New("Failed to decode " + id)
+	}
+	return quote, nil
+}
+
+func storeQuote(stub *shim.ChaincodeStub, quote *Quote) error {
+	if err := stampRecord(stub, quote.Quote_ID, quote); err != nil {
+		return err
+	}
+	quoteAsBytes, _ := json.Marshal(quote)
+	if err := stub.PutState(quote.Quote_ID, quoteAsBytes); err != nil {
+		return errors.New("Failed to store " + quote.Quote_ID)
+	}
+	return nil
+}
+
+type byContractStart []Contract
+
+func (s byContractStart) Len() int      { return len(s) }
+func (s byContractStart) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byContractStart) Less(i, j int) bool {
+	return s[i].Contract_Start_Date < s[j].Contract_Start_Date
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestQuoteValidUntil(t *testing.T) {
+	check := func(today string, validDays int, want string) {
+		if got := quoteValidUntil(today, validDays); got != want {
+			t.Errorf("generated %s, valid %d days: until %s, want %s", today, validDays, got, want)
+		}
+	}
+	check("2016-10-01", 1, "2016-10-01")
+	check("2016-10-01", 30, "2016-10-30")
+	check("2016-02-15", 15, "2016-02-29")
+	check("2016-12-20", 14, "2017-01-02")
+	check("2016-01-01", maxQuoteValidDays, "2016-12-30")
+}
+
+func TestTotalQuote(t *testing.T) {
+	line := func(itemType string, total string) quoteLine {
+		return quoteLine{Item_Type: itemType, Line_Total: mustDecimal(t, total)}
+	}
+	quote := Quote{Currency: "USD", Discount_Percent: mustDecimal(t, "12.5"),
+		Lines: []quoteLine{line("offering", "100.10"), line("product", "19.99"), line("product", "0.01")}}
+	if err := totalQuote(&quote); err != nil {
+		t.Fatal(err)
+	}
+	if quote.Subtotal.String() != "120.10" || quote.Discount_Amount.String() != "15.01" || quote.Total.String() != "105.09" {
+		t.Errorf("USD quote: %s - %s = %s, want 120.10 - 15.01 = 105.09", quote.Subtotal, quote.Discount_Amount, quote.Total)
+	}
+
+	// totalling again starts from the lines, not from the previous subtotal
+	if err := totalQuote(&quote); err != nil || quote.Subtotal.String() != "120.10" {
+		t.Errorf("totalled twice: %s, %v", quote.Subtotal, err)
+	}
+
+	yen := Quote{Currency: "JPY", Discount_Percent: mustDecimal(t, "10"), Lines: []quoteLine{line("offering", "1005")}}
+	if err := totalQuote(&yen); err != nil || yen.Discount_Amount.String() != "101" || yen.Total.String() != "904" {
+		t.Errorf("JPY quote: discount %s, total %s, %v, want whole yen", yen.Discount_Amount, yen.Total, err)
+	}
+}
+
+func TestTotalQuoteMustFitAContract(t *testing.T) {
+	quote := Quote{Currency: "USD"}
+	for i := 0; i < contractProductSlots; i++ {
+		quote.Lines = append(quote.Lines, quoteLine{Item_Type: "product"})
+	}
+	for i := 0; i < contractOfferingSlots; i++ {
+		quote.Lines = append(quote.Lines, quoteLine{Item_Type: "offering"})
+	}
+	if err := totalQuote(&quote); err != nil {
+		t.Errorf("a full contract's worth of items refused: %v", err)
+	}
+	for _, extra := range []string{"product", "offering"} {
+		over := quote
+		over.Lines = append(append([]quoteLine{}, quote.Lines...), quoteLine{Item_Type: extra})
+		if err := totalQuote(&over); err == nil || !strings.Contains(err.Error(), "slots of a contract") {
+			t.Errorf("one %s too many: %v", extra, err)
+		}
+	}
+}
+
+func TestContractsSortByStart(t *testing.T) {
+	contracts := byContractStart{
+		{Contract_ID: "c2", Contract_Start_Date: "2016-06-01"},
+		{Contract_ID: "c3", Contract_Start_Date: "2016-09-01"},
+		{Contract_ID: "c1", Contract_Start_Date: "2016-01-01"},
+	}
+	sort.Sort(contracts)
+	if contracts[0].Contract_ID != "c1" || contracts[2].Contract_ID != "c3" {
+		t.Errorf("sorted %v, want c1 c2 c3 so the contract that started last wins", contracts)
+	}
+}
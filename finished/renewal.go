@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// statuses of contracts whose term has passed: expired, or renewed into a successor contract
+const (
+	contractExpired = "expired"
+	contractRenewed = "renewed"
+)
+
+// expirationNotice - the process_expirations action for a contract entering its notice window
+const expirationNotice = "notice"
+
+// longest renewal term and notice period set_renewal_terms takes
+const (
+	maxRenewalMonths = 120
+	maxNoticeDays    = 365
+)
+
+// renewalTerms - what happens when a contract term ends. An auto-renewing contract is renewed for Term_Months into a
+// successor contract with its rates raised by Uplift_Percent, otherwise it expires. Auto-renewal can only be turned
+// off before the notice window, the Notice_Days before the end of the term.
+type renewalTerms struct {
+	Auto_Renew     bool    `json:"auto_renew"`
+	Term_Months    int     `json:"term_months"`
+	Notice_Days    int     `json:"notice_days"`
+	Uplift_Percent Decimal `json:"uplift_percent"`
+}
+
+// expirationRun - the process_expirations result, also sent as the "process_expirations" event
+type expirationRun struct {
+	Run_Date string              `json:"run_date"`
+	Expired  []string            `json:"expired"`
+	Renewed  []contractRenewal   `json:"renewed"`
+	Notices  []expiringContract  `json:"notices"` //contracts that entered their notice window
+	Errors   []expirationFailure `json:"errors"`
+}
+
+type contractRenewal struct {
+	Contract_ID  string `json:"contract_id"`
+	Successor_ID string `json:"successor_id"`
+}
+
+type expirationFailure struct {
+	Contract_ID string `json:"contract_id"`
+	Error       string `json:"error"`
+}
+
+// expiringContract - a list_expiring_contracts row and a notice window event
+type expiringContract struct {
+	Contract_ID       string `json:"contract_id"`
+	Client_ID         string `json:"client_id"`
+	Supplier_ID       string `json:"supplier_id"`
+	Contract_End_Date string `json:"contract_end_date"`
+	Days_Left         int    `json:"days_left"`
+	Notice_Date       string `json:"notice_date"` //the notice window starts, auto-renewal can no longer be turned off
+	Auto_Renew        bool   `json:"auto_renew"`
+}
+
+func (r renewalTerms) String() string {
+	if !r.Auto_Renew {
+		return "expires, " + strconv.Itoa(r.Notice_Days) + " days notice"
+	}
+	return "renews for " + strconv.Itoa(r.Term_Months) + " months at +" + r.Uplift_Percent.String() + "%, " +
+		strconv.Itoa(r.Notice_Days) + " days notice"
+}
+
+// ============================================================================================================================
+// Set renewal terms - whether a contract renews when its term ends, for how long, the notice period and the price
+// uplift of the renewal. Auto-renewal cannot be turned off once the contract is in its notice window.
+//
+// args: contract_id, auto_renew (true or false), term_months, notice_days, uplift_percent
+// ============================================================================================================================
+func (t *SimpleChaincode) set_renewal_terms(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+	fmt.Println("- start set renewal terms")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if status := contractStatus(contract.Status); status != contractActive && status != contractDraft {
+		return nil, errors.New("Contract " + args[0] + " is " + status + ", its renewal terms cannot change")
+	}
+	renewal, err := buildRenewalTerms(args[1], args[2], args[3], args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	from := "none"
+	if contract.Renewal != nil {
+		from = contract.Renewal.String()
+		today, err := txDate(stub)
+		if err != nil {
+			return nil, err
+		}
+		if contract.Renewal.Auto_Renew && !renewal.Auto_Renew && noticeDate(contract) <= today {
+			return nil, errors.New("Contract " + args[0] + " is in its notice window since " + noticeDate(contract) +
+				", auto-renewal can no longer be turned off")
+		}
+	}
+	contract.Renewal = renewal
+	if err := storeContract(stub, &contract); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "renewal", from, renewal.String()); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end set renewal terms")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Process expirations - on the transaction date, renew the auto-renewing contracts whose term has ended, expire the
+// others and report the contracts that entered their notice window, once per term end. A renewal that is itself
+// already over is renewed again. A contract that cannot be renewed or stored is reported and left for the next run.
+// ============================================================================================================================
+func (t *SimpleChaincode) process_expirations(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	fmt.Println("- start process expirations")
+	today, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	run := expirationRun{Run_Date: today, Expired: []string{}, Renewed: []contractRenewal{}, Notices: []expiringContract{},
+		Errors: []expirationFailure{}}
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(contractIndex); i++ { //successors are appended as they are stored
+		id := contractIndex[i]
+		contract, err := getContract(stub, id)
+		if err != nil {
+			continue
+		}
+		status := contractStatus(contract.Status)
+		action := expirationAction(contract, today)
+		if action == "" {
+			continue
+		}
+		if action == expirationNotice {
+			contract.Notice_Sent = contract.Contract_End_Date
+			if err := storeContract(stub, &contract); err != nil {
+				run.Errors = append(run.Errors, expirationFailure{id, err.Error()})
+				continue
+			}
+			run.Notices = append(run.Notices, expiringRow(contract, today))
+			continue
+		}
+
+		to := action
+		if to == contractRenewed {
+			successor, err := renewContract(stub, contract)
+			if err != nil {
+				run.Errors = append(run.Errors, expirationFailure{id, err.Error()})
+				continue
+			}
+			contract.Renewed_To = successor.Contract_ID
+			contractIndex = append(contractIndex, successor.Contract_ID)
+		}
+		contract.Status = to
+		if err := storeContract(stub, &contract); err != nil {
+			run.Errors = append(run.Errors, expirationFailure{id, err.Error()})
+			continue
+		}
+		if err := recordChange(stub, id, "status", status, to); err != nil {
+			return nil, err
+		}
+		if to == contractRenewed {
+			run.Renewed = append(run.Renewed, contractRenewal{id, contract.Renewed_To})
+		} else {
+			run.Expired = append(run.Expired, id)
+		}
+	}
+
+	runAsBytes, _ := json.Marshal(run)
+	if err := stub.SetEvent("process_expirations", runAsBytes); err != nil {
+		fmt.Println("Failed to set process_expirations event")
+	}
+	fmt.Println("- end process expirations")
+	return runAsBytes, nil
+}
+
+// ============================================================================================================================
+// List expiring contracts - the active contracts whose term ends within the next N days, soonest first
+//
+// args: days
+// ============================================================================================================================
+func (t *SimpleChaincode) list_expiring_contracts(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	days, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil || days < 0 {
+		return nil, errors.New("days must be a whole number of days, 0 or more")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today, until := now.Format(dateLayout), now.AddDate(0, 0, days).Format(dateLayout)
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	rows := []expiringContract{}
+	for _, id := range contractIndex {
+		contract, err := getContract(stub, id)
+		if err != nil || contractStatus(contract.Status) != contractActive {
+			continue
+		}
+		if contract.Contract_End_Date >= today && contract.Contract_End_Date <= until {
+			rows = append(rows, expiringRow(contract, today))
+		}
+	}
+	sort.Sort(byEndDate(rows))
+	return json.Marshal(rows)
+}
+
+// buildRenewalTerms - the set_renewal_terms arguments as renewal terms
+func buildRenewalTerms(autoRenew string, termMonths string, noticeDays string, upliftPercent string) (*renewalTerms, error) {
+	renew, err := strconv.ParseBool(strings.TrimSpace(autoRenew))
+	if err != nil {
+		return nil, errors.New("auto_renew must be true or false")
+	}
+	months, err := strconv.Atoi(strings.TrimSpace(termMonths))
+	if err != nil || months < 1 || months > maxRenewalMonths {
+		return nil, errors.New("term_months must be a whole number of months from 1 to " + strconv.Itoa(maxRenewalMonths))
+	}
+	notice, err := strconv.Atoi(strings.TrimSpace(noticeDays))
+	if err != nil || notice < 0 || notice > maxNoticeDays {
+		return nil, errors.New("notice_days must be a whole number of days from 0 to " + strconv.Itoa(maxNoticeDays))
+	}
+	uplift, err := parsePercent("uplift_percent", upliftPercent)
+	if err != nil {
+		return nil, err
+	}
+	return &renewalTerms{renew, months, notice, uplift}, nil
+}
+
+// expirationAction - what process_expirations does with a contract on a date: send the notice of an active contract
+// that entered its notice window, once per term end, and renew or expire one whose term has ended
+func expirationAction(contract Contract, today string) string {
+	status := contractStatus(contract.Status)
+	if status != contractActive && status != contractDraft {
+		return ""
+	}
+	if contract.Contract_End_Date >= today {
+		if status == contractActive && contract.Renewal != nil && noticeDate(contract) <= today &&
+			contract.Notice_Sent != contract.Contract_End_Date {
+			return expirationNotice
+		}
+		return ""
+	}
+	if status == contractActive && contract.Renewal != nil && contract.Renewal.Auto_Renew {
+		return contractRenewed
+	}
+	return contractExpired
+}
+
+// renewContract - store the successor of a contract whose term has ended
+func renewContract(stub *shim.ChaincodeStub, contract Contract) (Contract, error) {
+	successor, err := successorTerms(contract)
+	if err != nil {
+		return successor, err
+	}
+	if _, err := getContract(stub, successor.Contract_ID); err == nil {
+		return successor, errors.New("Renewal " + successor.Contract_ID + " already exists")
+	}
+	if err := checkOverlaps(stub, successor, successor.Contract_Start_Date, false); err != nil {
+		return successor, err
+	}
+	if err := storeContract(stub, &successor); err != nil {
+		return successor, err
+	}
+	if err := recordChange(stub, successor.Contract_ID, "renewed_from", "", contract.Contract_ID); err != nil {
+		return successor, err
+	}
+	return successor, nil
+}
+
+// successorTerms - the successor of a contract: the same terms for the renewal term from the day after the end,
+// with the rates raised by the uplift. Its billing schedule is anchored on its own start date.
+func successorTerms(contract Contract) (Contract, error) {
+	successor := contract
+	successor.Contract_ID = successorId(contract)
+	end, err := time.Parse(dateLayout, contract.Contract_End_Date)
+	if err != nil || contract.Renewal == nil {
+		return successor, errors.New("Contract " + contract.Contract_ID + " has no valid end date or renewal terms")
+	}
+	start := end.AddDate(0, 0, 1)
+	successor.Contract_Start_Date = start.Format(dateLayout)
+	successor.Contract_End_Date = start.AddDate(0, contract.Renewal.Term_Months, -1).Format(dateLayout)
+	if contract.Billing != nil {
+		billing := *contract.Billing
+		billing.Anchor_Date = successor.Contract_Start_Date
+		successor.Billing = &billing
+	}
+
+	uplift := func(rate *Decimal) {
+		*rate = rate.Add(rate.Percent(contract.Renewal.Uplift_Percent)).RoundTo(contract.Currency)
+	}
+	for _, rate := range []*Decimal{&successor.Flat_Off_Rate_1, &successor.Flat_Off_Rate_2, &successor.Flat_Off_Rate_3,
+		&successor.Flat_Off_Rate_4, &successor.Flat_Prod_Rate_1, &successor.Flat_Prod_Rate_2, &successor.Flat_Prod_Rate_3,
+		&successor.Flat_Prod_Rate_4, &successor.Flat_Prod_Rate_5, &successor.Flat_Prod_Rate_6} {
+		uplift(rate)
+	}
+	successor.Status, successor.Terms_Version = contractActive, 1
+	successor.Renewed_From, successor.Renewed_To, successor.Notice_Sent = contract.Contract_ID, "", ""
+	successor.Created_At, successor.Updated_At = "", ""
+	return successor, nil
+}
+
+// successorId - renewals of c1 are c1-R1, c1-R2 and so on
+func successorId(contract Contract) string {
+	if contract.Renewed_From != "" {
+		if i := strings.LastIndex(contract.Contract_ID, "-R"); i > 0 {
+			if n, err := strconv.Atoi(contract.Contract_ID[i+2:]); err == nil {
+				return contract.Contract_ID[:i] + "-R" + strconv.Itoa(n+1)
+			}
+		}
+	}
+	return contract.Contract_ID + "-R1"
+}
+
+// noticeDate - the first day of a contract's notice window
+func noticeDate(contract Contract) string {
+	end, err := time.Parse(dateLayout, contract.Contract_End_Date)
+	if err != nil || contract.Renewal == nil {
+		return contract.Contract_End_Date
+	}
+	return end.AddDate(0, 0, -contract.Renewal.Notice_Days).Format(dateLayout)
+}
+
+func expiringRow(contract Contract, today string) expiringContract {
+	row := expiringContract{Contract_ID: contract.Contract_ID, Client_ID: contract.Client_ID, Supplier_ID: contract.Supplier_ID,
+		Contract_End_Date: contract.Contract_End_Date, Days_Left: dayCount(today, contract.Contract_End_Date) - 1,
+		Notice_Date: noticeDate(contract)}
+	if contract.Renewal != nil {
+		row.Auto_Renew = contract.Renewal.Auto_Renew
+	}
+	return row
+}
+
+type byEndDate []expiringContract
+
+func (s byEndDate) Len() int      { return len(s) }
+func (s byEndDate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byEndDate) Less(i, j int) bool {
+	if s[i].Contract_End_Date != s[j].Contract_End_Date {
+		return s[i].Contract_End_Date < s[j].Contract_End_Date
+	}
+	return s[i].Contract_ID < s[j].Contract_ID
+}
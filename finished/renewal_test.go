@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSuccessorId(t *testing.T) {
+	renewals := Contract{Contract_ID: "c1"}
+	for _, want := range []string{"c1-R1", "c1-R2", "c1-R3"} {
+		if got := successorId(renewals); got != want {
+			t.Fatalf("renewing %s gave %s, want %s", renewals.Contract_ID, got, want)
+		}
+		renewals = Contract{Contract_ID: successorId(renewals), Renewed_From: renewals.Contract_ID}
+	}
+	renewals.Contract_ID = "c1-R9"
+	if got := successorId(renewals); got != "c1-R10" {
+		t.Errorf("the renewal after c1-R9 is %s", got)
+	}
+
+	// ids that only look like renewals get a suffix of their own
+	for id, want := range map[string]string{"c1-R1": "c1-R1-R1", "acme-Renewal": "acme-Renewal-R1"} {
+		if got := successorId(Contract{Contract_ID: id}); got != want {
+			t.Errorf("successorId(%s) = %s, want %s", id, got, want)
+		}
+	}
+	if got := successorId(Contract{Contract_ID: "c1-Rx", Renewed_From: "c0"}); got != "c1-Rx-R1" {
+		t.Errorf("successorId(c1-Rx) = %s", got)
+	}
+}
+
+// a contract ending 2016-12-31 with 30 days notice, through the runs of process_expirations
+func TestExpirationAction(t *testing.T) {
+	contract := Contract{Contract_ID: "c1", Status: contractActive, Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-12-31",
+		Renewal: &renewalTerms{Auto_Renew: true, Term_Months: 12, Notice_Days: 30}}
+	run := func(today string, want string) {
+		if got := expirationAction(contract, today); got != want {
+			t.Errorf("%s contract on %s: %q, want %q", contract.Status, today, got, want)
+		}
+	}
+
+	run("2016-11-30", "")
+	run("2016-12-01", expirationNotice)
+	contract.Notice_Sent = contract.Contract_End_Date
+	run("2016-12-02", "") //the notice goes out once
+	run("2016-12-31", "")
+	run("2017-01-01", contractRenewed)
+
+	contract.Renewal.Auto_Renew = false
+	run("2017-01-01", contractExpired)
+	contract.Renewal = nil
+	run("2017-01-01", contractExpired)
+
+	// a draft that was never signed expires without notice, renewed and expired contracts are done with
+	contract.Status, contract.Notice_Sent = contractDraft, ""
+	contract.Renewal = &renewalTerms{Auto_Renew: true, Term_Months: 12, Notice_Days: 30}
+	run("2016-12-15", "")
+	run("2017-01-01", contractExpired)
+	for _, status := range []string{contractExpired, contractRenewed} {
+		contract.Status = status
+		run("2017-01-01", "")
+	}
+}
+
+func TestBuildRenewalTerms(t *testing.T) {
+	renewal, err := buildRenewalTerms(" TRUE", "12", "30", "3.5")
+	if err != nil || renewal.String() != "renews for 12 months at +3.5%, 30 days notice" {
+		t.Errorf("renewal = %v, %v", renewal, err)
+	}
+	if renewal, _ := buildRenewalTerms("false", "1", "0", "0"); renewal.String() != "expires, 0 days notice" {
+		t.Errorf("renewal = %v", renewal)
+	}
+	for _, bad := range [][4]string{
+		{"yes", "12", "30", "0"},
+		{"true", "0", "30", "0"},
+		{"true", "121", "30", "0"},
+		{"true", "12", "-1", "0"},
+		{"true", "12", "366", "0"},
+		{"true", "12", "30", "101"},
+	} {
+		if renewal, err := buildRenewalTerms(bad[0], bad[1], bad[2], bad[3]); err == nil {
+			t.Errorf("%v gave %v", bad, renewal)
+		}
+	}
+}
+
+// list_expiring_contracts rows, soonest first, with the day the notice window opens
+func TestExpiringRows(t *testing.T) {
+	rows := byEndDate{}
+	for _, contract := range []Contract{
+		{Contract_ID: "c3", Contract_End_Date: "2016-12-31", Renewal: &renewalTerms{Auto_Renew: true, Term_Months: 12, Notice_Days: 30}},
+		{Contract_ID: "c2", Contract_End_Date: "2016-10-01", Renewal: &renewalTerms{Term_Months: 12, Notice_Days: 60}},
+		{Contract_ID: "c1", Contract_End_Date: "2016-12-31"},
+	} {
+		rows = append(rows, expiringRow(contract, "2016-10-01"))
+	}
+	sort.Sort(rows)
+
+	got := []string{}
+	for _, row := range rows {
+		got = append(got, fmt.Sprintf("%s %d days left, notice %s, auto_renew %v", row.Contract_ID, row.Days_Left, row.Notice_Date, row.Auto_Renew))
+	}
+	want := []string{
+		"c2 0 days left, notice 2016-08-02, auto_renew false",
+		"c1 91 days left, notice 2016-12-31, auto_renew false", //no renewal terms, the notice window is the last day
+		"c3 91 days left, notice 2016-12-01, auto_renew true",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSuccessorTermsBillFromTheirStart(t *testing.T) {
+	contract := testContract(t)
+	contract.Billing = &billingSchedule{Frequency: "monthly", Anchor_Date: "2016-01-15", Timing: billInArrears}
+	contract.Renewal = &renewalTerms{Auto_Renew: true, Term_Months: 12, Notice_Days: 30, Uplift_Percent: mustDecimal(t, "3")}
+	successor, err := successorTerms(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successor.Contract_ID != "c0-R1" || successor.Contract_Start_Date != "2017-01-01" ||
+		successor.Contract_End_Date != "2017-12-31" {
+		t.Fatalf("successor %s runs %s to %s", successor.Contract_ID, successor.Contract_Start_Date, successor.Contract_End_Date)
+	}
+	if successor.Flat_Off_Rate_1.String() != "82.40" || successor.Flat_Prod_Rate_1.String() != "9.79" {
+		t.Errorf("uplifted rates %s and %s, want 82.40 and 9.79", successor.Flat_Off_Rate_1, successor.Flat_Prod_Rate_1)
+	}
+	if contract.Billing.Anchor_Date != "2016-01-15" {
+		t.Errorf("renewing moved the anchor of the original contract to %s", contract.Billing.Anchor_Date)
+	}
+
+	periods := billingPeriods(successor)
+	if len(periods) != 12 {
+		t.Fatalf("%d billing periods, want 12: %v", len(periods), periods)
+	}
+	next := successor.Contract_Start_Date
+	for _, period := range periods {
+		if period.Period_Start != next || period.Period_End < period.Period_Start {
+			t.Fatalf("period %s to %s does not follow on from %s", period.Period_Start, period.Period_End, next)
+		}
+		if days := dayCount(period.Period_Start, period.Period_End); days != period.Full_Days {
+			t.Errorf("period %s to %s is billed for %d of %d days", period.Period_Start, period.Period_End, days, period.Full_Days)
+		}
+		end, _ := parseDate(period.Period_End)
+		next = end.AddDate(0, 0, 1).Format(dateLayout)
+	}
+	if last := periods[len(periods)-1]; last.Period_End != "2017-12-31" || last.Bill_Date != "2018-01-01" {
+		t.Errorf("last period %s to %s billed on %s", last.Period_Start, last.Period_End, last.Bill_Date)
+	}
+	if value := valueAfter(periods, mustDecimal(t, "100.00"), "2016-12-31", "USD"); value.String() != "1200.00" {
+		t.Errorf("the renewal term bills %s, want 1200.00", value)
+	}
+
+	contract.Renewal = nil
+	if _, err := successorTerms(contract); err == nil {
+		t.Errorf("a contract without renewal terms has a successor")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// set_user_type and set_category_user_type load the product with getProduct, which refuses anything but a product
+func TestDecodePricedRecordRefusesOtherRecords(t *testing.T) {
+	if _, err := decodePricedRecord("p9", nil); err == nil || !strings.HasPrefix(err.Error(), "NOT_FOUND") {
+		t.Errorf("missing id: %v, want NOT_FOUND", err)
+	}
+	for id, stored := range map[string]string{
+		"c1":  `{"doc_type":"contracts","contract_id":"c1","client_id":"cl1"}`,
+		"cl1": `{"doc_type":"clients","client_id":"cl1","username":"jo"}`,
+		"old": `{"contract_id":"old","client_id":"cl1"}`,
+		"bad": `["p1"]`,
+	} {
+		if rec, err := decodePricedRecord(id, []byte(stored)); err == nil {
+			t.Errorf("%s decoded as %#v", id, rec)
+		}
+	}
+
+	rec, err := decodePricedRecord("p1", []byte(`{"doc_type":"products","product_id":"p1","category":"hw",
+		"list_price":"10.99","currency":"USD","user_type":"gold","price_start_date":"2016-01-01",
+		"price_end_date":"2016-12-31"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	product, ok := rec.(*Product)
+	if !ok || product.User_Type != "gold" {
+		t.Fatalf("decoded %#v, want the gold product", rec)
+	}
+	if schedule := *product.schedule(); len(schedule) != 1 || schedule[0].Price.String() != "10.99" {
+		t.Errorf("schedule %+v, want the stored list price", schedule)
+	}
+}
+
+func TestRetagsProduct(t *testing.T) {
+	hardware := &Product{Category: "Hardware", User_Type: "silver"}
+	if !retagsProduct(hardware, "hardware", "gold") {
+		t.Error("a silver hardware product is not retagged gold")
+	}
+	if !retagsProduct(hardware, "HARDWARE", "") {
+		t.Error("a silver hardware product is not opened to everybody")
+	}
+	if retagsProduct(hardware, "software", "gold") {
+		t.Error("a product of another category is retagged")
+	}
+	hardware.User_Type = " Gold"
+	if retagsProduct(hardware, "hardware", "gold") {
+		t.Error("a product that is already gold is retagged, adding a history entry for nothing")
+	}
+}
+
+func TestRecordChangeSkipsUnchangedValues(t *testing.T) {
+	// nothing is read or written when the value stays the same, so no stub is needed
+	if err := recordChange(nil, "p1", "user_type", "gold", "gold"); err != nil {
+		t.Error(err)
+	}
+}
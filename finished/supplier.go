@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Supplier index and table structure, Contract.Supplier_ID refers to Supplier_ID
+type Supplier struct {
+	Supplier_ID        string `json:"supplier_id"`
+	Legal_Name         string `json:"legal_name"`
+	Contact_Name       string `json:"contact_name"`
+	Contact_Email      string `json:"contact_email"`
+	Contact_Phone      string `json:"contact_phone"`
+	Payment_Terms_Days int    `json:"payment_terms_days,string"` //invoices are due this many days after issue
+	Status             string `json:"status"`
+	Created_At         string `json:"created_at"`
+	Updated_At         string `json:"updated_at"`
+	Doc_Type           string `json:"doc_type"`
+}
+
+var supplierIndexStr = "_supplierindex"
+
+// supplier statuses, new contracts may only be made with an active supplier
+var supplierStatuses = []string{"active", "inactive"}
+
+// maxPaymentTermsDays - payment terms longer than a year are refused as a typo
+const maxPaymentTermsDays = 365
+
+var supplierFields = []string{"supplier_id", "legal_name", "contact_name", "contact_email", "contact_phone",
+	"payment_terms_days", "status"}
+
+var supplierImportSpec = importSpec{"suppliers", supplierIndexStr, supplierFields, "", nil,
+	func(args []string) (stampedRecord, error) { s, err := buildSupplier(args); return &s, err }}
+
+var supplierListSpec = listSpec{
+	name:     "list_suppliers",
+	indexStr: supplierIndexStr,
+	idField:  "supplier_id",
+	statusFn: func(rec map[string]interface{}, asOf string) string { return fieldString(rec, "status") },
+}
+
+func (s *Supplier) setTimestamps(created_at string, updated_at string) {
+	s.Created_At, s.Updated_At, s.Doc_Type = created_at, updated_at, supplierImportSpec.name
+}
+
+// supplierRecords - the get_supplier_records result
+type supplierRecords struct {
+	Supplier  Supplier                 `json:"supplier"`
+	Contracts []map[string]interface{} `json:"contracts"`
+	Offerings []map[string]interface{} `json:"offerings"`
+	Products  []map[string]interface{} `json:"products"`
+}
+
+// ============================================================================================================================
+// Init supplier - create a new supplier
+//
+// args: supplier_id, legal_name, contact_name, contact_email, contact_phone, payment_terms_days, status
+// ============================================================================================================================
+func (t *SimpleChaincode) init_supplier(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7")
+	}
+	fmt.Println("- start init supplier")
+	supplier, err := buildSupplier(args)
+	if err != nil {
+		return nil, err
+	}
+	existingAsBytes, err := stub.GetState(supplier.Supplier_ID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + supplier.Supplier_ID)
+	}
+	if existingAsBytes != nil {
+		return nil, errors.New("Supplier " + supplier.Supplier_ID + " already exists, use update_supplier to change it")
+	}
+	if err := storeSupplier(stub, supplier); err != nil {
+		return nil, err
+	}
+
+	supplierIndex, err := getIndex(stub, supplierIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	if !find_id_in_index(supplierIndex, supplier.Supplier_ID) {
+		supplierIndex = append(supplierIndex, supplier.Supplier_ID)
+		fmt.Println("! supplier index: ", supplierIndex)
+		jsonAsBytes, _ := json.Marshal(supplierIndex)
+		if err := stub.PutState(supplierIndexStr, jsonAsBytes); err != nil {
+			return nil, errors.New("Failed to add supplier index")
+		}
+	}
+	fmt.Println("- end init supplier")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Update supplier - replace the details of an existing supplier
+//
+// args: supplier_id, legal_name, contact_name, contact_email, contact_phone, payment_terms_days, status
+// ============================================================================================================================
+func (t *SimpleChaincode) update_supplier(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7")
+	}
+	fmt.Println("- start update supplier")
+	supplier, err := buildSupplier(args)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getSupplier(stub, supplier.Supplier_ID); err != nil {
+		return nil, err
+	}
+	if err := storeSupplier(stub, supplier); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end update supplier")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Delete supplier - refused while contracts still refer to the supplier
+//
+// args: supplier_id
+// ============================================================================================================================
+func (t *SimpleChaincode) delete_supplier(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	fmt.Println("- start delete supplier")
+	if _, err := getSupplier(stub, args[0]); err != nil {
+		return nil, err
+	}
+	contracts, err := supplierContracts(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(contracts) > 0 {
+		ids := []string{}
+		for _, c := range contracts {
+			ids = append(ids, fieldString(c, "contract_id"))
+		}
+		return nil, errors.New("Supplier " + args[0] + " is referenced by contracts " + strings.Join(ids, ", ") + ", set it inactive instead")
+	}
+	if err := stub.DelState(args[0]); err != nil {
+		return nil, errors.New("Failed to delete state")
+	}
+
+	supplierIndex, err := getIndex(stub, supplierIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range supplierIndex {
+		if val == args[0] {
+			supplierIndex = append(supplierIndex[:i], supplierIndex[i+1:]...)
+			break
+		}
+	}
+	jsonAsBytes, _ := json.Marshal(supplierIndex)
+	if err := stub.PutState(supplierIndexStr, jsonAsBytes); err != nil {
+		return nil, errors.New("Failed to update supplier index")
+	}
+	fmt.Println("- end delete supplier")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get supplier - one supplier by id
+//
+// args: supplier_id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_supplier(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	supplier, err := getSupplier(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(supplier)
+}
+
+// List suppliers - like the other list_* queries, the status filter matches the supplier status
+func (t *SimpleChaincode) list_suppliers(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	return t.list_records(stub, supplierListSpec, args)
+}
+
+// ============================================================================================================================
+// Get supplier records - the supplier with its contracts, the offerings those contracts cover and the products
+// of the contracts and of those offerings
+//
+// args: supplier_id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_supplier_records(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	supplier, err := getSupplier(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	result := supplierRecords{Supplier: supplier, Offerings: []map[string]interface{}{}, Products: []map[string]interface{}{}}
+	if result.Contracts, err = supplierContracts(stub, args[0]); err != nil {
+		return nil, err
+	}
+
+	offeringIds, productIds := []string{}, []string{}
+	for _, c := range result.Contracts {
+		for i := 1; i <= 4; i++ {
+			offeringIds = appendUnique(offeringIds, fieldString(c, "offering_id_"+strconv.Itoa(i)))
+		}
+		for i := 1; i <= 6; i++ {
+			productIds = appendUnique(productIds, fieldString(c, "product_id_"+strconv.Itoa(i)))
+		}
+	}
+	for _, id := range offeringIds {
+		if offering, ok := loadRecord(stub, id, offeringImportSpec.name); ok {
+			result.Offerings = append(result.Offerings, offering)
+			productIds = appendUnique(productIds, fieldString(offering, "product_id_01"))
+			productIds = appendUnique(productIds, fieldString(offering, "product_id_02"))
+		}
+	}
+	for _, id := range productIds {
+		if product, ok := loadRecord(stub, id, productImportSpec.name); ok {
+			result.Products = append(result.Products, product)
+		}
+	}
+	v := currentViewer(stub)
+	result.Offerings, result.Products = v.visibleRecords(result.Offerings), v.visibleRecords(result.Products)
+	return json.Marshal(result)
+}
+
+// buildSupplier - validate init_supplier style arguments into a Supplier
+func buildSupplier(args []string) (Supplier, error) {
+	if len(args) < len(supplierFields) {
+		return Supplier{}, errors.New("Incorrect number of arguments. Expecting " + strconv.Itoa(len(supplierFields)))
+	}
+	if err := requireArgs(args, 2); err != nil {
+		return Supplier{}, err
+	}
+	days, err := strconv.Atoi(strings.TrimSpace(args[5]))
+	if err != nil || days < 0 || days > maxPaymentTermsDays {
+		return Supplier{}, errors.New("payment_terms_days must be a whole number of days between 0 and " + strconv.Itoa(maxPaymentTermsDays))
+	}
+	status := strings.ToLower(strings.TrimSpace(args[6]))
+	if status == "" {
+		status = "active"
+	}
+	if !find_id_in_index(supplierStatuses, status) {
+		return Supplier{}, errors.New("status must be one of " + strings.Join(supplierStatuses, ", "))
+	}
+	if args[3] != "" && !strings.Contains(args[3], "@") {
+		return Supplier{}, errors.New("contact_email \"" + args[3] + "\" is not an email address")
+	}
+	return Supplier{
+		Supplier_ID:        args[0],
+		Legal_Name:         args[1],
+		Contact_Name:       args[2],
+		Contact_Email:      args[3],
+		Contact_Phone:      args[4],
+		Payment_Terms_Days: days,
+		Status:             status,
+	}, nil
+}
+
+// getSupplier - load a supplier, refusing keys that hold anything else
+func getSupplier(stub *shim.ChaincodeStub, id string) (Supplier, error) {
+	var supplier Supplier
+	recAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return supplier, errors.New("Failed to get state for " + id)
+	}
+	if recAsBytes == nil {
+		return supplier, errors.New("NOT_FOUND: supplier " + id)
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(recAsBytes, &fields) != nil || recordKind(fields) != supplierImportSpec.name {
+		return supplier, errors.New(id + " is not a supplier")
+	}
+	if err := json.Unmarshal(recAsBytes, &supplier); err != nil {
+		return supplier, errors.New("Failed to decode " + id)
+	}
+	return supplier, nil
+}
+
+func storeSupplier(stub *shim.ChaincodeStub, supplier Supplier) error {
+	if err := stampRecord(stub, supplier.Supplier_ID, &supplier); err != nil {
+		return err
+	}
+	supplierAsBytes, _ := json.Marshal(supplier)
+	if err := stub.PutState(supplier.Supplier_ID, supplierAsBytes); err != nil {
+		return errors.New("Failed to store " + supplier.Supplier_ID)
+	}
+	return nil
+}
+
+// checkContractSupplier - a new or changed contract must name an existing, active supplier
+func checkContractSupplier(stub *shim.ChaincodeStub, id string) error {
+	supplier, err := getSupplier(stub, id)
+	if err != nil {
+		return err
+	}
+	if supplier.Status != "active" {
+		return errors.New("Supplier " + id + " is " + supplier.Status + ", contracts need an active supplier")
+	}
+	return nil
+}
+
+// newContractSupplier - whether storing the contract creates or activates it or gives it another supplier
+func newContractSupplier(stub *shim.ChaincodeStub, contract Contract) bool {
+	stored, err := getContract(stub, contract.Contract_ID)
+	if err != nil || stored.Supplier_ID != contract.Supplier_ID {
+		return true
+	}
+	return contractStatus(stored.Status) == contractDraft && contractStatus(contract.Status) != contractDraft
+}
+
+// supplierContracts - every indexed contract of the supplier
+func supplierContracts(stub *shim.ChaincodeStub, id string) ([]map[string]interface{}, error) {
+	contracts := []map[string]interface{}{}
+	contractIndex, err := getIndex(stub, contractIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, contractId := range contractIndex {
+		if contract, ok := loadRecord(stub, contractId, contractImportSpec.name); ok && fieldString(contract, "supplier_id") == id {
+			contracts = append(contracts, contract)
+		}
+	}
+	return contracts, nil
+}
+
+// loadRecord - a stored record of the given kind as a map, false when it is missing or of another kind
+func loadRecord(stub *shim.ChaincodeStub, id string, kind string) (map[string]interface{}, bool) {
+	if id == "" {
+		return nil, false
+	}
+	recAsBytes, err := stub.GetState(id)
+	if err != nil || recAsBytes == nil {
+		return nil, false
+	}
+	var rec map[string]interface{}
+	if json.Unmarshal(recAsBytes, &rec) != nil || recordKind(rec) != kind {
+		return nil, false
+	}
+	return rec, true
+}
+
+// requireKind - the delete_* invokes only remove a stored record of their own kind, a missing key is only taken off
+// the index
+func requireKind(stub *shim.ChaincodeStub, id string, kind string) error {
+	recAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return errors.New("Failed to get state for " + id)
+	}
+	if recAsBytes == nil {
+		return nil
+	}
+	if _, ok := loadRecord(stub, id, kind); !ok {
+		return errors.New(id + " is not one of the " + kind)
+	}
+	return nil
+}
+
+func appendUnique(list []string, id string) []string {
+	if id == "" || find_id_in_index(list, id) {
+		return list
+	}
+	return append(list, id)
+}
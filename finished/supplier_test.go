@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// supplierArgs - valid init_supplier arguments, with the given positions replaced
+func supplierArgs(replace map[int]string) []string {
+	args := []string{"s1", "Acme Ltd", "Jo Doe", "jo@acme.example", "555-0100", "30", "active"}
+	for i, v := range replace {
+		args[i] = v
+	}
+	return args
+}
+
+func TestBuildSupplier(t *testing.T) {
+	supplier, err := buildSupplier(supplierArgs(map[int]string{5: " 45 ", 6: "Inactive"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if supplier.Payment_Terms_Days != 45 || supplier.Status != "inactive" || supplier.Legal_Name != "Acme Ltd" {
+		t.Errorf("supplier = %+v", supplier)
+	}
+
+	supplier, err = buildSupplier(supplierArgs(map[int]string{3: "", 4: "", 6: ""}))
+	if err != nil || supplier.Status != "active" {
+		t.Errorf("contact details left out and no status: %+v, %v, want an active supplier", supplier, err)
+	}
+
+	refused := []struct {
+		why     string
+		args    []string
+		message string
+	}{
+		{"too few arguments", supplierArgs(nil)[:6], "Expecting 7"},
+		{"no legal name", supplierArgs(map[int]string{1: ""}), "2nd argument"},
+		{"negative terms", supplierArgs(map[int]string{5: "-1"}), "payment_terms_days"},
+		{"terms over a year", supplierArgs(map[int]string{5: "366"}), "payment_terms_days"},
+		{"terms in words", supplierArgs(map[int]string{5: "thirty"}), "payment_terms_days"},
+		{"unknown status", supplierArgs(map[int]string{6: "suspended"}), "status must be one of active, inactive"},
+		{"email without @", supplierArgs(map[int]string{3: "jo.acme"}), "not an email address"},
+	}
+	for _, r := range refused {
+		if _, err := buildSupplier(r.args); err == nil || !strings.Contains(err.Error(), r.message) {
+			t.Errorf("%s: error %v, want one mentioning %q", r.why, err, r.message)
+		}
+	}
+}
+
+func TestSupplierJSON(t *testing.T) {
+	supplier, _ := buildSupplier(supplierArgs(nil))
+	supplier.setTimestamps("2016-01-01T00:00:00Z", "2016-01-01T00:00:00Z")
+	supplierAsBytes, _ := json.Marshal(supplier)
+
+	var fields map[string]interface{}
+	json.Unmarshal(supplierAsBytes, &fields)
+	if fields["payment_terms_days"] != "30" {
+		t.Errorf("payment_terms_days stored as %#v, want the string every other field uses", fields["payment_terms_days"])
+	}
+	if kind := recordKind(fields); kind != supplierImportSpec.name {
+		t.Errorf("stored supplier is a %q", kind)
+	}
+	if status := supplierListSpec.statusFn(fields, "2016-10-01"); status != "active" {
+		t.Errorf("list status = %q", status)
+	}
+
+	var back Supplier
+	if err := json.Unmarshal(supplierAsBytes, &back); err != nil || back != supplier {
+		t.Errorf("round trip = %+v, %v", back, err)
+	}
+}
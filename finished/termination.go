@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// contractTerminated - the status of a contract ended early with terminate_contract
+const contractTerminated = "terminated"
+
+// early termination fee types
+const (
+	feeFixed    = "fixed"
+	feePercent  = "percent"
+	feeSchedule = "schedule"
+)
+
+// terminationTerms - what ending a contract early costs: a fixed fee, a percentage of the value left on the contract
+// or a fee that depends on when it ends
+type terminationTerms struct {
+	Fee_Type    string    `json:"fee_type"`
+	Fixed_Fee   Decimal   `json:"fixed_fee"`
+	Fee_Percent Decimal   `json:"fee_percent"`
+	Schedule    []feeStep `json:"schedule"`
+}
+
+// feeStep - ending the contract on or before Until costs Fee, after the last step there is no fee
+type feeStep struct {
+	Until string  `json:"until"`
+	Fee   Decimal `json:"fee"`
+}
+
+// contractTermination - how a contract was ended early and settled
+type contractTermination struct {
+	Effective_Date     string   `json:"effective_date"` //the last day in force
+	Reason             string   `json:"reason"`
+	Original_End_Date  string   `json:"original_end_date"`
+	Remaining_Value    Decimal  `json:"remaining_value"` //what the rest of the term would have billed, after the discount
+	Fee                Decimal  `json:"fee"`
+	Settlement_Invoice string   `json:"settlement_invoice"`
+	Credit_Notes       []string `json:"credit_notes"`
+	Net                Decimal  `json:"net"` //the fee and the adjustments, negative when the client is owed money
+	Terminated_At      string   `json:"terminated_at"`
+}
+
+func (t terminationTerms) String() string {
+	switch t.Fee_Type {
+	case feeFixed:
+		return "fixed fee " + t.Fixed_Fee.String()
+	case feePercent:
+		return t.Fee_Percent.String() + "% of the remaining value"
+	}
+	steps := []string{}
+	for _, step := range t.Schedule {
+		steps = append(steps, step.Fee.String()+" until "+step.Until)
+	}
+	return "schedule " + strings.Join(steps, ", ")
+}
+
+// ============================================================================================================================
+// Set termination terms - the fee for ending a contract early, in the contract currency
+//
+// value is the fee for fixed, the percentage of the remaining value for percent, and for schedule a JSON array such as
+// [{"until": "2016-06-30", "fee": "500.00"}, {"until": "2016-12-31", "fee": "200.00"}]
+// args: contract_id, fee_type (fixed, percent, schedule or none), value
+// ============================================================================================================================
+func (t *SimpleChaincode) set_termination_terms(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	fmt.Println("- start set termination terms")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if status := contractStatus(contract.Status); status != contractActive && status != contractDraft {
+		return nil, errors.New("Contract " + args[0] + " is " + status + ", its termination terms cannot change")
+	}
+	terms, err := buildTerminationTerms(contract.Currency, args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	from, to := "none", "none"
+	if contract.Termination_Terms != nil {
+		from = contract.Termination_Terms.String()
+	}
+	if terms != nil {
+		to = terms.String()
+	}
+	contract.Termination_Terms = terms
+	if err := storeContract(stub, &contract); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "termination_terms", from, to); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end set termination terms")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Terminate contract - end an active contract early. The contract is kept, marked terminated and its term ends on the
+// effective date. What was invoiced beyond that date is credited and the termination fee charged on a final
+// settlement invoice. When the credits are more than the fee, the difference is credited back on the contract's
+// invoices with credit notes instead.
+//
+// args: contract_id, effective_date (the last day the contract is in force), reason
+// ============================================================================================================================
+func (t *SimpleChaincode) terminate_contract(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	fmt.Println("- start terminate contract")
+	if err := requireArgs(args, 3); err != nil {
+		return nil, err
+	}
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if status := contractStatus(contract.Status); status != contractActive {
+		return nil, errors.New("Contract " + args[0] + " is " + status + ", only active contracts are terminated")
+	}
+	effective, err := canonicalDate("effective_date", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWithin("effective_date", effective, effective, "contract term", contract.Contract_Start_Date, contract.Contract_End_Date); err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	termination := contractTermination{Effective_Date: effective, Reason: args[2], Original_End_Date: contract.Contract_End_Date,
+		Credit_Notes: []string{}, Terminated_At: now.Format(time.RFC3339)}
+	if termination.Remaining_Value, err = remainingValue(stub, contract, effective); err != nil {
+		return nil, err
+	}
+	termination.Fee = terminationFee(contract, effective, termination.Remaining_Value)
+
+	reason := "terminated: " + args[2]
+	ended, err := endContractEarly(stub, contract, effective, reason)
+	if err != nil {
+		return nil, err
+	}
+	end, _ := time.Parse(dateLayout, effective)
+	credits, err := prorateChange(stub, ended, end.AddDate(0, 0, 1).Format(dateLayout), reason)
+	if err != nil {
+		return nil, err
+	}
+	settlement, err := settleContract(stub, ended, &termination, credits)
+	if err != nil {
+		return nil, err
+	}
+	termination.Settlement_Invoice = settlement.Invoice_ID
+
+	ended.Status, ended.Termination = contractTerminated, &termination
+	if err := storeContract(stub, &ended); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "status", contractActive, contractTerminated); err != nil {
+		return nil, err
+	}
+	terminationAsBytes, _ := json.Marshal(termination)
+	if err := stub.SetEvent("terminate_contract", terminationAsBytes); err != nil {
+		fmt.Println("Failed to set terminate_contract event")
+	}
+	fmt.Println("- end terminate contract")
+	return terminationAsBytes, nil
+}
+
+// settleContract - the final settlement invoice of a terminated contract: the fee, the contract's pending adjustments
+// and the credits for what was invoiced beyond the effective date. A settlement that comes out negative is credited
+// back on the contract's invoices, newest first, and the invoice is left at zero. Nothing is issued when there is
+// nothing to settle.
+func settleContract(stub *shim.ChaincodeStub, contract Contract, termination *contractTermination, credits []adjustmentLine) (Invoice, error) {
+	invoice := Invoice{
+		Supplier_ID:      contract.Supplier_ID,
+		Client_ID:        contract.Client_ID,
+		Contract_ID:      contract.Contract_ID,
+		Terms_Version:    termsVersion(contract),
+		Settlement:       true,
+		Currency:         contract.Currency,
+		Period_Start:     termination.Effective_Date,
+		Period_End:       termination.Effective_Date,
+		Lines:            []invoiceLine{},
+		Adjustments:      []adjustmentLine{},
+		Credit_Notes:     []string{},
+		Discount_Percent: Decimal{},
+		Status:           invoiceIssued,
+	}
+	pending, err := takeAdjustments(stub, contract.Contract_ID)
+	if err != nil {
+		return invoice, err
+	}
+	settlementLines(&invoice, termination.Fee, append(pending, credits...))
+	termination.Net = invoice.Total
+	if len(invoice.Lines) == 0 && len(invoice.Adjustments) == 0 {
+		return invoice, nil
+	}
+	if contract.Supplier_ID == "" {
+		return invoice, errors.New("Contract " + contract.Contract_ID + " has no supplier to invoice the settlement from")
+	}
+	supplier, err := getSupplier(stub, contract.Supplier_ID)
+	if err != nil {
+		return invoice, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return invoice, err
+	}
+	invoice.Issue_Date = now.Format(dateLayout)
+	invoice.Due_Date = now.AddDate(0, 0, supplier.Payment_Terms_Days).Format(dateLayout)
+	if err := numberInvoice(stub, &invoice); err != nil {
+		return invoice, err
+	}
+
+	if invoice.Total.Sign() < 0 {
+		notes, credited, err := creditShortfall(stub, contract.Contract_ID, invoice.Total.Neg(), "settlement of "+invoice.Invoice_ID)
+		if err != nil {
+			return invoice, err
+		}
+		termination.Credit_Notes = notes
+		line := adjustmentLine{Invoice_ID: invoice.Invoice_ID, Item_Type: "credited", Amount: credited,
+			Reason: "credited on " + strings.Join(notes, ", ")}
+		invoice.Adjustments = append(invoice.Adjustments, line)
+		invoice.Adjustments_Total = invoice.Adjustments_Total.Add(credited)
+		invoice.Total = Decimal{} //credits never come to more than was invoiced, anything left over is not owed
+	}
+	if invoice.Total.IsZero() {
+		invoice.Status = invoicePaid
+	}
+	if err := storeInvoice(stub, &invoice); err != nil {
+		return invoice, err
+	}
+	if err := addToIndexes(stub, invoice.Invoice_ID, invoiceIndexStr, invoiceClientIndexPrefix+invoice.Client_ID,
+		invoiceContractIndexPrefix+invoice.Contract_ID); err != nil {
+		return invoice, err
+	}
+	return invoice, nil
+}
+
+// settlementLines - the termination fee as the one line of a settlement invoice and the adjustments it carries,
+// with its totals
+func settlementLines(invoice *Invoice, fee Decimal, adjustments []adjustmentLine) {
+	if fee.Sign() > 0 {
+		invoice.Lines = append(invoice.Lines, invoiceLine{Item_Type: "termination_fee", Item_ID: invoice.Contract_ID, Quantity: 1,
+			Unit_Price: fee, Line_Total: fee})
+		invoice.Subtotal = fee
+	}
+	for _, line := range adjustments {
+		invoice.Adjustments = append(invoice.Adjustments, line)
+		invoice.Adjustments_Total = invoice.Adjustments_Total.Add(line.Amount)
+	}
+	invoice.Total = invoice.Subtotal.Add(invoice.Adjustments_Total)
+}
+
+// creditShortfall - credit up to amount back on a contract's invoices that are not void, newest first, with a credit
+// note per invoice. Returns the credit notes and what they credited.
+func creditShortfall(stub *shim.ChaincodeStub, contractId string, amount Decimal, reason string) ([]string, Decimal, error) {
+	notes, credited := []string{}, Decimal{}
+	invoices, err := contractInvoices(stub, contractId)
+	if err != nil {
+		return nil, credited, err
+	}
+	for i := len(invoices) - 1; i >= 0 && amount.Sign() > 0; i-- {
+		invoice := invoices[i]
+		if invoice.Status == invoiceVoid || invoice.Settlement {
+			continue
+		}
+		creditable := invoice.Total.Sub(invoice.Amount_Credited)
+		left, err := creditableLines(stub, invoice)
+		if err != nil {
+			return nil, credited, err
+		}
+		requests := []creditRequest{}
+		for _, line := range invoice.Lines {
+			take := left[line.Item_ID]
+			if take.Cmp(amount) > 0 {
+				take = amount
+			}
+			if take.Cmp(creditable) > 0 {
+				take = creditable
+			}
+			if take.Sign() <= 0 {
+				continue
+			}
+			requests = append(requests, creditRequest{Item_ID: line.Item_ID, Amount: &take})
+			amount, creditable = amount.Sub(take), creditable.Sub(take)
+		}
+		if len(requests) == 0 {
+			continue
+		}
+		note, err := creditInvoice(stub, &invoice, reason, requests)
+		if err != nil {
+			return nil, credited, err
+		}
+		if invoice.Status == invoiceIssued && invoice.outstanding().IsZero() {
+			invoice.Status = invoicePaid
+			if err := recordChange(stub, invoice.Invoice_ID, "status", invoiceIssued, invoicePaid); err != nil {
+				return nil, credited, err
+			}
+		}
+		if err := storeInvoice(stub, &invoice); err != nil {
+			return nil, credited, err
+		}
+		notes = append(notes, note.Credit_Note_ID)
+		credited = credited.Add(note.Total)
+	}
+	return notes, credited, nil
+}
+
+// buildTerminationTerms - the set_termination_terms arguments as termination terms in the contract currency, nil
+// for none
+func buildTerminationTerms(currency string, feeType string, value string) (*terminationTerms, error) {
+	var terms *terminationTerms
+	switch strings.ToLower(strings.TrimSpace(feeType)) {
+	case "none":
+	case feeFixed:
+		fee, err := parseAmount("fee", value, currency)
+		if err != nil {
+			return nil, err
+		}
+		terms = &terminationTerms{Fee_Type: feeFixed, Fixed_Fee: fee.RoundTo(currency)}
+	case feePercent:
+		percent, err := parsePercent("fee_percent", value)
+		if err != nil {
+			return nil, err
+		}
+		terms = &terminationTerms{Fee_Type: feePercent, Fee_Percent: percent}
+	case feeSchedule:
+		var schedule []feeStep
+		if err := json.Unmarshal([]byte(value), &schedule); err != nil || len(schedule) == 0 {
+			return nil, errors.New("schedule must be a non-empty JSON array of {until, fee}")
+		}
+		for i := range schedule {
+			until, err := canonicalDate("until", schedule[i].Until)
+			if err != nil {
+				return nil, err
+			}
+			schedule[i].Until = until
+			if err := checkAmount("fee", schedule[i].Fee, currency); err != nil {
+				return nil, err
+			}
+			schedule[i].Fee = schedule[i].Fee.RoundTo(currency)
+		}
+		sort.Sort(byUntil(schedule))
+		terms = &terminationTerms{Fee_Type: feeSchedule, Schedule: schedule}
+	default:
+		return nil, errors.New("fee_type must be one of fixed, percent, schedule or none")
+	}
+	return terms, nil
+}
+
+// checkDeletable - only drafts are deleted, a contract that was signed is kept and ended with terminate_contract
+func checkDeletable(contract Contract) error {
+	if contract.Status != contractDraft {
+		return errors.New("Contract " + contract.Contract_ID + " is " + contractStatus(contract.Status) + ", only drafts can be deleted, end it with terminate_contract")
+	}
+	return nil
+}
+
+// remainingValue - what a contract would still have billed after the effective date, on the terms in effect then
+// and after the discount. Each billing period is prorated by day over its full length, the rates of a contract
+// without a billing schedule are for its whole term.
+func remainingValue(stub *shim.ChaincodeStub, contract Contract, effective string) (Decimal, error) {
+	terms, err := contractTermsOn(stub, contract, effective)
+	if err != nil {
+		return Decimal{}, err
+	}
+	_, net, err := netRates(stub, terms, effective)
+	if err != nil {
+		return Decimal{}, err
+	}
+	periodNet := Decimal{}
+	for _, rate := range net {
+		periodNet = periodNet.Add(rate)
+	}
+	periods := []billingPeriod{{Period_Start: contract.Contract_Start_Date, Period_End: contract.Contract_End_Date,
+		Full_Days: dayCount(contract.Contract_Start_Date, contract.Contract_End_Date)}}
+	if contract.Billing != nil {
+		periods = billingPeriods(contract)
+	}
+	return valueAfter(periods, periodNet, effective, contract.Currency), nil
+}
+
+// valueAfter - what the periods bill for the days after the effective date, a period billing periodNet for its full
+// days like invoiceContract does
+func valueAfter(periods []billingPeriod, periodNet Decimal, effective string, currency string) Decimal {
+	value := Decimal{}
+	for _, period := range periods {
+		if period.Period_End <= effective {
+			continue
+		}
+		start := period.Period_Start
+		if start <= effective {
+			end, _ := time.Parse(dateLayout, effective)
+			start = end.AddDate(0, 0, 1).Format(dateLayout)
+		}
+		value = value.Add(periodShare(periodNet, dayCount(start, period.Period_End), period.Full_Days, currency))
+	}
+	return value
+}
+
+// terminationFee - the fee the contract's termination terms charge for ending it on the effective date
+func terminationFee(contract Contract, effective string, remaining Decimal) Decimal {
+	terms := contract.Termination_Terms
+	if terms == nil {
+		return Decimal{}
+	}
+	switch terms.Fee_Type {
+	case feeFixed:
+		return terms.Fixed_Fee
+	case feePercent:
+		return remaining.Percent(terms.Fee_Percent).RoundTo(contract.Currency)
+	case feeSchedule:
+		for _, step := range terms.Schedule {
+			if effective <= step.Until {
+				return step.Fee
+			}
+		}
+	}
+	return Decimal{}
+}
+
+type byUntil []feeStep
+
+func (s byUntil) Len() int           { return len(s) }
+func (s byUntil) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byUntil) Less(i, j int) bool { return s[i].Until < s[j].Until }
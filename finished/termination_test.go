@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// a 2016 contract billing 100.00 a quarter, ended on different days
+func TestValueAfter(t *testing.T) {
+	quarterly := billingPeriods(Contract{Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-12-31",
+		Billing: &billingSchedule{"quarterly", "2016-01-01", billInAdvance}})
+	left := func(periods []billingPeriod, effective string) string {
+		return valueAfter(periods, mustDecimal(t, "100.00"), effective, "USD").String()
+	}
+
+	if got := left(quarterly, "2015-12-31"); got != "400.00" {
+		t.Errorf("ended before it started: %s left, want the whole year", got)
+	}
+	if got := left(quarterly, "2016-06-30"); got != "200.00" {
+		t.Errorf("ended with June: %s left", got)
+	}
+	if got := left(quarterly, "2016-11-15"); got != "50.00" {
+		t.Errorf("ended on November 15: %s left, want 46 of the last quarter's 92 days", got)
+	}
+	if got := left(quarterly, "2016-12-31"); got != "0" {
+		t.Errorf("ended on its last day: %s left", got)
+	}
+
+	// cut periods are valued over their full quarter like they were billed
+	cut := billingPeriods(Contract{Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-12-31",
+		Billing: &billingSchedule{"quarterly", "2016-02-01", billInAdvance}})
+	if got := left(cut, "2016-11-30"); got != "33.70" {
+		t.Errorf("December of a November quarter: %s", got)
+	}
+	if got := left(cut, "2016-01-15"); got != "383.69" {
+		t.Errorf("from January 16 with the quarters starting in February: %s", got)
+	}
+
+	// without a schedule the rates are for the whole term
+	if got := valueAfter([]billingPeriod{{Period_Start: "2016-01-01", Period_End: "2016-12-31", Full_Days: 366}},
+		mustDecimal(t, "1000.00"), "2016-06-30", "USD"); got.String() != "502.73" {
+		t.Errorf("half the year unscheduled: %s", got)
+	}
+	if got := left(nil, "2016-06-30"); got != "0" {
+		t.Errorf("no periods: %s", got)
+	}
+}
+
+func TestTerminationFee(t *testing.T) {
+	remaining := mustDecimal(t, "502.73")
+	fee := func(terms *terminationTerms, effective string) string {
+		return terminationFee(Contract{Currency: "USD", Termination_Terms: terms}, effective, remaining).String()
+	}
+
+	if got := fee(nil, "2016-06-30"); got != "0" {
+		t.Errorf("no termination terms: %s", got)
+	}
+	if got := fee(&terminationTerms{Fee_Type: feeFixed, Fixed_Fee: mustDecimal(t, "250.00")}, "2016-06-30"); got != "250.00" {
+		t.Errorf("fixed: %s", got)
+	}
+	if got := fee(&terminationTerms{Fee_Type: feePercent, Fee_Percent: mustDecimal(t, "10")}, "2016-06-30"); got != "50.27" {
+		t.Errorf("10%% of 502.73: %s", got)
+	}
+
+	stepped := &terminationTerms{Fee_Type: feeSchedule, Schedule: []feeStep{
+		{Until: "2016-06-30", Fee: mustDecimal(t, "500.00")}, {Until: "2016-09-30", Fee: mustDecimal(t, "250.00")}}}
+	for effective, want := range map[string]string{"2016-05-01": "500.00", "2016-06-30": "500.00", "2016-07-01": "250.00",
+		"2016-10-01": "0"} {
+		if got := fee(stepped, effective); got != want {
+			t.Errorf("scheduled fee ending on %s: %s, want %s", effective, got, want)
+		}
+	}
+}
+
+func TestBuildTerminationTerms(t *testing.T) {
+	terms, err := buildTerminationTerms("USD", " Schedule", `[{"until": "2016-12-31", "fee": "200"}, {"until": "2016-06-30T00:00:00Z", "fee": 500}]`)
+	if err != nil || terms.String() != "schedule 500.00 until 2016-06-30, 200.00 until 2016-12-31" {
+		t.Errorf("schedule = %v, %v, want it sorted by date with fees in cents", terms, err)
+	}
+	if terms, err := buildTerminationTerms("JPY", "fixed", "30000"); err != nil || terms.String() != "fixed fee 30000" {
+		t.Errorf("fixed = %v, %v", terms, err)
+	}
+	if terms, err := buildTerminationTerms("USD", "percent", "12.5"); err != nil || terms.String() != "12.5% of the remaining value" {
+		t.Errorf("percent = %v, %v", terms, err)
+	}
+	if terms, err := buildTerminationTerms("USD", "none", ""); terms != nil || err != nil {
+		t.Errorf("none = %v, %v", terms, err)
+	}
+
+	for _, bad := range [][2]string{
+		{"fixed", "250.001"},
+		{"fixed", "-1"},
+		{"percent", "150"},
+		{"schedule", "[]"},
+		{"schedule", `[{"until": "someday", "fee": "1"}]`},
+		{"schedule", `[{"until": "2016-06-30", "fee": "1.005"}]`},
+		{"penalty", "100"},
+	} {
+		if terms, err := buildTerminationTerms("USD", bad[0], bad[1]); err == nil {
+			t.Errorf("%s %s gave %v", bad[0], bad[1], terms)
+		}
+	}
+}
+
+func TestSettlementLines(t *testing.T) {
+	credit := func(amount string) adjustmentLine {
+		return adjustmentLine{Invoice_ID: "INV-s1-000004", Item_ID: "o1", Amount: mustDecimal(t, amount)}
+	}
+
+	// a fee of 250 less 160.44 invoiced beyond the end is owed by the client
+	invoice := Invoice{Contract_ID: "c0"}
+	settlementLines(&invoice, mustDecimal(t, "250.00"), []adjustmentLine{credit("-150.44"), credit("-10.00")})
+	if len(invoice.Lines) != 1 || invoice.Lines[0].Item_Type != "termination_fee" || invoice.Lines[0].Item_ID != "c0" {
+		t.Errorf("lines = %+v, want the fee", invoice.Lines)
+	}
+	if invoice.Subtotal.String() != "250.00" || invoice.Adjustments_Total.String() != "-160.44" || invoice.Total.String() != "89.56" {
+		t.Errorf("settlement %s %s = %s", invoice.Subtotal, invoice.Adjustments_Total, invoice.Total)
+	}
+
+	// without a fee the credits make it negative, for credit notes to settle
+	invoice = Invoice{Contract_ID: "c0"}
+	settlementLines(&invoice, Decimal{}, []adjustmentLine{credit("-150.44")})
+	if len(invoice.Lines) != 0 || len(invoice.Adjustments) != 1 || invoice.Total.String() != "-150.44" {
+		t.Errorf("no fee: %d lines, total %s", len(invoice.Lines), invoice.Total)
+	}
+}
+
+// the settlement invoice covers the effective date only, it neither blocks nor counts as billing of that period
+func TestSettlementsAreNotPeriodInvoices(t *testing.T) {
+	billed := []Invoice{{Invoice_ID: "INV-s1-000009", Period_Start: "2016-06-30", Period_End: "2016-06-30", Settlement: true,
+		Status: invoiceIssued}}
+	if other, found := overlappingInvoice(billed, "2016-04-01", "2016-06-30"); found {
+		t.Errorf("the second quarter clashes with settlement %s", other.Invoice_ID)
+	}
+	contract := Contract{Contract_Start_Date: "2016-01-01", Contract_End_Date: "2016-06-30",
+		Billing: &billingSchedule{"quarterly", "2016-01-01", billInArrears}}
+	if periods := periodStatuses(billingPeriods(contract), billed, "2016-07-01"); periods[1].Status != "due" {
+		t.Errorf("the second quarter is %s %s after the settlement", periods[1].Status, periods[1].Invoice_ID)
+	}
+}
+
+func TestOnlyDraftsAreDeleted(t *testing.T) {
+	if err := checkDeletable(Contract{Contract_ID: "c1", Status: contractDraft}); err != nil {
+		t.Errorf("deleting a draft: %v", err)
+	}
+	for _, status := range []string{contractActive, contractTerminated, contractExpired, contractRenewed, ""} {
+		err := checkDeletable(Contract{Contract_ID: "c1", Status: status})
+		if err == nil || !strings.Contains(err.Error(), "terminate_contract") {
+			t.Errorf("deleting a %q contract: %v", status, err)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// tier modes - graduated prices each unit at the rate of the tier it falls in, volume prices every unit at the rate
+// of the tier the whole quantity falls in
+const (
+	tierGraduated = "graduated"
+	tierVolume    = "volume"
+)
+
+// tierTable - the tiered unit prices of an offering in one currency
+type tierTable struct {
+	Currency string      `json:"currency"`
+	Mode     string      `json:"mode"`
+	Tiers    []priceTier `json:"tiers"`
+}
+
+// priceTier - the unit price up to and including a quantity, the last tier has no Up_To and takes every unit beyond
+type priceTier struct {
+	Up_To      int     `json:"up_to,omitempty"`
+	Unit_Price Decimal `json:"unit_price"`
+}
+
+func (t tierTable) String() string {
+	tiers := []string{}
+	for _, tier := range t.Tiers {
+		upTo := "rest"
+		if tier.Up_To > 0 {
+			upTo = strconv.Itoa(tier.Up_To)
+		}
+		tiers = append(tiers, upTo+"@"+tier.Unit_Price.String())
+	}
+	return t.Mode + " " + t.Currency + ": " + strings.Join(tiers, ", ")
+}
+
+// tierBand - the units of a quantity priced at one rate
+type tierBand struct {
+	From       int     `json:"from"`
+	To         int     `json:"to"`
+	Quantity   int     `json:"quantity"`
+	Unit_Price Decimal `json:"unit_price"`
+	Amount     Decimal `json:"amount"`
+}
+
+// offeringPrice - what a quantity of an offering costs. Pricing is graduated or volume when a tier table priced it
+// and list otherwise. The bands and Source_Total are in the currency of the table or list price, Total is converted
+// into the requested currency when they differ.
+type offeringPrice struct {
+	Offering_ID     string        `json:"offering_id"`
+	Quantity        int           `json:"quantity"`
+	Date            string        `json:"date"`
+	Pricing         string        `json:"pricing"`
+	Source_Currency string        `json:"source_currency"`
+	Bands           []tierBand    `json:"bands"`
+	Source_Total    Decimal       `json:"source_total"`
+	Conversion      *fxConversion `json:"conversion,omitempty"`
+	Currency        string        `json:"currency"`
+	Unit_Price      Decimal       `json:"unit_price"` //the average, Total over Quantity
+	Total           Decimal       `json:"total"`
+}
+
+// contractUnits - how many units of an offering or product a contract bills each period. A tiered offering is
+// priced from the offering's tier table on each invoice and its flat rate is ignored, the others are billed at
+// their flat rate per unit. Items without units bill one unit.
+type contractUnits struct {
+	Quantity int  `json:"quantity"`
+	Tiered   bool `json:"tiered"`
+}
+
+// ============================================================================================================================
+// Set offering tiers - replace the tier table of an offering in one currency, or drop it with mode none
+//
+// tiers is a JSON array such as [{"up_to": 100, "unit_price": "10.00"}, {"up_to": 1000, "unit_price": "8.50"},
+// {"unit_price": "7.00"}], ascending, with the last tier open ended
+// args: offering_id, currency, mode (graduated, volume or none), tiers
+// ============================================================================================================================
+func (t *SimpleChaincode) set_offering_tiers(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting offering_id, currency, mode and tiers")
+	}
+	fmt.Println("- start set offering tiers")
+	offering, err := getOffering(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	currency, err := currencyCode(args[1])
+	if err != nil {
+		return nil, err
+	}
+	mode := strings.ToLower(strings.TrimSpace(args[2]))
+	from, to := "none", "none"
+	tables := []tierTable{}
+	for _, table := range offering.Tiers {
+		if table.Currency == currency {
+			from = table.String()
+		} else {
+			tables = append(tables, table)
+		}
+	}
+	if mode != "none" {
+		if len(args) != 4 {
+			return nil, errors.New("Incorrect number of arguments. Expecting 4")
+		}
+		table, err := buildTierTable(currency, mode, args[3])
+		if err != nil {
+			return nil, err
+		}
+		tables, to = append(tables, table), table.String()
+	}
+	offering.Tiers = tables
+	if len(tables) == 0 {
+		offering.Tiers = nil
+	}
+	if err := storePricedRecord(stub, args[0], offering); err != nil {
+		return nil, err
+	}
+	if err := recordChange(stub, args[0], "tiers "+currency, from, to); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end set offering tiers")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Price offering - what a quantity of an offering costs, from its tier table when it has one and from its list
+// price otherwise
+//
+// args: offering_id, quantity, optional currency (defaults to the offering's), optional date (defaults to the
+// transaction date)
+// ============================================================================================================================
+func (t *SimpleChaincode) price_offering(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting offering_id, quantity, optional currency and optional date")
+	}
+	if err := requireVisible(stub, args[0]); err != nil {
+		return nil, err
+	}
+	offering, err := getOffering(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	quantity, err := strconv.Atoi(strings.TrimSpace(args[1]))
+	if err != nil || quantity < 1 {
+		return nil, errors.New("quantity must be a whole number of at least 1")
+	}
+	currency := offering.Currency
+	if len(args) >= 3 && args[2] != "" {
+		if currency, err = currencyCode(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	var date string
+	if len(args) == 4 && args[3] != "" {
+		date, err = canonicalDate("date", args[3])
+	} else {
+		date, err = txDate(stub)
+	}
+	if err != nil {
+		return nil, err
+	}
+	price, err := priceOffering(stub, offering, quantity, currency, date)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(price)
+}
+
+// ============================================================================================================================
+// Set contract units - the quantities a draft contract bills each period, and which offerings are priced from their
+// tier tables. Active contracts change their units with amend_contract and a "units" change.
+//
+// units is a JSON object such as {"o1": {"quantity": 250, "tiered": true}, "p1": {"quantity": 2}}
+// args: contract_id, units
+// ============================================================================================================================
+func (t *SimpleChaincode) set_contract_units(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	fmt.Println("- start set contract units")
+	contract, err := getContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if status := contractStatus(contract.Status); status != contractDraft {
+		return nil, errors.New("Contract " + args[0] + " is " + status + ", active contracts change their units with amend_contract")
+	}
+	units, err := parseUnits(contract, args[1])
+	if err != nil {
+		return nil, err
+	}
+	contract.Units = units
+	if err := checkUnits(stub, contract); err != nil {
+		return nil, err
+	}
+	if err := storeContract(stub, &contract); err != nil {
+		return nil, err
+	}
+	fmt.Println("- end set contract units")
+	return nil, nil
+}
+
+// priceOffering - a quantity of an offering priced from its tier table in the currency, or from the table in the
+// offering's own currency converted on the date, or failing both from the list price on the date
+func priceOffering(stub *shim.ChaincodeStub, offering *Offering, quantity int, currency string, date string) (offeringPrice, error) {
+	price := offeringPrice{Offering_ID: offering.Offering_ID, Quantity: quantity, Date: date, Pricing: "list",
+		Source_Currency: offering.Currency, Currency: currency}
+	if table, found := tierTableFor(offering, currency); found {
+		price.Pricing, price.Source_Currency = table.Mode, table.Currency
+		price.Bands, price.Source_Total = priceTiers(table, quantity)
+	} else {
+		entry, ok := priceOn(offering.Prices, date)
+		if !ok {
+			return price, errors.New("NOT_FOUND: no price for " + offering.Offering_ID + " on " + date)
+		}
+		amount := entry.Price.MulInt(int64(quantity)).RoundTo(offering.Currency)
+		price.Bands = []tierBand{{From: 1, To: quantity, Quantity: quantity, Unit_Price: entry.Price, Amount: amount}}
+		price.Source_Total = amount
+	}
+	price.Total = price.Source_Total
+	if price.Source_Currency != currency {
+		conversion, err := convertAmount(stub, price.Source_Total, price.Source_Currency, currency, date)
+		if err != nil {
+			return price, err
+		}
+		price.Conversion, price.Total = &conversion, conversion.Amount.RoundTo(currency)
+	}
+	price.Unit_Price = price.Total.ProRata(1, int64(quantity), currencyMinorUnits[currency])
+	return price, nil
+}
+
+// priceTiers - the bands a quantity falls in and their total, in the table's currency
+func priceTiers(table tierTable, quantity int) ([]tierBand, Decimal) {
+	bands := []tierBand{}
+	total := Decimal{}
+	from := 1
+	for _, tier := range table.Tiers {
+		to := quantity
+		if tier.Up_To > 0 && tier.Up_To < quantity {
+			to = tier.Up_To
+		}
+		if table.Mode == tierVolume {
+			if to < quantity {
+				from = to + 1
+				continue
+			}
+			from = 1
+		}
+		if from <= to {
+			band := tierBand{From: from, To: to, Quantity: to - from + 1, Unit_Price: tier.Unit_Price}
+			band.Amount = tier.Unit_Price.MulInt(int64(band.Quantity)).RoundTo(table.Currency)
+			bands = append(bands, band)
+			total = total.Add(band.Amount)
+		}
+		if to == quantity {
+			break
+		}
+		from = to + 1
+	}
+	return bands, total
+}
+
+// buildTierTable - validate the tiers argument of set_offering_tiers
+func buildTierTable(currency string, mode string, tiersJSON string) (tierTable, error) {
+	table := tierTable{Currency: currency, Mode: mode}
+	if mode != tierGraduated && mode != tierVolume {
+		return table, errors.New("mode must be " + tierGraduated + ", " + tierVolume + " or none")
+	}
+	if err := json.Unmarshal([]byte(tiersJSON), &table.Tiers); err != nil || len(table.Tiers) == 0 {
+		return table, errors.New("tiers must be a non-empty JSON array of {up_to, unit_price}")
+	}
+	last := 0
+	for i, tier := range table.Tiers {
+		name := "tier " + strconv.Itoa(i+1)
+		if i == len(table.Tiers)-1 {
+			if tier.Up_To != 0 {
+				return table, errors.New(name + " is the last tier, it has no up_to and takes every unit beyond " + strconv.Itoa(last))
+			}
+		} else if tier.Up_To <= last {
+			return table, errors.New(name + " up_to must be more than " + strconv.Itoa(last))
+		}
+		if err := checkAmount(name+" unit_price", tier.Unit_Price, currency); err != nil {
+			return table, err
+		}
+		table.Tiers[i].Unit_Price, last = tier.Unit_Price.RoundTo(currency), tier.Up_To
+	}
+	return table, nil
+}
+
+// tierTableIn - the tier table of an offering in a currency
+func tierTableIn(offering *Offering, currency string) (tierTable, bool) {
+	for _, table := range offering.Tiers {
+		if table.Currency == currency {
+			return table, true
+		}
+	}
+	return tierTable{}, false
+}
+
+// tierTableFor - the tier table an offering is priced from in a currency: the one in that currency, else the one in
+// the offering's own currency, converted
+func tierTableFor(offering *Offering, currency string) (tierTable, bool) {
+	if table, found := tierTableIn(offering, currency); found {
+		return table, true
+	}
+	return tierTableIn(offering, offering.Currency)
+}
+
+// itemLine - what a contract bills for one of its items in the period starting on the date: tiered offerings at
+// their tier price in the contract currency, the rest at their flat rate per unit
+func itemLine(stub *shim.ChaincodeStub, contract Contract, item contractItem, date string) (invoiceLine, error) {
+	line := invoiceLine{Item_Type: item.itemType, Item_ID: item.id, Quantity: item.quantity, Unit_Price: item.rate}
+	if !item.tiered {
+		line.Line_Total = item.rate.MulInt(int64(item.quantity)).RoundTo(contract.Currency)
+		return line, nil
+	}
+	offering, err := getOffering(stub, item.id)
+	if err != nil {
+		return line, errors.New("Contract " + contract.Contract_ID + " prices " + item.id + " from its tiers: " + err.Error())
+	}
+	if _, found := tierTableFor(offering, contract.Currency); !found {
+		return line, errors.New("Contract " + contract.Contract_ID + " prices " + item.id + " from its tiers, it has no " +
+			"tier table in " + contract.Currency + " or " + offering.Currency)
+	}
+	price, err := priceOffering(stub, offering, item.quantity, contract.Currency, date)
+	if err != nil {
+		return line, err
+	}
+	line.Pricing, line.Tiers, line.Unit_Price, line.Line_Total = price.Pricing, price.Bands, price.Unit_Price, price.Total
+	return line, nil
+}
+
+// parseUnits - validate a units argument against the items of a contract
+func parseUnits(contract Contract, unitsJSON string) (map[string]contractUnits, error) {
+	var units map[string]contractUnits
+	if err := json.Unmarshal([]byte(unitsJSON), &units); err != nil {
+		return nil, errors.New("units must be a JSON object of item ids to {quantity, tiered}")
+	}
+	items := map[string]string{}
+	for _, item := range contractItems(contract) {
+		items[item.id] = item.itemType
+	}
+	for id, unit := range units {
+		itemType, found := items[id]
+		if !found {
+			return nil, errors.New(id + " is not an offering or product of contract " + contract.Contract_ID)
+		}
+		if unit.Quantity < 1 {
+			return nil, errors.New(id + " quantity must be a whole number of at least 1")
+		}
+		if unit.Tiered && itemType != "offering" {
+			return nil, errors.New(id + " is a product, only offerings are tiered")
+		}
+	}
+	if len(units) == 0 {
+		return nil, nil
+	}
+	return units, nil
+}
+
+// checkUnits - every offering a contract prices from its tiers must have a tier table in the contract currency or
+// its own, or it would be billed at its list price
+func checkUnits(stub *shim.ChaincodeStub, contract Contract) error {
+	for _, item := range contractItems(contract) {
+		if !item.tiered {
+			continue
+		}
+		offering, err := getOffering(stub, item.id)
+		if err != nil {
+			return err
+		}
+		if _, found := tierTableFor(offering, contract.Currency); !found {
+			return errors.New("Offering " + item.id + " has no tier table in " + contract.Currency + " or " +
+				offering.Currency + ", set one with set_offering_tiers")
+		}
+	}
+	return nil
+}
+
+// getOffering - load an offering, refusing products and keys that hold anything else
+func getOffering(stub *shim.ChaincodeStub, id string) (*Offering, error) {
+	rec, err := getPricedRecord(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	offering, ok := rec.(*Offering)
+	if !ok {
+		return nil, errors.New(id + " is not an offering")
+	}
+	return offering, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testTiers - 10.00 a unit up to 100, 8.50 up to 1000 and 7.00 beyond
+func testTiers(t *testing.T, mode string) tierTable {
+	tiers := `[{"up_to":100,"unit_price":"10"},{"up_to":1000,"unit_price":"8.5"},{"unit_price":"7"}]`
+	table, err := buildTierTable("USD", mode, tiers)
+	if err != nil {
+		t.Fatalf("buildTierTable: %v", err)
+	}
+	return table
+}
+
+// describeBands - bands as "from-to x unit_price", each checked to add up to its amount
+func describeBands(t *testing.T, bands []tierBand, total Decimal) string {
+	out, sum := []string{}, Decimal{}
+	for _, band := range bands {
+		if band.Quantity != band.To-band.From+1 || !band.Amount.Equal(band.Unit_Price.MulInt(int64(band.Quantity))) {
+			t.Errorf("band %+v does not add up", band)
+		}
+		out = append(out, fmt.Sprintf("%d-%d x %s", band.From, band.To, band.Unit_Price))
+		sum = sum.Add(band.Amount)
+	}
+	if !sum.Equal(total) {
+		t.Errorf("bands %v add up to %s, total %s", out, sum, total)
+	}
+	return strings.Join(out, ", ") + " = " + total.String()
+}
+
+func TestGraduatedTiers(t *testing.T) {
+	table := testTiers(t, tierGraduated)
+	for quantity, want := range map[int]string{
+		1:    "1-1 x 10.00 = 10.00",
+		100:  "1-100 x 10.00 = 1000.00",
+		101:  "1-100 x 10.00, 101-101 x 8.50 = 1008.50",
+		1000: "1-100 x 10.00, 101-1000 x 8.50 = 8650.00",
+		1001: "1-100 x 10.00, 101-1000 x 8.50, 1001-1001 x 7.00 = 8657.00",
+	} {
+		bands, total := priceTiers(table, quantity)
+		if got := describeBands(t, bands, total); got != want {
+			t.Errorf("%d graduated: %s, want %s", quantity, got, want)
+		}
+	}
+}
+
+// volume pricing charges every unit the rate of the tier the quantity reaches, so 101 units cost less than 100
+func TestVolumeTiers(t *testing.T) {
+	table := testTiers(t, tierVolume)
+	price := func(quantity int) string {
+		bands, total := priceTiers(table, quantity)
+		return describeBands(t, bands, total)
+	}
+	if got := price(100); got != "1-100 x 10.00 = 1000.00" {
+		t.Errorf("100 units: %s", got)
+	}
+	if got := price(101); got != "1-101 x 8.50 = 858.50" {
+		t.Errorf("101 units: %s", got)
+	}
+	if got := price(1000); got != "1-1000 x 8.50 = 8500.00" {
+		t.Errorf("1000 units: %s", got)
+	}
+	if got := price(1001); got != "1-1001 x 7.00 = 7007.00" {
+		t.Errorf("1001 units: %s", got)
+	}
+}
+
+func TestBuildTierTable(t *testing.T) {
+	table, err := buildTierTable("USD", tierGraduated, `[{"up_to":10,"unit_price":9.99},{"unit_price":"7"}]`)
+	if err != nil || table.String() != "graduated USD: 10@9.99, rest@7.00" {
+		t.Errorf("table = %s, %v", table, err)
+	}
+
+	refused := map[string][3]string{
+		"mode must be":                          {"USD", "stepped", `[{"unit_price":"7"}]`},
+		"non-empty JSON array":                  {"USD", tierVolume, `[]`},
+		"tiers must be":                         {"USD", tierVolume, `tiers`},
+		"tier 2 is the last tier":               {"USD", tierVolume, `[{"up_to":10,"unit_price":"9"},{"up_to":20,"unit_price":"7"}]`},
+		"tier 2 up_to must be more than 10":     {"USD", tierVolume, `[{"up_to":10,"unit_price":"9"},{"up_to":10,"unit_price":"8"},{"unit_price":"7"}]`},
+		"tier 1 up_to must be more than 0":      {"USD", tierVolume, `[{"up_to":0,"unit_price":"9"},{"unit_price":"7"}]`},
+		"more decimals than USD":                {"USD", tierVolume, `[{"unit_price":"7.001"}]`},
+		"more decimals than JPY":                {"JPY", tierVolume, `[{"unit_price":"7.5"}]`},
+		"tier 1 unit_price may not be negative": {"USD", tierVolume, `[{"unit_price":"-1"}]`},
+	}
+	for message, args := range refused {
+		if _, err := buildTierTable(args[0], args[1], args[2]); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s %s %s: %v, want %q", args[0], args[1], args[2], err, message)
+		}
+	}
+}
+
+func TestTierTableFor(t *testing.T) {
+	offering := &Offering{Offering_ID: "o1", Currency: "EUR", Tiers: []tierTable{{Currency: "USD", Mode: tierVolume},
+		{Currency: "EUR", Mode: tierGraduated}}}
+	if table, _ := tierTableFor(offering, "USD"); table.Mode != tierVolume {
+		t.Errorf("USD priced from the %s table", table.Currency)
+	}
+	// a currency without a table of its own is priced from the offering currency's, converted
+	if table, found := tierTableFor(offering, "JPY"); !found || table.Currency != "EUR" {
+		t.Errorf("JPY priced from %q %v, want the EUR table", table.Currency, found)
+	}
+	offering.Tiers = offering.Tiers[:1]
+	if table, found := tierTableFor(offering, "GBP"); found {
+		t.Errorf("GBP priced from the %s table of a EUR offering", table.Currency)
+	}
+}
+
+// price_offering without a conversion: the tier table when there is one, else the list price in force
+func TestPriceOffering(t *testing.T) {
+	offering := &Offering{Offering_ID: "o1", Currency: "USD", Prices: []priceEntry{
+		{Price: mustDecimal(t, "12.00"), Start_Date: "2016-01-01", End_Date: "2016-12-31"}}}
+
+	price, err := priceOffering(nil, offering, 3, "USD", "2016-10-01")
+	if err != nil || price.Pricing != "list" || price.Total.String() != "36.00" || price.Unit_Price.String() != "12.00" {
+		t.Errorf("list price: %+v, %v", price, err)
+	}
+	if _, err := priceOffering(nil, offering, 3, "USD", "2017-01-01"); err == nil || !strings.HasPrefix(err.Error(), "NOT_FOUND") {
+		t.Errorf("no price in force: %v", err)
+	}
+
+	offering.Tiers = []tierTable{testTiers(t, tierGraduated)}
+	price, err = priceOffering(nil, offering, 150, "USD", "2017-01-01")
+	if err != nil || price.Pricing != tierGraduated || price.Total.String() != "1425.00" || len(price.Bands) != 2 {
+		t.Fatalf("150 graduated: %+v, %v", price, err)
+	}
+	if price.Unit_Price.String() != "9.50" || price.Conversion != nil || price.Source_Total.String() != "1425.00" {
+		t.Errorf("150 graduated at %s a unit, source %s", price.Unit_Price, price.Source_Total)
+	}
+}
+
+func TestContractUnits(t *testing.T) {
+	contract := testContract(t)
+	units, err := parseUnits(contract, `{"o1": {"quantity": 250, "tiered": true}, "p1": {"quantity": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract.Units = units
+	items := contractItems(contract)
+	if len(items) != 2 || items[0].quantity != 250 || !items[0].tiered || items[1].quantity != 2 || items[1].tiered {
+		t.Fatalf("items = %+v", items)
+	}
+	// an item that is not tiered bills its flat rate per unit, without needing the ledger
+	line, err := itemLine(nil, contract, items[1], "2016-01-01")
+	if err != nil || line.Line_Total.String() != "19.00" || line.Quantity != 2 {
+		t.Errorf("2 of p1 at 9.50: %+v, %v", line, err)
+	}
+
+	if units, err := parseUnits(contract, `{}`); units != nil || err != nil {
+		t.Errorf("no units = %v, %v, want every item back to one unit", units, err)
+	}
+	for units, message := range map[string]string{
+		`{"o9": {"quantity": 1}}`:                 "o9 is not an offering or product of contract c0",
+		`{"o1": {"quantity": 0}}`:                 "o1 quantity must be",
+		`{"p1": {"quantity": 2, "tiered": true}}`: "only offerings are tiered",
+		`["o1"]`: "units must be a JSON object",
+	} {
+		if _, err := parseUnits(contract, units); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: %v, want %q", units, err, message)
+		}
+	}
+}
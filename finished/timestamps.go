@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// stampedRecord - a record that carries created_at/updated_at. Setting them also sets its doc_type, so every record
+// the chaincode stores says which section it belongs to.
+type stampedRecord interface {
+	setTimestamps(created_at string, updated_at string)
+}
+
+func (p *Product) setTimestamps(created_at string, updated_at string) {
+	p.Created_At, p.Updated_At, p.Doc_Type = created_at, updated_at, productImportSpec.name
+}
+
+func (o *Offering) setTimestamps(created_at string, updated_at string) {
+	o.Created_At, o.Updated_At, o.Doc_Type = created_at, updated_at, offeringImportSpec.name
+}
+
+// Last_Modified predates updated_at and is kept in step with it
+func (c *Contract) setTimestamps(created_at string, updated_at string) {
+	c.Created_At, c.Updated_At, c.Last_Modified = created_at, updated_at, updated_at
+	c.Doc_Type = contractImportSpec.name
+}
+
+func (c *Client) setTimestamps(created_at string, updated_at string) {
+	c.Created_At, c.Updated_At, c.Last_Modified = created_at, updated_at, updated_at
+	c.Doc_Type = clientImportSpec.name
+}
+
+func (p *pendingOffering) setTimestamps(created_at string, updated_at string) {
+	p.Created_At, p.Updated_At, p.Doc_Type = created_at, updated_at, pendingOfferingImportSpec.name
+}
+
+// ============================================================================================================================
+// txTime - the transaction timestamp. Every peer executing the transaction sees the same value, so unlike
+// time.Now() it is safe to store and to compare dates against.
+// ============================================================================================================================
+func txTime(stub *shim.ChaincodeStub) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		return time.Time{}, errors.New("Failed to get transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// txDate - the transaction date, the value date windows are compared against
+func txDate(stub *shim.ChaincodeStub) (string, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return "", err
+	}
+	return now.Format("2006-01-02"), nil
+}
+
+// stampRecord - set updated_at to the transaction time, created_at too unless a record is already stored under key
+func stampRecord(stub *shim.ChaincodeStub, key string, rec stampedRecord) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	existingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get state for " + key)
+	}
+	rec.setTimestamps(stampTimes(now, existingAsBytes))
+	return nil
+}
+
+// stampTimes - created_at and updated_at for a record written at now over the stored existingAsBytes, which is nil
+// for a new record. A stored record keeps its created_at, one saved before it had one gets now.
+func stampTimes(now time.Time, existingAsBytes []byte) (string, string) {
+	updated_at := now.UTC().Format(time.RFC3339)
+	if existingAsBytes != nil {
+		var existing struct {
+			Created_At string `json:"created_at"`
+		}
+		if json.Unmarshal(existingAsBytes, &existing) == nil && existing.Created_At != "" {
+			return existing.Created_At, updated_at
+		}
+	}
+	return updated_at, updated_at
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStampTimes(t *testing.T) {
+	now := time.Date(2016, 10, 1, 9, 30, 15, 500, time.FixedZone("CEST", 2*60*60))
+
+	created, updated := stampTimes(now, nil)
+	if updated != "2016-10-01T07:30:15Z" {
+		t.Errorf("updated_at = %s, want the transaction time in UTC to the second", updated)
+	}
+	if created != updated {
+		t.Errorf("new record: created_at %s, updated_at %s, want them equal", created, updated)
+	}
+
+	created, updated = stampTimes(now, []byte(`{"client_id":"cl1","created_at":"2016-01-02T03:04:05Z"}`))
+	if created != "2016-01-02T03:04:05Z" || updated != "2016-10-01T07:30:15Z" {
+		t.Errorf("stored record: %s %s, want the stored created_at kept", created, updated)
+	}
+
+	// records stored before they were stamped, and state that is not a record, start their history now
+	for _, existing := range []string{`{"client_id":"cl1"}`, `{"created_at":""}`, `not json`} {
+		if created, _ := stampTimes(now, []byte(existing)); created != "2016-10-01T07:30:15Z" {
+			t.Errorf("over %s: created_at %s, want the transaction time", existing, created)
+		}
+	}
+}
+
+func TestSetTimestamps(t *testing.T) {
+	var client Client
+	client.setTimestamps("2016-01-01T00:00:00Z", "2016-02-01T00:00:00Z")
+	if client.Created_At != "2016-01-01T00:00:00Z" || client.Updated_At != "2016-02-01T00:00:00Z" ||
+		client.Last_Modified != client.Updated_At {
+		t.Errorf("client timestamps = %s %s %s", client.Created_At, client.Updated_At, client.Last_Modified)
+	}
+	var contract Contract
+	contract.setTimestamps("2016-01-01T00:00:00Z", "2016-02-01T00:00:00Z")
+	if contract.Last_Modified != "2016-02-01T00:00:00Z" {
+		t.Errorf("contract last_modified = %q, want it to follow updated_at", contract.Last_Modified)
+	}
+}
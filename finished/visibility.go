@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// userTypesStr - the user types products can be restricted to, maintained by administrators
+var userTypesStr = "_usertypes"
+
+// viewer - who is asking. Administrators see everything, everybody else sees the products whose User_Type is
+// empty or equal to their own user type, and the offerings made up of such products.
+//
+// A caller's user type comes from the user_type attribute of their certificate or, failing that, from the
+// Client named by the client_id attribute.
+type viewer struct {
+	stub     *shim.ChaincodeStub
+	admin    bool
+	userType string
+	products map[string]bool //product visibility already worked out
+}
+
+// ============================================================================================================================
+// Define user type - admin only, add a user type products can be restricted to
+//
+// args: user_type
+// ============================================================================================================================
+func (t *SimpleChaincode) define_user_type(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err
+	}
+	userType := normalizeUserType(args[0])
+	if userType == "" {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	userTypes, err := getIndex(stub, userTypesStr)
+	if err != nil {
+		return nil, err
+	}
+	if find_id_in_index(userTypes, userType) {
+		return nil, nil
+	}
+	userTypes = append(userTypes, userType)
+	sort.Strings(userTypes)
+	jsonAsBytes, _ := json.Marshal(userTypes)
+	if err := stub.PutState(userTypesStr, jsonAsBytes); err != nil {
+		return nil, errors.New("Failed to store user types")
+	}
+	fmt.Println("! user types: ", userTypes)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Remove user type - admin only, refused while products or clients still carry the user type
+//
+// args: user_type
+// ============================================================================================================================
+func (t *SimpleChaincode) remove_user_type(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err
+	}
+	userType := normalizeUserType(args[0])
+	userTypes, err := getIndex(stub, userTypesStr)
+	if err != nil {
+		return nil, err
+	}
+	if !find_id_in_index(userTypes, userType) {
+		return nil, errors.New("NOT_FOUND: user type " + userType)
+	}
+	for _, spec := range []importSpec{productImportSpec, clientImportSpec} {
+		index, err := getIndex(stub, spec.indexStr)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range index {
+			if rec, ok := loadRecord(stub, id, spec.name); ok && normalizeUserType(fieldString(rec, "user_type")) == userType {
+				return nil, errors.New("User type " + userType + " is still used by " + id)
+			}
+		}
+	}
+	for i, val := range userTypes {
+		if val == userType {
+			userTypes = append(userTypes[:i], userTypes[i+1:]...)
+			break
+		}
+	}
+	jsonAsBytes, _ := json.Marshal(userTypes)
+	if err := stub.PutState(userTypesStr, jsonAsBytes); err != nil {
+		return nil, errors.New("Failed to store user types")
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Assign user type - admin only, give a client the user type that decides which products it sees.
+// An empty user type leaves the client with the unrestricted products only.
+//
+// args: client_id, user_type
+// ============================================================================================================================
+func (t *SimpleChaincode) assign_user_type(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err
+	}
+	userType := normalizeUserType(args[1])
+	if userType != "" {
+		if err := checkUserType(stub, userType); err != nil {
+			return nil, err
+		}
+	}
+	clientAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + args[0])
+	}
+	var fields map[string]interface{}
+	if clientAsBytes == nil || json.Unmarshal(clientAsBytes, &fields) != nil || recordKind(fields) != clientImportSpec.name {
+		return nil, errors.New("NOT_FOUND: client " + args[0])
+	}
+	client := Client{}
+	if err := json.Unmarshal(clientAsBytes, &client); err != nil {
+		return nil, errors.New("Failed to decode " + args[0])
+	}
+	previous := client.User_Type
+	client.User_Type = userType
+	if err := stampRecord(stub, args[0], &client); err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(client)
+	if err := stub.PutState(args[0], jsonAsBytes); err != nil {
+		return nil, errors.New("Failed to store " + args[0])
+	}
+	if err := recordChange(stub, args[0], "user_type", previous, userType); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Set category user type - admin only, retag every product of a category with one user type
+//
+// The category matches like the list_products category filter, without regard to case.
+// args: category, user_type
+// ============================================================================================================================
+func (t *SimpleChaincode) set_category_user_type(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return nil, err
+	}
+	if err := requireArgs(args, 1); err != nil {
+		return nil, err
+	}
+	fmt.Println("- start set category user type")
+	userType := normalizeUserType(args[1])
+	if userType != "" {
+		if err := checkUserType(stub, userType); err != nil {
+			return nil, err
+		}
+	}
+	productIndex, err := getIndex(stub, productIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	retagged := []string{}
+	for _, id := range productIndex {
+		product, err := getProduct(stub, id)
+		if err != nil {
+			fmt.Println("set_category_user_type: skipping " + id + ", " + err.Error())
+			continue
+		}
+		if !retagsProduct(product, args[0], userType) {
+			continue
+		}
+		if err := setProductUserType(stub, id, product, userType); err != nil {
+			return nil, errors.New(id + ": " + err.Error())
+		}
+		retagged = append(retagged, id)
+	}
+	fmt.Println("- end set category user type")
+	return json.Marshal(struct {
+		Category  string   `json:"category"`
+		User_Type string   `json:"user_type"`
+		Retagged  []string `json:"retagged"`
+	}{args[0], userType, retagged})
+}
+
+// retagsProduct - whether set_category_user_type changes the product, it must be in the category and have another
+// user type
+func retagsProduct(product *Product, category string, userType string) bool {
+	return strings.EqualFold(product.Category, category) && normalizeUserType(product.User_Type) != userType
+}
+
+// setProductUserType - store a product with its new user type and record the change
+func setProductUserType(stub *shim.ChaincodeStub, id string, product *Product, userType string) error {
+	previous := product.User_Type
+	product.User_Type = userType
+	if err := storePricedRecord(stub, id, product); err != nil {
+		return err
+	}
+	return recordChange(stub, id, "user_type", previous, userType)
+}
+
+// settleProductUserType - init_product and bulk imports may only change a product's user type as an admin, to a
+// defined user type, like set_user_type. A restore is admin only and keeps the user type it was exported with.
+func settleProductUserType(stub *shim.ChaincodeStub, id string, product *Product, restoring bool) error {
+	product.User_Type = normalizeUserType(product.User_Type)
+	if restoring {
+		return nil
+	}
+	previous := ""
+	if stored, err := getProduct(stub, id); err == nil {
+		previous = normalizeUserType(stored.User_Type)
+	}
+	if product.User_Type == previous {
+		return nil
+	}
+	if err := requireAdmin(stub); err != nil {
+		return errors.New("user_type cannot change from \"" + previous + "\" to \"" + product.User_Type + "\": " + err.Error())
+	}
+	if product.User_Type == "" {
+		return nil
+	}
+	return checkUserType(stub, product.User_Type)
+}
+
+// List user types - the user types defined so far
+func (t *SimpleChaincode) list_user_types(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	userTypes, err := getIndex(stub, userTypesStr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(userTypes)
+}
+
+// currentViewer - work out who the caller is from their certificate attributes
+func currentViewer(stub *shim.ChaincodeStub) *viewer {
+	v := &viewer{stub: stub, products: map[string]bool{}}
+	if role, err := stub.ReadCertAttribute("role"); err == nil && string(role) == "admin" {
+		v.admin = true
+		return v
+	}
+	if userType, err := stub.ReadCertAttribute("user_type"); err == nil && len(userType) > 0 {
+		v.userType = normalizeUserType(string(userType))
+		return v
+	}
+	if clientId, err := stub.ReadCertAttribute("client_id"); err == nil && len(clientId) > 0 {
+		if client, ok := loadRecord(stub, string(clientId), clientImportSpec.name); ok {
+			v.userType = normalizeUserType(fieldString(client, "user_type"))
+		}
+	}
+	return v
+}
+
+// canSee - whether a stored record is visible, records other than products and offerings always are
+func (v *viewer) canSee(rec map[string]interface{}) bool {
+	switch recordKind(rec) {
+	case productImportSpec.name:
+		return v.canSeeProduct(rec)
+	case offeringImportSpec.name:
+		return v.canSeeOffering(rec)
+	}
+	return true
+}
+
+func (v *viewer) canSeeProduct(rec map[string]interface{}) bool {
+	userType := normalizeUserType(fieldString(rec, "user_type"))
+	return v.admin || userType == "" || userType == v.userType
+}
+
+// canSeeOffering - an offering is visible when every product in it that still exists is visible
+func (v *viewer) canSeeOffering(rec map[string]interface{}) bool {
+	if v.admin {
+		return true
+	}
+	for _, field := range []string{"product_id_01", "product_id_02"} {
+		id := fieldString(rec, field)
+		visible, known := v.products[id]
+		if !known {
+			product, ok := loadRecord(v.stub, id, productImportSpec.name)
+			visible = !ok || v.canSeeProduct(product)
+			v.products[id] = visible
+		}
+		if !visible {
+			return false
+		}
+	}
+	return true
+}
+
+// visibleRecords - the records of a list the viewer may see
+func (v *viewer) visibleRecords(records []map[string]interface{}) []map[string]interface{} {
+	visible := []map[string]interface{}{}
+	for _, rec := range records {
+		if v.canSee(rec) {
+			visible = append(visible, rec)
+		}
+	}
+	return visible
+}
+
+// requireVisible - a product or offering the caller may not see is reported like a missing one
+func requireVisible(stub *shim.ChaincodeStub, id string) error {
+	recAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return errors.New("Failed to get state for " + id)
+	}
+	var rec map[string]interface{}
+	if recAsBytes == nil || json.Unmarshal(recAsBytes, &rec) != nil {
+		return nil
+	}
+	if !currentViewer(stub).canSee(rec) {
+		return errors.New("NOT_FOUND: " + id)
+	}
+	return nil
+}
+
+// checkUserType - the user type must have been defined with define_user_type
+func checkUserType(stub *shim.ChaincodeStub, userType string) error {
+	userTypes, err := getIndex(stub, userTypesStr)
+	if err != nil {
+		return err
+	}
+	if !find_id_in_index(userTypes, userType) {
+		return errors.New("user_type \"" + userType + "\" is not defined, expecting one of " + strings.Join(userTypes, ", "))
+	}
+	return nil
+}
+
+func normalizeUserType(userType string) string {
+	return strings.ToLower(strings.TrimSpace(userType))
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func productRec(id, userType string) map[string]interface{} {
+	return map[string]interface{}{"doc_type": productImportSpec.name, "product_id": id, "user_type": userType}
+}
+
+func offeringRec(id string, productIds ...string) map[string]interface{} {
+	rec := map[string]interface{}{"doc_type": offeringImportSpec.name, "offering_id": id}
+	for i, productId := range productIds {
+		rec[[]string{"product_id_01", "product_id_02"}[i]] = productId
+	}
+	return rec
+}
+
+func TestViewerProducts(t *testing.T) {
+	gold := &viewer{userType: "gold"}
+	anonymous := &viewer{}
+	admin := &viewer{admin: true}
+
+	if !gold.canSee(productRec("p1", "")) || !anonymous.canSee(productRec("p1", "")) {
+		t.Error("a product open to everybody is hidden")
+	}
+	if !gold.canSee(productRec("p2", " Gold ")) {
+		t.Error("gold cannot see a gold product stored before user types were normalized")
+	}
+	if anonymous.canSee(productRec("p2", "gold")) || (&viewer{userType: "silver"}).canSee(productRec("p2", "gold")) {
+		t.Error("a gold product is visible without the gold user type")
+	}
+	if !admin.canSee(productRec("p2", "gold")) {
+		t.Error("an admin cannot see a gold product")
+	}
+	if !anonymous.canSee(map[string]interface{}{"doc_type": clientImportSpec.name, "user_type": "gold"}) {
+		t.Error("a client record was treated as a restricted product")
+	}
+}
+
+func TestViewerOfferings(t *testing.T) {
+	// products already looked at are not loaded again, so the viewer needs no stub here; a product id that is left
+	// out of an offering is never looked up
+	v := &viewer{userType: "silver", products: map[string]bool{"p1": true, "p2": false}}
+	if !v.canSee(offeringRec("o1", "p1")) {
+		t.Error("an offering of a visible product is hidden")
+	}
+	if v.canSee(offeringRec("o2", "p1", "p2")) {
+		t.Error("an offering with a hidden product is visible")
+	}
+
+	listed := v.visibleRecords([]map[string]interface{}{offeringRec("o1", "p1"), productRec("p3", "gold"),
+		offeringRec("o2", "p2"), productRec("p4", "silver")})
+	var ids []string
+	for _, rec := range listed {
+		ids = append(ids, fieldString(rec, "offering_id")+fieldString(rec, "product_id"))
+	}
+	if len(ids) != 2 || ids[0] != "o1" || ids[1] != "p4" {
+		t.Errorf("visible records %v, want o1 and p4 in their listed order", ids)
+	}
+	if listed := v.visibleRecords(nil); listed == nil {
+		t.Error("nothing visible gave a nil list, want an empty one")
+	}
+}